@@ -10,10 +10,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func NewAnnotateDataset(dataset skyhook.Dataset, inputs []skyhook.ExecParent, tool string, params string) (*DBAnnotateDataset, error) {
+func NewAnnotateDataset(dataset skyhook.Dataset, inputs []skyhook.ExecParent, tool string, params string, sampler skyhook.AnnotateSampler) (*DBAnnotateDataset, error) {
 	res := db.Exec(
-		"INSERT INTO annotate_datasets (dataset_id, inputs, tool, params) VALUES (?, ?, ?, ?)",
-		dataset.ID, string(skyhook.JsonMarshal(inputs)), tool, params,
+		"INSERT INTO annotate_datasets (dataset_id, inputs, tool, params, sampler) VALUES (?, ?, ?, ?, ?)",
+		dataset.ID, string(skyhook.JsonMarshal(inputs)), tool, params, string(skyhook.JsonMarshal(sampler)),
 	)
 	return GetAnnotateDataset(res.LastInsertId()), nil
 }
@@ -43,13 +43,14 @@ func init() {
 			Inputs []skyhook.ExecParent
 			Tool string
 			Params string
+			Sampler skyhook.AnnotateSampler
 		}
 		if err := skyhook.ParseJsonRequest(w, r, &request); err != nil {
 			return
 		}
 
 		dataset := GetDataset(request.DatasetID)
-		ds, err := NewAnnotateDataset(dataset.Dataset, request.Inputs, request.Tool, request.Params)
+		ds, err := NewAnnotateDataset(dataset.Dataset, request.Inputs, request.Tool, request.Params, request.Sampler)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Options for checking dataset integrity.
+type CheckOptions struct {
+	// Re-derive metadata of items where it doesn't match the underlying data.
+	RepairMetadata bool
+	// Remove items whose data is missing or cannot be decoded.
+	RemoveBroken bool
+	// Optional Video dataset used to verify that Detection/Shape items have one
+	// entry per frame of the video with the same key.
+	VideoDataset *DBDataset
+}
+
+// A problem found with an item during Check.
+type CheckProblem struct {
+	Key string
+	Problem string
+	// Whether the item data is unusable (as opposed to, e.g., just having bad metadata).
+	Broken bool
+	// Description of the repair that was applied, if any.
+	Repaired string
+}
+
+// Video durations within this many seconds (or this fraction of the duration)
+// of the ffprobe duration are considered to match.
+const checkDurationTolerance = 0.5
+const checkDurationFraction = 0.01
+
+// Returns whether the frame count of a Detection/Shape item is consistent with
+// the approximate number of frames in the corresponding video.
+func checkFrameCount(count int, video skyhook.VideoMetadata) bool {
+	expected := video.NumFrames()
+	tolerance := expected/100
+	if tolerance < 2 {
+		tolerance = 2
+	}
+	return int(math.Abs(float64(count - expected))) <= tolerance
+}
+
+// Check a single item.
+// Returns problems found with the item, and a function that repairs the item metadata
+// if the problem can be fixed that way.
+func (ds *DBDataset) checkItem(item *DBItem, opts CheckOptions) (problems []CheckProblem, repair func() (string, error)) {
+	addProblem := func(broken bool, format string, args ...interface{}) {
+		problems = append(problems, CheckProblem{
+			Key: item.Key,
+			Problem: fmt.Sprintf(format, args...),
+			Broken: broken,
+		})
+	}
+
+	// metadata decoding panics on invalid JSON, so we check it first
+	if item.Metadata != "" && !json.Valid([]byte(item.Metadata)) {
+		addProblem(true, "metadata is not valid JSON")
+		return
+	}
+
+	// make sure the provider can be resolved
+	if item.Provider != nil {
+		if _, ok := skyhook.ItemProviders[*item.Provider]; !ok {
+			addProblem(true, "unknown provider %s", *item.Provider)
+			return
+		}
+		if item.ProviderInfo == nil {
+			addProblem(true, "provider %s is missing provider info", *item.Provider)
+			return
+		}
+	}
+
+	// make sure the file exists
+	// for reference items, this is the referenced file
+	fname := item.Fname()
+	if fname != "" {
+		if _, err := os.Stat(fname); err != nil {
+			addProblem(true, "missing file %s", fname)
+			return
+		}
+	}
+
+	// Videos are too expensive to decode, so we just probe them.
+	if ds.DataType == skyhook.VideoType {
+		if fname == "" {
+			return
+		}
+		width, height, duration, err := skyhook.Ffprobe(fname)
+		if err != nil {
+			addProblem(true, "ffprobe failed: %v", err)
+			return
+		}
+		metadata := item.DecodeMetadata().(skyhook.VideoMetadata)
+		fixed := metadata
+		if math.Abs(metadata.Duration - duration) > math.Max(checkDurationTolerance, checkDurationFraction*duration) {
+			addProblem(false, "metadata duration %v does not match file duration %v", metadata.Duration, duration)
+			fixed.Duration = duration
+		}
+		// Dims may intentionally differ from the file to rescale the video when reading it,
+		// so we only check that it is set and has the same aspect ratio.
+		if metadata.Dims[0] <= 0 || metadata.Dims[1] <= 0 {
+			addProblem(false, "metadata is missing dimensions")
+			fixed.Dims = [2]int{width, height}
+		} else if width > 0 && height > 0 && math.Abs(float64(metadata.Dims[0]*height) / float64(metadata.Dims[1]*width) - 1) > 0.02 {
+			addProblem(false, "metadata dimensions %dx%d do not match aspect ratio of file dimensions %dx%d", metadata.Dims[0], metadata.Dims[1], width, height)
+			fixed.Dims = [2]int{width, height}
+		}
+		if metadata.Framerate[0] <= 0 || metadata.Framerate[1] <= 0 {
+			addProblem(false, "metadata is missing framerate")
+			_, defaultMetadata, err := ds.DataSpec().(skyhook.MetadataFromFileDataSpec).GetMetadataFromFile(fname)
+			if err != nil {
+				// we can still repair the other fields
+				addProblem(false, "could not get framerate from file: %v", err)
+			} else {
+				fixed.Framerate = defaultMetadata.(skyhook.VideoMetadata).Framerate
+			}
+		}
+		if fixed != metadata {
+			repair = func() (string, error) {
+				item.SetMetadata(item.Format, fixed)
+				return "re-derived metadata from file", nil
+			}
+		}
+		return
+	}
+
+	// For other types, we make sure the item can be decoded.
+	data, metadata, err := item.LoadData()
+	if err != nil {
+		addProblem(true, "could not decode item: %v", err)
+		return
+	}
+
+	// Get the metadata of the corresponding video, if any.
+	var video *skyhook.VideoMetadata
+	if opts.VideoDataset != nil {
+		if videoItem := opts.VideoDataset.GetItem(item.Key); videoItem != nil {
+			videoMetadata := videoItem.DecodeMetadata().(skyhook.VideoMetadata)
+			video = &videoMetadata
+		}
+	}
+
+	if ds.DataType == skyhook.DetectionType {
+		frames := data.([][]skyhook.Detection)
+		invalid := 0
+		for _, dlist := range frames {
+			for _, d := range dlist {
+				if d.Right < d.Left || d.Bottom < d.Top {
+					invalid++
+				}
+			}
+		}
+		if invalid > 0 {
+			addProblem(false, "%d detections have negative width or height", invalid)
+		}
+		if video != nil && !checkFrameCount(len(frames), *video) {
+			addProblem(false, "item has %d frames but video has about %d frames", len(frames), video.NumFrames())
+		}
+		detectionMetadata := metadata.(skyhook.DetectionMetadata)
+		if video != nil && detectionMetadata.CanvasDims[0] == 0 {
+			addProblem(false, "metadata is missing canvas dimensions")
+			repair = func() (string, error) {
+				detectionMetadata.CanvasDims = video.Dims
+				item.SetMetadata(item.Format, detectionMetadata)
+				return "set canvas dimensions from video", nil
+			}
+		}
+	} else if ds.DataType == skyhook.ShapeType {
+		frames := data.([][]skyhook.Shape)
+		empty := 0
+		for _, shapes := range frames {
+			for _, shp := range shapes {
+				if len(shp.Points) == 0 {
+					empty++
+				}
+			}
+		}
+		if empty > 0 {
+			addProblem(false, "%d shapes have no points", empty)
+		}
+		if video != nil && !checkFrameCount(len(frames), *video) {
+			addProblem(false, "item has %d frames but video has about %d frames", len(frames), video.NumFrames())
+		}
+		shapeMetadata := metadata.(skyhook.ShapeMetadata)
+		if video != nil && shapeMetadata.CanvasDims[0] == 0 {
+			addProblem(false, "metadata is missing canvas dimensions")
+			repair = func() (string, error) {
+				shapeMetadata.CanvasDims = video.Dims
+				item.SetMetadata(item.Format, shapeMetadata)
+				return "set canvas dimensions from video", nil
+			}
+		}
+	}
+
+	return
+}
+
+// Remove an item that failed the check.
+// Unlike DBItem.Delete, we only remove the file if the item owns it, since
+// reference items point at files in other datasets.
+func (ds *DBDataset) removeBrokenItem(item *DBItem) {
+	db := ds.getDB()
+	db.Exec("DELETE FROM items WHERE k = ?", item.Key)
+	item.removeOwnedFile()
+}
+
+// Check the integrity of every item in the dataset, optionally repairing problems.
+// Returns the problems found.
+func (ds *DBDataset) Check(opts CheckOptions, importOpts ImportOptions) ([]CheckProblem, error) {
+	count, err := ds.CountItems(ItemListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	importOpts.SetTasks(count)
+
+	// we collect the broken items first and remove them after iterating,
+	// so that we don't modify the items table while paging through it
+	var problems []CheckProblem
+	var broken []*DBItem
+	err = ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+		curProblems, repair := ds.checkItem(item, opts)
+		isBroken := false
+		for _, problem := range curProblems {
+			isBroken = isBroken || problem.Broken
+		}
+
+		var repaired string
+		if isBroken && opts.RemoveBroken {
+			broken = append(broken, item)
+			repaired = "removed item"
+		} else if !isBroken && repair != nil && opts.RepairMetadata {
+			var repairErr error
+			repaired, repairErr = repair()
+			if repairErr != nil {
+				repaired = fmt.Sprintf("repair failed: %v", repairErr)
+			}
+		}
+
+		var lines []string
+		for _, problem := range curProblems {
+			problem.Repaired = repaired
+			problems = append(problems, problem)
+			line := fmt.Sprintf("[%s] %s", problem.Key, problem.Problem)
+			if repaired != "" {
+				line += fmt.Sprintf(" (%s)", repaired)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) > 0 && importOpts.AppJobOp != nil {
+			importOpts.AppJobOp.Update(lines)
+		}
+
+		if stopping := importOpts.CompletedTask("", 1); stopping {
+			return fmt.Errorf("stopped by user")
+		}
+		return nil
+	})
+	if err != nil {
+		return problems, err
+	}
+
+	for _, item := range broken {
+		ds.removeBrokenItem(item)
+	}
+
+	importOpts.CompletedTask(fmt.Sprintf("Checked %d items: found %d problems, removed %d broken items.", count, len(problems), len(broken)), 0)
+	return problems, nil
+}
+
+func init() {
+	Router.HandleFunc("/datasets/{ds_id}/check", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+
+		r.ParseForm()
+		opts := CheckOptions{
+			RepairMetadata: r.PostForm.Get("repair_metadata") == "true",
+			RemoveBroken: r.PostForm.Get("remove_broken") == "true",
+		}
+		if videoID := r.PostForm.Get("video_dataset"); videoID != "" {
+			opts.VideoDataset = GetDataset(skyhook.ParseInt(videoID))
+			if opts.VideoDataset == nil || opts.VideoDataset.DataType != skyhook.VideoType {
+				http.Error(w, "no such video dataset", 404)
+				return
+			}
+		}
+
+		job := NewJob(
+			fmt.Sprintf("Check %s", dataset.Name),
+			"check",
+			"consoleprogress",
+			strconv.Itoa(dataset.ID),
+		)
+		progressJobOp := &ProgressJobOp{}
+		jobOp := &AppJobOp{
+			Job: job,
+			TailOp: &skyhook.TailJobOp{},
+			WrappedJobOps: map[string]skyhook.JobOp{
+				"progress": progressJobOp,
+			},
+		}
+		job.AttachOp(jobOp)
+		importOpts := ImportOptions{
+			AppJobOp: jobOp,
+			ProgressJobOp: progressJobOp,
+		}
+
+		log.Printf("[check] user requested check of dataset %s", dataset.Name)
+		go func() {
+			problems, err := dataset.Check(opts, importOpts)
+			if err == nil {
+				log.Printf("[check] check of %s found %d problems", dataset.Name, len(problems))
+			} else {
+				log.Printf("[check] check of %s failed: %v", dataset.Name, err)
+			}
+			importOpts.AppJobOp.SetDone(err)
+		}()
+		skyhook.JsonResponse(w, job)
+	}).Methods("POST")
+}
@@ -70,7 +70,33 @@ func (this *Database) Exec(q string, args ...interface{}) Result {
 func (this *Database) Transaction(f func(tx Tx)) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	f(Tx{this})
+	f(Tx{db: this})
+}
+
+// Like Transaction, but f runs inside a sqlite transaction.
+// The transaction is committed if f returns nil, and rolled back otherwise
+// (including if f panics).
+func (this *Database) Atomic(f func(tx Tx) error) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	sqlTx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			sqlTx.Rollback()
+		}
+	}()
+	if err := f(Tx{db: this, tx: sqlTx}); err != nil {
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
 }
 
 func (this *Database) Close() {
@@ -156,10 +182,26 @@ func (r Result) RowsAffected() int {
 
 type Tx struct {
 	db *Database
+	// set if we are in a sqlite transaction (see Database.Atomic)
+	tx *sql.Tx
+}
+
+// Interface implemented by both sql.DB and sql.Tx.
+type querier interface {
+	Query(q string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(q string, args ...interface{}) *sql.Row
+	Exec(q string, args ...interface{}) (sql.Result, error)
+}
+
+func (tx Tx) querier() querier {
+	if tx.tx != nil {
+		return tx.tx
+	}
+	return tx.db.db
 }
 
 func (tx Tx) Query(q string, args ...interface{}) Rows {
-	rows, err := tx.db.db.Query(q, args...)
+	rows, err := tx.querier().Query(q, args...)
 	if err != nil {
 		panic(err)
 	}
@@ -167,12 +209,12 @@ func (tx Tx) Query(q string, args ...interface{}) Rows {
 }
 
 func (tx Tx) QueryRow(q string, args ...interface{}) Row {
-	row := tx.db.db.QueryRow(q, args...)
+	row := tx.querier().QueryRow(q, args...)
 	return Row{tx.db, false, row}
 }
 
 func (tx Tx) Exec(q string, args ...interface{}) Result {
-	result, err := tx.db.db.Exec(q, args...)
+	result, err := tx.querier().Exec(q, args...)
 	if err != nil {
 		panic(err)
 	}
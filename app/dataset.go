@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -52,6 +55,63 @@ func (item *DBItem) Handle(format string, w http.ResponseWriter, r *http.Request
 	}
 }
 
+// Response to a paginated request for the items in a dataset.
+type ItemListResponse struct {
+	Items []*DBItem
+	// Total number of items matching the filters, across all pages.
+	// Counting may require scanning every item, so it is only computed for the first
+	// page or if the count parameter is set, and is -1 otherwise.
+	Total int
+	// If More is set, Next is the cursor to pass as "after" to get the next page.
+	More bool
+	Next string
+}
+
+// Parse item list options from the query parameters of GET /datasets/{ds_id}/items.
+// The supported parameters are:
+// - after, limit: cursor pagination.
+// - prefix, glob, regex: key filters.
+// - format: item format filter.
+// - meta.X: only match items with metadata field X equal to the value.
+// Also returns whether any option was specified.
+func parseItemListOptions(form url.Values) (ItemListOptions, bool, error) {
+	var opts ItemListOptions
+	paged := false
+	for k, v := range form {
+		if len(v) == 0 {
+			continue
+		}
+		value := v[0]
+		if k == "after" {
+			opts.After = value
+		} else if k == "limit" {
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return opts, false, fmt.Errorf("invalid limit %s", value)
+			}
+			opts.Limit = limit
+		} else if k == "prefix" {
+			opts.Prefix = value
+		} else if k == "glob" {
+			opts.Glob = value
+		} else if k == "regex" {
+			opts.Regex = value
+		} else if k == "format" {
+			opts.Format = value
+		} else if strings.HasPrefix(k, "meta.") {
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]string)
+			}
+			opts.Metadata[k[len("meta."):]] = value
+		} else {
+			// ignore unknown parameters
+			continue
+		}
+		paged = true
+	}
+	return opts, paged, nil
+}
+
 func init() {
 	Router.HandleFunc("/datasets", func(w http.ResponseWriter, r *http.Request) {
 		skyhook.JsonResponse(w, ListDatasets())
@@ -108,7 +168,43 @@ func init() {
 			http.Error(w, "no such dataset", 404)
 			return
 		}
-		skyhook.JsonResponse(w, dataset.ListItems())
+		r.ParseForm()
+		opts, paged, err := parseItemListOptions(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !paged {
+			// no options specified, so we return the full list of items
+			skyhook.JsonResponse(w, dataset.ListItems())
+			return
+		}
+
+		// fetch one more item than the limit so we know whether there is a next page
+		var response ItemListResponse
+		limit := opts.Limit
+		if limit > 0 {
+			opts.Limit++
+		}
+		response.Items, err = dataset.ListItemsPage(opts)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if limit > 0 && len(response.Items) > limit {
+			response.Items = response.Items[0:limit]
+			response.Next = response.Items[limit-1].Key
+			response.More = true
+		}
+		response.Total = -1
+		if opts.After == "" || r.Form.Get("count") == "1" {
+			response.Total, err = dataset.CountItems(opts)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		skyhook.JsonResponse(w, response)
 	}).Methods("GET")
 
 	Router.HandleFunc("/datasets/{ds_id}/items", func(w http.ResponseWriter, r *http.Request) {
@@ -149,6 +245,87 @@ func init() {
 		skyhook.JsonResponse(w, item_)
 	}).Methods("POST")
 
+	// Batch operations on items.
+	// Each of these runs in a single transaction, so either all items are updated or none are.
+	handleBatch := func(f func(http.ResponseWriter, *http.Request, *DBDataset)) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+			dataset := GetDataset(dsID)
+			if dataset == nil {
+				http.Error(w, "no such dataset", 404)
+				return
+			}
+			f(w, r, dataset)
+		}
+	}
+
+	Router.HandleFunc("/datasets/{ds_id}/batch/add", handleBatch(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset) {
+		var items []skyhook.Item
+		if err := skyhook.ParseJsonRequest(w, r, &items); err != nil {
+			return
+		}
+		log.Printf("add %d items to dataset %d", len(items), dataset.ID)
+		dbItems, err := dataset.AddItems(items)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		skyhook.JsonResponse(w, dbItems)
+	})).Methods("POST")
+
+	Router.HandleFunc("/datasets/{ds_id}/batch/delete", handleBatch(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset) {
+		var request struct {
+			Keys []string
+		}
+		if err := skyhook.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		if err := dataset.DeleteItems(request.Keys); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	})).Methods("POST")
+
+	Router.HandleFunc("/datasets/{ds_id}/batch/rename", handleBatch(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset) {
+		var request struct {
+			// Map from old key to new key.
+			Renames map[string]string
+		}
+		if err := skyhook.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		if err := dataset.RenameItems(request.Renames); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	})).Methods("POST")
+
+	// Copy items from this dataset into another dataset.
+	Router.HandleFunc("/datasets/{ds_id}/batch/copy", handleBatch(func(w http.ResponseWriter, r *http.Request, dataset *DBDataset) {
+		var request struct {
+			// ID of the destination dataset.
+			Dataset int
+			// Keys to copy, or empty to copy all items.
+			Keys []string
+			// Whether to reference the source files instead of copying them.
+			Reference bool
+		}
+		if err := skyhook.ParseJsonRequest(w, r, &request); err != nil {
+			return
+		}
+		dst := GetDataset(request.Dataset)
+		if dst == nil {
+			http.Error(w, "no such destination dataset", 404)
+			return
+		}
+		dbItems, err := dataset.CopyItems(dst, request.Keys, request.Reference)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		skyhook.JsonResponse(w, dbItems)
+	})).Methods("POST")
+
 	// handle endpoints starting with /datasets/{ds_id}/items/{item_key}
 	handleItem := func(f func(http.ResponseWriter, *http.Request, *DBDataset, *DBItem)) func(w http.ResponseWriter, r *http.Request) {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -3,9 +3,13 @@ package app
 import (
 	"github.com/skyhookml/skyhookml/skyhook"
 
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
 	"strings"
 )
 
@@ -60,18 +64,21 @@ func FindDataset(hash string) *DBDataset {
 	}
 }
 
-const AnnotateDatasetQuery = "SELECT a.id, d.id, d.name, d.type, d.data_type, a.inputs, a.tool, a.params FROM annotate_datasets AS a LEFT JOIN datasets AS d ON a.dataset_id = d.id"
+const AnnotateDatasetQuery = "SELECT a.id, d.id, d.name, d.type, d.data_type, a.inputs, a.tool, a.params, a.sampler FROM annotate_datasets AS a LEFT JOIN datasets AS d ON a.dataset_id = d.id"
 
 func annotateDatasetListHelper(rows *Rows) []*DBAnnotateDataset {
 	annosets := []*DBAnnotateDataset{}
 	for rows.Next() {
 		var s DBAnnotateDataset
-		var inputsRaw string
-		rows.Scan(&s.ID, &s.Dataset.ID, &s.Dataset.Name, &s.Dataset.Type, &s.Dataset.DataType, &inputsRaw, &s.Tool, &s.Params)
+		var inputsRaw, samplerRaw string
+		rows.Scan(&s.ID, &s.Dataset.ID, &s.Dataset.Name, &s.Dataset.Type, &s.Dataset.DataType, &inputsRaw, &s.Tool, &s.Params, &samplerRaw)
 		skyhook.JsonUnmarshal([]byte(inputsRaw), &s.Inputs)
 		if s.Inputs == nil {
 			s.Inputs = []skyhook.ExecParent{}
 		}
+		if samplerRaw != "" {
+			skyhook.JsonUnmarshal([]byte(samplerRaw), &s.Sampler)
+		}
 		annosets = append(annosets, &s)
 	}
 	return annosets
@@ -119,11 +126,11 @@ func (s *DBAnnotateDataset) SampleMissingKey() string {
 			// TODO: probably want to handle this error somehow
 			continue
 		}
-		items := ds.ListItems()
 		curKeys := make(map[string]bool)
-		for _, item := range items {
+		ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
 			curKeys[item.Key] = true
-		}
+			return nil
+		})
 		if keys == nil {
 			keys = curKeys
 		} else {
@@ -135,24 +142,72 @@ func (s *DBAnnotateDataset) SampleMissingKey() string {
 		}
 	}
 
-	items := (&DBDataset{Dataset: s.Dataset}).ListItems()
-	for _, item := range items {
+	(&DBDataset{Dataset: s.Dataset}).IterItems(ItemListOptions{}, func(item *DBItem) error {
 		delete(keys, item.Key)
+		return nil
+	})
+
+	if len(keys) == 0 {
+		return ""
+	}
+
+	if s.Sampler.Mode == "ranked" && s.Sampler.Ranking != nil {
+		key, err := s.sampleRankedKey(keys)
+		if err != nil {
+			log.Printf("[annotate] error sampling from ranking of annotate dataset %d, falling back to random: %v", s.ID, err)
+		} else if key != "" {
+			return key
+		}
 	}
 
 	var keyList []string
 	for key := range keys {
 		keyList = append(keyList, key)
 	}
-	if len(keyList) == 0 {
-		return ""
-	}
 	return keyList[rand.Intn(len(keyList))]
 }
 
+// Returns the highest-priority key in the sampler's ranking table that is in the
+// candidate set, or empty string if none of the ranked keys are candidates.
+func (s *DBAnnotateDataset) sampleRankedKey(candidates map[string]bool) (string, error) {
+	ds, err := ExecParentToDataset(*s.Sampler.Ranking)
+	if err != nil {
+		return "", err
+	}
+	if ds.DataType != skyhook.TableType {
+		return "", fmt.Errorf("ranking dataset must be a table, but got %s", ds.DataType)
+	}
+	var bestKey string
+	err = ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+		if bestKey != "" {
+			return nil
+		}
+		data, metadata, err := item.LoadData()
+		if err != nil {
+			return err
+		}
+		column := 0
+		for i, spec := range metadata.(skyhook.TableMetadata).Columns {
+			if spec.Label == "key" {
+				column = i
+				break
+			}
+		}
+		for _, row := range data.(skyhook.TableData) {
+			if column < len(row) && candidates[row[column]] {
+				bestKey = row[column]
+				break
+			}
+		}
+		return nil
+	})
+	return bestKey, err
+}
+
 type AnnotateDatasetUpdate struct {
 	Tool *string
 	Params *string
+	Sampler *skyhook.AnnotateSampler
 }
 
 func (s *DBAnnotateDataset) Update(req AnnotateDatasetUpdate) {
@@ -162,6 +217,9 @@ func (s *DBAnnotateDataset) Update(req AnnotateDatasetUpdate) {
 	if req.Params != nil {
 		db.Exec("UPDATE annotate_datasets SET params = ? WHERE id = ?", *req.Params, s.ID)
 	}
+	if req.Sampler != nil {
+		db.Exec("UPDATE annotate_datasets SET sampler = ? WHERE id = ?", string(skyhook.JsonMarshal(*req.Sampler)), s.ID)
+	}
 }
 
 func (s *DBAnnotateDataset) Delete() {
@@ -202,6 +260,13 @@ func (ds *DBDataset) getDB() *Database {
 			-- only set if computed
 			hash TEXT
 		)`)
+		db.Exec(`CREATE TABLE IF NOT EXISTS stats (
+			-- StatsKey of the dataset when the stats were computed
+			content_hash TEXT PRIMARY KEY,
+			-- JSON-encoded skyhook.DatasetStats
+			stats TEXT
+		)`)
+		addVersionCounter(db)
 		db.Exec(
 			"INSERT OR REPLACE INTO datasets (id, name, type, data_type, metadata, hash) VALUES (1, ?, ?, ?, ?, ?)",
 			ds.Name, ds.Type, ds.DataType, ds.Metadata, ds.Hash,
@@ -209,18 +274,225 @@ func (ds *DBDataset) getDB() *Database {
 	})
 }
 
-func (ds *DBDataset) ListItems() []*DBItem {
+// Add the counter that is incremented whenever the items change, see StatsKey.
+// This runs whenever a dataset database is opened, so it also migrates databases
+// created by older versions, including databases of imported datasets.
+func addVersionCounter(db *Database) {
+	db.Exec(`CREATE TABLE IF NOT EXISTS version (
+		id INTEGER PRIMARY KEY,
+		v INTEGER
+	)`)
+	db.Exec("INSERT OR IGNORE INTO version (id, v) VALUES (1, 0)")
+	for _, op := range []string{"insert", "update", "delete"} {
+		db.Exec(fmt.Sprintf(
+			"CREATE TRIGGER IF NOT EXISTS items_%s_version AFTER %s ON items BEGIN UPDATE version SET v = v + 1; END",
+			op, strings.ToUpper(op),
+		))
+	}
+}
+
+// Options for filtering and paginating the items in a dataset.
+// The zero value matches every item.
+type ItemListOptions struct {
+	// Only return items with key strictly greater than this key.
+	// This is the cursor for pagination: pass the last key of the previous page.
+	After string
+	// Maximum number of items to return, or 0 for no limit.
+	Limit int
+
+	// Key filters.
+	Prefix string
+	// Pattern in sqlite GLOB syntax, e.g. "frame_*.jpg".
+	Glob string
+	// Go regular expression that the key must match.
+	Regex string
+
+	// Only return items with this format.
+	Format string
+	// Only return items whose JSON metadata has these field values.
+	// String fields must equal the value exactly, while other fields (numbers, booleans,
+	// arrays, and objects) must equal the value decoded as JSON, e.g. "1000000" matches
+	// 1000000 and 1e6 but not "1000000" in quotes.
+	Metadata map[string]string
+}
+
+// number of rows to fetch from the items table per query in IterItems
+const itemPageSize = 1024
+
+// Returns the WHERE clauses and arguments for the filters that can be evaluated by sqlite.
+// The Regex and Metadata filters are applied in Go.
+func (opts ItemListOptions) sqlFilters() ([]string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if opts.Prefix != "" {
+		where = append(where, "instr(k, ?) = 1")
+		args = append(args, opts.Prefix)
+	}
+	if opts.Glob != "" {
+		where = append(where, "k GLOB ?")
+		args = append(args, opts.Glob)
+	}
+	if opts.Format != "" {
+		where = append(where, "format = ?")
+		args = append(args, opts.Format)
+	}
+	return where, args
+}
+
+// Iterate over the items in the dataset in key order, calling f on each item
+// that matches the options.
+// Items are fetched from the database in pages so that the database lock is not held
+// while f runs, and so that callers don't need to materialize every item in memory.
+// Iteration stops early if f returns an error, which is returned by IterItems.
+func (ds *DBDataset) IterItems(opts ItemListOptions, f func(item *DBItem) error) error {
+	var re *regexp.Regexp
+	if opts.Regex != "" {
+		var err error
+		re, err = regexp.Compile(opts.Regex)
+		if err != nil {
+			return fmt.Errorf("bad key regex: %v", err)
+		}
+	}
+
+	where, args := opts.sqlFilters()
+
+	matches := func(item *DBItem) bool {
+		if re != nil && !re.MatchString(item.Key) {
+			return false
+		}
+		if len(opts.Metadata) > 0 {
+			var metadata map[string]interface{}
+			if err := json.Unmarshal([]byte(item.Metadata), &metadata); err != nil {
+				return false
+			}
+			for field, value := range opts.Metadata {
+				x, ok := metadata[field]
+				if !ok || !metadataValueMatches(x, value) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
 	db := ds.getDB()
-	rows := db.Query(ItemQuery + " ORDER BY k")
-	items := itemListHelper(rows)
-	// populate dataset
-	for _, item := range items {
-		item.Dataset = ds.Dataset
-		item.loaded = true
+	// the empty string is a valid key, so we only apply the cursor on the first page
+	// if the caller provided one
+	after := opts.After
+	hasCursor := opts.After != ""
+	count := 0
+	for {
+		q := ItemQuery
+		curWhere := where
+		curArgs := args
+		if hasCursor {
+			curWhere = append(append([]string{}, where...), "k > ?")
+			curArgs = append(append([]interface{}{}, args...), after)
+		}
+		if len(curWhere) > 0 {
+			q += " WHERE " + strings.Join(curWhere, " AND ")
+		}
+		q += fmt.Sprintf(" ORDER BY k LIMIT %d", itemPageSize)
+		items := itemListHelper(db.Query(q, curArgs...))
+
+		for _, item := range items {
+			item.Dataset = ds.Dataset
+			item.loaded = true
+			if !matches(item) {
+				continue
+			}
+			if err := f(item); err != nil {
+				return err
+			}
+			count++
+			if opts.Limit > 0 && count >= opts.Limit {
+				return nil
+			}
+		}
+
+		if len(items) < itemPageSize {
+			return nil
+		}
+		after = items[len(items)-1].Key
+		hasCursor = true
+	}
+}
+
+// Returns whether a field decoded from JSON metadata matches a metadata filter value.
+func metadataValueMatches(x interface{}, value string) bool {
+	if s, ok := x.(string); ok {
+		return s == value
 	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, decoded)
+}
+
+// Returns the number of items matching the options.
+// The After and Limit options are ignored.
+func (ds *DBDataset) CountItems(opts ItemListOptions) (int, error) {
+	if opts.Regex == "" && len(opts.Metadata) == 0 {
+		// we can count directly in the database
+		where, args := opts.sqlFilters()
+		q := "SELECT COUNT(*) FROM items"
+		if len(where) > 0 {
+			q += " WHERE " + strings.Join(where, " AND ")
+		}
+		// use the underlying QueryRow so that we can return the error instead of panicking
+		db := ds.getDB()
+		var count int
+		err := func() error {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return db.db.QueryRow(q, args...).Scan(&count)
+		}()
+		if err != nil {
+			return 0, fmt.Errorf("error counting items: %v", err)
+		}
+		return count, nil
+	}
+
+	opts.After = ""
+	opts.Limit = 0
+	count := 0
+	err := ds.IterItems(opts, func(item *DBItem) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Returns one page of items matching the options.
+func (ds *DBDataset) ListItemsPage(opts ItemListOptions) ([]*DBItem, error) {
+	items := []*DBItem{}
+	err := ds.IterItems(opts, func(item *DBItem) error {
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func (ds *DBDataset) ListItems() []*DBItem {
+	var items []*DBItem
+	ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+		items = append(items, item)
+		return nil
+	})
 	return items
 }
 
+// Returns the keys of every item in the dataset, in key order.
+func (ds *DBDataset) ListKeys() []string {
+	var keys []string
+	ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+		keys = append(keys, item.Key)
+		return nil
+	})
+	return keys
+}
+
 func (ds *DBDataset) AddItem(item skyhook.Item) (*DBItem, error) {
 	db := ds.getDB()
 	// We use underlying Exec directly here since it is expected that we may encounter
@@ -243,6 +515,236 @@ func (ds *DBDataset) AddItem(item skyhook.Item) (*DBItem, error) {
 	return ds.GetItem(item.Key), nil
 }
 
+// Add several items in a single transaction.
+// If any of the keys already exist, or are repeated, then no items are added.
+func (ds *DBDataset) AddItems(items []skyhook.Item) ([]*DBItem, error) {
+	db := ds.getDB()
+	err := db.Atomic(func(tx Tx) error {
+		seen := make(map[string]bool)
+		for _, item := range items {
+			if seen[item.Key] {
+				return fmt.Errorf("key %s appears multiple times", item.Key)
+			}
+			seen[item.Key] = true
+			var count int
+			tx.QueryRow("SELECT COUNT(*) FROM items WHERE k = ?", item.Key).Scan(&count)
+			if count > 0 {
+				return fmt.Errorf("item with key %s already exists in the dataset", item.Key)
+			}
+			tx.Exec(
+				"INSERT INTO items (k, ext, format, metadata, provider, provider_info) VALUES (?, ?, ?, ?, ?, ?)",
+				item.Key, item.Ext, item.Format, item.Metadata, item.Provider, item.ProviderInfo,
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	dbItems := make([]*DBItem, len(items))
+	for i, item := range items {
+		item.Dataset = ds.Dataset
+		dbItems[i] = &DBItem{Item: item, loaded: true}
+	}
+	return dbItems, nil
+}
+
+// Get the items with the specified keys inside a transaction.
+// Returns error if any key doesn't exist.
+func (ds *DBDataset) getItemsTx(tx Tx, keys []string) ([]*DBItem, error) {
+	var items []*DBItem
+	for _, key := range keys {
+		rows := tx.Query(ItemQuery + " WHERE k = ?", key)
+		curItems := itemListHelper(&rows)
+		if len(curItems) != 1 {
+			return nil, fmt.Errorf("no item with key %s", key)
+		}
+		curItems[0].Dataset = ds.Dataset
+		curItems[0].loaded = true
+		items = append(items, curItems[0])
+	}
+	return items, nil
+}
+
+// Delete several items in a single transaction.
+// If any of the keys don't exist, then no items are deleted.
+func (ds *DBDataset) DeleteItems(keys []string) error {
+	db := ds.getDB()
+	var items []*DBItem
+	err := db.Atomic(func(tx Tx) error {
+		var err error
+		items, err = ds.getItemsTx(tx, keys)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			tx.Exec("DELETE FROM items WHERE k = ?", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		item.removeOwnedFile()
+	}
+	return nil
+}
+
+// Rename several items in a single transaction.
+// renames maps from old key to new key. Keys may be swapped or renamed in chains,
+// but the new keys must not collide with items that are not being renamed.
+func (ds *DBDataset) RenameItems(renames map[string]string) error {
+	var oldKeys []string
+	newKeys := make(map[string]bool)
+	for oldKey, newKey := range renames {
+		if newKeys[newKey] {
+			return fmt.Errorf("multiple items renamed to key %s", newKey)
+		}
+		newKeys[newKey] = true
+		oldKeys = append(oldKeys, oldKey)
+	}
+
+	// Items using the default provider also need their files renamed, since the
+	// filename is derived from the key. Unless the transaction commits, we undo the
+	// moves that were already applied, including if the transaction panics.
+	type move struct {
+		src string
+		dst string
+	}
+	var moves []move
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		for i := len(moves)-1; i >= 0; i-- {
+			os.Rename(moves[i].dst, moves[i].src)
+		}
+	}()
+
+	db := ds.getDB()
+	err := db.Atomic(func(tx Tx) error {
+		items, err := ds.getItemsTx(tx, oldKeys)
+		if err != nil {
+			return err
+		}
+		for newKey := range newKeys {
+			if _, ok := renames[newKey]; ok {
+				continue
+			}
+			var count int
+			tx.QueryRow("SELECT COUNT(*) FROM items WHERE k = ?", newKey).Scan(&count)
+			if count > 0 {
+				return fmt.Errorf("item with key %s already exists in the dataset", newKey)
+			}
+		}
+
+		// We rename in two phases through temporary keys so that swaps and chains work.
+		tmpSuffix := fmt.Sprintf(".renaming-%d", rand.Int63())
+		tmpKey := func(item *DBItem) string {
+			return item.Key + tmpSuffix
+		}
+		for _, phase := range []int{0, 1} {
+			for _, item := range items {
+				var src, dst skyhook.Item
+				src, dst = item.Item, item.Item
+				if phase == 0 {
+					dst.Key = tmpKey(item)
+				} else {
+					src.Key = tmpKey(item)
+					dst.Key = renames[item.Key]
+				}
+				tx.Exec("UPDATE items SET k = ? WHERE k = ?", dst.Key, src.Key)
+				if item.Provider != nil {
+					continue
+				}
+				if err := os.Rename(src.Fname(), dst.Fname()); err != nil {
+					return fmt.Errorf("error renaming item %s: %v", item.Key, err)
+				}
+				moves = append(moves, move{src.Fname(), dst.Fname()})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// Copy items from this dataset into another dataset of the same type.
+// If keys is empty, all items are copied.
+// If reference is true, the new items reference the files of the source items;
+// otherwise, the files are copied. Items backed by other providers (like virtual
+// providers) are always copied with the same provider.
+// The items are added in a single transaction.
+func (ds *DBDataset) CopyItems(dst *DBDataset, keys []string, reference bool) ([]*DBItem, error) {
+	if ds.DataType != dst.DataType {
+		return nil, fmt.Errorf("cannot copy items from %s dataset to %s dataset", ds.DataType, dst.DataType)
+	}
+
+	var srcItems []*DBItem
+	if len(keys) == 0 {
+		srcItems = ds.ListItems()
+	} else {
+		err := ds.getDB().Atomic(func(tx Tx) error {
+			var err error
+			srcItems, err = ds.getItemsTx(tx, keys)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var newItems []skyhook.Item
+	// files that we copied, which we need to remove if adding the items fails
+	var copied []string
+	cleanup := func() {
+		for _, fname := range copied {
+			os.Remove(fname)
+		}
+	}
+	dst.Mkdir()
+	for _, srcItem := range srcItems {
+		item := skyhook.Item{
+			Dataset: dst.Dataset,
+			Key: srcItem.Key,
+			Ext: srcItem.Ext,
+			Format: srcItem.Format,
+			Metadata: srcItem.Metadata,
+			Provider: srcItem.Provider,
+			ProviderInfo: srcItem.ProviderInfo,
+		}
+		if srcItem.Provider == nil || *srcItem.Provider == "reference" {
+			if reference {
+				provider := "reference"
+				fname := srcItem.Fname()
+				item.Provider = &provider
+				item.ProviderInfo = &fname
+			} else {
+				item.Provider = nil
+				item.ProviderInfo = nil
+				if err := skyhook.CopyFile(srcItem.Fname(), item.Fname()); err != nil {
+					cleanup()
+					return nil, fmt.Errorf("error copying item %s: %v", srcItem.Key, err)
+				}
+				copied = append(copied, item.Fname())
+			}
+		}
+		newItems = append(newItems, item)
+	}
+
+	dbItems, err := dst.AddItems(newItems)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return dbItems, nil
+}
+
 func (ds *DBDataset) GetItem(key string) *DBItem {
 	db := ds.getDB()
 	rows := db.Query(ItemQuery + " WHERE k = ?", key)
@@ -316,6 +818,16 @@ func (item *DBItem) Delete() {
 	item.Item.Remove()
 }
 
+// Remove the item's file if the item owns it.
+// Items backed by a provider (e.g. reference items) may point at files in other
+// datasets, so we leave those alone.
+func (item *DBItem) removeOwnedFile() {
+	if item.Provider != nil {
+		return
+	}
+	os.Remove(item.Fname())
+}
+
 func (item *DBItem) Load() {
 	if item.loaded {
 		return
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Databases are opened relative to the working directory, so we run the tests in a
+// temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "skyhook-app-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll("data/items", 0755); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Returns a dataset whose items are only stored in its own database, with the
+// specified keys and metadata.
+func newTestDataset(t *testing.T, id int, metadata map[string]string) *DBDataset {
+	ds := &DBDataset{Dataset: skyhook.Dataset{
+		ID: id,
+		Name: fmt.Sprintf("test%d", id),
+		Type: "data",
+		DataType: skyhook.IntType,
+	}}
+	var items []skyhook.Item
+	for key, meta := range metadata {
+		format := "json"
+		if key[0] == 'b' {
+			format = "other"
+		}
+		items = append(items, skyhook.Item{Key: key, Ext: "json", Format: format, Metadata: meta})
+	}
+	if _, err := ds.AddItems(items); err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func listKeys(t *testing.T, ds *DBDataset, opts ItemListOptions) []string {
+	items, err := ds.ListItemsPage(opts)
+	if err != nil {
+		t.Fatalf("ListItemsPage(%+v): %v", opts, err)
+	}
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+func TestListItemsPage(t *testing.T) {
+	ds := newTestDataset(t, 1, map[string]string{
+		"a1": `{"frames": 1000000, "flag": true, "name": "x"}`,
+		"a2": `{"frames": 10, "flag": false, "name": "1000000"}`,
+		"a3": `{"frames": 1000000.5, "dims": [640, 480]}`,
+		"b1": `{"name": "x"}`,
+		"b2": ``,
+		"c1": `{"name": "y", "nested": {"a": 1}}`,
+	})
+
+	tests := []struct {
+		label string
+		opts ItemListOptions
+		expected []string
+	}{
+		{"all", ItemListOptions{}, []string{"a1", "a2", "a3", "b1", "b2", "c1"}},
+		{"limit", ItemListOptions{Limit: 2}, []string{"a1", "a2"}},
+		{"cursor", ItemListOptions{After: "a2", Limit: 2}, []string{"a3", "b1"}},
+		{"cursor between keys", ItemListOptions{After: "a25"}, []string{"a3", "b1", "b2", "c1"}},
+		{"last page", ItemListOptions{After: "b2", Limit: 5}, []string{"c1"}},
+		{"past end", ItemListOptions{After: "c1"}, []string{}},
+		{"prefix", ItemListOptions{Prefix: "b"}, []string{"b1", "b2"}},
+		{"glob", ItemListOptions{Glob: "*1"}, []string{"a1", "b1", "c1"}},
+		{"regex", ItemListOptions{Regex: "^[ac][23]$"}, []string{"a2", "a3"}},
+		{"format", ItemListOptions{Format: "other"}, []string{"b1", "b2"}},
+		{"regex with cursor and limit", ItemListOptions{Regex: "1$", After: "a1", Limit: 1}, []string{"b1"}},
+		{"meta large number", ItemListOptions{Metadata: map[string]string{"frames": "1000000"}}, []string{"a1"}},
+		{"meta number in exponent form", ItemListOptions{Metadata: map[string]string{"frames": "1e6"}}, []string{"a1"}},
+		{"meta fraction", ItemListOptions{Metadata: map[string]string{"frames": "1000000.5"}}, []string{"a3"}},
+		{"meta bool", ItemListOptions{Metadata: map[string]string{"flag": "true"}}, []string{"a1"}},
+		{"meta bool false", ItemListOptions{Metadata: map[string]string{"flag": "false"}}, []string{"a2"}},
+		{"meta string", ItemListOptions{Metadata: map[string]string{"name": "x"}}, []string{"a1", "b1"}},
+		{"meta numeric string", ItemListOptions{Metadata: map[string]string{"name": "1000000"}}, []string{"a2"}},
+		{"meta array", ItemListOptions{Metadata: map[string]string{"dims": "[640, 480]"}}, []string{"a3"}},
+		{"meta object", ItemListOptions{Metadata: map[string]string{"nested": `{"a": 1}`}}, []string{"c1"}},
+		{"meta several fields", ItemListOptions{Metadata: map[string]string{"name": "x", "flag": "true"}}, []string{"a1"}},
+		{"meta and key filter", ItemListOptions{Prefix: "b", Metadata: map[string]string{"name": "x"}}, []string{"b1"}},
+		{"meta missing field", ItemListOptions{Metadata: map[string]string{"missing": "x"}}, []string{}},
+	}
+	for _, test := range tests {
+		keys := listKeys(t, ds, test.opts)
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("%s: keys = %v; want %v", test.label, keys, test.expected)
+		}
+		// CountItems ignores the cursor and limit
+		countOpts := test.opts
+		countOpts.After = ""
+		countOpts.Limit = 0
+		count, err := ds.CountItems(test.opts)
+		if err != nil {
+			t.Errorf("%s: CountItems: %v", test.label, err)
+		} else if expected := len(listKeys(t, ds, countOpts)); count != expected {
+			t.Errorf("%s: CountItems = %d; want %d", test.label, count, expected)
+		}
+	}
+
+	if _, err := ds.ListItemsPage(ItemListOptions{Regex: "("}); err == nil {
+		t.Errorf("expected error for invalid regex")
+	}
+}
+
+// IterItems fetches items from the database in pages of itemPageSize, so we check
+// that paging through the dataset with a cursor visits each item once, in order.
+func TestListItemsPageAcrossQueries(t *testing.T) {
+	n := 2*itemPageSize + 10
+	metadata := make(map[string]string)
+	var expected []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("a%05d", i)
+		metadata[key] = fmt.Sprintf(`{"even": %v}`, i%2 == 0)
+		if i%2 == 0 {
+			expected = append(expected, key)
+		}
+	}
+	ds := newTestDataset(t, 2, metadata)
+
+	// the filter is applied in Go, so most database pages yield fewer items than the limit
+	opts := ItemListOptions{Limit: 300, Metadata: map[string]string{"even": "true"}}
+	var keys []string
+	for {
+		page := listKeys(t, ds, opts)
+		keys = append(keys, page...)
+		if len(page) < opts.Limit {
+			break
+		}
+		opts.After = page[len(page)-1]
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("paged through %d keys; want %d", len(keys), len(expected))
+	}
+}
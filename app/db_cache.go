@@ -2,9 +2,13 @@ package app
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 // Database cache for per-dataset sqlite3 files.
@@ -55,3 +59,47 @@ func UncacheDB(fname string) {
 	}
 	dbCacheMu.Unlock()
 }
+
+// Write a consistent snapshot of the sqlite3 file at fname to dstFname using the
+// sqlite online backup API.
+// If we have a cached connection to fname, we hold its lock during the backup so
+// that our own writes don't run into the read lock held by the backup.
+func BackupDB(fname string, dstFname string) error {
+	dbCacheMu.Lock()
+	cached := dbCache[fname]
+	dbCacheMu.Unlock()
+	if cached != nil {
+		cached.mu.Lock()
+		defer cached.mu.Unlock()
+	}
+
+	driver := &sqlite3.SQLiteDriver{}
+	srcConn, err := driver.Open(fname)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", fname, err)
+	}
+	defer srcConn.Close()
+	dstConn, err := driver.Open(dstFname)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", dstFname, err)
+	}
+	defer dstConn.Close()
+
+	backup, err := dstConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return fmt.Errorf("error starting backup of %s: %v", fname, err)
+	}
+	for {
+		// Step returns false without error if the source is busy, so we retry after a delay
+		done, err := backup.Step(-1)
+		if err != nil {
+			backup.Finish()
+			return fmt.Errorf("error during backup of %s: %v", fname, err)
+		}
+		if done {
+			break
+		}
+		time.Sleep(100*time.Millisecond)
+	}
+	return backup.Finish()
+}
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"fmt"
 	"io/ioutil"
+	"log"
 	"path/filepath"
 	"strings"
 )
@@ -30,7 +32,8 @@ func InitDB(init bool) {
 			dataset_id INTEGER REFERENCES datasets(id),
 			inputs TEXT,
 			tool TEXT,
-			params TEXT
+			params TEXT,
+			sampler TEXT DEFAULT ''
 		)`)
 		db.Exec(`CREATE TABLE IF NOT EXISTS pytorch_archs (
 			id TEXT PRIMARY KEY,
@@ -119,6 +122,9 @@ func InitDB(init bool) {
 		}
 	}
 
+	// migrate databases created by older versions
+	addColumnIfMissing("annotate_datasets", "sampler", "TEXT DEFAULT ''")
+
 	// now run some database cleanup steps
 
 	// mark jobs that are still running as error
@@ -126,3 +132,15 @@ func InitDB(init bool) {
 
 	// delete temporary datasetsTODO
 }
+
+// Add a column to an existing table, for databases created before the column existed.
+// Does nothing if the table does not exist.
+func addColumnIfMissing(table string, column string, definition string) {
+	var numColumns, exists int
+	db.QueryRow("SELECT COUNT(*), COUNT(CASE WHEN name = ? THEN 1 END) FROM pragma_table_info(?)", column, table).Scan(&numColumns, &exists)
+	if numColumns == 0 || exists > 0 {
+		return
+	}
+	log.Printf("[db] adding missing column %s.%s", table, column)
+	db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+}
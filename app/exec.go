@@ -2,7 +2,6 @@ package app
 
 import (
 	"github.com/skyhookml/skyhookml/skyhook"
-	"github.com/skyhookml/skyhookml/exec_ops"
 
 	"fmt"
 	"log"
@@ -35,25 +34,55 @@ func ToSkyhookOutputDatasets(datasets map[string]*DBDataset) map[string]skyhook.
 // This only works for incremental nodes, which must produce the same keys across all output datasets.
 func (node *DBExecNode) GetComputedKeys() map[string]bool {
 	outputDatasets, _ := node.GetDatasets(false)
-	outputItems := make(map[string][][]skyhook.Item)
-	for name, ds := range outputDatasets {
+	// intersect the keys of the output datasets, like exec_ops.GroupItems, but without
+	// loading every item
+	var keySet map[string]bool
+	for _, ds := range outputDatasets {
 		if ds == nil {
 			return nil
 		}
-		var skItems []skyhook.Item
-		for _, item := range ds.ListItems() {
-			skItems = append(skItems, item.Item)
-		}
-		outputItems[name] = [][]skyhook.Item{skItems}
+		curSet := make(map[string]bool)
+		ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+			if keySet == nil || keySet[item.Key] {
+				curSet[item.Key] = true
+			}
+			return nil
+		})
+		keySet = curSet
 	}
-	groupedItems := exec_ops.GroupItems(outputItems)
-	keySet := make(map[string]bool)
-	for key := range groupedItems {
-		keySet[key] = true
+	if keySet == nil {
+		keySet = make(map[string]bool)
 	}
 	return keySet
 }
 
+// Collect the items of each input dataset for GetTasks and Resolve.
+// ExecOpImpl.GetTasks and Resolve take every input item as a [][]skyhook.Item, so we
+// can't avoid holding the item lists here. But we stream the items with IterItems into
+// lists sized from CountItems, so that we don't also hold the DBItems or grow the lists.
+func getInputItems(datasets map[string][]*DBDataset) (map[string][][]skyhook.Item, error) {
+	items := make(map[string][][]skyhook.Item)
+	for name, dslist := range datasets {
+		items[name] = make([][]skyhook.Item, len(dslist))
+		for i, ds := range dslist {
+			count, err := ds.CountItems(ItemListOptions{})
+			if err != nil {
+				return nil, err
+			}
+			list := make([]skyhook.Item, 0, count)
+			err = ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+				list = append(list, item.Item)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			items[name][i] = list
+		}
+	}
+	return items, nil
+}
+
 type ExecRunOptions struct {
 	// If force, we run even if outputs were already available.
 	Force bool
@@ -184,16 +213,9 @@ func (node *DBExecNode) PrepareRun(opts ExecRunOptions) (*RunData, error) {
 	}
 
 	// get items in parent datasets
-	items := make(map[string][][]skyhook.Item)
-	for name, dslist := range parentDatasets {
-		items[name] = make([][]skyhook.Item, len(dslist))
-		for i, ds := range dslist {
-			var skItems []skyhook.Item
-			for _, item := range ds.ListItems() {
-				skItems = append(skItems, item.Item)
-			}
-			items[name][i] = skItems
-		}
+	items, err := getInputItems(parentDatasets)
+	if err != nil {
+		return nil, err
 	}
 
 	// get tasks
@@ -416,21 +438,12 @@ func (node *DBExecNode) Incremental(opts IncrementalOptions) error {
 	computedOutputKeys := make(map[int][]string)
 	getKeys := func(parent skyhook.ExecParent) ([]string, bool) {
 		if parent.Type == "d" {
-			items := GetDataset(parent.ID).ListItems()
-			var keys []string
-			for _, item := range items {
-				keys = append(keys, item.Key)
-			}
-			return keys, true
+			return GetDataset(parent.ID).ListKeys(), true
 		} else if parent.Type == "n" {
 			node := GetExecNode(parent.ID)
 			if node.IsDone() {
 				datasets, _ := node.GetDatasets(false)
-				var keys []string
-				for _, item := range datasets[parent.Name].ListItems() {
-					keys = append(keys, item.Key)
-				}
-				return keys, true
+				return datasets[parent.Name].ListKeys(), true
 			} else if computedOutputKeys[node.ID] != nil {
 				return computedOutputKeys[node.ID], true
 			} else {
@@ -795,9 +808,7 @@ func init() {
 				http.Error(w, "could not find the specified dataset; make sure the dataset specifying keys to compute is already computed", 400)
 				return
 			}
-			for _, item := range dataset.ListItems() {
-				opts.Keys = append(opts.Keys, item.Key)
-			}
+			opts.Keys = append(opts.Keys, dataset.ListKeys()...)
 		}
 
 		// initialize job for this run
@@ -833,18 +844,18 @@ func init() {
 		}
 
 		// compute items in input datasets
-		items := make(map[string][][]skyhook.Item)
+		inputDatasets := make(map[string][]*DBDataset)
 		for name, dslist := range node.InputDatasets {
-			items[name] = make([][]skyhook.Item, len(dslist))
+			inputDatasets[name] = make([]*DBDataset, len(dslist))
 			for i, ds_ := range dslist {
-				ds := GetDataset(ds_.ID)
-				var curItems []skyhook.Item
-				for _, item := range ds.ListItems() {
-					curItems = append(curItems, item.Item)
-				}
-				items[name][i] = curItems
+				inputDatasets[name][i] = GetDataset(ds_.ID)
 			}
 		}
+		items, err := getInputItems(inputDatasets)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 
 		// get tasks
 		tasks, err := node.GetOp().GetTasks(node, items)
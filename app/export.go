@@ -4,12 +4,16 @@ import (
 	"github.com/skyhookml/skyhookml/skyhook"
 
 	"archive/zip"
+	"database/sql"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -24,40 +28,190 @@ func getExportFilename(name string) string {
 }
 
 // Export a dataset into the Skyhook .zip format.
-// Returns the zip filename or error.
+// The archive contains a db.sqlite3 snapshot along with each item's file, which
+// is the layout that ImportDataset expects.
 func (ds *DBDataset) Export(outFname string, opts ImportOptions) error {
-	// get absolute path to the export filename
-	// we need it to be absolute since we will run `zip` in different working directory
-	var err error
-	outFname, err = filepath.Abs(outFname)
+	log.Printf("[export] beginning export of %s to %s", ds.Name, outFname)
+	file, err := os.Create(outFname)
+	if err != nil {
+		return err
+	}
+	err = ds.ExportTo(file, opts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(outFname)
 		return err
 	}
+	return nil
+}
 
-	// run zip utility to produce the export
-	// TODO: well sqlite3 may be in use, maybe we should export/snapshot the sqlite3 separately before zipping or something
-	log.Printf("[export] beginning export of %s to %s", ds.Name, outFname)
-	cmd := exec.Command("zip", "-r", outFname, ".")
-	stdout, err := cmd.StdoutPipe()
+// Formats that are already compressed, so we store them in the archive without deflating.
+var exportStoredExts = map[string]bool{
+	"jpg": true,
+	"jpeg": true,
+	"png": true,
+	"mp4": true,
+	"zip": true,
+}
+
+// Write the Skyhook .zip format of the dataset to w.
+// Items using the reference provider are copied from the referenced file, and items
+// using other providers (like virtual providers) are materialized by loading their data,
+// so that the archive is self-contained.
+func (ds *DBDataset) ExportTo(w io.Writer, opts ImportOptions) error {
+	snapshot, err := ds.snapshotForExport()
 	if err != nil {
 		return err
 	}
-	stderr, err := cmd.StderrPipe()
+	defer snapshot.Close()
+	return snapshot.WriteZip(w, opts)
+}
+
+// A consistent view of a dataset to export, along with the items to write.
+type exportSnapshot struct {
+	ds *DBDataset
+	// filename of the sqlite3 database snapshot
+	fname string
+	items []*DBItem
+}
+
+// Snapshot the sqlite3 database so that we get a consistent view even if the
+// dataset is being written to.
+// This is separate from writing the archive so that callers streaming the export
+// can report errors here before anything is written.
+func (ds *DBDataset) snapshotForExport() (*exportSnapshot, error) {
+	tmpFile, err := ioutil.TempFile("", "export-*.sqlite3")
 	if err != nil {
+		return nil, err
+	}
+	snapshot := &exportSnapshot{
+		ds: ds,
+		fname: tmpFile.Name(),
+	}
+	tmpFile.Close()
+	if err := snapshot.load(); err != nil {
+		snapshot.Close()
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (snapshot *exportSnapshot) load() error {
+	// make sure the per-dataset database exists before backing it up
+	snapshot.ds.getDB()
+	if err := BackupDB(snapshot.ds.DBFname(), snapshot.fname); err != nil {
 		return err
 	}
-	cmd.Dir = ds.Dirname()
-	if err := cmd.Start(); err != nil {
+	db, err := sql.Open("sqlite3", snapshot.fname)
+	if err != nil {
 		return err
 	}
-	if opts.AppJobOp != nil {
-		go opts.AppJobOp.ReadFrom(stdout)
-		go opts.AppJobOp.ReadFrom(stderr)
+	defer db.Close()
+	// we enumerate items from the snapshot, so that the files match the database
+	rows, err := db.Query(ItemQuery + " ORDER BY k")
+	if err != nil {
+		return err
 	}
-	if err := cmd.Wait(); err != nil {
+	for rows.Next() {
+		item := &DBItem{loaded: true}
+		item.Dataset = snapshot.ds.Dataset
+		if err := rows.Scan(&item.Key, &item.Ext, &item.Format, &item.Metadata, &item.Provider, &item.ProviderInfo); err != nil {
+			rows.Close()
+			return err
+		}
+		snapshot.items = append(snapshot.items, item)
+	}
+	if err := rows.Err(); err != nil {
 		return err
 	}
-	return nil
+	// In the snapshot, items backed by providers become regular items since we
+	// write their data into the archive.
+	_, err = db.Exec("UPDATE items SET provider = NULL, provider_info = NULL")
+	return err
+}
+
+func (snapshot *exportSnapshot) Close() {
+	os.Remove(snapshot.fname)
+}
+
+func (snapshot *exportSnapshot) WriteZip(w io.Writer, opts ImportOptions) error {
+	zipWriter := zip.NewWriter(w)
+	items := snapshot.items
+
+	// Write the database.
+	if err := addFileToZip(zipWriter, "db.sqlite3", snapshot.fname, true); err != nil {
+		return err
+	}
+
+	// Write items one by one.
+	// Filenames match the default provider filename, which ImportDataset uses.
+	opts.SetTasks(len(items))
+	for _, item := range items {
+		name := fmt.Sprintf("%s.%s", item.Key, item.Ext)
+		compress := !exportStoredExts[item.Ext]
+
+		if item.Provider == nil || *item.Provider == "reference" {
+			// the file is available so we can copy it directly
+			if err := addFileToZip(zipWriter, name, item.Fname(), compress); err != nil {
+				return fmt.Errorf("error adding item %s: %v", item.Key, err)
+			}
+		} else {
+			data, metadata, err := item.LoadData()
+			if err != nil {
+				return fmt.Errorf("error loading item %s: %v", item.Key, err)
+			}
+			header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+			if !compress {
+				header.Method = zip.Store
+			}
+			header.SetModTime(time.Now())
+			fw, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if err := item.DataSpec().Write(data, item.Format, metadata, fw); err != nil {
+				return fmt.Errorf("error writing item %s: %v", item.Key, err)
+			}
+		}
+
+		stopping := opts.CompletedTask(fmt.Sprintf("Added %s", name), 1)
+		if stopping {
+			return fmt.Errorf("stopped by user")
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+// Add the file at fname to the zip archive with the specified name.
+func addFileToZip(zipWriter *zip.Writer, name string, fname string, compress bool) error {
+	file, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if compress {
+		header.Method = zip.Deflate
+	} else {
+		header.Method = zip.Store
+	}
+	w, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
 }
 
 // Export files in a file dataset.
@@ -162,6 +316,36 @@ func init() {
 	}
 
 	Router.HandleFunc("/datasets/{ds_id}/export", exportHandler(false)).Methods("POST")
+
+	// Stream the export directly in the response instead of writing it under exports/.
+	Router.HandleFunc("/datasets/{ds_id}/export", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+		log.Printf("[export] streaming export of dataset %s", dataset.Name)
+		snapshot, err := dataset.snapshotForExport()
+		if err != nil {
+			log.Printf("[export] error preparing streaming export of %s: %v", dataset.Name, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer snapshot.Close()
+		w.Header().Set("Content-Type", "application/zip")
+		// the dataset name may contain quotes or newlines, so we let mime escape it
+		// older Go versions return an empty string if the name can't be encoded
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": dataset.Name+".zip"})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Disposition", disposition)
+		// once we start writing we can't change the status code, so errors are only logged
+		if err := snapshot.WriteZip(w, ImportOptions{}); err != nil {
+			log.Printf("[export] streaming export of %s failed: %v", dataset.Name, err)
+		}
+	}).Methods("GET")
 	Router.HandleFunc("/datasets/{ds_id}/export-files", exportHandler(true)).Methods("POST")
 
 	fileServer := http.FileServer(http.Dir("exports/"))
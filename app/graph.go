@@ -263,16 +263,9 @@ func RunNode(targetNode *DBExecNode, opts RunNodeOptions) error {
 
 			// enumerate items
 			// we need these for Resolve/GetTasks
-			parentItems := make(map[string][][]skyhook.Item)
-			for name, dslist := range parentDatasets {
-				parentItems[name] = make([][]skyhook.Item, len(dslist))
-				for i, ds := range dslist {
-					var skItems []skyhook.Item
-					for _, item := range ds.ListItems() {
-						skItems = append(skItems, item.Item)
-					}
-					parentItems[name][i] = skItems
-				}
+			parentItems, err := getInputItems(parentDatasets)
+			if err != nil {
+				return err
 			}
 
 			// make sure this node doesn't Resolve to something else if needed
@@ -327,7 +320,6 @@ func RunNode(targetNode *DBExecNode, opts RunNodeOptions) error {
 
 			// Get tasks.
 			// We do this after initializing RunData so that we can log any error to the AppJobOp.
-			var err error
 			rd.Tasks, err = runnable.GetOp().GetTasks(runnable, parentItems)
 			if err != nil {
 				rd.JobOp.SetDone(err)
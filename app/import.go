@@ -3,6 +3,7 @@ package app
 import (
 	"github.com/skyhookml/skyhookml/skyhook"
 
+	"archive/zip"
 	"fmt"
 	"io"
 	"io/fs"
@@ -67,11 +68,14 @@ func ImportDataset(path string, opts ImportOptions) error {
 		return fmt.Errorf("error opening db.sqlite3 in %s", path)
 	}
 	var rawds skyhook.Dataset
-	dsdb.QueryRow("SELECT name, type, data_type, hash FROM datasets").Scan(&rawds.Name, &rawds.Type, &rawds.DataType, &rawds.Hash)
+	dsdb.QueryRow("SELECT name, type, data_type, metadata, hash FROM datasets").Scan(&rawds.Name, &rawds.Type, &rawds.DataType, &rawds.Metadata, &rawds.Hash)
 	UncacheDB(srcDBFname)
 
 	// create a new dataset and the directory, and copy the sqlite3
 	ds := NewDataset(rawds.Name, rawds.Type, rawds.DataType, rawds.Hash)
+	if rawds.Metadata != "" {
+		ds.Update(DatasetUpdate{Metadata: &rawds.Metadata})
+	}
 	opts.AppJobOp.Job.UpdateMetadata(strconv.Itoa(ds.ID))
 	ds.Mkdir()
 	if err := skyhook.CopyFile(srcDBFname, ds.DBFname()); err != nil {
@@ -226,11 +230,11 @@ func (ds *DBDataset) ImportFiles(fnames []string, opts ImportOptions) error {
 	}
 
 	// initial pass to make sure the filenames don't conflict with existing keys
-	items := ds.ListItems()
 	existingKeys := make(map[string]bool)
-	for _, item := range items {
+	ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
 		existingKeys[item.Key] = true
-	}
+		return nil
+	})
 	for _, fname := range fnames {
 		key := GetKeyFromFilename(filepath.Base(fname))
 		if existingKeys[key] {
@@ -343,18 +347,54 @@ func UnzipThen(fname string, f func(path string) error) error {
 		return err
 	}
 	defer os.RemoveAll(tmpDir)
-	err = skyhook.Command(
-		"unzip", skyhook.CommandOptions{
-			NoStdin: true,
-			NoStdout: true,
-			OnlyDebug: true,
-		},
-		"unzip", "-d", tmpDir, fname,
-	).Wait()
+	if err := unzip(fname, tmpDir); err != nil {
+		return fmt.Errorf("error extracting %s: %v", fname, err)
+	}
+	return f(tmpDir)
+}
+
+// Extract the zip archive at fname into dir.
+func unzip(fname string, dir string) error {
+	zipReader, err := zip.OpenReader(fname)
 	if err != nil {
 		return err
 	}
-	return f(tmpDir)
+	defer zipReader.Close()
+
+	extractFile := func(zf *zip.File) error {
+		// make sure the archive doesn't write outside dir
+		dstFname := filepath.Join(dir, zf.Name)
+		if !strings.HasPrefix(dstFname, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path %s in archive", zf.Name)
+		}
+		if zf.FileInfo().IsDir() {
+			return os.MkdirAll(dstFname, 0755)
+		}
+		if err := os.MkdirAll(filepath.Dir(dstFname), 0755); err != nil {
+			return err
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		file, err := os.Create(dstFname)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, r); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	for _, zf := range zipReader.File {
+		if err := extractFile(zf); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // handle parts of standard upload where we save to a temporary file with same
@@ -478,7 +518,7 @@ func init() {
 				if err != nil {
 					// This means we didn't quite make it to importFunc.
 					// So we need to set the error here.
-					log.Printf("[import-dataset] failed to download %s: %v", url)
+					log.Printf("[import-dataset] failed to download %s: %v", url, err)
 					opts.AppJobOp.SetDone(err)
 				}
 			}()
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a key that changes whenever the dataset content may have changed.
+// Item rows are versioned by a counter that sqlite triggers increment on every insert,
+// update, or delete, so this is cheap even for very large datasets. Rewriting an item's
+// data also goes through AddItem. We include the done flag since computed datasets
+// may still be writing item data.
+// Returns an error if the version can't be read, in which case the cache can't be used
+// since we wouldn't know when it becomes stale.
+func (ds *DBDataset) StatsKey() (string, error) {
+	var version int
+	// use the underlying QueryRow so that we can return the error instead of panicking
+	db := ds.getDB()
+	err := func() error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.db.QueryRow("SELECT v FROM version WHERE id = 1").Scan(&version)
+	}()
+	if err != nil {
+		return "", fmt.Errorf("error reading item version: %v", err)
+	}
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("version=%d\ndone=%v\ntype=%s\nmetadata=%s\n", version, ds.Done, ds.DataType, ds.Metadata)))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the cached statistics if they were computed for the specified StatsKey.
+func (ds *DBDataset) GetCachedStats(hash string) *skyhook.DatasetStats {
+	db := ds.getDB()
+	rows := db.Query("SELECT stats FROM stats WHERE content_hash = ?", hash)
+	var encoded *string
+	for rows.Next() {
+		rows.Scan(&encoded)
+	}
+	if encoded == nil {
+		return nil
+	}
+	var stats skyhook.DatasetStats
+	skyhook.JsonUnmarshal([]byte(*encoded), &stats)
+	return &stats
+}
+
+func (ds *DBDataset) setCachedStats(hash string, stats skyhook.DatasetStats) {
+	db := ds.getDB()
+	db.Transaction(func(tx Tx) {
+		tx.Exec("DELETE FROM stats")
+		tx.Exec("INSERT INTO stats (content_hash, stats) VALUES (?, ?)", hash, string(skyhook.JsonMarshal(stats)))
+	})
+}
+
+// Compute statistics over all items in the dataset.
+// Items that fail to load are recorded in DatasetStats.Errors rather than causing an error.
+func (ds *DBDataset) ComputeStats(opts ImportOptions) (skyhook.DatasetStats, error) {
+	stats := skyhook.DatasetStats{
+		Formats: make(map[string]int),
+	}
+	accumulator := skyhook.NewStatsAccumulator(ds.DataType)
+
+	count, err := ds.CountItems(ItemListOptions{})
+	if err != nil {
+		return stats, err
+	}
+	opts.SetTasks(count)
+
+	err = ds.IterItems(ItemListOptions{}, func(item *DBItem) error {
+		stats.Items++
+		stats.Formats[item.Format]++
+		if accumulator != nil {
+			if err := accumulator.Add(item.Item); err != nil {
+				stats.Errors.Add(item.Key)
+				opts.CompletedTask(fmt.Sprintf("Error reading item %s: %v", item.Key, err), 0)
+			}
+		}
+		if stopping := opts.CompletedTask("", 1); stopping {
+			return fmt.Errorf("stopped by user")
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if accumulator != nil {
+		stats.Data = accumulator.Result()
+	}
+	return stats, nil
+}
+
+// Stats jobs that are currently running, by dataset ID.
+var statsJobs = make(map[int]*DBJob)
+var statsJobsMu sync.Mutex
+
+// Start a job to compute and cache statistics for the dataset, unless one is already running.
+func (ds *DBDataset) startStatsJob(hash string) *DBJob {
+	statsJobsMu.Lock()
+	defer statsJobsMu.Unlock()
+	if job := statsJobs[ds.ID]; job != nil {
+		return job
+	}
+
+	job := NewJob(
+		fmt.Sprintf("Statistics %s", ds.Name),
+		"stats",
+		"consoleprogress",
+		strconv.Itoa(ds.ID),
+	)
+	progressJobOp := &ProgressJobOp{}
+	jobOp := &AppJobOp{
+		Job: job,
+		TailOp: &skyhook.TailJobOp{},
+		WrappedJobOps: map[string]skyhook.JobOp{
+			"progress": progressJobOp,
+		},
+	}
+	job.AttachOp(jobOp)
+	opts := ImportOptions{
+		AppJobOp: jobOp,
+		ProgressJobOp: progressJobOp,
+	}
+	statsJobs[ds.ID] = job
+
+	go func() {
+		log.Printf("[stats] computing statistics for dataset %s", ds.Name)
+		stats, err := ds.ComputeStats(opts)
+		if err == nil {
+			ds.setCachedStats(hash, stats)
+		} else {
+			log.Printf("[stats] error computing statistics for dataset %s: %v", ds.Name, err)
+		}
+		statsJobsMu.Lock()
+		delete(statsJobs, ds.ID)
+		statsJobsMu.Unlock()
+		opts.AppJobOp.SetDone(err)
+	}()
+
+	return job
+}
+
+func init() {
+	// Returns the statistics of a dataset if they are cached for the current dataset content.
+	// Otherwise, we start a job to compute them, and the client should retry after the job completes.
+	Router.HandleFunc("/datasets/{ds_id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		dsID := skyhook.ParseInt(mux.Vars(r)["ds_id"])
+		dataset := GetDataset(dsID)
+		if dataset == nil {
+			http.Error(w, "no such dataset", 404)
+			return
+		}
+
+		type StatsResponse struct {
+			// Set if the statistics are available.
+			Stats *skyhook.DatasetStats
+			// Set if the statistics are being computed.
+			Job *DBJob
+		}
+
+		hash, err := dataset.StatsKey()
+		if err != nil {
+			log.Printf("[stats] error getting stats key of dataset %s: %v", dataset.Name, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if stats := dataset.GetCachedStats(hash); stats != nil {
+			skyhook.JsonResponse(w, StatsResponse{Stats: stats})
+			return
+		}
+		job := dataset.startStatsJob(hash)
+		skyhook.JsonResponse(w, StatsResponse{Job: job})
+	}).Methods("GET")
+}
@@ -0,0 +1,432 @@
+package active_sample
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Rank keys by the uncertainty of model outputs, so that the most valuable items can be
+// annotated first. Keys that appear in any of the exclude datasets (e.g. the dataset
+// being annotated) are skipped.
+// The ranking table can be used directly by the "ranked" annotation sampler, and the
+// selected keys of the other inputs are copied to the outputs like the sample op.
+
+type Params struct {
+	// "least_confidence", "margin", "entropy", "detection", or "disagreement".
+	// Defaults to "disagreement" if there are two prediction inputs, "detection" for
+	// detection predictions, and "least_confidence" otherwise.
+	// A single int predictions input has no scores, so it can't be ranked; use two int
+	// inputs with "disagreement" instead.
+	Metric string
+	// How to combine the per-frame uncertainty of videos: "mean" (default) or "max".
+	Aggregate string
+	// Number of keys to select. Defaults to all keys.
+	Count int
+	// Weight in [0, 1] of feature diversity versus uncertainty when selecting keys.
+	Diversity float64
+}
+
+func (params Params) GetMetric(dataType skyhook.DataType, numPredictions int) string {
+	if params.Metric != "" {
+		return params.Metric
+	}
+	if numPredictions >= 2 {
+		return "disagreement"
+	} else if dataType == skyhook.DetectionType {
+		return "detection"
+	}
+	return "least_confidence"
+}
+
+// Check that the metric can be computed from the predictions inputs, so that we fail
+// in Prepare with a clear error instead of partway through scoring.
+func checkMetric(metric string, dataTypes []skyhook.DataType) error {
+	if len(dataTypes) == 0 {
+		return fmt.Errorf("active_sample requires at least one predictions input")
+	}
+	switch metric {
+	case "disagreement":
+		if len(dataTypes) < 2 {
+			return fmt.Errorf("disagreement requires two prediction inputs")
+		} else if dataTypes[0] != dataTypes[1] {
+			return fmt.Errorf("disagreement requires two prediction inputs of the same type, but got %s and %s", dataTypes[0], dataTypes[1])
+		}
+	case "detection":
+		if dataTypes[0] != skyhook.DetectionType {
+			return fmt.Errorf("metric detection requires detection predictions, but got %s", dataTypes[0])
+		}
+	case "least_confidence", "margin", "entropy":
+		if dataTypes[0] == skyhook.IntType {
+			return fmt.Errorf("metric %s requires floats predictions (class scores), but got int; use the disagreement metric with a second int predictions input instead", metric)
+		} else if dataTypes[0] != skyhook.FloatsType {
+			return fmt.Errorf("metric %s requires floats predictions (class scores), but got %s", metric, dataTypes[0])
+		}
+	default:
+		return fmt.Errorf("unknown metric %s", metric)
+	}
+	return nil
+}
+
+// The outputs of one model for each frame of a key.
+type predictions struct {
+	Ints []int
+	Floats [][]float64
+	Detections [][]skyhook.Detection
+}
+
+func (p predictions) NumFrames() int {
+	if p.Ints != nil {
+		return len(p.Ints)
+	} else if p.Floats != nil {
+		return len(p.Floats)
+	}
+	return len(p.Detections)
+}
+
+func loadPredictions(item skyhook.Item) (predictions, error) {
+	data, _, err := item.LoadData()
+	if err != nil {
+		return predictions{}, err
+	}
+	switch x := data.(type) {
+	case []int:
+		return predictions{Ints: x}, nil
+	case [][]float64:
+		return predictions{Floats: x}, nil
+	case [][]skyhook.Detection:
+		return predictions{Detections: x}, nil
+	}
+	return predictions{}, fmt.Errorf("unsupported prediction type %s", item.Dataset.DataType)
+}
+
+// Compute the uncertainty of one frame.
+func frameUncertainty(metric string, preds []predictions, frame int) (float64, error) {
+	p := preds[0]
+	if metric == "disagreement" {
+		if len(preds) < 2 {
+			return 0, fmt.Errorf("disagreement requires two prediction inputs")
+		}
+		q := preds[1]
+		if p.Ints != nil && q.Ints != nil {
+			if p.Ints[frame] != q.Ints[frame] {
+				return 1, nil
+			}
+			return 0, nil
+		} else if p.Floats != nil && q.Floats != nil {
+			return ClassDisagreement(probabilities(p.Floats[frame]), probabilities(q.Floats[frame])), nil
+		} else if p.Detections != nil && q.Detections != nil {
+			return DetectionDisagreement(p.Detections[frame], q.Detections[frame]), nil
+		}
+		return 0, fmt.Errorf("disagreement requires two prediction inputs of the same type")
+	}
+
+	if metric == "detection" {
+		if p.Detections == nil {
+			return 0, fmt.Errorf("metric detection requires detection predictions")
+		}
+		return DetectionUncertainty(p.Detections[frame]), nil
+	}
+
+	if p.Floats == nil {
+		return 0, fmt.Errorf("metric %s requires floats predictions (class scores)", metric)
+	}
+	probs := probabilities(p.Floats[frame])
+	switch metric {
+	case "least_confidence":
+		return LeastConfidence(probs), nil
+	case "margin":
+		return Margin(probs), nil
+	case "entropy":
+		return Entropy(probs), nil
+	}
+	return 0, fmt.Errorf("unknown metric %s", metric)
+}
+
+// Derive a feature vector for diversity sampling from the predictions, averaged over
+// frames: class probabilities for floats, one-hot classes for ints, and category
+// histograms for detections.
+func predictionFeatures(p predictions, categories map[string]int) []float64 {
+	var features []float64
+	add := func(idx int, x float64) {
+		for len(features) <= idx {
+			features = append(features, 0)
+		}
+		features[idx] += x
+	}
+	for _, cls := range p.Ints {
+		if cls >= 0 {
+			add(cls, 1)
+		}
+	}
+	for _, scores := range p.Floats {
+		for i, x := range probabilities(scores) {
+			add(i, x)
+		}
+	}
+	for _, detections := range p.Detections {
+		for _, d := range detections {
+			if _, ok := categories[d.Category]; !ok {
+				categories[d.Category] = len(categories)
+			}
+			add(categories[d.Category], 1)
+		}
+	}
+	return meanFeatures(features, p.NumFrames())
+}
+
+func meanFeatures(features []float64, n int) []float64 {
+	if n > 0 {
+		for i := range features {
+			features[i] /= float64(n)
+		}
+	}
+	return features
+}
+
+type candidate struct {
+	Key string
+	Uncertainty float64
+	Features []float64
+}
+
+func scoreCandidates(params Params, task skyhook.ExecTask) ([]candidate, error) {
+	predItems := task.Items["predictions"]
+	if len(predItems) == 0 {
+		return nil, fmt.Errorf("active_sample requires at least one predictions input")
+	} else if len(predItems[0]) == 0 {
+		return nil, nil
+	}
+	metric := params.GetMetric(predItems[0][0].Dataset.DataType, len(predItems))
+
+	// index the items by key
+	byKey := func(items []skyhook.Item) map[string]skyhook.Item {
+		m := make(map[string]skyhook.Item)
+		for _, item := range items {
+			m[item.Key] = item
+		}
+		return m
+	}
+	excluded := make(map[string]bool)
+	for _, items := range task.Items["exclude"] {
+		for _, item := range items {
+			excluded[item.Key] = true
+		}
+	}
+	var otherPreds []map[string]skyhook.Item
+	for _, items := range predItems[1:] {
+		otherPreds = append(otherPreds, byKey(items))
+	}
+	var featureItems map[string]skyhook.Item
+	if len(task.Items["features"]) > 0 {
+		featureItems = byKey(task.Items["features"][0])
+	}
+
+	categories := make(map[string]int)
+	var candidates []candidate
+	for _, item := range predItems[0] {
+		if excluded[item.Key] {
+			continue
+		}
+		items := []skyhook.Item{item}
+		for _, m := range otherPreds {
+			if other, ok := m[item.Key]; ok {
+				items = append(items, other)
+			}
+		}
+		if len(items) < len(predItems) {
+			continue
+		}
+
+		preds := make([]predictions, len(items))
+		numFrames := -1
+		for i, item := range items {
+			var err error
+			preds[i], err = loadPredictions(item)
+			if err != nil {
+				return nil, fmt.Errorf("error loading predictions for %s: %v", item.Key, err)
+			}
+			if numFrames == -1 || preds[i].NumFrames() < numFrames {
+				numFrames = preds[i].NumFrames()
+			}
+		}
+		var uncertainty float64
+		for frame := 0; frame < numFrames; frame++ {
+			u, err := frameUncertainty(metric, preds, frame)
+			if err != nil {
+				return nil, err
+			}
+			if params.Aggregate == "max" {
+				uncertainty = math.Max(uncertainty, u)
+			} else {
+				uncertainty += u / float64(numFrames)
+			}
+		}
+
+		var features []float64
+		if featureItem, ok := featureItems[item.Key]; ok {
+			data, _, err := featureItem.LoadData()
+			if err != nil {
+				return nil, fmt.Errorf("error loading features for %s: %v", item.Key, err)
+			}
+			vectors := data.([][]float64)
+			for _, vector := range vectors {
+				for len(features) < len(vector) {
+					features = append(features, 0)
+				}
+				for i, x := range vector {
+					features[i] += x
+				}
+			}
+			features = meanFeatures(features, len(vectors))
+		} else {
+			features = predictionFeatures(preds[0], categories)
+		}
+
+		candidates = append(candidates, candidate{
+			Key: item.Key,
+			Uncertainty: uncertainty,
+			Features: features,
+		})
+	}
+	return candidates, nil
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "active_sample",
+			Name: "Active Sample",
+			Description: "Rank and sample unannotated items by the uncertainty of model outputs",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predictions", DataTypes: []skyhook.DataType{skyhook.IntType, skyhook.FloatsType, skyhook.DetectionType}, Variable: true},
+			{Name: "exclude", Variable: true},
+			{Name: "features", DataTypes: []skyhook.DataType{skyhook.FloatsType}, Variable: true},
+			{Name: "inputs", Variable: true},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			outputs := []skyhook.ExecOutput{{Name: "ranking", DataType: skyhook.TableType}}
+			return append(outputs, exec_ops.GetOutputsSimilarToInputs(rawParams, inputTypes)...)
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask("ranking"),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			var dataTypes []skyhook.DataType
+			for _, ds := range node.InputDatasets["predictions"] {
+				dataTypes = append(dataTypes, ds.DataType)
+			}
+			if len(dataTypes) > 0 {
+				if err := checkMetric(params.GetMetric(dataTypes[0], len(dataTypes)), dataTypes); err != nil {
+					return nil, err
+				}
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				candidates, err := scoreCandidates(params, task)
+				if err != nil {
+					return err
+				}
+				// sort by key first so that ties are broken deterministically
+				sort.Slice(candidates, func(i, j int) bool {
+					return candidates[i].Key < candidates[j].Key
+				})
+
+				uncertainty := make([]float64, len(candidates))
+				features := make([][]float64, len(candidates))
+				for i, c := range candidates {
+					uncertainty[i] = c.Uncertainty
+					features[i] = c.Features
+				}
+				count := params.Count
+				diversity := params.Diversity
+				if count <= 0 {
+					// when selecting everything, diversity doesn't change which candidates
+					// are selected, so skip the greedy selection and just rank by uncertainty
+					count = len(candidates)
+					diversity = 0
+				}
+				selected := selectDiverse(uncertainty, features, count, diversity)
+
+				// the ranking lists the selected keys in order of selection,
+				// followed by the other keys in decreasing order of uncertainty
+				isSelected := make(map[int]bool)
+				for _, idx := range selected {
+					isSelected[idx] = true
+				}
+				var rest []int
+				for idx := range candidates {
+					if !isSelected[idx] {
+						rest = append(rest, idx)
+					}
+				}
+				sortByUncertainty(rest, uncertainty)
+				var table skyhook.TableData
+				for rank, idx := range append(append([]int{}, selected...), rest...) {
+					selectedFlag := 0
+					if isSelected[idx] {
+						selectedFlag = 1
+					}
+					table = append(table, []string{
+						strconv.Itoa(rank),
+						candidates[idx].Key,
+						strconv.FormatFloat(uncertainty[idx], 'f', 6, 64),
+						strconv.Itoa(selectedFlag),
+					})
+				}
+				err = exec_ops.WriteItem(url, node.OutputDatasets["ranking"], task.Key, table, skyhook.TableMetadata{
+					Columns: []skyhook.ColumnSpec{
+						{Label: "rank", Type: "int"},
+						{Label: "key", Type: "string"},
+						{Label: "uncertainty", Type: "float64"},
+						{Label: "selected", Type: "int"},
+					},
+				})
+				if err != nil {
+					return err
+				}
+
+				// copy the selected keys of the other inputs by reference
+				buf := exec_ops.NewItemBuffer(url)
+				for i, items := range task.Items["inputs"] {
+					output := node.OutputDatasets[fmt.Sprintf("outputs%d", i)] // matches exec_ops.GetOutputsSimilarToInputs
+					itemsByKey := make(map[string]skyhook.Item)
+					for _, item := range items {
+						itemsByKey[item.Key] = item
+					}
+					for _, idx := range selected {
+						item, ok := itemsByKey[candidates[idx].Key]
+						if !ok {
+							continue
+						}
+						provider := "reference"
+						fname := item.Fname()
+						err := buf.Add(output, skyhook.Item{
+							Key: item.Key,
+							Ext: item.Ext,
+							Format: item.Format,
+							Metadata: item.Metadata,
+							Provider: &provider,
+							ProviderInfo: &fname,
+						})
+						if err != nil {
+							return err
+						}
+					}
+				}
+				return buf.Flush()
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
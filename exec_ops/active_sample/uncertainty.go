@@ -0,0 +1,260 @@
+package active_sample
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"math"
+	"sort"
+)
+
+// Uncertainty measures of model outputs for one frame.
+// Each measure is in [0, 1], where higher means the model is less certain.
+
+// Normalize class scores into a probability distribution.
+// Scores that already form a distribution are kept as is, otherwise we assume they
+// are logits and apply softmax.
+func probabilities(scores []float64) []float64 {
+	var sum float64
+	isDistribution := true
+	for _, x := range scores {
+		if x < 0 || x > 1 {
+			isDistribution = false
+		}
+		sum += x
+	}
+	if isDistribution && math.Abs(sum-1) < 1e-3 {
+		return scores
+	}
+	maxScore := math.Inf(-1)
+	for _, x := range scores {
+		maxScore = math.Max(maxScore, x)
+	}
+	probs := make([]float64, len(scores))
+	sum = 0
+	for i, x := range scores {
+		probs[i] = math.Exp(x - maxScore)
+		sum += probs[i]
+	}
+	for i := range probs {
+		probs[i] /= sum
+	}
+	return probs
+}
+
+// One minus the probability of the most likely class.
+func LeastConfidence(probs []float64) float64 {
+	if len(probs) == 0 {
+		return 0
+	}
+	var best float64
+	for _, p := range probs {
+		best = math.Max(best, p)
+	}
+	return 1 - best
+}
+
+// One minus the difference between the two most likely classes.
+func Margin(probs []float64) float64 {
+	if len(probs) < 2 {
+		return LeastConfidence(probs)
+	}
+	sorted := append([]float64{}, probs...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	return 1 - (sorted[0] - sorted[1])
+}
+
+// Entropy of the distribution, normalized by the maximum entropy over the classes.
+func Entropy(probs []float64) float64 {
+	if len(probs) < 2 {
+		return 0
+	}
+	var h float64
+	for _, p := range probs {
+		if p > 0 {
+			h -= p * math.Log(p)
+		}
+	}
+	return h / math.Log(float64(len(probs)))
+}
+
+// Binary entropy of a detection score (in bits, so it is 1 at score 0.5).
+func binaryEntropy(p float64) float64 {
+	if p <= 0 || p >= 1 {
+		return 0
+	}
+	return -p*math.Log2(p) - (1-p)*math.Log2(1-p)
+}
+
+// Score-weighted mean binary entropy of the detection scores.
+// Detections with scores near 0.5 are the most uncertain, and weighting by the score
+// keeps many low-confidence background detections from dominating the frame.
+func DetectionUncertainty(detections []skyhook.Detection) float64 {
+	var sum, weight float64
+	for _, d := range detections {
+		sum += d.Score * binaryEntropy(d.Score)
+		weight += d.Score
+	}
+	if weight == 0 {
+		return 0
+	}
+	return sum / weight
+}
+
+// Total variation distance between the class distributions of two models.
+func ClassDisagreement(p []float64, q []float64) float64 {
+	n := len(p)
+	if len(q) > n {
+		n = len(q)
+	}
+	var sum float64
+	for i := 0; i < n; i++ {
+		var a, b float64
+		if i < len(p) {
+			a = p[i]
+		}
+		if i < len(q) {
+			b = q[i]
+		}
+		sum += math.Abs(a - b)
+	}
+	return sum / 2
+}
+
+// Disagreement between the detections of two models: we greedily match detections of
+// the same category in decreasing order of IOU, and return one minus the total
+// matched IOU divided by the number of detections in the larger set.
+func DetectionDisagreement(a []skyhook.Detection, b []skyhook.Detection) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	if n == 0 {
+		return 0
+	}
+	type pair struct {
+		I, J int
+		IOU float64
+	}
+	var pairs []pair
+	for i := range a {
+		for j := range b {
+			if a[i].Category != b[j].Category {
+				continue
+			}
+			if iou := a[i].IOU(b[j]); iou > 0 {
+				pairs = append(pairs, pair{i, j, iou})
+			}
+		}
+	}
+	sort.Slice(pairs, func(x, y int) bool {
+		return pairs[x].IOU > pairs[y].IOU
+	})
+	usedA := make(map[int]bool)
+	usedB := make(map[int]bool)
+	var matched float64
+	for _, p := range pairs {
+		if usedA[p.I] || usedB[p.J] {
+			continue
+		}
+		usedA[p.I] = true
+		usedB[p.J] = true
+		matched += p.IOU
+	}
+	return 1 - matched/float64(n)
+}
+
+func euclidean(a []float64, b []float64) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	var sum float64
+	for i := 0; i < n; i++ {
+		var x, y float64
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		sum += (x-y)*(x-y)
+	}
+	return math.Sqrt(sum)
+}
+
+// Greedily select up to count candidates, trading off uncertainty and diversity.
+// At each step, we pick the candidate maximizing
+//   (1-diversity)*uncertainty + diversity*distance,
+// where distance is the feature distance to the closest already selected candidate.
+// Both terms are normalized by their maximum over the remaining candidates.
+// This is quadratic in the number of candidates, so if diversity is 0 we just pick
+// the most uncertain candidates.
+func selectDiverse(uncertainty []float64, features [][]float64, count int, diversity float64) []int {
+	if count > len(uncertainty) {
+		count = len(uncertainty)
+	}
+	if diversity <= 0 {
+		indices := make([]int, len(uncertainty))
+		for i := range indices {
+			indices[i] = i
+		}
+		sortByUncertainty(indices, uncertainty)
+		return indices[0:count]
+	}
+	minDistances := make([]float64, len(uncertainty))
+	for i := range minDistances {
+		minDistances[i] = math.Inf(1)
+	}
+	chosen := make([]bool, len(uncertainty))
+	var selected []int
+	for len(selected) < count {
+		var maxUncertainty, maxDistance float64
+		for i := range uncertainty {
+			if chosen[i] {
+				continue
+			}
+			maxUncertainty = math.Max(maxUncertainty, uncertainty[i])
+			if !math.IsInf(minDistances[i], 1) {
+				maxDistance = math.Max(maxDistance, minDistances[i])
+			}
+		}
+		best := -1
+		var bestScore float64
+		for i := range uncertainty {
+			if chosen[i] {
+				continue
+			}
+			var u, d float64
+			if maxUncertainty > 0 {
+				u = uncertainty[i] / maxUncertainty
+			}
+			if len(selected) == 0 {
+				// all candidates are equally far from the empty selection
+				d = 1
+			} else if maxDistance > 0 {
+				d = minDistances[i] / maxDistance
+			}
+			score := (1-diversity)*u + diversity*d
+			if best == -1 || score > bestScore {
+				best = i
+				bestScore = score
+			}
+		}
+		chosen[best] = true
+		selected = append(selected, best)
+		for i := range uncertainty {
+			if !chosen[i] {
+				minDistances[i] = math.Min(minDistances[i], euclidean(features[i], features[best]))
+			}
+		}
+	}
+	return selected
+}
+
+// Sort the candidate indices in decreasing order of uncertainty.
+// The sort is stable so that ties keep their original order.
+func sortByUncertainty(indices []int, uncertainty []float64) {
+	sort.SliceStable(indices, func(i, j int) bool {
+		return uncertainty[indices[i]] > uncertainty[indices[j]]
+	})
+}
@@ -0,0 +1,381 @@
+package augment
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Produce augmented copies of images along with correctly transformed labels.
+// Each labels input (Detection or Shape) is transformed along with the images, and
+// written to the corresponding labelsN output.
+// Augmentations are sampled from a random generator seeded by the Seed parameter,
+// the key, and the copy index, so the output is deterministic.
+
+type Params struct {
+	// Number of augmented copies to produce per key.
+	Copies int
+	// Whether to also output the original image and labels under the original key.
+	KeepOriginal bool
+	Seed int64
+
+	// Probability of flipping the image horizontally or vertically.
+	FlipHorizontal float64
+	FlipVertical float64
+	// Maximum rotation in degrees.
+	Rotate float64
+	// Range of scale factors, e.g. [0.8, 1.2].
+	Scale [2]float64
+	// Minimum fraction of the width and height to keep when cropping.
+	// The crop is resized back to the original size.
+	Crop float64
+	// Maximum brightness, contrast, and saturation change, e.g. 0.2.
+	Brightness float64
+	Contrast float64
+	Saturation float64
+	// Probability of blurring the image, and the blur radius (default 2).
+	Blur float64
+	BlurRadius int
+	// Probability of combining the image with three other images in a 2x2 mosaic.
+	Mosaic float64
+
+	// Boxes with less than this fraction of their area remaining visible are dropped.
+	MinVisibility float64
+}
+
+func (params Params) GetCopies() int {
+	if params.Copies <= 0 {
+		return 1
+	}
+	return params.Copies
+}
+
+func (params Params) GetBlurRadius() int {
+	if params.BlurRadius <= 0 {
+		return 2
+	}
+	return params.BlurRadius
+}
+
+// Returns a random generator seeded by the seed parameter and some strings.
+func (params Params) Rand(parts ...string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("%d", params.Seed)))
+	for _, part := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(part))
+	}
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+func uniform(rng *rand.Rand, lo float64, hi float64) float64 {
+	return lo + rng.Float64()*(hi-lo)
+}
+
+// An image with its labels.
+type Sample struct {
+	Image skyhook.Image
+	// For each labels input, either []skyhook.Detection or []skyhook.Shape.
+	Labels []interface{}
+}
+
+// Transform the sample by m into a new canvas of the same size.
+func (s Sample) Transform(m Affine, minVisibility float64) Sample {
+	if m.IsIdentity() {
+		return Sample{Image: s.Image.Copy(), Labels: s.Labels}
+	}
+	rect := [4]int{0, 0, s.Image.Width, s.Image.Height}
+	out := Sample{Image: skyhook.NewImage(s.Image.Width, s.Image.Height)}
+	warpInto(out.Image, s.Image, m, rect)
+	for _, labels := range s.Labels {
+		out.Labels = append(out.Labels, transformLabels(labels, m, rect, minVisibility))
+	}
+	return out
+}
+
+func transformLabels(labels interface{}, m Affine, rect [4]int, minVisibility float64) interface{} {
+	switch x := labels.(type) {
+	case []skyhook.Detection:
+		return transformDetections(x, m, rect, minVisibility)
+	case []skyhook.Shape:
+		return transformShapes(x, m, rect, minVisibility)
+	}
+	return labels
+}
+
+// Combine four samples in a 2x2 mosaic with a random center.
+// Each sample is resized to fill its quadrant. The output has the size of the first sample.
+func mosaic(samples []Sample, rng *rand.Rand) Sample {
+	width, height := samples[0].Image.Width, samples[0].Image.Height
+	cx := int(uniform(rng, 0.25, 0.75)*float64(width))
+	cy := int(uniform(rng, 0.25, 0.75)*float64(height))
+	quadrants := [][4]int{
+		{0, 0, cx, cy},
+		{cx, 0, width, cy},
+		{0, cy, cx, height},
+		{cx, cy, width, height},
+	}
+	out := Sample{
+		Image: skyhook.NewImage(width, height),
+		Labels: make([]interface{}, len(samples[0].Labels)),
+	}
+	for i, rect := range quadrants {
+		s := samples[i]
+		m := Scale(float64(rect[2]-rect[0])/float64(s.Image.Width), float64(rect[3]-rect[1])/float64(s.Image.Height))
+		m = m.Then(Translate(float64(rect[0]), float64(rect[1])))
+		warpInto(out.Image, s.Image, m, rect)
+		for j, labels := range s.Labels {
+			transformed := transformLabels(labels, m, rect, 0)
+			if out.Labels[j] == nil {
+				out.Labels[j] = transformed
+			} else if detections, ok := transformed.([]skyhook.Detection); ok {
+				out.Labels[j] = append(out.Labels[j].([]skyhook.Detection), detections...)
+			} else {
+				out.Labels[j] = append(out.Labels[j].([]skyhook.Shape), transformed.([]skyhook.Shape)...)
+			}
+		}
+	}
+	return out
+}
+
+// Produce one augmented copy of the sample.
+// partners are the other samples to use if we decide to make a mosaic.
+func (params Params) Augment(s Sample, partners []Sample, rng *rand.Rand) Sample {
+	if params.Mosaic > 0 && len(partners) >= 3 && rng.Float64() < params.Mosaic {
+		s = mosaic(append([]Sample{s}, partners[0:3]...), rng)
+	}
+
+	width, height := float64(s.Image.Width), float64(s.Image.Height)
+	cx, cy := width/2, height/2
+	m := Identity()
+	if params.FlipHorizontal > 0 && rng.Float64() < params.FlipHorizontal {
+		m = m.ThenAround(Scale(-1, 1), cx, cy)
+	}
+	if params.FlipVertical > 0 && rng.Float64() < params.FlipVertical {
+		m = m.ThenAround(Scale(1, -1), cx, cy)
+	}
+	if params.Rotate > 0 {
+		theta := uniform(rng, -params.Rotate, params.Rotate) * math.Pi / 180
+		m = m.ThenAround(Rotate(theta), cx, cy)
+	}
+	if params.Scale[0] > 0 && params.Scale[1] > 0 {
+		factor := uniform(rng, params.Scale[0], params.Scale[1])
+		m = m.ThenAround(Scale(factor, factor), cx, cy)
+	}
+	if params.Crop > 0 && params.Crop < 1 {
+		fraction := uniform(rng, params.Crop, 1)
+		x0 := uniform(rng, 0, width*(1-fraction))
+		y0 := uniform(rng, 0, height*(1-fraction))
+		m = m.Then(Translate(-x0, -y0)).Then(Scale(1/fraction, 1/fraction))
+	}
+	out := s.Transform(m, params.MinVisibility)
+
+	if params.Brightness > 0 || params.Contrast > 0 || params.Saturation > 0 {
+		brightness := uniform(rng, -params.Brightness, params.Brightness)
+		contrast := 1 + uniform(rng, -params.Contrast, params.Contrast)
+		saturation := 1 + uniform(rng, -params.Saturation, params.Saturation)
+		colorJitter(out.Image, brightness, contrast, saturation)
+	}
+	if params.Blur > 0 && rng.Float64() < params.Blur {
+		boxBlur(out.Image, params.GetBlurRadius())
+	}
+	return out
+}
+
+// Load an image along with its labels, rescaled to the image dimensions if needed.
+func loadSample(imageItem skyhook.Item, labelItems []skyhook.Item) (Sample, error) {
+	data, _, err := imageItem.LoadData()
+	if err != nil {
+		return Sample{}, err
+	}
+	s := Sample{Image: data.(skyhook.Image)}
+	dims := [2]int{s.Image.Width, s.Image.Height}
+	for _, item := range labelItems {
+		data, metadata, err := item.LoadData()
+		if err != nil {
+			return Sample{}, err
+		}
+		if item.Dataset.DataType == skyhook.DetectionType {
+			var detections []skyhook.Detection
+			if frames := data.([][]skyhook.Detection); len(frames) > 0 {
+				detections = frames[0]
+			}
+			canvasDims := metadata.(skyhook.DetectionMetadata).CanvasDims
+			if canvasDims[0] > 0 && canvasDims != dims {
+				for i := range detections {
+					detections[i] = detections[i].Rescale(canvasDims, dims)
+				}
+			}
+			s.Labels = append(s.Labels, detections)
+		} else {
+			var shapes []skyhook.Shape
+			if frames := data.([][]skyhook.Shape); len(frames) > 0 {
+				shapes = frames[0]
+			}
+			canvasDims := metadata.(skyhook.ShapeMetadata).CanvasDims
+			if canvasDims[0] > 0 && canvasDims != dims {
+				for i := range shapes {
+					for j, p := range shapes[i].Points {
+						shapes[i].Points[j] = [2]int{p[0]*dims[0]/canvasDims[0], p[1]*dims[1]/canvasDims[1]}
+					}
+				}
+			}
+			s.Labels = append(s.Labels, shapes)
+		}
+	}
+	return s, nil
+}
+
+// Returns the labels in each task grouped by labels input.
+func taskLabelItems(items map[string][][]skyhook.Item, name string, idx int) []skyhook.Item {
+	var labelItems []skyhook.Item
+	for _, itemList := range items[name] {
+		labelItems = append(labelItems, itemList[idx])
+	}
+	return labelItems
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "augment",
+			Name: "Augment",
+			Description: "Produce augmented copies of images with correctly transformed detections or shapes",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType}},
+			{Name: "labels", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}, Variable: true},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			outputs := []skyhook.ExecOutput{{Name: "images", DataType: skyhook.ImageType}}
+			for i, dataType := range inputTypes["labels"] {
+				outputs = append(outputs, skyhook.ExecOutput{
+					Name: fmt.Sprintf("labels%d", i),
+					DataType: dataType,
+				})
+			}
+			return outputs
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			tasks, err := exec_ops.SimpleTasks(node, rawItems)
+			if err != nil {
+				return nil, err
+			}
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if params.Mosaic <= 0 || len(tasks) < 2 {
+				return tasks, nil
+			}
+
+			// pick the partner images for mosaics of each task
+			// the partners are chosen deterministically like the augmentations
+			sort.Slice(tasks, func(i, j int) bool {
+				return tasks[i].Key < tasks[j].Key
+			})
+			partnerTasks := make([]skyhook.ExecTask, len(tasks))
+			copy(partnerTasks, tasks)
+			numPartners := 3*params.GetCopies()
+			for i := range tasks {
+				rng := params.Rand(tasks[i].Key, "mosaic")
+				tasks[i].Items["partner_images"] = [][]skyhook.Item{{}}
+				tasks[i].Items["partner_labels"] = make([][]skyhook.Item, len(tasks[i].Items["labels"]))
+				for j := 0; j < numPartners; j++ {
+					idx := rng.Intn(len(partnerTasks)-1)
+					if idx >= i {
+						idx++
+					}
+					partner := partnerTasks[idx]
+					tasks[i].Items["partner_images"][0] = append(tasks[i].Items["partner_images"][0], partner.Items["images"][0][0])
+					for k, itemList := range partner.Items["labels"] {
+						tasks[i].Items["partner_labels"][k] = append(tasks[i].Items["partner_labels"][k], itemList[0])
+					}
+				}
+			}
+			return tasks, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				s, err := loadSample(task.Items["images"][0][0], taskLabelItems(task.Items, "labels", 0))
+				if err != nil {
+					return err
+				}
+				var partners []Sample
+				if len(task.Items["partner_images"]) > 0 {
+					for i, item := range task.Items["partner_images"][0] {
+						partner, err := loadSample(item, taskLabelItems(task.Items, "partner_labels", i))
+						if err != nil {
+							return err
+						}
+						partners = append(partners, partner)
+					}
+				}
+
+				// get the metadata of each labels output
+				var labelMetadatas []skyhook.DataMetadata
+				for _, itemList := range task.Items["labels"] {
+					labelMetadatas = append(labelMetadatas, itemList[0].DecodeMetadata())
+				}
+				dims := [2]int{s.Image.Width, s.Image.Height}
+
+				buf := exec_ops.NewItemBuffer(url)
+				write := func(key string, out Sample) error {
+					if err := buf.WriteItem(node.OutputDatasets["images"], key, out.Image, skyhook.NoMetadata{}); err != nil {
+						return err
+					}
+					for i, labels := range out.Labels {
+						dataset := node.OutputDatasets[fmt.Sprintf("labels%d", i)]
+						var err error
+						switch x := labels.(type) {
+						case []skyhook.Detection:
+							metadata := labelMetadatas[i].(skyhook.DetectionMetadata)
+							metadata.CanvasDims = dims
+							err = buf.WriteItem(dataset, key, [][]skyhook.Detection{x}, metadata)
+						case []skyhook.Shape:
+							metadata := labelMetadatas[i].(skyhook.ShapeMetadata)
+							metadata.CanvasDims = dims
+							err = buf.WriteItem(dataset, key, [][]skyhook.Shape{x}, metadata)
+						}
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+
+				if params.KeepOriginal {
+					if err := write(task.Key, s); err != nil {
+						return err
+					}
+				}
+				for i := 0; i < params.GetCopies(); i++ {
+					rng := params.Rand(task.Key, fmt.Sprintf("%d", i))
+					var curPartners []Sample
+					if len(partners) >= 3*(i+1) {
+						curPartners = partners[3*i:3*(i+1)]
+					}
+					out := params.Augment(s, curPartners, rng)
+					if err := write(fmt.Sprintf("%s_aug%d", task.Key, i), out); err != nil {
+						return err
+					}
+				}
+				return buf.Flush()
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
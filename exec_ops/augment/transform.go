@@ -0,0 +1,297 @@
+package augment
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"math"
+)
+
+// Affine transformation [a b c; d e f] mapping (x, y) to (ax+by+c, dx+ey+f).
+type Affine [6]float64
+
+func Identity() Affine {
+	return Affine{1, 0, 0, 0, 1, 0}
+}
+
+func Translate(dx float64, dy float64) Affine {
+	return Affine{1, 0, dx, 0, 1, dy}
+}
+
+func Scale(sx float64, sy float64) Affine {
+	return Affine{sx, 0, 0, 0, sy, 0}
+}
+
+// Rotate by theta radians around the origin.
+func Rotate(theta float64) Affine {
+	cos, sin := math.Cos(theta), math.Sin(theta)
+	return Affine{cos, -sin, 0, sin, cos, 0}
+}
+
+// Returns the transformation that applies m and then n.
+func (m Affine) Then(n Affine) Affine {
+	return Affine{
+		n[0]*m[0] + n[1]*m[3], n[0]*m[1] + n[1]*m[4], n[0]*m[2] + n[1]*m[5] + n[2],
+		n[3]*m[0] + n[4]*m[3], n[3]*m[1] + n[4]*m[4], n[3]*m[2] + n[4]*m[5] + n[5],
+	}
+}
+
+// Like Then, but n is applied around the specified center point.
+func (m Affine) ThenAround(n Affine, cx float64, cy float64) Affine {
+	return m.Then(Translate(-cx, -cy)).Then(n).Then(Translate(cx, cy))
+}
+
+func (m Affine) Inverse() Affine {
+	det := m[0]*m[4] - m[1]*m[3]
+	a, b, d, e := m[4]/det, -m[1]/det, -m[3]/det, m[0]/det
+	return Affine{a, b, -a*m[2] - b*m[5], d, e, -d*m[2] - e*m[5]}
+}
+
+func (m Affine) IsIdentity() bool {
+	return m == Identity()
+}
+
+func (m Affine) Apply(p [2]float64) [2]float64 {
+	return [2]float64{m[0]*p[0] + m[1]*p[1] + m[2], m[3]*p[0] + m[4]*p[1] + m[5]}
+}
+
+// Fill the rectangle in dst with the src image transformed by m, using bilinear sampling.
+// Pixels that map outside src are left unchanged.
+func warpInto(dst skyhook.Image, src skyhook.Image, m Affine, rect [4]int) {
+	inv := m.Inverse()
+	for y := rect[1]; y < rect[3]; y++ {
+		for x := rect[0]; x < rect[2]; x++ {
+			p := inv.Apply([2]float64{float64(x)+0.5, float64(y)+0.5})
+			sx, sy := p[0]-0.5, p[1]-0.5
+			if sx < -0.5 || sy < -0.5 || sx > float64(src.Width)-0.5 || sy > float64(src.Height)-0.5 {
+				continue
+			}
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			var color [3]float64
+			for _, corner := range [][3]float64{{0, 0, (1-fx)*(1-fy)}, {1, 0, fx*(1-fy)}, {0, 1, (1-fx)*fy}, {1, 1, fx*fy}} {
+				cx := skyhook.Clip(x0+int(corner[0]), 0, src.Width-1)
+				cy := skyhook.Clip(y0+int(corner[1]), 0, src.Height-1)
+				c := src.GetRGB(cx, cy)
+				for i := range color {
+					color[i] += corner[2]*float64(c[i])
+				}
+			}
+			dst.SetRGB(x, y, [3]uint8{clipByte(color[0]), clipByte(color[1]), clipByte(color[2])})
+		}
+	}
+}
+
+func clipByte(x float64) uint8 {
+	if x < 0 {
+		return 0
+	} else if x > 255 {
+		return 255
+	}
+	return uint8(math.Round(x))
+}
+
+// Returns the bounding box of the transformed rectangle.
+func transformBox(m Affine, box [4]float64) [4]float64 {
+	corners := [][2]float64{{box[0], box[1]}, {box[2], box[1]}, {box[0], box[3]}, {box[2], box[3]}}
+	var bounds [4]float64
+	for i, corner := range corners {
+		p := m.Apply(corner)
+		if i == 0 {
+			bounds = [4]float64{p[0], p[1], p[0], p[1]}
+			continue
+		}
+		bounds[0] = math.Min(bounds[0], p[0])
+		bounds[1] = math.Min(bounds[1], p[1])
+		bounds[2] = math.Max(bounds[2], p[0])
+		bounds[3] = math.Max(bounds[3], p[1])
+	}
+	return bounds
+}
+
+// Clip a box to the rectangle, and return whether enough of it remains visible.
+func clipBox(box [4]float64, rect [4]int, minVisibility float64) ([4]int, bool) {
+	area := (box[2]-box[0])*(box[3]-box[1])
+	clipped := [4]float64{
+		math.Max(box[0], float64(rect[0])),
+		math.Max(box[1], float64(rect[1])),
+		math.Min(box[2], float64(rect[2])),
+		math.Min(box[3], float64(rect[3])),
+	}
+	clippedArea := (clipped[2]-clipped[0])*(clipped[3]-clipped[1])
+	if clipped[2] <= clipped[0] || clipped[3] <= clipped[1] || clippedArea < minVisibility*area {
+		return [4]int{}, false
+	}
+	return [4]int{
+		int(math.Round(clipped[0])),
+		int(math.Round(clipped[1])),
+		int(math.Round(clipped[2])),
+		int(math.Round(clipped[3])),
+	}, true
+}
+
+func transformDetections(detections []skyhook.Detection, m Affine, rect [4]int, minVisibility float64) []skyhook.Detection {
+	ndetections := []skyhook.Detection{}
+	for _, d := range detections {
+		box := transformBox(m, [4]float64{float64(d.Left), float64(d.Top), float64(d.Right), float64(d.Bottom)})
+		clipped, ok := clipBox(box, rect, minVisibility)
+		if !ok {
+			continue
+		}
+		d.Left, d.Top, d.Right, d.Bottom = clipped[0], clipped[1], clipped[2], clipped[3]
+		ndetections = append(ndetections, d)
+	}
+	return ndetections
+}
+
+// Clip a polygon to the rectangle (Sutherland-Hodgman).
+func clipPolygon(points [][2]float64, rect [4]int) [][2]float64 {
+	// each edge is specified by the axis, the boundary, and whether we keep points less than the boundary
+	edges := []struct {
+		Axis int
+		Value float64
+		Less bool
+	}{
+		{0, float64(rect[0]), false},
+		{1, float64(rect[1]), false},
+		{0, float64(rect[2]), true},
+		{1, float64(rect[3]), true},
+	}
+	for _, edge := range edges {
+		inside := func(p [2]float64) bool {
+			if edge.Less {
+				return p[edge.Axis] <= edge.Value
+			}
+			return p[edge.Axis] >= edge.Value
+		}
+		intersect := func(a, b [2]float64) [2]float64 {
+			t := (edge.Value - a[edge.Axis]) / (b[edge.Axis] - a[edge.Axis])
+			return [2]float64{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}
+		}
+		var output [][2]float64
+		for i, cur := range points {
+			prev := points[(i+len(points)-1) % len(points)]
+			if inside(cur) {
+				if !inside(prev) {
+					output = append(output, intersect(prev, cur))
+				}
+				output = append(output, cur)
+			} else if inside(prev) {
+				output = append(output, intersect(prev, cur))
+			}
+		}
+		points = output
+		if len(points) == 0 {
+			break
+		}
+	}
+	return points
+}
+
+func roundPoints(points [][2]float64) [][2]int {
+	rounded := make([][2]int, len(points))
+	for i, p := range points {
+		rounded[i] = [2]int{int(math.Round(p[0])), int(math.Round(p[1]))}
+	}
+	return rounded
+}
+
+func transformShapes(shapes []skyhook.Shape, m Affine, rect [4]int, minVisibility float64) []skyhook.Shape {
+	nshapes := []skyhook.Shape{}
+	for _, shape := range shapes {
+		if len(shape.Points) == 0 {
+			continue
+		}
+		points := make([][2]float64, len(shape.Points))
+		for i, p := range shape.Points {
+			points[i] = m.Apply([2]float64{float64(p[0]), float64(p[1])})
+		}
+
+		switch shape.Type {
+		case skyhook.BoxShape:
+			bounds := shape.Bounds()
+			box := transformBox(m, [4]float64{float64(bounds[0]), float64(bounds[1]), float64(bounds[2]), float64(bounds[3])})
+			clipped, ok := clipBox(box, rect, minVisibility)
+			if !ok {
+				continue
+			}
+			shape.Points = [][2]int{{clipped[0], clipped[1]}, {clipped[2], clipped[3]}}
+		case skyhook.PolygonShape:
+			points = clipPolygon(points, rect)
+			if len(points) < 3 {
+				continue
+			}
+			shape.Points = roundPoints(points)
+		default:
+			// points, lines, and polylines: drop the shape if all points are outside,
+			// otherwise clamp the points to the rectangle
+			anyInside := false
+			for i, p := range points {
+				if p[0] >= float64(rect[0]) && p[0] <= float64(rect[2]) && p[1] >= float64(rect[1]) && p[1] <= float64(rect[3]) {
+					anyInside = true
+				}
+				points[i] = [2]float64{
+					math.Max(float64(rect[0]), math.Min(float64(rect[2]), p[0])),
+					math.Max(float64(rect[1]), math.Min(float64(rect[3]), p[1])),
+				}
+			}
+			if !anyInside {
+				continue
+			}
+			shape.Points = roundPoints(points)
+		}
+		nshapes = append(nshapes, shape)
+	}
+	return nshapes
+}
+
+// Adjust brightness (additive, in [-1, 1]), contrast and saturation (multiplicative factors).
+func colorJitter(im skyhook.Image, brightness float64, contrast float64, saturation float64) {
+	for i := 0; i+2 < len(im.Bytes); i += 3 {
+		r, g, b := float64(im.Bytes[i]), float64(im.Bytes[i+1]), float64(im.Bytes[i+2])
+		gray := 0.299*r + 0.587*g + 0.114*b
+		for j, v := range []float64{r, g, b} {
+			v = gray + (v-gray)*saturation
+			v = (v-128)*contrast + 128 + brightness*255
+			im.Bytes[i+j] = clipByte(v)
+		}
+	}
+}
+
+// Box blur with the specified radius, applied horizontally and then vertically.
+func boxBlur(im skyhook.Image, radius int) {
+	if radius <= 0 {
+		return
+	}
+	blurAxis := func(length int, count int, index func(line int, pos int) int) {
+		values := make([][3]float64, length)
+		for line := 0; line < count; line++ {
+			for pos := 0; pos < length; pos++ {
+				offset := index(line, pos)
+				values[pos] = [3]float64{float64(im.Bytes[offset]), float64(im.Bytes[offset+1]), float64(im.Bytes[offset+2])}
+			}
+			for pos := 0; pos < length; pos++ {
+				var sum [3]float64
+				n := 0
+				for k := pos-radius; k <= pos+radius; k++ {
+					if k < 0 || k >= length {
+						continue
+					}
+					for c := range sum {
+						sum[c] += values[k][c]
+					}
+					n++
+				}
+				offset := index(line, pos)
+				for c := range sum {
+					im.Bytes[offset+c] = clipByte(sum[c]/float64(n))
+				}
+			}
+		}
+	}
+	blurAxis(im.Width, im.Height, func(y int, x int) int {
+		return (y*im.Width+x)*3
+	})
+	blurAxis(im.Height, im.Width, func(x int, y int) int {
+		return (y*im.Width+x)*3
+	})
+}
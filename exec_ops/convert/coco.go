@@ -6,12 +6,16 @@ import (
 
 	"encoding/json"
 	"fmt"
+	"math"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 // Convert to and from COCO format.
-// Currently we only support object detections. And we don't support RLE yet.
+// We support object detections, and segmentations via Shape datasets.
+// Polygon segmentations become PolygonShape entries, and RLE segmentations are
+// converted to polygons by tracing the mask contours.
 // We assume annotations JSON is together with images in a flat file tree.
 // It could also just be JSON in which case image dataset output will be empty.
 
@@ -31,7 +35,7 @@ type CocoImage struct {
 // We have to use a custom struct for Segmentation because COCO is stupid and
 // uses different types for the exact same field. Terrible design, COCO.
 type CocoRLE struct {
-	Counts []int `json:"counts"`
+	Counts CocoRLECounts `json:"counts"`
 	Size [2]int `json:"size"`
 }
 type CocoSegmentation struct {
@@ -55,16 +59,45 @@ func (s *CocoSegmentation) UnmarshalJSON(data []byte) error {
 
 type CocoAnnotation struct {
 	ImageID int `json:"image_id"`
-	Bbox [4]int `json:"bbox"`
+	Bbox [4]float64 `json:"bbox"`
 	CategoryID int `json:"category_id"`
-
-	// only used when encoding to COCO
 	ID int `json:"id"`
 	IsCrowd int `json:"iscrowd"`
-	Area int `json:"area"`
+	Area float64 `json:"area"`
 	Segmentation CocoSegmentation `json:"segmentation"`
 }
 
+// Returns the polygons of the segmentation, decoding RLE into polygons if needed.
+func (a CocoAnnotation) Polygons(image CocoImage) ([][][2]int, error) {
+	var polygons [][][2]int
+	if a.Segmentation.Points != nil {
+		for _, coords := range a.Segmentation.Points {
+			var polygon [][2]int
+			for i := 0; i+1 < len(coords); i += 2 {
+				polygon = append(polygon, [2]int{int(math.Round(coords[i])), int(math.Round(coords[i+1]))})
+			}
+			if len(polygon) >= 3 {
+				polygons = append(polygons, polygon)
+			}
+		}
+		return polygons, nil
+	}
+	rle := a.Segmentation.RLE
+	if len(rle.Counts) == 0 {
+		return nil, nil
+	}
+	// RLE size is [height, width]
+	height, width := rle.Size[0], rle.Size[1]
+	if width == 0 || height == 0 {
+		width, height = image.Width, image.Height
+	}
+	mask, err := decodeCocoRLE(rle.Counts, width, height)
+	if err != nil {
+		return nil, err
+	}
+	return traceMaskContours(mask, width, height), nil
+}
+
 type CocoCategory struct {
 	SuperCategory string `json:"supercategory"`
 	ID int `json:"id"`
@@ -77,6 +110,109 @@ type CocoJSON struct {
 	Categories []CocoCategory `json:"categories"`
 }
 
+// A COCO annotation along with its category name.
+// The image, annotation, and category IDs are assigned when adding it to CocoJSON.
+type cocoLabel struct {
+	Category string
+	Annotation CocoAnnotation
+}
+
+func boundsToCocoBbox(bounds [4]int) [4]float64 {
+	return [4]float64{
+		float64(bounds[0]),
+		float64(bounds[1]),
+		float64(bounds[2]-bounds[0]),
+		float64(bounds[3]-bounds[1]),
+	}
+}
+
+func detectionToCoco(detection skyhook.Detection) cocoLabel {
+	return cocoLabel{
+		Category: detection.Category,
+		Annotation: CocoAnnotation{
+			Bbox: boundsToCocoBbox([4]int{detection.Left, detection.Top, detection.Right, detection.Bottom}),
+			Area: float64((detection.Right-detection.Left)*(detection.Bottom-detection.Top)),
+			Segmentation: CocoSegmentation{
+				Points: [][]float64{{
+					float64(detection.Left),
+					float64(detection.Top),
+					float64(detection.Right),
+					float64(detection.Top),
+					float64(detection.Right),
+					float64(detection.Bottom),
+					float64(detection.Left),
+					float64(detection.Bottom),
+				}},
+			},
+		},
+	}
+}
+
+// Convert the shapes in one frame to COCO annotations.
+// Boxes are converted like detections, and polygons that share a coco_id in their
+// metadata (from from_coco) are grouped into one annotation with multiple polygons.
+// Other shape types are skipped.
+func shapesToCoco(shapes []skyhook.Shape) []cocoLabel {
+	var labels []cocoLabel
+	groups := make(map[string]int)
+	for _, shape := range shapes {
+		if shape.Type == skyhook.BoxShape {
+			bounds := shape.Bounds()
+			labels = append(labels, detectionToCoco(skyhook.Detection{
+				Left: bounds[0],
+				Top: bounds[1],
+				Right: bounds[2],
+				Bottom: bounds[3],
+				Category: shape.Category,
+			}))
+			continue
+		} else if shape.Type != skyhook.PolygonShape || len(shape.Points) < 3 {
+			continue
+		}
+
+		var coords []float64
+		for _, p := range shape.Points {
+			coords = append(coords, float64(p[0]), float64(p[1]))
+		}
+		area := math.Abs(polygonArea(shape.Points))
+		bounds := shape.Bounds()
+
+		if cocoID := shape.Metadata["coco_id"]; cocoID != "" {
+			if idx, ok := groups[cocoID]; ok {
+				annotation := &labels[idx].Annotation
+				annotation.Segmentation.Points = append(annotation.Segmentation.Points, coords)
+				annotation.Area += area
+				// extend the bbox to include this polygon
+				prev := annotation.Bbox
+				combined := skyhook.Shape{Points: [][2]int{
+					{bounds[0], bounds[1]},
+					{bounds[2], bounds[3]},
+					{int(prev[0]), int(prev[1])},
+					{int(prev[0]+prev[2]), int(prev[1]+prev[3])},
+				}}
+				annotation.Bbox = boundsToCocoBbox(combined.Bounds())
+				continue
+			}
+			groups[cocoID] = len(labels)
+		}
+
+		isCrowd := 0
+		if shape.Metadata["iscrowd"] == "1" {
+			isCrowd = 1
+		}
+		labels = append(labels, cocoLabel{
+			Category: shape.Category,
+			Annotation: CocoAnnotation{
+				Bbox: boundsToCocoBbox(bounds),
+				IsCrowd: isCrowd,
+				Area: area,
+				Segmentation: CocoSegmentation{Points: [][]float64{coords}},
+			},
+		})
+	}
+	return labels
+}
+
 func init() {
 	imageSpec := skyhook.DataSpecs[skyhook.ImageType].(skyhook.ImageDataSpec)
 
@@ -84,11 +220,11 @@ func init() {
 		Config: skyhook.ExecOpConfig{
 			ID: "to_coco",
 			Name: "To COCO",
-			Description: "Convert from [image, detection] datasets to COCO image/JSON format",
+			Description: "Convert from [image, detection or shape] datasets to COCO image/JSON format",
 		},
 		Inputs: []skyhook.ExecInput{
 			{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType}},
-			{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}},
 		},
 		Outputs: []skyhook.ExecOutput{{Name: "output", DataType: skyhook.FileType}},
 		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
@@ -154,16 +290,34 @@ func init() {
 				var coco CocoJSON
 				for _, itemList := range task.Items["detections"] {
 					for _, item := range itemList {
-						data, metadata_, err := item.LoadData()
+						data, metadata, err := item.LoadData()
 						if err != nil {
 							return err
 						}
-						detections := data.([][]skyhook.Detection)
-						metadata := metadata_.(skyhook.DetectionMetadata)
+						var categories []string
+						var canvasDims [2]int
+						var labels []cocoLabel
+						if item.Dataset.DataType == skyhook.ShapeType {
+							shapeMetadata := metadata.(skyhook.ShapeMetadata)
+							categories = shapeMetadata.Categories
+							canvasDims = shapeMetadata.CanvasDims
+							for _, shapes := range data.([][]skyhook.Shape) {
+								labels = append(labels, shapesToCoco(shapes)...)
+							}
+						} else {
+							detectionMetadata := metadata.(skyhook.DetectionMetadata)
+							categories = detectionMetadata.Categories
+							canvasDims = detectionMetadata.CanvasDims
+							for _, dlist := range data.([][]skyhook.Detection) {
+								for _, detection := range dlist {
+									labels = append(labels, detectionToCoco(detection))
+								}
+							}
+						}
 
 						// add categories if not already populated
 						if len(coco.Categories) == 0 {
-							for i, category := range metadata.Categories {
+							for i, category := range categories {
 								coco.Categories = append(coco.Categories, CocoCategory{
 									SuperCategory: category,
 									ID: i+1,
@@ -172,7 +326,7 @@ func init() {
 							}
 						}
 						catToID := make(map[string]int)
-						for i, category := range metadata.Categories {
+						for i, category := range categories {
 							catToID[category] = i+1
 						}
 
@@ -180,8 +334,8 @@ func init() {
 						imageID := len(coco.Images)+1
 						image := CocoImage{
 							Filename: item.Key+"."+outputExt,
-							Width: metadata.CanvasDims[0],
-							Height: metadata.CanvasDims[1],
+							Width: canvasDims[0],
+							Height: canvasDims[1],
 							ID: imageID,
 							License: 4,
 							DateCaptured: "2000-01-01 00:00:00",
@@ -190,30 +344,13 @@ func init() {
 						image.FlickrURL = image.CocoURL
 						coco.Images = append(coco.Images, image)
 
-						// add annotation for each detection
-						for _, dlist := range detections {
-							for _, detection := range dlist {
-								coco.Annotations = append(coco.Annotations, CocoAnnotation{
-									ImageID: imageID,
-									Bbox: [4]int{detection.Left, detection.Top, detection.Right-detection.Left, detection.Bottom-detection.Top},
-									CategoryID: catToID[detection.Category],
-									ID: len(coco.Annotations)+1,
-									IsCrowd: 0,
-									Area: (detection.Right-detection.Left)*(detection.Top-detection.Bottom),
-									Segmentation: CocoSegmentation{
-										Points: [][]float64{{
-											float64(detection.Left),
-											float64(detection.Top),
-											float64(detection.Right),
-											float64(detection.Top),
-											float64(detection.Right),
-											float64(detection.Bottom),
-											float64(detection.Left),
-											float64(detection.Bottom),
-										}},
-									},
-								})
-							}
+						// add the annotations
+						for _, label := range labels {
+							annotation := label.Annotation
+							annotation.ImageID = imageID
+							annotation.ID = len(coco.Annotations)+1
+							annotation.CategoryID = catToID[label.Category]
+							coco.Annotations = append(coco.Annotations, annotation)
 						}
 					}
 				}
@@ -237,12 +374,13 @@ func init() {
 		Config: skyhook.ExecOpConfig{
 			ID: "from_coco",
 			Name: "From COCO",
-			Description: "Convert from COCO image/JSON format to [image, detection] datasets",
+			Description: "Convert from COCO image/JSON format to [image, detection, shape] datasets",
 		},
 		Inputs: []skyhook.ExecInput{{Name: "input", DataTypes: []skyhook.DataType{skyhook.FileType}}},
 		Outputs: []skyhook.ExecOutput{
 			{Name: "images", DataType: skyhook.ImageType},
 			{Name: "detections", DataType: skyhook.DetectionType},
+			{Name: "shapes", DataType: skyhook.ShapeType},
 		},
 		Requirements: func(node skyhook.Runnable) map[string]int {
 			return nil
@@ -257,6 +395,7 @@ func init() {
 			}
 			imageDS := node.OutputDatasets["images"]
 			labelDS := node.OutputDatasets["detections"]
+			shapeDS := node.OutputDatasets["shapes"]
 
 			// convert an image filename to the key that we should store it under
 			filenameToKey := func(filename string) string {
@@ -291,7 +430,7 @@ func init() {
 					return nil
 				}
 
-				// so this is JSON, means we need to populate all the detections from this item
+				// so this is JSON, means we need to populate all the detections and shapes from this item
 				// (0) parse JSON
 				// (1) parse categories
 				// (2) group annotations by image ID
@@ -324,18 +463,63 @@ func init() {
 				for _, image := range coco.Images {
 					annotations := groups[image.ID]
 					var detections []skyhook.Detection
+					shapes := []skyhook.Shape{}
 					for _, a := range annotations {
-						detections = append(detections, skyhook.Detection{
-							Left: int(a.Bbox[0]),
-							Top: int(a.Bbox[1]),
-							Right: int(a.Bbox[0]+a.Bbox[2]),
-							Bottom: int(a.Bbox[1]+a.Bbox[3]),
-							Category: idToCategory[a.CategoryID],
-						})
+						category := idToCategory[a.CategoryID]
+						detection := skyhook.Detection{
+							Left: int(math.Round(a.Bbox[0])),
+							Top: int(math.Round(a.Bbox[1])),
+							Right: int(math.Round(a.Bbox[0]+a.Bbox[2])),
+							Bottom: int(math.Round(a.Bbox[1]+a.Bbox[3])),
+							Category: category,
+						}
+						detections = append(detections, detection)
+
+						polygons, err := a.Polygons(image)
+						if err != nil {
+							return fmt.Errorf("error decoding segmentation of annotation %d (%s): %v", a.ID, filename, err)
+						}
+						// use the bbox if there's no segmentation
+						if len(polygons) == 0 {
+							shapes = append(shapes, skyhook.Shape{
+								Type: skyhook.BoxShape,
+								Points: [][2]int{{detection.Left, detection.Top}, {detection.Right, detection.Bottom}},
+								Category: category,
+							})
+							continue
+						}
+						// keep the annotation ID if there are several polygons, so that
+						// to_coco can group them again, along with the crowd flag
+						var shapeMetadata map[string]string
+						if len(polygons) > 1 || a.IsCrowd == 1 {
+							shapeMetadata = make(map[string]string)
+							if len(polygons) > 1 {
+								shapeMetadata["coco_id"] = strconv.Itoa(a.ID)
+							}
+							if a.IsCrowd == 1 {
+								shapeMetadata["iscrowd"] = "1"
+							}
+						}
+						for _, polygon := range polygons {
+							shapes = append(shapes, skyhook.Shape{
+								Type: skyhook.PolygonShape,
+								Points: polygon,
+								Category: category,
+								Metadata: shapeMetadata,
+							})
+						}
 					}
 					key := filenameToKey(image.Filename)
+					dims := [2]int{image.Width, image.Height}
 					err := exec_ops.WriteItem(url, labelDS, key, [][]skyhook.Detection{detections}, skyhook.DetectionMetadata{
-						CanvasDims: [2]int{image.Width, image.Height},
+						CanvasDims: dims,
+						Categories: categories,
+					})
+					if err != nil {
+						return err
+					}
+					err = exec_ops.WriteItem(url, shapeDS, key, [][]skyhook.Shape{shapes}, skyhook.ShapeMetadata{
+						CanvasDims: dims,
 						Categories: categories,
 					})
 					if err != nil {
@@ -0,0 +1,193 @@
+package convert
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// COCO RLE counts are either a list of run lengths, or a compressed string
+// in the format used by pycocotools.
+type CocoRLECounts []int
+
+func (c *CocoRLECounts) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		counts, err := decodeCocoRLEString(str)
+		if err != nil {
+			return err
+		}
+		*c = counts
+		return nil
+	}
+	var counts []int
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return err
+	}
+	*c = counts
+	return nil
+}
+
+// Decode compressed RLE counts (see rleFrString in pycocotools).
+// Each count is a variable-length sequence of 6-bit characters, and counts after
+// the second are stored as differences from the count two positions earlier.
+func decodeCocoRLEString(str string) ([]int, error) {
+	var counts []int
+	p := 0
+	for p < len(str) {
+		x := 0
+		k := uint(0)
+		more := true
+		for more {
+			if p >= len(str) {
+				return nil, fmt.Errorf("truncated RLE string")
+			}
+			c := int(str[p]) - 48
+			x |= (c & 0x1f) << (5*k)
+			more = c & 0x20 != 0
+			p++
+			k++
+			if !more && c & 0x10 != 0 {
+				x |= -1 << (5*k)
+			}
+		}
+		if len(counts) > 2 {
+			x += counts[len(counts)-2]
+		}
+		counts = append(counts, x)
+	}
+	return counts, nil
+}
+
+// Decode RLE into a row-major mask of the specified width and height.
+// COCO RLE runs alternate between background and foreground starting with background,
+// and pixels are ordered column by column.
+func decodeCocoRLE(counts []int, width int, height int) ([]bool, error) {
+	mask := make([]bool, width*height)
+	pos := 0
+	for i, count := range counts {
+		if count < 0 || pos+count > width*height {
+			return nil, fmt.Errorf("RLE counts exceed mask size")
+		}
+		if i%2 == 1 {
+			for j := pos; j < pos+count; j++ {
+				x := j / height
+				y := j % height
+				mask[y*width+x] = true
+			}
+		}
+		pos += count
+	}
+	return mask, nil
+}
+
+// Trace the boundaries of foreground regions in a row-major mask.
+// Returns one polygon for the outer boundary of each 4-connected region, with
+// vertices at pixel corners. Holes are not supported by Shape, so we drop them.
+func traceMaskContours(mask []bool, width int, height int) [][][2]int {
+	isSet := func(x, y int) bool {
+		return x >= 0 && x < width && y >= 0 && y < height && mask[y*width+x]
+	}
+
+	// Directions, in clockwise order (on screen, where y points down).
+	deltas := [4][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+
+	// Collect directed boundary edges, oriented so that the foreground is on the right.
+	// Then the outer boundaries are clockwise and holes are counterclockwise.
+	edges := make(map[[2]int][]int)
+	var starts [][2]int
+	addEdge := func(x, y int, dir int) {
+		p := [2]int{x, y}
+		if len(edges[p]) == 0 {
+			starts = append(starts, p)
+		}
+		edges[p] = append(edges[p], dir)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !mask[y*width+x] {
+				continue
+			}
+			if !isSet(x, y-1) {
+				addEdge(x, y, 0)
+			}
+			if !isSet(x+1, y) {
+				addEdge(x+1, y, 1)
+			}
+			if !isSet(x, y+1) {
+				addEdge(x+1, y+1, 2)
+			}
+			if !isSet(x-1, y) {
+				addEdge(x, y+1, 3)
+			}
+		}
+	}
+	removeEdge := func(p [2]int, dir int) bool {
+		for i, d := range edges[p] {
+			if d == dir {
+				edges[p] = append(edges[p][:i], edges[p][i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	var polygons [][][2]int
+	for _, start := range starts {
+		for len(edges[start]) > 0 {
+			// follow edges until we return to the start
+			// at vertices where two regions touch diagonally, we prefer turning right so
+			// that the regions are traced separately
+			dir := edges[start][0]
+			removeEdge(start, dir)
+			var polygon [][2]int
+			p := start
+			for {
+				polygon = append(polygon, p)
+				p = [2]int{p[0]+deltas[dir][0], p[1]+deltas[dir][1]}
+				if p == start {
+					break
+				}
+				found := false
+				for _, turn := range []int{1, 0, 3} {
+					if removeEdge(p, (dir+turn)%4) {
+						dir = (dir+turn)%4
+						found = true
+						break
+					}
+				}
+				if !found {
+					break
+				}
+			}
+			polygon = removeCollinear(polygon)
+			if polygonArea(polygon) > 0 {
+				polygons = append(polygons, polygon)
+			}
+		}
+	}
+	return polygons
+}
+
+// Remove vertices that lie on the line between their neighbors.
+func removeCollinear(points [][2]int) [][2]int {
+	var result [][2]int
+	for i, p := range points {
+		prev := points[(i+len(points)-1) % len(points)]
+		next := points[(i+1) % len(points)]
+		cross := (p[0]-prev[0])*(next[1]-p[1]) - (p[1]-prev[1])*(next[0]-p[0])
+		if cross != 0 {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Returns the signed area of a polygon, which is positive if it is clockwise on screen.
+func polygonArea(points [][2]int) float64 {
+	var sum int
+	for i := range points {
+		j := (i+1) % len(points)
+		sum += points[i][0]*points[j][1] - points[j][0]*points[i][1]
+	}
+	return float64(sum)/2
+}
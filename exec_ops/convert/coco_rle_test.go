@@ -0,0 +1,149 @@
+package convert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The compressed strings were produced by rleToString from pycocotools.
+func TestDecodeCocoRLEString(t *testing.T) {
+	tests := []struct {
+		label string
+		str string
+		expected []int
+	}{
+		{"empty background", "04", []int{0, 4}},
+		{"positive differences", "34201", []int{3, 4, 2, 4, 3}},
+		{"negative difference", "5230N", []int{5, 2, 3, 2, 1}},
+		{"mixed differences", "632040L", []int{6, 3, 2, 3, 6, 3, 2}},
+		{"multi-character counts", "T3Xo0P1YQOXk4O", []int{100, 1000, 32, 17, 5000, 16}},
+	}
+	for _, test := range tests {
+		counts, err := decodeCocoRLEString(test.str)
+		if err != nil {
+			t.Errorf("%s: decodeCocoRLEString(%q): %v", test.label, test.str, err)
+		} else if !reflect.DeepEqual(counts, test.expected) {
+			t.Errorf("%s: decodeCocoRLEString(%q) = %v; want %v", test.label, test.str, counts, test.expected)
+		}
+	}
+
+	if _, err := decodeCocoRLEString("T3Xo"); err == nil {
+		t.Errorf("expected error for truncated string")
+	}
+}
+
+// Parse a mask from rows of '#' (foreground) and '.' (background).
+func parseMask(rows ...string) ([]bool, int, int) {
+	width, height := len(rows[0]), len(rows)
+	mask := make([]bool, width*height)
+	for y, row := range rows {
+		for x, c := range row {
+			mask[y*width+x] = c == '#'
+		}
+	}
+	return mask, width, height
+}
+
+func TestDecodeCocoRLE(t *testing.T) {
+	// runs are column by column, so the square spans two runs of two pixels
+	counts, err := decodeCocoRLEString("52203")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask, err := decodeCocoRLE(counts, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _, _ := parseMask(
+		"....",
+		".##.",
+		".##.",
+		"....",
+	)
+	if !reflect.DeepEqual(mask, expected) {
+		t.Errorf("decodeCocoRLE(%v) = %v; want %v", counts, mask, expected)
+	}
+
+	if _, err := decodeCocoRLE([]int{10, 7}, 4, 4); err == nil {
+		t.Errorf("expected error for counts exceeding the mask size")
+	}
+}
+
+func TestTraceMaskContours(t *testing.T) {
+	tests := []struct {
+		label string
+		rows []string
+		expected [][][2]int
+	}{{
+		"empty",
+		[]string{
+			"...",
+			"...",
+		},
+		nil,
+	}, {
+		"filled square",
+		[]string{
+			"....",
+			".##.",
+			".##.",
+			"....",
+		},
+		[][][2]int{{{1, 1}, {3, 1}, {3, 3}, {1, 3}}},
+	}, {
+		"full mask",
+		[]string{
+			"###",
+			"###",
+		},
+		[][][2]int{{{0, 0}, {3, 0}, {3, 2}, {0, 2}}},
+	}, {
+		// the hole is dropped, leaving the outer boundary
+		"square with hole",
+		[]string{
+			".....",
+			".###.",
+			".#.#.",
+			".###.",
+			".....",
+		},
+		[][][2]int{{{1, 1}, {4, 1}, {4, 4}, {1, 4}}},
+	}, {
+		"two disjoint blobs",
+		[]string{
+			"#...",
+			"....",
+			"..##",
+			"....",
+		},
+		[][][2]int{
+			{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+			{{2, 2}, {4, 2}, {4, 3}, {2, 3}},
+		},
+	}, {
+		"diagonal neighbors",
+		[]string{
+			"#.",
+			".#",
+		},
+		[][][2]int{
+			{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+			{{1, 1}, {2, 1}, {2, 2}, {1, 2}},
+		},
+	}, {
+		"L shape",
+		[]string{
+			"#.",
+			"##",
+		},
+		[][][2]int{{{0, 0}, {1, 0}, {1, 1}, {2, 1}, {2, 2}, {0, 2}}},
+	}}
+	for _, test := range tests {
+		mask, width, height := parseMask(test.rows...)
+		polygons := traceMaskContours(mask, width, height)
+		if !reflect.DeepEqual(polygons, test.expected) {
+			t.Errorf("%s: traceMaskContours(\n%s\n) = %v; want %v", test.label, strings.Join(test.rows, "\n"), polygons, test.expected)
+		}
+	}
+}
@@ -0,0 +1,740 @@
+package convert
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Convert to and from CVAT 1.1 XML format.
+// CVAT exports image annotations as <image> elements containing boxes, polygons,
+// polylines, and points, and video annotations as <track> elements with one shape per frame.
+// Tracks only need shapes at keyframes: we interpolate boxes (and polygons with the same
+// number of points) between keyframes, and a shape with outside="1" ends the track
+// until the next keyframe.
+// Track IDs are stored as the CVAT track ID plus one, since TrackID zero means no track.
+// CVAT attributes are stored in the Detection/Shape metadata, along with occluded="1".
+
+type CvatAttribute struct {
+	Name string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// A box, polygon, polyline, or points element.
+// The element name is stored in XMLName.
+type CvatShape struct {
+	XMLName xml.Name
+	Label string `xml:"label,attr,omitempty"`
+	// Only set for shapes in tracks.
+	Frame string `xml:"frame,attr,omitempty"`
+	Outside string `xml:"outside,attr,omitempty"`
+	Keyframe string `xml:"keyframe,attr,omitempty"`
+
+	Occluded string `xml:"occluded,attr,omitempty"`
+	Source string `xml:"source,attr,omitempty"`
+	// Only set for boxes.
+	Xtl string `xml:"xtl,attr,omitempty"`
+	Ytl string `xml:"ytl,attr,omitempty"`
+	Xbr string `xml:"xbr,attr,omitempty"`
+	Ybr string `xml:"ybr,attr,omitempty"`
+	// Set for other shapes, like "x1,y1;x2,y2".
+	Points string `xml:"points,attr,omitempty"`
+	ZOrder string `xml:"z_order,attr,omitempty"`
+	Attributes []CvatAttribute `xml:"attribute"`
+}
+
+type CvatImage struct {
+	ID int `xml:"id,attr"`
+	Name string `xml:"name,attr"`
+	Width int `xml:"width,attr"`
+	Height int `xml:"height,attr"`
+	Shapes []CvatShape `xml:",any"`
+}
+
+type CvatTrack struct {
+	ID int `xml:"id,attr"`
+	Label string `xml:"label,attr"`
+	Source string `xml:"source,attr,omitempty"`
+	Shapes []CvatShape `xml:",any"`
+}
+
+type CvatLabel struct {
+	Name string `xml:"name"`
+}
+
+type CvatTask struct {
+	Size int `xml:"size"`
+	Mode string `xml:"mode"`
+	Labels []CvatLabel `xml:"labels>label"`
+	OriginalSize *VocSize `xml:"original_size,omitempty"`
+}
+
+type CvatMeta struct {
+	Task *CvatTask `xml:"task,omitempty"`
+	// Annotations exported from a job rather than a task have <job> instead of <task>.
+	Job *CvatTask `xml:"job,omitempty"`
+}
+
+type CvatAnnotations struct {
+	XMLName xml.Name `xml:"annotations"`
+	Version string `xml:"version"`
+	Meta CvatMeta `xml:"meta"`
+	Images []CvatImage `xml:"image"`
+	Tracks []CvatTrack `xml:"track"`
+}
+
+func (annotations CvatAnnotations) task() CvatTask {
+	if annotations.Meta.Task != nil {
+		return *annotations.Meta.Task
+	} else if annotations.Meta.Job != nil {
+		return *annotations.Meta.Job
+	}
+	return CvatTask{}
+}
+
+// Map from CVAT element names to shape types.
+var cvatShapeTypes = map[string]skyhook.TypeOfShape{
+	"box": skyhook.BoxShape,
+	"polygon": skyhook.PolygonShape,
+	"polyline": skyhook.PolyLineShape,
+	"points": skyhook.PointShape,
+}
+
+// A CVAT shape with floating point coordinates, used for interpolating tracks.
+type cvatGeometry struct {
+	Type skyhook.TypeOfShape
+	Points [][2]float64
+}
+
+func parseCvatFloat(str string) (float64, error) {
+	x, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate %q", str)
+	}
+	return x, nil
+}
+
+// Returns the geometry of a CVAT shape.
+// ok is false if the shape type is not supported (e.g., tags, masks, or cuboids).
+func (elem CvatShape) geometry() (geom cvatGeometry, ok bool, err error) {
+	geom.Type, ok = cvatShapeTypes[elem.XMLName.Local]
+	if !ok {
+		return geom, false, nil
+	}
+	if geom.Type == skyhook.BoxShape {
+		var coords [4]float64
+		for i, str := range []string{elem.Xtl, elem.Ytl, elem.Xbr, elem.Ybr} {
+			coords[i], err = parseCvatFloat(str)
+			if err != nil {
+				return geom, true, err
+			}
+		}
+		geom.Points = [][2]float64{{coords[0], coords[1]}, {coords[2], coords[3]}}
+		return geom, true, nil
+	}
+	for _, part := range strings.Split(elem.Points, ";") {
+		xy := strings.Split(part, ",")
+		if len(xy) != 2 {
+			return geom, true, fmt.Errorf("invalid point %q", part)
+		}
+		var p [2]float64
+		for i := range xy {
+			p[i], err = parseCvatFloat(xy[i])
+			if err != nil {
+				return geom, true, err
+			}
+		}
+		geom.Points = append(geom.Points, p)
+	}
+	return geom, true, nil
+}
+
+// Returns the CVAT attributes and occluded flag as Detection/Shape metadata.
+func (elem CvatShape) metadata() map[string]string {
+	if len(elem.Attributes) == 0 && elem.Occluded != "1" {
+		return nil
+	}
+	metadata := make(map[string]string)
+	for _, attr := range elem.Attributes {
+		metadata[attr.Name] = attr.Value
+	}
+	if elem.Occluded == "1" {
+		metadata["occluded"] = "1"
+	}
+	return metadata
+}
+
+// Interpolate between two geometries, where t is between 0 and 1.
+// We can only interpolate if the geometries have the same type and number of points,
+// otherwise we keep the first geometry.
+func (geom cvatGeometry) interpolate(other cvatGeometry, t float64) cvatGeometry {
+	if geom.Type != other.Type || len(geom.Points) != len(other.Points) {
+		return geom
+	}
+	result := cvatGeometry{Type: geom.Type}
+	for i := range geom.Points {
+		result.Points = append(result.Points, [2]float64{
+			geom.Points[i][0] + t*(other.Points[i][0]-geom.Points[i][0]),
+			geom.Points[i][1] + t*(other.Points[i][1]-geom.Points[i][1]),
+		})
+	}
+	return result
+}
+
+// Convert the geometry to skyhook shapes.
+// CVAT points elements may have several points, but skyhook point shapes have one
+// point, so we produce one shape for each point.
+func (geom cvatGeometry) shapes(category string, trackID int, metadata map[string]string) []skyhook.Shape {
+	var points [][2]int
+	for _, p := range geom.Points {
+		points = append(points, [2]int{int(math.Round(p[0])), int(math.Round(p[1]))})
+	}
+	shape := skyhook.Shape{
+		Type: geom.Type,
+		Category: category,
+		TrackID: trackID,
+		Metadata: metadata,
+	}
+	if geom.Type != skyhook.PointShape {
+		shape.Points = points
+		return []skyhook.Shape{shape}
+	}
+	var shapes []skyhook.Shape
+	for _, p := range points {
+		shape.Points = [][2]int{p}
+		shapes = append(shapes, shape)
+	}
+	return shapes
+}
+
+// Returns the detections corresponding to box shapes.
+func cvatShapesToDetections(shapes []skyhook.Shape) []skyhook.Detection {
+	detections := []skyhook.Detection{}
+	for _, shape := range shapes {
+		if shape.Type != skyhook.BoxShape {
+			continue
+		}
+		bounds := shape.Bounds()
+		detections = append(detections, skyhook.Detection{
+			Left: bounds[0],
+			Top: bounds[1],
+			Right: bounds[2],
+			Bottom: bounds[3],
+			Category: shape.Category,
+			TrackID: shape.TrackID,
+			Metadata: shape.Metadata,
+		})
+	}
+	return detections
+}
+
+// Convert a CVAT track into per-frame shapes, interpolating between keyframes.
+func cvatTrackShapes(track CvatTrack, numFrames int) ([][]skyhook.Shape, error) {
+	type keyframe struct {
+		frame int
+		outside bool
+		geom cvatGeometry
+		elem CvatShape
+	}
+	var keyframes []keyframe
+	for _, elem := range track.Shapes {
+		geom, ok, err := elem.geometry()
+		if err != nil {
+			return nil, fmt.Errorf("track %d: %v", track.ID, err)
+		} else if !ok {
+			continue
+		}
+		frame, err := strconv.Atoi(elem.Frame)
+		if err != nil {
+			return nil, fmt.Errorf("track %d: invalid frame %q", track.ID, elem.Frame)
+		}
+		keyframes = append(keyframes, keyframe{
+			frame: frame,
+			outside: elem.Outside == "1",
+			geom: geom,
+			elem: elem,
+		})
+	}
+	sort.Slice(keyframes, func(i, j int) bool {
+		return keyframes[i].frame < keyframes[j].frame
+	})
+
+	shapes := make([][]skyhook.Shape, numFrames)
+	for i, cur := range keyframes {
+		if cur.outside {
+			continue
+		}
+		// the track continues until the next keyframe, or the end of the video
+		end := numFrames
+		var next *keyframe
+		if i+1 < len(keyframes) {
+			next = &keyframes[i+1]
+			end = next.frame
+		}
+		for frame := cur.frame; frame < end && frame < numFrames; frame++ {
+			geom := cur.geom
+			// we don't interpolate towards an outside keyframe since the object isn't visible there
+			if next != nil && !next.outside && frame > cur.frame {
+				t := float64(frame-cur.frame) / float64(next.frame-cur.frame)
+				geom = cur.geom.interpolate(next.geom, t)
+			}
+			shapes[frame] = append(shapes[frame], geom.shapes(track.Label, track.ID+1, cur.elem.metadata())...)
+		}
+	}
+	return shapes, nil
+}
+
+// Convert a skyhook shape to a CVAT element.
+func shapeToCvat(shape skyhook.Shape) CvatShape {
+	elem := CvatShape{
+		Occluded: "0",
+		ZOrder: "0",
+	}
+	switch shape.Type {
+	case skyhook.BoxShape:
+		elem.XMLName.Local = "box"
+	case skyhook.PolygonShape:
+		elem.XMLName.Local = "polygon"
+	case skyhook.PointShape:
+		elem.XMLName.Local = "points"
+	default:
+		// CVAT doesn't have lines, so we use polylines for them too.
+		elem.XMLName.Local = "polyline"
+	}
+	if shape.Type == skyhook.BoxShape {
+		bounds := shape.Bounds()
+		elem.Xtl = strconv.Itoa(bounds[0])
+		elem.Ytl = strconv.Itoa(bounds[1])
+		elem.Xbr = strconv.Itoa(bounds[2])
+		elem.Ybr = strconv.Itoa(bounds[3])
+	} else {
+		var parts []string
+		for _, p := range shape.Points {
+			parts = append(parts, fmt.Sprintf("%d,%d", p[0], p[1]))
+		}
+		elem.Points = strings.Join(parts, ";")
+	}
+
+	var attrNames []string
+	for name := range shape.Metadata {
+		if name == "occluded" {
+			continue
+		}
+		attrNames = append(attrNames, name)
+	}
+	sort.Strings(attrNames)
+	for _, name := range attrNames {
+		elem.Attributes = append(elem.Attributes, CvatAttribute{
+			Name: name,
+			Value: shape.Metadata[name],
+		})
+	}
+	if shape.Metadata["occluded"] == "1" {
+		elem.Occluded = "1"
+	}
+	return elem
+}
+
+// Load a Detection or Shape item as per-frame shapes.
+func loadCvatShapes(item skyhook.Item) ([][]skyhook.Shape, [2]int, []string, error) {
+	data, metadata, err := item.LoadData()
+	if err != nil {
+		return nil, [2]int{}, nil, err
+	}
+	if item.Dataset.DataType == skyhook.ShapeType {
+		shapeMetadata := metadata.(skyhook.ShapeMetadata)
+		return data.([][]skyhook.Shape), shapeMetadata.CanvasDims, shapeMetadata.Categories, nil
+	}
+	detectionMetadata := metadata.(skyhook.DetectionMetadata)
+	var shapes [][]skyhook.Shape
+	for _, dlist := range data.([][]skyhook.Detection) {
+		var cur []skyhook.Shape
+		for _, d := range dlist {
+			cur = append(cur, skyhook.Shape{
+				Type: skyhook.BoxShape,
+				Points: [][2]int{{d.Left, d.Top}, {d.Right, d.Bottom}},
+				Category: d.Category,
+				TrackID: d.TrackID,
+				Metadata: d.Metadata,
+			})
+		}
+		shapes = append(shapes, cur)
+	}
+	return shapes, detectionMetadata.CanvasDims, detectionMetadata.Categories, nil
+}
+
+func cvatLabels(categories []string) []CvatLabel {
+	var labels []CvatLabel
+	for _, category := range categories {
+		labels = append(labels, CvatLabel{Name: category})
+	}
+	return labels
+}
+
+func encodeCvatAnnotations(annotations CvatAnnotations) ([]byte, error) {
+	annotations.Version = "1.1"
+	bytes, err := xml.MarshalIndent(annotations, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	bytes = append([]byte(xml.Header), bytes...)
+	return append(bytes, '\n'), nil
+}
+
+// Convert the per-frame shapes of a video into CVAT tracks.
+// Shapes with the same TrackID and type form a track, while shapes without a TrackID
+// each get their own single-frame track.
+func shapesToCvatTracks(shapes [][]skyhook.Shape) []CvatTrack {
+	type trackKey struct {
+		trackID int
+		shapeType skyhook.TypeOfShape
+		// used for shapes without a TrackID
+		index int
+	}
+	type trackEntry struct {
+		frame int
+		shape skyhook.Shape
+	}
+	var keys []trackKey
+	groups := make(map[trackKey][]trackEntry)
+	counter := 0
+	for frame, shapeList := range shapes {
+		for _, shape := range shapeList {
+			k := trackKey{trackID: shape.TrackID, shapeType: shape.Type}
+			if shape.TrackID == 0 {
+				counter++
+				k.index = counter
+			}
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], trackEntry{frame, shape})
+		}
+	}
+
+	// keep the CVAT track ID of tracked shapes so that IDs survive a round trip,
+	// and allocate unused IDs for the other tracks
+	usedIDs := make(map[int]bool)
+	for _, k := range keys {
+		if k.trackID > 0 {
+			usedIDs[k.trackID-1] = true
+		}
+	}
+	assigned := make(map[int]bool)
+	nextID := 0
+	var tracks []CvatTrack
+	for _, k := range keys {
+		entries := groups[k]
+		var id int
+		if k.trackID > 0 && !assigned[k.trackID] {
+			// if the same TrackID is used with several shape types, only the first track gets the ID
+			id = k.trackID-1
+			assigned[k.trackID] = true
+		} else {
+			for usedIDs[nextID] {
+				nextID++
+			}
+			id = nextID
+			usedIDs[id] = true
+		}
+		track := CvatTrack{
+			ID: id,
+			Label: entries[0].shape.Category,
+			Source: "manual",
+		}
+		for i, entry := range entries {
+			elem := shapeToCvat(entry.shape)
+			elem.Frame = strconv.Itoa(entry.frame)
+			elem.Outside = "0"
+			elem.Keyframe = "1"
+			track.Shapes = append(track.Shapes, elem)
+
+			// if the track is missing in the next frame, we need an outside keyframe to end it
+			if (i+1 < len(entries) && entries[i+1].frame == entry.frame+1) || entry.frame+1 >= len(shapes) {
+				continue
+			}
+			elem.Frame = strconv.Itoa(entry.frame+1)
+			elem.Outside = "1"
+			track.Shapes = append(track.Shapes, elem)
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+func init() {
+	imageSpec := skyhook.DataSpecs[skyhook.ImageType].(skyhook.ImageDataSpec)
+
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "to_cvat",
+			Name: "To CVAT",
+			Description: "Convert from detection or shape dataset to CVAT 1.1 XML format",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "input", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}},
+		},
+		Outputs: []skyhook.ExecOutput{{Name: "output", DataType: skyhook.FileType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			var params struct {
+				Mode string
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			// In video mode, we write one XML file with tracks for each item.
+			// Otherwise, we write one annotations.xml with all the items as images.
+			if params.Mode == "video" {
+				return exec_ops.SimpleTasks(node, rawItems)
+			}
+			return []skyhook.ExecTask{{
+				Key: "annotations",
+				Items: rawItems,
+			}}, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params struct {
+				// "image" (default) or "video".
+				Mode string
+				// Extension of image filenames in annotations.xml.
+				ImageExt string
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if params.ImageExt == "" {
+				params.ImageExt = "jpg"
+			}
+
+			outDS := node.OutputDatasets["output"]
+
+			writeVideo := func(item skyhook.Item) error {
+				shapes, dims, categories, err := loadCvatShapes(item)
+				if err != nil {
+					return err
+				}
+				annotations := CvatAnnotations{
+					Meta: CvatMeta{Task: &CvatTask{
+						Size: len(shapes),
+						Mode: "interpolation",
+						Labels: cvatLabels(categories),
+						OriginalSize: &VocSize{Width: dims[0], Height: dims[1]},
+					}},
+					Tracks: shapesToCvatTracks(shapes),
+				}
+				bytes, err := encodeCvatAnnotations(annotations)
+				if err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, outDS, item.Key, bytes, skyhook.FileMetadata{
+					Filename: item.Key+".xml",
+				})
+			}
+
+			writeImages := func(items []skyhook.Item) error {
+				var annotations CvatAnnotations
+				var categories []string
+				for _, item := range items {
+					shapes, dims, curCategories, err := loadCvatShapes(item)
+					if err != nil {
+						return err
+					}
+					if len(categories) == 0 {
+						categories = curCategories
+					}
+					image := CvatImage{
+						ID: len(annotations.Images),
+						Name: item.Key+"."+params.ImageExt,
+						Width: dims[0],
+						Height: dims[1],
+					}
+					if len(shapes) > 0 {
+						for _, shape := range shapes[0] {
+							elem := shapeToCvat(shape)
+							elem.Label = shape.Category
+							elem.Source = "manual"
+							image.Shapes = append(image.Shapes, elem)
+						}
+					}
+					annotations.Images = append(annotations.Images, image)
+				}
+				annotations.Meta = CvatMeta{Task: &CvatTask{
+					Size: len(annotations.Images),
+					Mode: "annotation",
+					Labels: cvatLabels(categories),
+				}}
+				bytes, err := encodeCvatAnnotations(annotations)
+				if err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, outDS, "annotations", bytes, skyhook.FileMetadata{
+					Filename: "annotations.xml",
+				})
+			}
+
+			applyFunc := func(task skyhook.ExecTask) error {
+				if params.Mode == "video" {
+					return writeVideo(task.Items["input"][0][0])
+				}
+				var items []skyhook.Item
+				for _, itemList := range task.Items["input"] {
+					items = append(items, itemList...)
+				}
+				return writeImages(items)
+			}
+
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "from_cvat",
+			Name: "From CVAT",
+			Description: "Convert from CVAT 1.1 XML format to [image, detection, shape] datasets",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "input", DataTypes: []skyhook.DataType{skyhook.FileType}}},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "images", DataType: skyhook.ImageType},
+			{Name: "detections", DataType: skyhook.DetectionType},
+			{Name: "shapes", DataType: skyhook.ShapeType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params struct {
+				Symlink bool
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			imageDS := node.OutputDatasets["images"]
+			detectionDS := node.OutputDatasets["detections"]
+			shapeDS := node.OutputDatasets["shapes"]
+
+			// convert a filename to the key that we should store it under
+			filenameToKey := func(filename string) string {
+				filename = filepath.Base(filename)
+				ext := filepath.Ext(filename)
+				return filename[0:len(filename)-len(ext)]
+			}
+
+			writeLabels := func(key string, shapes [][]skyhook.Shape, dims [2]int, categories []string) error {
+				var detections [][]skyhook.Detection
+				for _, shapeList := range shapes {
+					detections = append(detections, cvatShapesToDetections(shapeList))
+				}
+				for i := range shapes {
+					if shapes[i] == nil {
+						shapes[i] = []skyhook.Shape{}
+					}
+				}
+				err := exec_ops.WriteItem(url, detectionDS, key, detections, skyhook.DetectionMetadata{
+					CanvasDims: dims,
+					Categories: categories,
+				})
+				if err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, shapeDS, key, shapes, skyhook.ShapeMetadata{
+					CanvasDims: dims,
+					Categories: categories,
+				})
+			}
+
+			applyFunc := func(task skyhook.ExecTask) error {
+				inItem := task.Items["input"][0][0]
+				fileMetadata := inItem.DecodeMetadata().(skyhook.FileMetadata)
+
+				if inItem.Ext != "xml" {
+					// copy images, and skip other files
+					format, _, err := imageSpec.GetMetadataFromFile(fileMetadata.Filename)
+					if err != nil {
+						return nil
+					}
+					ext := imageSpec.GetExtFromFormat(format)
+					outImageItem, err := exec_ops.AddItem(url, imageDS, filenameToKey(fileMetadata.Filename), ext, format, skyhook.NoMetadata{})
+					if err != nil {
+						return err
+					}
+					return inItem.CopyTo(outImageItem.Fname(), format, params.Symlink)
+				}
+
+				data, _, err := inItem.LoadData()
+				if err != nil {
+					return err
+				}
+				var annotations CvatAnnotations
+				if err := xml.Unmarshal(data.([]byte), &annotations); err != nil {
+					return fmt.Errorf("error decoding CVAT XML (%s): %v", fileMetadata.Filename, err)
+				}
+				cvatTask := annotations.task()
+				var categories []string
+				for _, label := range cvatTask.Labels {
+					categories = append(categories, label.Name)
+				}
+
+				// video annotations: one item for the whole XML file
+				if len(annotations.Tracks) > 0 || cvatTask.Mode == "interpolation" {
+					numFrames := cvatTask.Size
+					for _, track := range annotations.Tracks {
+						for _, elem := range track.Shapes {
+							if frame, err := strconv.Atoi(elem.Frame); err == nil && frame >= numFrames {
+								numFrames = frame+1
+							}
+						}
+					}
+					shapes := make([][]skyhook.Shape, numFrames)
+					for _, track := range annotations.Tracks {
+						trackShapes, err := cvatTrackShapes(track, numFrames)
+						if err != nil {
+							return fmt.Errorf("error decoding CVAT XML (%s): %v", fileMetadata.Filename, err)
+						}
+						for frame := range trackShapes {
+							shapes[frame] = append(shapes[frame], trackShapes[frame]...)
+						}
+					}
+					var dims [2]int
+					if cvatTask.OriginalSize != nil {
+						dims = [2]int{cvatTask.OriginalSize.Width, cvatTask.OriginalSize.Height}
+					}
+					return writeLabels(filenameToKey(fileMetadata.Filename), shapes, dims, categories)
+				}
+
+				// image annotations: one item per image
+				for _, image := range annotations.Images {
+					shapes := []skyhook.Shape{}
+					for _, elem := range image.Shapes {
+						geom, ok, err := elem.geometry()
+						if err != nil {
+							return fmt.Errorf("error decoding CVAT XML (%s): image %s: %v", fileMetadata.Filename, image.Name, err)
+						} else if !ok {
+							continue
+						}
+						shapes = append(shapes, geom.shapes(elem.Label, 0, elem.metadata())...)
+					}
+					err := writeLabels(filenameToKey(image.Name), [][]skyhook.Shape{shapes}, [2]int{image.Width, image.Height}, categories)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -0,0 +1,459 @@
+package convert
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Convert to and from MOTChallenge format.
+// Skyhook inputs are a video dataset and a detection dataset with track IDs.
+// Each video corresponds to a sequence directory with seqinfo.ini, gt/gt.txt or
+// det/det.txt, and optionally the frames under img1/.
+// gt.txt lines are "frame,id,left,top,width,height,conf,class,visibility", where conf
+// is 0 for boxes that should be ignored. det.txt lines are
+// "frame,id,left,top,width,height,score,-1,-1,-1" with id=-1 for untracked detections.
+// Frame indices and box coordinates are 1-based.
+
+type MotSeqInfo struct {
+	Name string
+	ImDir string
+	FrameRate int
+	SeqLength int
+	ImWidth int
+	ImHeight int
+	ImExt string
+}
+
+func decodeMotSeqInfo(bytes []byte) MotSeqInfo {
+	info := MotSeqInfo{
+		ImDir: "img1",
+		ImExt: ".jpg",
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '[' || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		k := strings.TrimSpace(parts[0])
+		v := strings.TrimSpace(parts[1])
+		n, _ := strconv.Atoi(v)
+		switch k {
+		case "name":
+			info.Name = v
+		case "imDir":
+			info.ImDir = v
+		case "frameRate":
+			info.FrameRate = n
+		case "seqLength":
+			info.SeqLength = n
+		case "imWidth":
+			info.ImWidth = n
+		case "imHeight":
+			info.ImHeight = n
+		case "imExt":
+			info.ImExt = v
+		}
+	}
+	return info
+}
+
+func (info MotSeqInfo) Encode() []byte {
+	s := "[Sequence]\n"
+	s += fmt.Sprintf("name=%s\n", info.Name)
+	s += fmt.Sprintf("imDir=%s\n", info.ImDir)
+	s += fmt.Sprintf("frameRate=%d\n", info.FrameRate)
+	s += fmt.Sprintf("seqLength=%d\n", info.SeqLength)
+	s += fmt.Sprintf("imWidth=%d\n", info.ImWidth)
+	s += fmt.Sprintf("imHeight=%d\n", info.ImHeight)
+	s += fmt.Sprintf("imExt=%s\n", info.ImExt)
+	return []byte(s)
+}
+
+// Parse a gt.txt or det.txt file into per-frame detections.
+// If isGT, the seventh column is the ignore flag and the last two are class and visibility,
+// otherwise the seventh column is the detection score.
+func decodeMotLabels(bytes []byte, isGT bool, numFrames int, includeIgnored bool, minVisibility float64) ([][]skyhook.Detection, error) {
+	detections := make([][]skyhook.Detection, numFrames)
+	for lineIdx, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, ",")
+		if len(parts) < 6 {
+			return nil, fmt.Errorf("line %d: expected at least 6 columns", lineIdx+1)
+		}
+		values := make([]float64, len(parts))
+		for i, part := range parts {
+			var err error
+			values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", lineIdx+1, part)
+			}
+		}
+		frameIdx := int(values[0])-1
+		if frameIdx < 0 {
+			return nil, fmt.Errorf("line %d: invalid frame %d", lineIdx+1, int(values[0]))
+		}
+		// convert the 1-based bb_left and bb_top to 0-based pixel coordinates
+		detection := skyhook.Detection{
+			Left: int(math.Round(values[2]))-1,
+			Top: int(math.Round(values[3]))-1,
+			Right: int(math.Round(values[2]+values[4]))-1,
+			Bottom: int(math.Round(values[3]+values[5]))-1,
+		}
+		if id := int(values[1]); id > 0 {
+			detection.TrackID = id
+		}
+		if isGT {
+			if len(values) >= 7 && values[6] == 0 {
+				if !includeIgnored {
+					continue
+				}
+				detection.Metadata = map[string]string{"ignored": "1"}
+			}
+			if len(values) >= 9 {
+				if values[8] < minVisibility {
+					continue
+				}
+				if detection.Metadata == nil {
+					detection.Metadata = make(map[string]string)
+				}
+				detection.Metadata["class"] = parts[7]
+				detection.Metadata["visibility"] = parts[8]
+			}
+		} else if len(values) >= 7 {
+			detection.Score = values[6]
+		}
+		for frameIdx >= len(detections) {
+			detections = append(detections, []skyhook.Detection{})
+		}
+		detections[frameIdx] = append(detections[frameIdx], detection)
+	}
+	for i := range detections {
+		if detections[i] == nil {
+			detections[i] = []skyhook.Detection{}
+		}
+	}
+	return detections, nil
+}
+
+// Encode per-frame detections as gt.txt or det.txt lines.
+// Detections are scaled from canvasDims to the video dims.
+func encodeMotLabels(detections [][]skyhook.Detection, isGT bool, canvasDims [2]int, dims [2]int) []byte {
+	scaleX, scaleY := 1.0, 1.0
+	if canvasDims[0] > 0 && canvasDims[1] > 0 && dims[0] > 0 && dims[1] > 0 {
+		scaleX = float64(dims[0])/float64(canvasDims[0])
+		scaleY = float64(dims[1])/float64(canvasDims[1])
+	}
+	var lines []string
+	for frameIdx, dlist := range detections {
+		for _, d := range dlist {
+			// bb_left and bb_top are 1-based
+			left := float64(d.Left)*scaleX + 1
+			top := float64(d.Top)*scaleY + 1
+			width := float64(d.Right-d.Left)*scaleX
+			height := float64(d.Bottom-d.Top)*scaleY
+			id := d.TrackID
+			if id == 0 {
+				id = -1
+			}
+			prefix := fmt.Sprintf("%d,%d,%.2f,%.2f,%.2f,%.2f", frameIdx+1, id, left, top, width, height)
+			if isGT {
+				conf := 1
+				if d.Metadata["ignored"] == "1" {
+					conf = 0
+				}
+				class := "1"
+				if d.Metadata["class"] != "" {
+					class = d.Metadata["class"]
+				}
+				visibility := "1"
+				if d.Metadata["visibility"] != "" {
+					visibility = d.Metadata["visibility"]
+				}
+				lines = append(lines, fmt.Sprintf("%s,%d,%s,%s", prefix, conf, class, visibility))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s,%v,-1,-1,-1", prefix, d.Score))
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\n")+"\n")
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "to_mot",
+			Name: "To MOT",
+			Description: "Convert from [video, detection] datasets to MOTChallenge format",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "video", DataTypes: []skyhook.DataType{skyhook.VideoType}},
+			{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		},
+		Outputs: []skyhook.ExecOutput{{Name: "output", DataType: skyhook.FileType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params struct {
+				// "gt" (default) to write gt/gt.txt, or "det" to write det/det.txt.
+				Mode string
+				// Whether to also write the video frames under img1/.
+				Frames bool
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			isGT := params.Mode != "det"
+
+			outDS := node.OutputDatasets["output"]
+			applyFunc := func(task skyhook.ExecTask) error {
+				videoItem := task.Items["video"][0][0]
+				labelItem := task.Items["detections"][0][0]
+				videoMetadata := videoItem.DecodeMetadata().(skyhook.VideoMetadata)
+
+				labelData, labelMetadata, err := labelItem.LoadData()
+				if err != nil {
+					return err
+				}
+				detections := labelData.([][]skyhook.Detection)
+				canvasDims := labelMetadata.(skyhook.DetectionMetadata).CanvasDims
+
+				frameRate := 10
+				if videoMetadata.Framerate[0] > 0 && videoMetadata.Framerate[1] > 0 {
+					frameRate = int(math.Round(float64(videoMetadata.Framerate[0])/float64(videoMetadata.Framerate[1])))
+				}
+				info := MotSeqInfo{
+					Name: task.Key,
+					ImDir: "img1",
+					FrameRate: frameRate,
+					SeqLength: len(detections),
+					ImWidth: videoMetadata.Dims[0],
+					ImHeight: videoMetadata.Dims[1],
+					ImExt: ".jpg",
+				}
+				err = exec_ops.WriteItem(url, outDS, task.Key+"-seqinfo", info.Encode(), skyhook.FileMetadata{
+					Filename: task.Key+"/seqinfo.ini",
+				})
+				if err != nil {
+					return err
+				}
+
+				labelFname := task.Key+"/gt/gt.txt"
+				if !isGT {
+					labelFname = task.Key+"/det/det.txt"
+				}
+				err = exec_ops.WriteItem(url, outDS, task.Key+"-labels", encodeMotLabels(detections, isGT, canvasDims, videoMetadata.Dims), skyhook.FileMetadata{
+					Filename: labelFname,
+				})
+				if err != nil {
+					return err
+				}
+
+				if !params.Frames {
+					return nil
+				}
+				buffer := exec_ops.NewItemBuffer(url)
+				err = skyhook.PerFrame([]skyhook.Item{videoItem}, func(pos int, datas []interface{}) error {
+					im := datas[0].([]skyhook.Image)[0]
+					bytes, err := im.AsJPG()
+					if err != nil {
+						return err
+					}
+					return buffer.WriteItem(outDS, fmt.Sprintf("%s-frame-%06d", task.Key, pos+1), bytes, skyhook.FileMetadata{
+						Filename: fmt.Sprintf("%s/img1/%06d.jpg", task.Key, pos+1),
+					})
+				})
+				if err != nil {
+					return err
+				}
+				return buffer.Flush()
+			}
+
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "from_mot",
+			Name: "From MOT",
+			Description: "Convert from MOTChallenge format to [video, detection] datasets",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "input", DataTypes: []skyhook.DataType{skyhook.FileType}}},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "video", DataType: skyhook.VideoType},
+			{Name: "detections", DataType: skyhook.DetectionType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			var params struct {
+				Mode string
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			labelFname := "gt/gt.txt"
+			if params.Mode == "det" {
+				labelFname = "det/det.txt"
+			}
+
+			// create one task for each sequence, i.e., each directory containing seqinfo.ini
+			files := ItemsToFileMap(rawItems["input"][0], false)
+			var tasks []skyhook.ExecTask
+			// sequence directory of each key, to detect collisions
+			keyDirs := make(map[string]string)
+			for fname, item := range files {
+				if path.Base(fname) != "seqinfo.ini" {
+					continue
+				}
+				dir := path.Dir(fname)
+				labelItem, ok := files[path.Join(dir, labelFname)]
+				if !ok {
+					return nil, fmt.Errorf("from_mot: could not find %s for sequence %s", labelFname, dir)
+				}
+
+				// collect the frames, which we pass in order
+				infoData, _, err := item.LoadData()
+				if err != nil {
+					return nil, fmt.Errorf("from_mot: error loading %s: %v", fname, err)
+				}
+				info := decodeMotSeqInfo(infoData.([]byte))
+				var frameNames []string
+				for other := range files {
+					if path.Dir(other) == path.Join(dir, info.ImDir) && path.Ext(other) == info.ImExt {
+						frameNames = append(frameNames, other)
+					}
+				}
+				sort.Strings(frameNames)
+				var frames []skyhook.Item
+				for _, frameName := range frameNames {
+					frames = append(frames, files[frameName])
+				}
+
+				// use the path relative to the import root, since sequences in different
+				// directories (e.g. train/ and test/) may have the same name
+				key := strings.ReplaceAll(dir, "/", "_")
+				if dir == "." {
+					key = "sequence"
+				}
+				if other, ok := keyDirs[key]; ok {
+					return nil, fmt.Errorf("from_mot: sequences %s and %s would both be imported as %s", other, dir, key)
+				}
+				keyDirs[key] = dir
+				tasks = append(tasks, skyhook.ExecTask{
+					Key: key,
+					Items: map[string][][]skyhook.Item{
+						"seqinfo": {{item}},
+						"labels": {{labelItem}},
+						"frames": {frames},
+					},
+				})
+			}
+			return tasks, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params struct {
+				// "gt" (default) to read gt/gt.txt, or "det" to read det/det.txt.
+				Mode string
+				// Whether to keep gt boxes that are marked to be ignored.
+				IncludeIgnored bool
+				// Skip gt boxes with lower visibility than this.
+				MinVisibility float64
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			videoDS := node.OutputDatasets["video"]
+			labelDS := node.OutputDatasets["detections"]
+
+			applyFunc := func(task skyhook.ExecTask) error {
+				infoData, _, err := task.Items["seqinfo"][0][0].LoadData()
+				if err != nil {
+					return err
+				}
+				info := decodeMotSeqInfo(infoData.([]byte))
+				frames := task.Items["frames"][0]
+
+				labelData, _, err := task.Items["labels"][0][0].LoadData()
+				if err != nil {
+					return err
+				}
+				numFrames := info.SeqLength
+				if len(frames) > numFrames {
+					numFrames = len(frames)
+				}
+				detections, err := decodeMotLabels(labelData.([]byte), params.Mode != "det", numFrames, params.IncludeIgnored, params.MinVisibility)
+				if err != nil {
+					return fmt.Errorf("error decoding labels for sequence %s: %v", task.Key, err)
+				}
+				dims := [2]int{info.ImWidth, info.ImHeight}
+				if (dims[0] <= 0 || dims[1] <= 0) && len(frames) > 0 && frames[0].Fname() != "" {
+					dims, err = skyhook.GetImageDimsFromFile(frames[0].Fname())
+					if err != nil {
+						return err
+					}
+				}
+				err = exec_ops.WriteItem(url, labelDS, task.Key, detections, skyhook.DetectionMetadata{
+					CanvasDims: dims,
+				})
+				if err != nil {
+					return err
+				}
+
+				// encode the frames as a video, if the sequence has them
+				if len(frames) == 0 {
+					return nil
+				}
+				frameRate := info.FrameRate
+				if frameRate <= 0 {
+					frameRate = 10
+				}
+				videoMetadata := skyhook.VideoMetadata{
+					Dims: dims,
+					Framerate: [2]int{frameRate, 1},
+					Duration: float64(len(frames))/float64(frameRate),
+				}
+				videoItem, err := exec_ops.AddItem(url, videoDS, task.Key, "mp4", "mp4", videoMetadata)
+				if err != nil {
+					return err
+				}
+				writer := videoItem.LoadWriter()
+				for _, frame := range frames {
+					im, err := skyhook.ImageFromFile(frame.Fname())
+					if err != nil {
+						writer.Close()
+						return fmt.Errorf("error reading frame %s: %v", frame.Key, err)
+					}
+					if err := writer.Write([]skyhook.Image{im}); err != nil {
+						writer.Close()
+						return err
+					}
+				}
+				return writer.Close()
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
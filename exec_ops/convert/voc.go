@@ -0,0 +1,490 @@
+package convert
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Convert to and from Pascal VOC format.
+// Skyhook inputs requires two datasets, one image and one detection.
+// This format is a FileDataset with JPEGImages/{key}.jpg and Annotations/{key}.xml,
+// along with split files under ImageSets/Main/.
+// VOC coordinates are 1-based and inclusive, so we shift xmin/ymin by one pixel.
+
+type VocSize struct {
+	Width int `xml:"width"`
+	Height int `xml:"height"`
+	Depth int `xml:"depth"`
+}
+
+// Some datasets use fractional coordinates, so we keep them as strings and parse with vocCoordinate.
+type VocBox struct {
+	Xmin string `xml:"xmin"`
+	Ymin string `xml:"ymin"`
+	Xmax string `xml:"xmax"`
+	Ymax string `xml:"ymax"`
+}
+
+type VocObject struct {
+	Name string `xml:"name"`
+	Pose string `xml:"pose,omitempty"`
+	Truncated string `xml:"truncated,omitempty"`
+	Difficult string `xml:"difficult,omitempty"`
+	Occluded string `xml:"occluded,omitempty"`
+	Box VocBox `xml:"bndbox"`
+}
+
+type VocAnnotation struct {
+	XMLName xml.Name `xml:"annotation"`
+	Folder string `xml:"folder"`
+	Filename string `xml:"filename"`
+	Size VocSize `xml:"size"`
+	Segmented int `xml:"segmented"`
+	Objects []VocObject `xml:"object"`
+}
+
+// VOC object fields that we store in Detection.Metadata.
+var vocFlags = []string{"pose", "truncated", "difficult", "occluded"}
+
+func (obj VocObject) getFlag(name string) string {
+	switch name {
+	case "pose":
+		return obj.Pose
+	case "truncated":
+		return obj.Truncated
+	case "difficult":
+		return obj.Difficult
+	case "occluded":
+		return obj.Occluded
+	}
+	return ""
+}
+
+func (obj *VocObject) setFlag(name string, value string) {
+	switch name {
+	case "pose":
+		obj.Pose = value
+	case "truncated":
+		obj.Truncated = value
+	case "difficult":
+		obj.Difficult = value
+	case "occluded":
+		obj.Occluded = value
+	}
+}
+
+func vocCoordinate(str string) (int, error) {
+	x, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid coordinate %q", str)
+	}
+	return int(math.Round(x)), nil
+}
+
+func decodeVocAnnotation(bytes []byte) (VocAnnotation, error) {
+	var annotation VocAnnotation
+	err := xml.Unmarshal(bytes, &annotation)
+	return annotation, err
+}
+
+// Returns the ImageSets split ("train" or "val") that the key should be assigned to.
+// We hash the key so that the assignment doesn't depend on the other items.
+func vocSplit(key string, valFraction float64) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	if float64(h.Sum32() % 1000) < valFraction*1000 {
+		return "val"
+	}
+	return "train"
+}
+
+func init() {
+	imageSpec := skyhook.DataSpecs[skyhook.ImageType].(skyhook.ImageDataSpec)
+
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "to_voc",
+			Name: "To VOC",
+			Description: "Convert from [image, detection] datasets to Pascal VOC image/XML format",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType}},
+			{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		},
+		Outputs: []skyhook.ExecOutput{{Name: "output", DataType: skyhook.FileType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			// one task for each image/detection pair
+			// plus one task with all the detections to write the ImageSets split files
+			// we mark that task by setting the metadata to "imagesets", which applyFunc below will check
+			tasks, err := exec_ops.SimpleTasks(node, rawItems)
+			if err != nil {
+				return nil, err
+			}
+			// the key of that task must not collide with the key of an image
+			taskKeys := make(map[string]bool)
+			for _, task := range tasks {
+				taskKeys[task.Key] = true
+			}
+			imageSetsKey := "imagesets"
+			for taskKeys[imageSetsKey] {
+				imageSetsKey += "_"
+			}
+			tasks = append(tasks, skyhook.ExecTask{
+				Key: imageSetsKey,
+				Items: map[string][][]skyhook.Item{"detections": rawItems["detections"]},
+				Metadata: "imagesets",
+			})
+			return tasks, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params struct {
+				Symlink bool
+				// Fraction of images to list in ImageSets/Main/val.txt instead of train.txt.
+				ValFraction float64
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+
+			outDS := node.OutputDatasets["output"]
+
+			writeImageSets := func(task skyhook.ExecTask) error {
+				// collect the keys in each split, and the categories present in each image
+				var categories []string
+				splits := make(map[string][]string)
+				imageCategories := make(map[string]map[string]int)
+				for _, itemList := range task.Items["detections"] {
+					for _, item := range itemList {
+						data, metadata, err := item.LoadData()
+						if err != nil {
+							return err
+						}
+						if len(categories) == 0 {
+							categories = metadata.(skyhook.DetectionMetadata).Categories
+						}
+						split := vocSplit(item.Key, params.ValFraction)
+						splits[split] = append(splits[split], item.Key)
+						splits["trainval"] = append(splits["trainval"], item.Key)
+
+						// VOC uses 1 if the category is present, 0 if only difficult objects are present, -1 otherwise
+						imageCategories[item.Key] = make(map[string]int)
+						frames := data.([][]skyhook.Detection)
+						if len(frames) == 0 {
+							continue
+						}
+						for _, detection := range frames[0] {
+							label := 1
+							if detection.Metadata["difficult"] == "1" {
+								label = 0
+							}
+							if label > imageCategories[item.Key][detection.Category] {
+								imageCategories[item.Key][detection.Category] = label
+							}
+						}
+					}
+				}
+
+				writeSplitFile := func(name string, lines []string) error {
+					bytes := []byte(strings.Join(lines, "\n")+"\n")
+					return exec_ops.WriteItem(url, outDS, "imageset-"+name, bytes, skyhook.FileMetadata{
+						Filename: "ImageSets/Main/"+name+".txt",
+					})
+				}
+				for _, split := range []string{"train", "val", "trainval"} {
+					keys := splits[split]
+					sort.Strings(keys)
+					if err := writeSplitFile(split, keys); err != nil {
+						return err
+					}
+					for _, category := range categories {
+						var lines []string
+						for _, key := range keys {
+							label, ok := imageCategories[key][category]
+							if !ok {
+								label = -1
+							}
+							lines = append(lines, fmt.Sprintf("%s %2d", key, label))
+						}
+						if err := writeSplitFile(category+"_"+split, lines); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			}
+
+			applyFunc := func(task skyhook.ExecTask) error {
+				if task.Metadata == "imagesets" {
+					return writeImageSets(task)
+				}
+
+				inImageItem := task.Items["images"][0][0]
+				inLabelItem := task.Items["detections"][0][0]
+
+				// write the image
+				// VOC images are always JPEG, so we only symlink if the input is already JPEG
+				outImageItem, err := exec_ops.AddItem(url, outDS, task.Key+"-image", "jpg", "", skyhook.FileMetadata{
+					Filename: "JPEGImages/"+task.Key+".jpg",
+				})
+				if err != nil {
+					return err
+				}
+				err = inImageItem.CopyTo(outImageItem.Fname(), "jpeg", params.Symlink)
+				if err != nil {
+					return err
+				}
+
+				// write the annotation XML
+				labelData, labelMetadata_, err := inLabelItem.LoadData()
+				if err != nil {
+					return err
+				}
+				labelMetadata := labelMetadata_.(skyhook.DetectionMetadata)
+				canvasDims := labelMetadata.CanvasDims
+				if canvasDims[0] == 0 && inImageItem.Fname() != "" {
+					canvasDims, err = skyhook.GetImageDimsFromFile(inImageItem.Fname())
+					if err != nil {
+						return err
+					}
+				}
+				annotation := VocAnnotation{
+					Folder: "JPEGImages",
+					Filename: task.Key+".jpg",
+					Size: VocSize{
+						Width: canvasDims[0],
+						Height: canvasDims[1],
+						Depth: 3,
+					},
+				}
+				var detections []skyhook.Detection
+				if frames := labelData.([][]skyhook.Detection); len(frames) > 0 {
+					detections = frames[0]
+				}
+				for _, detection := range detections {
+					obj := VocObject{
+						Name: detection.Category,
+						Pose: "Unspecified",
+						Truncated: "0",
+						Difficult: "0",
+						Box: VocBox{
+							Xmin: strconv.Itoa(detection.Left+1),
+							Ymin: strconv.Itoa(detection.Top+1),
+							Xmax: strconv.Itoa(detection.Right),
+							Ymax: strconv.Itoa(detection.Bottom),
+						},
+					}
+					for _, flag := range vocFlags {
+						if value, ok := detection.Metadata[flag]; ok {
+							obj.setFlag(flag, value)
+						}
+					}
+					annotation.Objects = append(annotation.Objects, obj)
+				}
+				bytes, err := xml.MarshalIndent(annotation, "", "\t")
+				if err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, outDS, task.Key+"-label", append(bytes, '\n'), skyhook.FileMetadata{
+					Filename: "Annotations/"+task.Key+".xml",
+				})
+			}
+
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "from_voc",
+			Name: "From VOC",
+			Description: "Convert from Pascal VOC image/XML format to [image, detection] datasets",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "input", DataTypes: []skyhook.DataType{skyhook.FileType}}},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "images", DataType: skyhook.ImageType},
+			{Name: "detections", DataType: skyhook.DetectionType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			var params struct {
+				// If set, only convert images listed in ImageSets/Main/{ImageSet}.txt.
+				ImageSet string
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+
+			files := ItemsToFileMap(rawItems["input"][0], true)
+
+			var allowed map[string]bool
+			if params.ImageSet != "" {
+				item, ok := files[params.ImageSet+".txt"]
+				if !ok {
+					return nil, fmt.Errorf("from_voc: could not find image set %s", params.ImageSet)
+				}
+				data, _, err := item.LoadData()
+				if err != nil {
+					return nil, fmt.Errorf("from_voc: error loading image set: %v", err)
+				}
+				allowed = make(map[string]bool)
+				for _, line := range strings.Split(string(data.([]byte)), "\n") {
+					// per-category split files have a label after the key
+					fields := strings.Fields(line)
+					if len(fields) == 0 {
+						continue
+					}
+					allowed[fields[0]] = true
+				}
+			}
+
+			// VOC doesn't list the categories anywhere, so we collect them from the annotations
+			// we pass them to tasks in task metadata so that every item has the same categories
+			categorySet := make(map[string]bool)
+			var tasks []skyhook.ExecTask
+			for fname, item := range files {
+				ext := filepath.Ext(fname)
+				if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+					continue
+				}
+				prefix := fname[0:len(fname)-len(ext)]
+				if allowed != nil && !allowed[prefix] {
+					continue
+				}
+				labelItem, ok := files[prefix+".xml"]
+				if !ok {
+					return nil, fmt.Errorf("from_voc: could not find annotation for image %s", fname)
+				}
+				data, _, err := labelItem.LoadData()
+				if err != nil {
+					return nil, fmt.Errorf("from_voc: error loading annotation for %s: %v", fname, err)
+				}
+				annotation, err := decodeVocAnnotation(data.([]byte))
+				if err != nil {
+					return nil, fmt.Errorf("from_voc: error decoding annotation for %s: %v", fname, err)
+				}
+				for _, obj := range annotation.Objects {
+					categorySet[obj.Name] = true
+				}
+				tasks = append(tasks, skyhook.ExecTask{
+					Key: prefix,
+					Items: map[string][][]skyhook.Item{
+						"image": {{item}},
+						"detections": {{labelItem}},
+					},
+				})
+			}
+
+			var categories []string
+			for category := range categorySet {
+				categories = append(categories, category)
+			}
+			sort.Strings(categories)
+			taskMetadata := string(skyhook.JsonMarshal(categories))
+			for i := range tasks {
+				tasks[i].Metadata = taskMetadata
+			}
+			return tasks, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params struct {
+				Symlink bool
+			}
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			imageDS := node.OutputDatasets["images"]
+			labelDS := node.OutputDatasets["detections"]
+			applyFunc := func(task skyhook.ExecTask) error {
+				inImageItem := task.Items["image"][0][0]
+				inLabelItem := task.Items["detections"][0][0]
+				var categories []string
+				skyhook.JsonUnmarshal([]byte(task.Metadata), &categories)
+
+				inLabelData, _, err := inLabelItem.LoadData()
+				if err != nil {
+					return err
+				}
+				annotation, err := decodeVocAnnotation(inLabelData.([]byte))
+				if err != nil {
+					return fmt.Errorf("error decoding annotation for %s: %v", task.Key, err)
+				}
+
+				// use the size in the annotation if set, otherwise read it from the image
+				dims := [2]int{annotation.Size.Width, annotation.Size.Height}
+				if (dims[0] <= 0 || dims[1] <= 0) && inImageItem.Fname() != "" {
+					dims, err = skyhook.GetImageDimsFromFile(inImageItem.Fname())
+					if err != nil {
+						return err
+					}
+				}
+
+				var detections []skyhook.Detection
+				for _, obj := range annotation.Objects {
+					var coords [4]int
+					for i, str := range []string{obj.Box.Xmin, obj.Box.Ymin, obj.Box.Xmax, obj.Box.Ymax} {
+						coords[i], err = vocCoordinate(str)
+						if err != nil {
+							return fmt.Errorf("error decoding annotation for %s: %v", task.Key, err)
+						}
+					}
+					detection := skyhook.Detection{
+						Category: obj.Name,
+						Left: coords[0]-1,
+						Top: coords[1]-1,
+						Right: coords[2],
+						Bottom: coords[3],
+					}
+					// we skip default values so that the detections stay compact
+					// to_voc writes the defaults back
+					for _, flag := range vocFlags {
+						value := strings.TrimSpace(obj.getFlag(flag))
+						if value == "" || value == "0" || value == "Unspecified" {
+							continue
+						}
+						if detection.Metadata == nil {
+							detection.Metadata = make(map[string]string)
+						}
+						detection.Metadata[flag] = value
+					}
+					detections = append(detections, detection)
+				}
+
+				err = exec_ops.WriteItem(url, labelDS, task.Key, [][]skyhook.Detection{detections}, skyhook.DetectionMetadata{
+					CanvasDims: dims,
+					Categories: categories,
+				})
+				if err != nil {
+					return err
+				}
+
+				// add the image
+				// we use the original filename to determine skyhook ext/format
+				imageFileMetadata := inImageItem.DecodeMetadata().(skyhook.FileMetadata)
+				format, _, _ := imageSpec.GetMetadataFromFile(imageFileMetadata.Filename)
+				ext := imageSpec.GetExtFromFormat(format)
+				outImageItem, err := exec_ops.AddItem(url, imageDS, task.Key, ext, format, skyhook.NoMetadata{})
+				if err != nil {
+					return err
+				}
+				return inImageItem.CopyTo(outImageItem.Fname(), format, params.Symlink)
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -4,15 +4,192 @@ import (
 	"github.com/skyhookml/skyhookml/exec_ops"
 	"github.com/skyhookml/skyhookml/skyhook"
 
+	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 // Convert to and from YOLOv3 format.
 // Skyhook inputs requires two datasets, one image and one detection.
 // This format is a flat FileDataset with paired images and labels stored under same original filename.
-// An obj.names file is also created for the category names.
+// An obj.names file is also created for the category names, along with a data.yaml for
+// training repositories that expect the dataset YAML.
+//
+// The Variant parameter selects the label format:
+// - "box" (default): "class cx cy width height"
+// - "segment": "class x1 y1 x2 y2 ...", paired with a Shape dataset of polygons
+// - "pose": "class cx cy width height px1 py1 [v1] ...", where the keypoints are stored
+//   in Detection.Metadata["keypoints"] as "x,y[,v];x,y[,v];..." in pixel coordinates
+// All coordinates in the label files are normalized by the image dimensions.
+
+type YoloParams struct {
+	Variant string
+	// For the pose variant, the number of keypoints and the number of values per
+	// keypoint (2 for x/y, or 3 to include visibility).
+	KeypointShape [2]int
+}
+
+func (p YoloParams) GetVariant() string {
+	if p.Variant == "" {
+		return "box"
+	}
+	return p.Variant
+}
+
+// Returns the name and data type of the label dataset for the variant.
+func (p YoloParams) LabelDataset() (string, skyhook.DataType) {
+	if p.GetVariant() == "segment" {
+		return "shapes", skyhook.ShapeType
+	}
+	return "detections", skyhook.DetectionType
+}
+
+func decodeYoloParams(rawParams string) YoloParams {
+	var params YoloParams
+	if rawParams != "" {
+		json.Unmarshal([]byte(rawParams), &params)
+	}
+	return params
+}
+
+// Encode keypoints for Detection.Metadata.
+func EncodeKeypoints(keypoints [][]float64) string {
+	var parts []string
+	for _, kp := range keypoints {
+		var values []string
+		for _, x := range kp {
+			values = append(values, strconv.FormatFloat(x, 'f', -1, 64))
+		}
+		parts = append(parts, strings.Join(values, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Decode keypoints from Detection.Metadata.
+func DecodeKeypoints(str string) ([][]float64, error) {
+	if str == "" {
+		return nil, nil
+	}
+	var keypoints [][]float64
+	for _, part := range strings.Split(str, ";") {
+		var kp []float64
+		for _, value := range strings.Split(part, ",") {
+			x, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keypoint %q", part)
+			}
+			kp = append(kp, x)
+		}
+		keypoints = append(keypoints, kp)
+	}
+	return keypoints, nil
+}
+
+// Produce the dataset YAML for YOLO training repositories.
+// Images and labels are together in the same directory, so train and val both point there.
+func encodeYoloYAML(categories []string, params YoloParams) []byte {
+	s := "path: .\ntrain: .\nval: .\n"
+	s += fmt.Sprintf("nc: %d\n", len(categories))
+	s += "names:\n"
+	for i, category := range categories {
+		s += fmt.Sprintf("  %d: %s\n", i, strconv.Quote(category))
+	}
+	if params.GetVariant() == "pose" {
+		s += fmt.Sprintf("kpt_shape: [%d, %d]\n", params.KeypointShape[0], params.KeypointShape[1])
+	}
+	return []byte(s)
+}
+
+// Parse the category names and keypoint shape from a dataset YAML.
+// We only support the subset of YAML that these files use: names may be a flow
+// list, a block list, or a block mapping from class ID to name.
+func decodeYoloYAML(bytes []byte) (categories []string, kptShape [2]int) {
+	unquote := func(str string) string {
+		str = strings.TrimSpace(str)
+		if len(str) >= 2 && (str[0] == '"' || str[0] == '\'') && str[len(str)-1] == str[0] {
+			if str[0] == '"' {
+				if s, err := strconv.Unquote(str); err == nil {
+					return s
+				}
+			}
+			return str[1:len(str)-1]
+		}
+		return str
+	}
+	parseFlowList := func(str string) []string {
+		str = strings.TrimSpace(str)
+		str = strings.TrimPrefix(str, "[")
+		str = strings.TrimSuffix(str, "]")
+		var items []string
+		for _, part := range strings.Split(str, ",") {
+			if part = unquote(part); part != "" {
+				items = append(items, part)
+			}
+		}
+		return items
+	}
+
+	byID := make(map[int]string)
+	inNames := false
+	for _, line := range strings.Split(string(bytes), "\n") {
+		if idx := strings.Index(line, " #"); idx >= 0 {
+			line = line[0:idx]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		line = strings.TrimSpace(line)
+		if !indented {
+			inNames = false
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			k, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			if k == "names" {
+				if v == "" {
+					inNames = true
+				} else {
+					categories = parseFlowList(v)
+				}
+			} else if k == "kpt_shape" {
+				values := parseFlowList(v)
+				if len(values) == 2 {
+					kptShape[0], _ = strconv.Atoi(values[0])
+					kptShape[1], _ = strconv.Atoi(values[1])
+				}
+			}
+			continue
+		}
+		if !inNames {
+			continue
+		}
+		if strings.HasPrefix(line, "- ") {
+			categories = append(categories, unquote(line[2:]))
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSpace(parts[0])); err == nil {
+			byID[id] = unquote(parts[1])
+		}
+	}
+	for id := 0; id < len(byID); id++ {
+		categories = append(categories, byID[id])
+	}
+	return categories, kptShape
+}
+
+// Metadata passed to from_yolo tasks.
+type yoloTaskMetadata struct {
+	Categories []string
+	KeypointShape [2]int
+}
 
 func init() {
 	imageSpec := skyhook.DataSpecs[skyhook.ImageType].(skyhook.ImageDataSpec)
@@ -21,11 +198,14 @@ func init() {
 		Config: skyhook.ExecOpConfig{
 			ID: "to_yolo",
 			Name: "To YOLO",
-			Description: "Convert from [image, detection] datasets to YOLO image/txt format",
+			Description: "Convert from [image, detection or shape] datasets to YOLO image/txt format",
 		},
-		Inputs: []skyhook.ExecInput{
-			{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType}},
-			{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		GetInputs: func(rawParams string) []skyhook.ExecInput {
+			labelName, labelType := decodeYoloParams(rawParams).LabelDataset()
+			return []skyhook.ExecInput{
+				{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType}},
+				{Name: labelName, DataTypes: []skyhook.DataType{labelType}},
+			}
 		},
 		Outputs: []skyhook.ExecOutput{{Name: "output", DataType: skyhook.FileType}},
 		Requirements: func(node skyhook.Runnable) map[string]int {
@@ -33,7 +213,7 @@ func init() {
 		},
 		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
 			// we mostly use SimpleTasks, which creates a task for each corresponding image/detection pair between the input datasets
-			// but we need to assign one task for writing the "obj.names" output
+			// but we need to assign one task for writing the "obj.names" and "data.yaml" outputs
 			// to assign it, we just set the metadata to "obj.names", which applyFunc below will check
 			tasks, err := exec_ops.SimpleTasks(node, rawItems)
 			if err != nil {
@@ -46,6 +226,7 @@ func init() {
 		},
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 			var params struct {
+				YoloParams
 				Format string
 				Symlink bool
 			}
@@ -55,11 +236,19 @@ func init() {
 			if node.Params == "" {
 				params.Format = "jpeg"
 			}
+			variant := params.GetVariant()
+			if variant == "pose" && params.KeypointShape[0] <= 0 {
+				return nil, fmt.Errorf("to_yolo: KeypointShape must be set for the pose variant")
+			}
+			if params.KeypointShape[1] != 2 {
+				params.KeypointShape[1] = 3
+			}
+			labelName, _ := params.LabelDataset()
 
 			outDS := node.OutputDatasets["output"]
 			applyFunc := func(task skyhook.ExecTask) error {
 				inImageItem := task.Items["images"][0][0]
-				inLabelItem := task.Items["detections"][0][0]
+				inLabelItem := task.Items[labelName][0][0]
 
 				// write the image
 				// we produce a symlink if requested by the user and if the output format matches
@@ -87,25 +276,78 @@ func init() {
 
 				// write the labels
 				// we need to convert coordinates and also change category string to category ID
-				labelData, labelMetadata_, err := inLabelItem.LoadData()
+				labelData, labelMetadata, err := inLabelItem.LoadData()
 				if err != nil {
 					return err
 				}
-				labelMetadata := labelMetadata_.(skyhook.DetectionMetadata)
-				canvasDims := labelMetadata.CanvasDims
+				var canvasDims [2]int
+				var categories []string
+				if variant == "segment" {
+					canvasDims = labelMetadata.(skyhook.ShapeMetadata).CanvasDims
+					categories = labelMetadata.(skyhook.ShapeMetadata).Categories
+				} else {
+					canvasDims = labelMetadata.(skyhook.DetectionMetadata).CanvasDims
+					categories = labelMetadata.(skyhook.DetectionMetadata).Categories
+				}
 				categoryToID := make(map[string]int)
-				for i, category := range labelMetadata.Categories {
+				for i, category := range categories {
 					categoryToID[category] = i
 				}
+				normX := func(x float64) float64 {
+					return x/float64(canvasDims[0])
+				}
+				normY := func(y float64) float64 {
+					return y/float64(canvasDims[1])
+				}
 				var lines []string
-				for _, detection := range labelData.([][]skyhook.Detection)[0] {
-					cx := float64(detection.Left+detection.Right)/2/float64(canvasDims[0])
-					cy := float64(detection.Top+detection.Bottom)/2/float64(canvasDims[1])
-					width := float64(detection.Right-detection.Left)/float64(canvasDims[0])
-					height := float64(detection.Bottom-detection.Top)/float64(canvasDims[1])
-					catID := categoryToID[detection.Category] // default to 0 if not found
-					line := fmt.Sprintf("%v %v %v %v %v", catID, cx, cy, width, height)
-					lines = append(lines, line)
+				if variant == "segment" {
+					for _, shape := range labelData.([][]skyhook.Shape)[0] {
+						points := shape.Points
+						if shape.Type == skyhook.BoxShape {
+							bounds := shape.Bounds()
+							points = [][2]int{{bounds[0], bounds[1]}, {bounds[2], bounds[1]}, {bounds[2], bounds[3]}, {bounds[0], bounds[3]}}
+						} else if shape.Type != skyhook.PolygonShape {
+							continue
+						}
+						parts := []string{strconv.Itoa(categoryToID[shape.Category])}
+						for _, p := range points {
+							parts = append(parts, fmt.Sprintf("%v %v", normX(float64(p[0])), normY(float64(p[1]))))
+						}
+						lines = append(lines, strings.Join(parts, " "))
+					}
+				} else {
+					for _, detection := range labelData.([][]skyhook.Detection)[0] {
+						cx := normX(float64(detection.Left+detection.Right)/2)
+						cy := normY(float64(detection.Top+detection.Bottom)/2)
+						width := normX(float64(detection.Right-detection.Left))
+						height := normY(float64(detection.Bottom-detection.Top))
+						catID := categoryToID[detection.Category] // default to 0 if not found
+						line := fmt.Sprintf("%v %v %v %v %v", catID, cx, cy, width, height)
+						if variant == "pose" {
+							keypoints, err := DecodeKeypoints(detection.Metadata["keypoints"])
+							if err != nil {
+								return fmt.Errorf("item %s: %v", task.Key, err)
+							}
+							// every line needs the same number of keypoints, so we pad with zeros
+							// (which YOLO treats as missing)
+							for i := 0; i < params.KeypointShape[0]; i++ {
+								kp := []float64{0, 0, 0}
+								if i < len(keypoints) && len(keypoints[i]) >= 2 {
+									kp[0] = normX(keypoints[i][0])
+									kp[1] = normY(keypoints[i][1])
+									kp[2] = 2
+									if len(keypoints[i]) >= 3 {
+										kp[2] = keypoints[i][2]
+									}
+								}
+								line += fmt.Sprintf(" %v %v", kp[0], kp[1])
+								if params.KeypointShape[1] == 3 {
+									line += fmt.Sprintf(" %v", kp[2])
+								}
+							}
+						}
+						lines = append(lines, line)
+					}
 				}
 				bytes := []byte(strings.Join(lines, "\n")+"\n")
 				err = exec_ops.WriteItem(url, outDS, task.Key+"-label", bytes, skyhook.FileMetadata{
@@ -115,15 +357,21 @@ func init() {
 					return err
 				}
 
-				// we may also need to write obj.names, if this is the one task assigned to it
+				// we may also need to write obj.names and data.yaml, if this is the one task assigned to it
 				if task.Metadata == "obj.names" {
-					bytes := []byte(strings.Join(labelMetadata.Categories, "\n")+"\n")
+					bytes := []byte(strings.Join(categories, "\n")+"\n")
 					err := exec_ops.WriteItem(url, outDS, "obj.names", bytes, skyhook.FileMetadata{
 						Filename: "obj.names",
 					})
 					if err != nil {
 						return err
 					}
+					err = exec_ops.WriteItem(url, outDS, "data.yaml", encodeYoloYAML(categories, params.YoloParams), skyhook.FileMetadata{
+						Filename: "data.yaml",
+					})
+					if err != nil {
+						return err
+					}
 				}
 
 				return nil
@@ -138,40 +386,68 @@ func init() {
 		Config: skyhook.ExecOpConfig{
 			ID: "from_yolo",
 			Name: "From YOLO",
-			Description: "Convert from YOLO image/txt format to [image, detection] datasets",
+			Description: "Convert from YOLO image/txt format to [image, detection or shape] datasets",
 		},
 		Inputs: []skyhook.ExecInput{{Name: "input", DataTypes: []skyhook.DataType{skyhook.FileType}}},
-		Outputs: []skyhook.ExecOutput{
-			{Name: "images", DataType: skyhook.ImageType},
-			{Name: "detections", DataType: skyhook.DetectionType},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			labelName, labelType := decodeYoloParams(rawParams).LabelDataset()
+			return []skyhook.ExecOutput{
+				{Name: "images", DataType: skyhook.ImageType},
+				{Name: labelName, DataType: labelType},
+			}
 		},
 		Requirements: func(node skyhook.Runnable) map[string]int {
 			return nil
 		},
 		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			params := decodeYoloParams(node.Params)
 			files := ItemsToFileMap(rawItems["input"][0], true)
 
-			// first load obj.names to get object categories
+			loadFile := func(item skyhook.Item) ([]byte, error) {
+				data, _, err := item.LoadData()
+				if err != nil {
+					return nil, fmt.Errorf("from_yolo: error loading categories: %v", err)
+				}
+				return data.([]byte), nil
+			}
+
+			// first load the dataset YAML or obj.names to get object categories
 			// we will pass it to tasks in task metadata
-			var categories []string
+			var taskMetadata yoloTaskMetadata
+			taskMetadata.KeypointShape = params.KeypointShape
+			for _, fname := range []string{"data.yaml", "dataset.yaml"} {
+				if item, ok := files[fname]; ok {
+					bytes, err := loadFile(item)
+					if err != nil {
+						return nil, err
+					}
+					var kptShape [2]int
+					taskMetadata.Categories, kptShape = decodeYoloYAML(bytes)
+					if taskMetadata.KeypointShape[0] == 0 {
+						taskMetadata.KeypointShape = kptShape
+					}
+					break
+				}
+			}
 			for _, fname := range []string{"obj.names", "label_map.txt", "labels.txt"} {
+				if len(taskMetadata.Categories) > 0 {
+					break
+				}
 				if item, ok := files[fname]; ok {
-					 data, _, err := item.LoadData()
+					 bytes, err := loadFile(item)
 					 if err != nil {
-						 return nil, fmt.Errorf("from_yolo: error loading categories: %v", err)
+						 return nil, err
 					 }
-					 bytes := data.([]byte)
 					 for _, line := range strings.Split(string(bytes), "\n") {
 						 line = strings.TrimSpace(line)
 						 if line == "" {
 							 continue
 						 }
-						 categories = append(categories, line)
+						 taskMetadata.Categories = append(taskMetadata.Categories, line)
 					 }
-					 break
 				}
 			}
-			taskMetadata := string(skyhook.JsonMarshal(categories))
+			encodedMetadata := string(skyhook.JsonMarshal(taskMetadata))
 
 			// now create one task for each .jpg/.jpeg/.png file that has corresponding .txt
 			var tasks []skyhook.ExecTask
@@ -191,25 +467,29 @@ func init() {
 						"image": {{item}},
 						"detections": {{files[labelFname]}},
 					},
-					Metadata: taskMetadata,
+					Metadata: encodedMetadata,
 				})
 			}
 			return tasks, nil
 		},
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 			var params struct {
+				YoloParams
 				Symlink bool
 			}
 			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
 				return nil, err
 			}
+			variant := params.GetVariant()
 			imageDS := node.OutputDatasets["images"]
-			labelDS := node.OutputDatasets["detections"]
+			labelName, _ := params.LabelDataset()
+			labelDS := node.OutputDatasets[labelName]
 			applyFunc := func(task skyhook.ExecTask) error {
 				inImageItem := task.Items["image"][0][0]
 				inLabelItem := task.Items["detections"][0][0]
-				var categories []string
-				skyhook.JsonUnmarshal([]byte(task.Metadata), &categories)
+				var taskMetadata yoloTaskMetadata
+				skyhook.JsonUnmarshal([]byte(task.Metadata), &taskMetadata)
+				categories := taskMetadata.Categories
 
 				// read first few bytes of image to get the dimensions
 				// default to 720p, anyway we store it in canvas dims
@@ -220,44 +500,114 @@ func init() {
 						dims = imDims
 					}
 				}
+				toX := func(x float64) int {
+					return int(x*float64(dims[0]))
+				}
+				toY := func(y float64) int {
+					return int(y*float64(dims[1]))
+				}
 
-				// convert the labels .txt file to skyhook detection format
+				// convert the labels .txt file to skyhook detection or shape format
 				inLabelData, _, err := inLabelItem.LoadData()
 				if err != nil {
 					return err
 				}
 				var detections []skyhook.Detection
+				shapes := []skyhook.Shape{}
 				for _, line := range strings.Split(string(inLabelData.([]byte)), "\n") {
 					line = strings.TrimSpace(line)
 					if line == "" {
 						continue
 					}
-					parts := strings.Split(line, " ")
+					parts := strings.Fields(line)
+					if len(parts) < 5 {
+						return fmt.Errorf("item %s: invalid label line %q", task.Key, line)
+					}
 					clsID := skyhook.ParseInt(parts[0])
-					cx := skyhook.ParseFloat(parts[1])
-					cy := skyhook.ParseFloat(parts[2])
-					width := skyhook.ParseFloat(parts[3])
-					height := skyhook.ParseFloat(parts[4])
+					values := make([]float64, len(parts)-1)
+					for i := range values {
+						values[i] = skyhook.ParseFloat(parts[i+1])
+					}
 
 					var category string
 					if clsID >= 0 && clsID < len(categories) {
 						category = categories[clsID]
 					}
 
-					detections = append(detections, skyhook.Detection{
+					if variant == "segment" {
+						// some segmentation datasets mix in box labels, which have exactly four values
+						if len(values) == 4 {
+							cx, cy, width, height := values[0], values[1], values[2], values[3]
+							shapes = append(shapes, skyhook.Shape{
+								Type: skyhook.BoxShape,
+								Points: [][2]int{
+									{toX(cx-width/2), toY(cy-height/2)},
+									{toX(cx+width/2), toY(cy+height/2)},
+								},
+								Category: category,
+							})
+							continue
+						}
+						shape := skyhook.Shape{
+							Type: skyhook.PolygonShape,
+							Category: category,
+						}
+						for i := 0; i+1 < len(values); i += 2 {
+							shape.Points = append(shape.Points, [2]int{toX(values[i]), toY(values[i+1])})
+						}
+						shapes = append(shapes, shape)
+						continue
+					}
+
+					cx, cy, width, height := values[0], values[1], values[2], values[3]
+					detection := skyhook.Detection{
 						Category: category,
-						Left: int((cx-width/2)*float64(dims[0])),
-						Top: int((cy-height/2)*float64(dims[1])),
-						Right: int((cx+width/2)*float64(dims[0])),
-						Bottom: int((cy+height/2)*float64(dims[1])),
-					})
+						Left: toX(cx-width/2),
+						Top: toY(cy-height/2),
+						Right: toX(cx+width/2),
+						Bottom: toY(cy+height/2),
+					}
+					if variant == "pose" && len(values) > 4 {
+						// determine number of values per keypoint from the YAML if possible
+						kptValues := values[4:]
+						kptDims := taskMetadata.KeypointShape[1]
+						if kptDims != 2 && kptDims != 3 {
+							if len(kptValues) % 3 == 0 {
+								kptDims = 3
+							} else {
+								kptDims = 2
+							}
+						}
+						var keypoints [][]float64
+						for i := 0; i+kptDims <= len(kptValues); i += kptDims {
+							kp := []float64{
+								float64(toX(kptValues[i])),
+								float64(toY(kptValues[i+1])),
+							}
+							if kptDims == 3 {
+								kp = append(kp, kptValues[i+2])
+							}
+							keypoints = append(keypoints, kp)
+						}
+						detection.Metadata = map[string]string{
+							"keypoints": EncodeKeypoints(keypoints),
+						}
+					}
+					detections = append(detections, detection)
 				}
 
-				// add the detections
-				err = exec_ops.WriteItem(url, labelDS, task.Key, [][]skyhook.Detection{detections}, skyhook.DetectionMetadata{
-					CanvasDims: dims,
-					Categories: categories,
-				})
+				// add the labels
+				if variant == "segment" {
+					err = exec_ops.WriteItem(url, labelDS, task.Key, [][]skyhook.Shape{shapes}, skyhook.ShapeMetadata{
+						CanvasDims: dims,
+						Categories: categories,
+					})
+				} else {
+					err = exec_ops.WriteItem(url, labelDS, task.Key, [][]skyhook.Detection{detections}, skyhook.DetectionMetadata{
+						CanvasDims: dims,
+						Categories: categories,
+					})
+				}
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,261 @@
+package dedup
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Find near-duplicate images or video frames using perceptual hashes.
+// We greedily cluster the images: in order of key (and frame), each image that is not
+// yet in a cluster becomes the representative of a new cluster, which also includes
+// all unclustered images within the Hamming distance threshold of it.
+// The output includes only the representative of each cluster.
+
+type Params struct {
+	// "phash" (default), "dhash", or "ahash"
+	Hash string
+	// Maximum Hamming distance between the 64-bit hashes of near-duplicates.
+	Threshold int
+}
+
+func (params Params) GetHash() string {
+	if params.Hash == "" {
+		return "phash"
+	}
+	return params.Hash
+}
+
+func (params Params) GetThreshold() int {
+	if params.Threshold <= 0 {
+		return 5
+	}
+	return params.Threshold
+}
+
+func (params Params) HashFunc() (func(skyhook.Image) uint64, error) {
+	switch params.GetHash() {
+	case "phash":
+		return PerceptualHash, nil
+	case "dhash":
+		return DifferenceHash, nil
+	case "ahash":
+		return AverageHash, nil
+	}
+	return nil, fmt.Errorf("unknown hash %s", params.Hash)
+}
+
+// An image or video frame.
+type hashedImage struct {
+	Item skyhook.Item
+	// Frame index for videos, 0 for images.
+	Frame int
+	Hash uint64
+}
+
+func (h hashedImage) OutputKey() string {
+	if h.Item.Dataset.DataType == skyhook.VideoType {
+		return fmt.Sprintf("%s_%d", h.Item.Key, h.Frame)
+	}
+	return h.Item.Key
+}
+
+// Compute the hashes of all the images, or all the frames of the videos.
+func hashItems(items []skyhook.Item, hashFunc func(skyhook.Image) uint64) ([]hashedImage, error) {
+	hashes := make([][]hashedImage, len(items))
+	errors := make([]error, len(items))
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range ch {
+				item := items[idx]
+				errors[idx] = skyhook.PerFrame([]skyhook.Item{item}, func(pos int, datas []interface{}) error {
+					var im skyhook.Image
+					if images, ok := datas[0].([]skyhook.Image); ok {
+						im = images[0]
+					} else {
+						im = datas[0].(skyhook.Image)
+					}
+					hashes[idx] = append(hashes[idx], hashedImage{
+						Item: item,
+						Frame: pos,
+						Hash: hashFunc(im),
+					})
+					return nil
+				})
+			}
+		}()
+	}
+	for idx := range items {
+		ch <- idx
+	}
+	close(ch)
+	wg.Wait()
+
+	var flat []hashedImage
+	for idx, itemHashes := range hashes {
+		if errors[idx] != nil {
+			return nil, fmt.Errorf("error hashing %s: %v", items[idx].Key, errors[idx])
+		}
+		flat = append(flat, itemHashes...)
+	}
+	return flat, nil
+}
+
+// Cluster the hashes, returning the cluster index of each hash and the representative
+// (first member) of each cluster.
+func clusterHashes(hashes []uint64, threshold int) (clusters []int, representatives []int) {
+	tree := &BKTree{}
+	for i, hash := range hashes {
+		tree.Insert(hash, i)
+	}
+	clusters = make([]int, len(hashes))
+	for i := range clusters {
+		clusters[i] = -1
+	}
+	for i, hash := range hashes {
+		if clusters[i] != -1 {
+			continue
+		}
+		clusterIdx := len(representatives)
+		representatives = append(representatives, i)
+		for _, j := range tree.Query(hash, threshold) {
+			if clusters[j] == -1 {
+				clusters[j] = clusterIdx
+			}
+		}
+	}
+	return clusters, representatives
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "dedup",
+			Name: "Deduplicate",
+			Description: "Find near-duplicate images or video frames using perceptual hashes, and output one image from each cluster",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "input", DataTypes: []skyhook.DataType{skyhook.ImageType, skyhook.VideoType}}},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "output", DataType: skyhook.ImageType},
+			{Name: "clusters", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask("clusters"),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			hashFunc, err := params.HashFunc()
+			if err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				items := append([]skyhook.Item{}, task.Items["input"][0]...)
+				sort.Slice(items, func(i, j int) bool {
+					return items[i].Key < items[j].Key
+				})
+				images, err := hashItems(items, hashFunc)
+				if err != nil {
+					return err
+				}
+				hashes := make([]uint64, len(images))
+				for i, image := range images {
+					hashes[i] = image.Hash
+				}
+				clusters, representatives := clusterHashes(hashes, params.GetThreshold())
+
+				var table skyhook.TableData
+				for i, image := range images {
+					rep := representatives[clusters[i]]
+					isRepresentative := 0
+					if rep == i {
+						isRepresentative = 1
+					}
+					table = append(table, []string{
+						strconv.Itoa(clusters[i]),
+						image.Item.Key,
+						strconv.Itoa(image.Frame),
+						image.OutputKey(),
+						strconv.Itoa(isRepresentative),
+						strconv.Itoa(HammingDistance(image.Hash, images[rep].Hash)),
+						fmt.Sprintf("%016x", image.Hash),
+					})
+				}
+				err = exec_ops.WriteItem(url, node.OutputDatasets["clusters"], task.Key, table, skyhook.TableMetadata{
+					Columns: []skyhook.ColumnSpec{
+						{Label: "cluster", Type: "int"},
+						{Label: "key", Type: "string"},
+						{Label: "frame", Type: "int"},
+						{Label: "output_key", Type: "string"},
+						{Label: "representative", Type: "int"},
+						{Label: "distance", Type: "int"},
+						{Label: "hash", Type: "string"},
+					},
+				})
+				if err != nil {
+					return err
+				}
+
+				// add the representatives to the output
+				// images are added by reference, while we need to extract frames from videos
+				buf := exec_ops.NewItemBuffer(url)
+				output := node.OutputDatasets["output"]
+				neededFrames := make(map[string]map[int]bool)
+				for _, idx := range representatives {
+					image := images[idx]
+					if image.Item.Dataset.DataType == skyhook.VideoType {
+						if neededFrames[image.Item.Key] == nil {
+							neededFrames[image.Item.Key] = make(map[int]bool)
+						}
+						neededFrames[image.Item.Key][image.Frame] = true
+						continue
+					}
+					provider := "reference"
+					fname := image.Item.Fname()
+					err := buf.Add(output, skyhook.Item{
+						Key: image.Item.Key,
+						Ext: image.Item.Ext,
+						Format: image.Item.Format,
+						Metadata: image.Item.Metadata,
+						Provider: &provider,
+						ProviderInfo: &fname,
+					})
+					if err != nil {
+						return err
+					}
+				}
+				for _, item := range items {
+					frames := neededFrames[item.Key]
+					if len(frames) == 0 {
+						continue
+					}
+					err := skyhook.PerFrame([]skyhook.Item{item}, func(pos int, datas []interface{}) error {
+						if !frames[pos] {
+							return nil
+						}
+						im := datas[0].([]skyhook.Image)[0]
+						return buf.WriteItem(output, hashedImage{Item: item, Frame: pos}.OutputKey(), im, skyhook.NoMetadata{})
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return buf.Flush()
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
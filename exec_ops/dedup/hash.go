@@ -0,0 +1,175 @@
+package dedup
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Perceptual hashes of images, which are similar (in Hamming distance) for images
+// that look similar.
+
+// Resize the image to the specified size in grayscale, averaging the pixels in each cell.
+func grayscaleThumbnail(im skyhook.Image, width int, height int) []float64 {
+	sums := make([]float64, width*height)
+	counts := make([]int, width*height)
+	for y := 0; y < im.Height; y++ {
+		ty := y*height/im.Height
+		for x := 0; x < im.Width; x++ {
+			tx := x*width/im.Width
+			offset := (y*im.Width+x)*3
+			gray := 0.299*float64(im.Bytes[offset]) + 0.587*float64(im.Bytes[offset+1]) + 0.114*float64(im.Bytes[offset+2])
+			sums[ty*width+tx] += gray
+			counts[ty*width+tx]++
+		}
+	}
+	for i := range sums {
+		if counts[i] > 0 {
+			sums[i] /= float64(counts[i])
+		}
+	}
+	return sums
+}
+
+// Average hash: whether each pixel of an 8x8 thumbnail is brighter than the mean.
+func AverageHash(im skyhook.Image) uint64 {
+	pixels := grayscaleThumbnail(im, 8, 8)
+	var mean float64
+	for _, v := range pixels {
+		mean += v
+	}
+	mean /= float64(len(pixels))
+	var hash uint64
+	for i, v := range pixels {
+		if v > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// Difference hash: whether each pixel of a 9x8 thumbnail is brighter than the pixel to its right.
+func DifferenceHash(im skyhook.Image) uint64 {
+	pixels := grayscaleThumbnail(im, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// Perceptual hash: whether each of the 8x8 lowest frequency DCT coefficients of a
+// 32x32 thumbnail is above the median coefficient.
+func PerceptualHash(im skyhook.Image) uint64 {
+	const n = 32
+	pixels := grayscaleThumbnail(im, n, n)
+
+	// separable 2D DCT-II, but we only need the first 8 coefficients along each axis
+	cosines := make([][]float64, 8)
+	for k := range cosines {
+		cosines[k] = make([]float64, n)
+		for i := range cosines[k] {
+			cosines[k][i] = math.Cos(math.Pi / n * (float64(i) + 0.5) * float64(k))
+		}
+	}
+	rows := make([]float64, n*8)
+	for y := 0; y < n; y++ {
+		for k := 0; k < 8; k++ {
+			var sum float64
+			for x := 0; x < n; x++ {
+				sum += pixels[y*n+x] * cosines[k][x]
+			}
+			rows[y*8+k] = sum
+		}
+	}
+	coefficients := make([]float64, 64)
+	for ky := 0; ky < 8; ky++ {
+		for kx := 0; kx < 8; kx++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				sum += rows[y*8+kx] * cosines[ky][y]
+			}
+			coefficients[ky*8+kx] = sum
+		}
+	}
+
+	// the median excludes the DC coefficient, which is much larger than the others
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for i, v := range coefficients {
+		if v > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// A BK-tree indexes hashes for finding all hashes within some Hamming distance of a query.
+type BKTree struct {
+	root *bkNode
+}
+
+type bkNode struct {
+	Hash uint64
+	// Indices of the hashes at this node (there may be several identical hashes).
+	Indices []int
+	Children map[int]*bkNode
+}
+
+func (t *BKTree) Insert(hash uint64, idx int) {
+	if t.root == nil {
+		t.root = &bkNode{Hash: hash, Indices: []int{idx}, Children: make(map[int]*bkNode)}
+		return
+	}
+	node := t.root
+	for {
+		d := HammingDistance(hash, node.Hash)
+		if d == 0 {
+			node.Indices = append(node.Indices, idx)
+			return
+		}
+		child := node.Children[d]
+		if child == nil {
+			node.Children[d] = &bkNode{Hash: hash, Indices: []int{idx}, Children: make(map[int]*bkNode)}
+			return
+		}
+		node = child
+	}
+}
+
+// Returns the indices of all hashes within the threshold of the query.
+func (t *BKTree) Query(hash uint64, threshold int) []int {
+	var matches []int
+	if t.root == nil {
+		return nil
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[0:len(stack)-1]
+		d := HammingDistance(hash, node.Hash)
+		if d <= threshold {
+			matches = append(matches, node.Indices...)
+		}
+		// by the triangle inequality, matches can only be under children at distance within threshold of d
+		for childDistance, child := range node.Children {
+			if childDistance >= d-threshold && childDistance <= d+threshold {
+				stack = append(stack, child)
+			}
+		}
+	}
+	sort.Ints(matches)
+	return matches
+}
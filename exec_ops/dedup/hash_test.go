@@ -0,0 +1,61 @@
+package dedup
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// BKTree.Query should return the same indices as a brute-force scan.
+func TestBKTreeQuery(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	// cluster the hashes around a few bases so that there are near-duplicates to find
+	var bases []uint64
+	for i := 0; i < 10; i++ {
+		bases = append(bases, rng.Uint64())
+	}
+	var hashes []uint64
+	for i := 0; i < 500; i++ {
+		hash := bases[rng.Intn(len(bases))]
+		for flips := rng.Intn(8); flips > 0; flips-- {
+			hash ^= 1 << uint(rng.Intn(64))
+		}
+		hashes = append(hashes, hash)
+	}
+	tree := &BKTree{}
+	for idx, hash := range hashes {
+		tree.Insert(hash, idx)
+	}
+
+	queries := append([]uint64{}, hashes[0:20]...)
+	queries = append(queries, rng.Uint64(), bases[0])
+
+	tests := []struct {
+		label string
+		threshold int
+	}{
+		{"exact", 0},
+		{"near", 3},
+		{"default", 5},
+		{"far", 12},
+	}
+	for _, test := range tests {
+		for _, query := range queries {
+			var expected []int
+			for idx, hash := range hashes {
+				if HammingDistance(query, hash) <= test.threshold {
+					expected = append(expected, idx)
+				}
+			}
+			got := tree.Query(query, test.threshold)
+			sort.Ints(got)
+			if len(got) == 0 && len(expected) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: Query(%x) = %v; want %v", test.label, query, got, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package detection_merge
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+)
+
+type Params struct {
+	// "nms" (default), "soft_nms", or "wbf" (weighted box fusion)
+	Mode string
+	// IOU threshold for suppressing or fusing detections of the same category
+	IOU float64
+	// Weight of each input, which multiplies the detection scores.
+	// Defaults to 1 for each input.
+	Weights []float64
+	// Gaussian decay parameter for soft NMS
+	Sigma float64
+	// Detections with lower score after merging are removed
+	MinScore float64
+}
+
+func (params Params) GetMode() string {
+	if params.Mode == "" {
+		return "nms"
+	}
+	return params.Mode
+}
+
+func (params Params) GetIOU() float64 {
+	if params.IOU == 0 {
+		return 0.5
+	}
+	return params.IOU
+}
+
+func (params Params) GetWeight(idx int) float64 {
+	if idx < len(params.Weights) {
+		return params.Weights[idx]
+	}
+	return 1
+}
+
+func (params Params) GetSigma() float64 {
+	if params.Sigma == 0 {
+		return 0.5
+	}
+	return params.Sigma
+}
+
+// Sort detections by decreasing score.
+func sortByScore(detections []skyhook.Detection) {
+	sort.SliceStable(detections, func(i, j int) bool {
+		return detections[i].Score > detections[j].Score
+	})
+}
+
+// Group detections by category, preserving the order of first occurrence.
+func groupByCategory(detections []skyhook.Detection) [][]skyhook.Detection {
+	var groups [][]skyhook.Detection
+	groupIdx := make(map[string]int)
+	for _, d := range detections {
+		idx, ok := groupIdx[d.Category]
+		if !ok {
+			idx = len(groups)
+			groupIdx[d.Category] = idx
+			groups = append(groups, nil)
+		}
+		groups[idx] = append(groups[idx], d)
+	}
+	return groups
+}
+
+// Greedily keep the highest scoring detection, and remove others that overlap it.
+func NMS(detections []skyhook.Detection, iouThreshold float64) []skyhook.Detection {
+	sortByScore(detections)
+	var kept []skyhook.Detection
+	for _, d := range detections {
+		suppressed := false
+		for _, other := range kept {
+			if d.IOU(other) > iouThreshold {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// Like NMS, but instead of removing overlapping detections we decay their scores
+// based on the overlap with the gaussian penalty.
+func SoftNMS(detections []skyhook.Detection, sigma float64, minScore float64) []skyhook.Detection {
+	remaining := append([]skyhook.Detection{}, detections...)
+	var kept []skyhook.Detection
+	for len(remaining) > 0 {
+		sortByScore(remaining)
+		best := remaining[0]
+		kept = append(kept, best)
+		var next []skyhook.Detection
+		for _, d := range remaining[1:] {
+			iou := d.IOU(best)
+			d.Score *= math.Exp(-iou*iou/sigma)
+			if d.Score >= minScore {
+				next = append(next, d)
+			}
+		}
+		remaining = next
+	}
+	return kept
+}
+
+// Weighted box fusion: cluster overlapping detections, and replace each cluster with
+// the score-weighted average of its boxes.
+// The fused score is the average score, decreased if fewer than numInputs detections
+// were in the cluster (since the other inputs didn't detect the object).
+func WBF(detections []skyhook.Detection, iouThreshold float64, numInputs int) []skyhook.Detection {
+	sortByScore(detections)
+	type cluster struct {
+		Members []skyhook.Detection
+		Fused skyhook.Detection
+	}
+	var clusters []*cluster
+	for _, d := range detections {
+		var best *cluster
+		bestIOU := iouThreshold
+		for _, c := range clusters {
+			if iou := d.IOU(c.Fused); iou > bestIOU {
+				best = c
+				bestIOU = iou
+			}
+		}
+		if best == nil {
+			clusters = append(clusters, &cluster{
+				Members: []skyhook.Detection{d},
+				Fused: d,
+			})
+			continue
+		}
+		best.Members = append(best.Members, d)
+
+		// recompute the fused box
+		// we start from the highest scoring member so that other fields are preserved
+		var left, top, right, bottom, scoreSum float64
+		for _, member := range best.Members {
+			left += member.Score*float64(member.Left)
+			top += member.Score*float64(member.Top)
+			right += member.Score*float64(member.Right)
+			bottom += member.Score*float64(member.Bottom)
+			scoreSum += member.Score
+		}
+		fused := best.Members[0]
+		if scoreSum > 0 {
+			fused.Left = int(math.Round(left/scoreSum))
+			fused.Top = int(math.Round(top/scoreSum))
+			fused.Right = int(math.Round(right/scoreSum))
+			fused.Bottom = int(math.Round(bottom/scoreSum))
+		}
+		fused.Score = scoreSum / float64(len(best.Members))
+		best.Fused = fused
+	}
+
+	var fused []skyhook.Detection
+	for _, c := range clusters {
+		d := c.Fused
+		n := len(c.Members)
+		if n > numInputs {
+			n = numInputs
+		}
+		d.Score = d.Score * float64(n) / float64(numInputs)
+		fused = append(fused, d)
+	}
+	sortByScore(fused)
+	return fused
+}
+
+// Merge the detections in one frame from all of the inputs.
+// The scores should already be multiplied by the input weights.
+func (params Params) Merge(detections []skyhook.Detection, numInputs int) []skyhook.Detection {
+	merged := []skyhook.Detection{}
+	for _, group := range groupByCategory(detections) {
+		var cur []skyhook.Detection
+		switch params.GetMode() {
+		case "soft_nms":
+			cur = SoftNMS(group, params.GetSigma(), params.MinScore)
+		case "wbf":
+			cur = WBF(group, params.GetIOU(), numInputs)
+		default:
+			cur = NMS(group, params.GetIOU())
+		}
+		for _, d := range cur {
+			if d.Score < params.MinScore {
+				continue
+			}
+			merged = append(merged, d)
+		}
+	}
+	sortByScore(merged)
+	return merged
+}
+
+type DetectionMerge struct {
+	URL string
+	Params Params
+	Dataset skyhook.Dataset
+}
+
+func (e *DetectionMerge) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *DetectionMerge) Apply(task skyhook.ExecTask) error {
+	// we use the canvas dimensions and categories of the first input,
+	// and rescale detections from other inputs if needed
+	var frames [][]skyhook.Detection
+	var outputMetadata skyhook.DetectionMetadata
+	for inputIdx, items := range task.Items["detections"] {
+		data, metadata, err := items[0].LoadData()
+		if err != nil {
+			return err
+		}
+		detections := data.([][]skyhook.Detection)
+		dims := metadata.(skyhook.DetectionMetadata).CanvasDims
+		if inputIdx == 0 {
+			outputMetadata = metadata.(skyhook.DetectionMetadata)
+		} else {
+			// include categories that only appear in later inputs
+			for _, category := range metadata.(skyhook.DetectionMetadata).Categories {
+				found := false
+				for _, existing := range outputMetadata.Categories {
+					found = found || existing == category
+				}
+				if !found {
+					outputMetadata.Categories = append(outputMetadata.Categories, category)
+				}
+			}
+		}
+		for frameIdx, dlist := range detections {
+			for len(frames) <= frameIdx {
+				frames = append(frames, nil)
+			}
+			for _, d := range dlist {
+				if dims[0] > 0 && outputMetadata.CanvasDims[0] > 0 && dims != outputMetadata.CanvasDims {
+					d = d.Rescale(dims, outputMetadata.CanvasDims)
+				}
+				d.Score *= e.Params.GetWeight(inputIdx)
+				frames[frameIdx] = append(frames[frameIdx], d)
+			}
+		}
+	}
+
+	numInputs := len(task.Items["detections"])
+	ndetections := make([][]skyhook.Detection, len(frames))
+	for frameIdx, dlist := range frames {
+		ndetections[frameIdx] = e.Params.Merge(dlist, numInputs)
+	}
+	return exec_ops.WriteItem(e.URL, e.Dataset, task.Key, ndetections, outputMetadata)
+}
+
+func (e *DetectionMerge) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "detection_merge",
+			Name: "Detection Merge",
+			Description: "Merge detections from one or more inputs using NMS, soft NMS, or weighted box fusion",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}, Variable: true}},
+		Outputs: []skyhook.ExecOutput{{Name: "detections", DataType: skyhook.DetectionType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if mode := params.GetMode(); mode != "nms" && mode != "soft_nms" && mode != "wbf" {
+				return nil, fmt.Errorf("unknown merge mode %s", mode)
+			}
+			op := &DetectionMerge{
+				URL: url,
+				Params: params,
+				Dataset: node.OutputDatasets["detections"],
+			}
+			return op, nil
+		},
+		Incremental: true,
+		GetOutputKeys: exec_ops.MapGetOutputKeys,
+		GetNeededInputs: exec_ops.MapGetNeededInputs,
+		ImageName: "skyhookml/basic",
+	})
+}
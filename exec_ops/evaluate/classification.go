@@ -0,0 +1,187 @@
+package evaluate
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Evaluate predicted class labels (Int) against ground truth labels.
+// Items are matched by key and frame, and class IDs are compared by category name
+// if the datasets specify categories in their metadata.
+
+type ClassificationParams struct {
+	// Names of the class IDs, used for datasets that don't specify categories in their metadata.
+	Categories []string
+}
+
+// Returns the category name of a class ID, or the ID itself if there is no such category.
+func classLabel(categories []string, cls int) string {
+	if cls >= 0 && cls < len(categories) {
+		return categories[cls]
+	}
+	return strconv.Itoa(cls)
+}
+
+// Order labels with the categories first, followed by other observed labels.
+func orderLabels(categories []string, seen map[string]bool) []string {
+	var labels []string
+	added := make(map[string]bool)
+	for _, category := range categories {
+		if added[category] {
+			continue
+		}
+		labels = append(labels, category)
+		added[category] = true
+	}
+	extra := make(map[string]bool)
+	for label := range seen {
+		if !added[label] {
+			extra[label] = true
+		}
+	}
+	return append(labels, sortedKeys(extra)...)
+}
+
+// Counts of (ground truth, predicted) label pairs.
+type labelCounts map[[2]string]int
+
+// Per-class precision, recall, and F1 from the pair counts.
+// Adds one row for each label to the table, and returns the macro-averaged metrics.
+func addClassMetrics(t *Table, counts labelCounts, labels []string) (precision float64, recall float64, f1 float64) {
+	gtTotals := make(map[string]int)
+	predTotals := make(map[string]int)
+	for pair, count := range counts {
+		gtTotals[pair[0]] += count
+		predTotals[pair[1]] += count
+	}
+	var precisions, recalls, f1s []float64
+	for _, label := range labels {
+		tp := counts[[2]string{label, label}]
+		p := safeDiv(tp, predTotals[label])
+		r := safeDiv(tp, gtTotals[label])
+		f := 0.0
+		if p+r > 0 {
+			f = 2*p*r/(p+r)
+		}
+		t.Add(label, p, r, f, gtTotals[label], predTotals[label])
+		// labels that never appear in the ground truth don't count towards the macro average
+		if gtTotals[label] > 0 {
+			precisions = append(precisions, p)
+			recalls = append(recalls, r)
+			f1s = append(f1s, f)
+		}
+	}
+	return validMean(precisions), validMean(recalls), validMean(f1s)
+}
+
+func evaluateClassification(gtItems []skyhook.Item, predItems []skyhook.Item, params ClassificationParams) (summary *Table, confusion *Table, err error) {
+	predByKey := make(map[string]skyhook.Item)
+	for _, item := range predItems {
+		predByKey[item.Key] = item
+	}
+
+	counts := make(labelCounts)
+	seen := make(map[string]bool)
+	var categories []string
+	total := 0
+	correct := 0
+	for _, gtItem := range gtItems {
+		predItem, ok := predByKey[gtItem.Key]
+		if !ok {
+			log.Printf("[evaluate_classification] warning: no prediction for item %s", gtItem.Key)
+			continue
+		}
+		gtData, gtMetadata, err := gtItem.LoadData()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading ground truth %s: %v", gtItem.Key, err)
+		}
+		predData, predMetadata, err := predItem.LoadData()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading prediction %s: %v", predItem.Key, err)
+		}
+		gtCategories := gtMetadata.(skyhook.IntMetadata).Categories
+		predCategories := predMetadata.(skyhook.IntMetadata).Categories
+		if len(gtCategories) == 0 {
+			gtCategories = params.Categories
+		}
+		if len(predCategories) == 0 {
+			predCategories = params.Categories
+		}
+		if len(categories) == 0 {
+			categories = append(append([]string{}, gtCategories...), predCategories...)
+		}
+
+		gt := gtData.([]int)
+		pred := predData.([]int)
+		if len(gt) != len(pred) {
+			log.Printf("[evaluate_classification] warning: item %s has %d ground truth labels but %d predicted labels", gtItem.Key, len(gt), len(pred))
+		}
+		for i := 0; i < len(gt) && i < len(pred); i++ {
+			gtLabel := classLabel(gtCategories, gt[i])
+			predLabel := classLabel(predCategories, pred[i])
+			counts[[2]string{gtLabel, predLabel}]++
+			seen[gtLabel] = true
+			seen[predLabel] = true
+			total++
+			if gtLabel == predLabel {
+				correct++
+			}
+		}
+	}
+
+	labels := orderLabels(categories, seen)
+	summary = NewTable("category", "precision:float64", "recall:float64", "f1:float64", "gt:int", "predicted:int")
+	perClass := NewTable()
+	precision, recall, f1 := addClassMetrics(perClass, counts, labels)
+	// with one label per example, micro-averaged precision, recall, and F1 are all equal to the accuracy
+	accuracy := safeDiv(correct, total)
+	summary.Add("(all)", accuracy, accuracy, accuracy, total, total)
+	summary.Add("(macro)", precision, recall, f1, total, total)
+	summary.Rows = append(summary.Rows, perClass.Rows...)
+
+	return summary, confusionTable(counts, labels), nil
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "evaluate_classification",
+			Name: "Evaluate Classification",
+			Description: "Compute accuracy, per-class precision/recall/F1, and confusion matrix of predicted class labels against ground truth",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.IntType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.IntType}},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "summary", DataType: skyhook.TableType},
+			{Name: "confusion", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask(OutputKey),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params ClassificationParams
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				summary, confusion, err := evaluateClassification(task.Items["ground_truth"][0], task.Items["predicted"][0], params)
+				if err != nil {
+					return err
+				}
+				if err := summary.Write(url, node.OutputDatasets["summary"]); err != nil {
+					return err
+				}
+				return confusion.Write(url, node.OutputDatasets["confusion"])
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
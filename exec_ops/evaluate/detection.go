@@ -0,0 +1,381 @@
+package evaluate
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"log"
+	"math"
+	"sort"
+)
+
+// Evaluate predicted detections against ground truth detections.
+// Items are matched by key and frame. Keys that only appear in the predictions are ignored.
+// We compute COCO-style AP averaged over IOU thresholds, along with precision/recall,
+// a confusion matrix, and a per-key breakdown of errors at a single IOU threshold.
+
+type DetectionParams struct {
+	// IOU thresholds to average AP over, defaults to 0.5:0.05:0.95 like COCO.
+	IOUThresholds []float64
+	// IOU threshold for precision/recall, the PR curve, the confusion matrix, and the errors.
+	IOU float64
+	// Predictions with lower score are ignored for precision/recall, the confusion matrix, and the errors.
+	// AP always uses all predictions.
+	MinScore float64
+}
+
+func (params DetectionParams) GetIOUThresholds() []float64 {
+	if len(params.IOUThresholds) > 0 {
+		return params.IOUThresholds
+	}
+	var thresholds []float64
+	for i := 0; i < 10; i++ {
+		thresholds = append(thresholds, 0.5 + float64(i)*0.05)
+	}
+	return thresholds
+}
+
+func (params DetectionParams) GetIOU() float64 {
+	if params.IOU == 0 {
+		return 0.5
+	}
+	return params.IOU
+}
+
+// Minimum IOU between a false positive and a ground truth object of the same category for
+// us to consider it a localization error rather than a background error.
+const localizationIOU = 0.1
+
+// Label used for unmatched objects in the confusion matrix.
+const backgroundLabel = "(background)"
+
+type detectionFrame struct {
+	Key string
+	GT []skyhook.Detection
+	Pred []skyhook.Detection
+}
+
+// Load the frames of corresponding ground truth and predicted items.
+// Predictions are rescaled to the ground truth canvas if needed.
+func loadDetectionFrames(gtItems []skyhook.Item, predItems []skyhook.Item) ([]detectionFrame, error) {
+	predByKey := make(map[string]skyhook.Item)
+	for _, item := range predItems {
+		predByKey[item.Key] = item
+	}
+
+	var frames []detectionFrame
+	for _, gtItem := range gtItems {
+		gtData, gtMetadata, err := gtItem.LoadData()
+		if err != nil {
+			return nil, fmt.Errorf("error loading ground truth %s: %v", gtItem.Key, err)
+		}
+		gtDetections := gtData.([][]skyhook.Detection)
+		gtDims := gtMetadata.(skyhook.DetectionMetadata).CanvasDims
+
+		var predDetections [][]skyhook.Detection
+		if predItem, ok := predByKey[gtItem.Key]; ok {
+			predData, predMetadata, err := predItem.LoadData()
+			if err != nil {
+				return nil, fmt.Errorf("error loading prediction %s: %v", predItem.Key, err)
+			}
+			predDetections = predData.([][]skyhook.Detection)
+			predDims := predMetadata.(skyhook.DetectionMetadata).CanvasDims
+			if gtDims[0] > 0 && predDims[0] > 0 && gtDims != predDims {
+				for i := range predDetections {
+					for j := range predDetections[i] {
+						predDetections[i][j] = predDetections[i][j].Rescale(predDims, gtDims)
+					}
+				}
+			}
+			if len(predDetections) != len(gtDetections) {
+				log.Printf("[evaluate] warning: item %s has %d ground truth frames but %d predicted frames", gtItem.Key, len(gtDetections), len(predDetections))
+			}
+		} else {
+			log.Printf("[evaluate] warning: no prediction for item %s", gtItem.Key)
+		}
+
+		for frameIdx, gt := range gtDetections {
+			frame := detectionFrame{Key: gtItem.Key, GT: gt}
+			if frameIdx < len(predDetections) {
+				frame.Pred = predDetections[frameIdx]
+			}
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
+
+func filterCategory(detections []skyhook.Detection, category string) []skyhook.Detection {
+	var filtered []skyhook.Detection
+	for _, d := range detections {
+		if d.Category == category {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+func filterScore(detections []skyhook.Detection, minScore float64) []skyhook.Detection {
+	if minScore <= 0 {
+		return detections
+	}
+	var filtered []skyhook.Detection
+	for _, d := range detections {
+		if d.Score >= minScore {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// Compute AP of one category at one IOU threshold.
+func categoryAP(frames []detectionFrame, category string, threshold float64) (float64, []float64) {
+	var matches []ScoredMatch
+	numGT := 0
+	for _, frame := range frames {
+		gt := filterCategory(frame.GT, category)
+		pred := filterCategory(frame.Pred, category)
+		numGT += len(gt)
+		for predIdx, gtIdx := range skyhook.MatchDetections(gt, pred, threshold, false) {
+			matches = append(matches, ScoredMatch{
+				Score: pred[predIdx].Score,
+				Correct: gtIdx >= 0,
+			})
+		}
+	}
+	return AveragePrecision(matches, numGT)
+}
+
+// Counts of errors at the primary IOU threshold.
+type detectionErrors struct {
+	GT int
+	Predicted int
+	TP int
+	FN int
+	// False positives, broken down by cause.
+	Mislabeled int
+	Localization int
+	Duplicate int
+	Background int
+}
+
+func (e detectionErrors) FP() int {
+	return e.Mislabeled + e.Localization + e.Duplicate + e.Background
+}
+
+func (e *detectionErrors) Add(other detectionErrors) {
+	e.GT += other.GT
+	e.Predicted += other.Predicted
+	e.TP += other.TP
+	e.FN += other.FN
+	e.Mislabeled += other.Mislabeled
+	e.Localization += other.Localization
+	e.Duplicate += other.Duplicate
+	e.Background += other.Background
+}
+
+// Classify the errors in one frame.
+func frameErrors(gt []skyhook.Detection, pred []skyhook.Detection, threshold float64) detectionErrors {
+	errors := detectionErrors{
+		GT: len(gt),
+		Predicted: len(pred),
+	}
+	matches := skyhook.MatchDetections(gt, pred, threshold, true)
+	gtMatched := make([]bool, len(gt))
+	for _, gtIdx := range matches {
+		if gtIdx >= 0 {
+			errors.TP++
+			gtMatched[gtIdx] = true
+		}
+	}
+	errors.FN = len(gt) - errors.TP
+
+	for predIdx, gtIdx := range matches {
+		if gtIdx >= 0 {
+			continue
+		}
+		p := pred[predIdx]
+		var mislabeled, duplicate, localization bool
+		for i, g := range gt {
+			iou := p.IOU(g)
+			if g.Category != p.Category {
+				mislabeled = mislabeled || iou >= threshold
+			} else if iou >= threshold && gtMatched[i] {
+				duplicate = true
+			} else if iou >= localizationIOU {
+				localization = true
+			}
+		}
+		if mislabeled {
+			errors.Mislabeled++
+		} else if duplicate {
+			errors.Duplicate++
+		} else if localization {
+			errors.Localization++
+		} else {
+			errors.Background++
+		}
+	}
+	return errors
+}
+
+func evaluateDetections(frames []detectionFrame, params DetectionParams) (summary *Table, prCurve *Table, confusion *Table, errorTable *Table) {
+	iouThreshold := params.GetIOU()
+
+	categorySet := make(map[string]bool)
+	for _, frame := range frames {
+		for _, d := range frame.GT {
+			categorySet[d.Category] = true
+		}
+		for _, d := range frame.Pred {
+			categorySet[d.Category] = true
+		}
+	}
+	categories := sortedKeys(categorySet)
+
+	// AP for each category, and the PR curve at the primary threshold
+	summary = NewTable("category", "ap:float64", "ap50:float64", "ap75:float64", "precision:float64", "recall:float64", "gt:int", "predicted:int")
+	prCurve = NewTable("category", "recall:float64", "precision:float64")
+	type categoryResult struct {
+		AP float64
+		AP50 float64
+		AP75 float64
+		Errors detectionErrors
+	}
+	results := make(map[string]categoryResult)
+	var aps, ap50s, ap75s []float64
+	for _, category := range categories {
+		var result categoryResult
+		var thresholdAPs []float64
+		for _, threshold := range params.GetIOUThresholds() {
+			ap, _ := categoryAP(frames, category, threshold)
+			thresholdAPs = append(thresholdAPs, ap)
+		}
+		result.AP = validMean(thresholdAPs)
+		result.AP50, _ = categoryAP(frames, category, 0.5)
+		result.AP75, _ = categoryAP(frames, category, 0.75)
+		_, curve := categoryAP(frames, category, iouThreshold)
+		for i, precision := range curve {
+			prCurve.Add(category, float64(i)/float64(RecallPoints-1), precision)
+		}
+		for _, frame := range frames {
+			result.Errors.Add(frameErrors(filterCategory(frame.GT, category), filterScore(filterCategory(frame.Pred, category), params.MinScore), iouThreshold))
+		}
+		results[category] = result
+		aps = append(aps, result.AP)
+		ap50s = append(ap50s, result.AP50)
+		ap75s = append(ap75s, result.AP75)
+	}
+
+	// errors for each key, considering all categories together
+	errorsByKey := make(map[string]*detectionErrors)
+	var keys []string
+	var total detectionErrors
+	for _, frame := range frames {
+		if errorsByKey[frame.Key] == nil {
+			errorsByKey[frame.Key] = &detectionErrors{}
+			keys = append(keys, frame.Key)
+		}
+		cur := frameErrors(frame.GT, filterScore(frame.Pred, params.MinScore), iouThreshold)
+		errorsByKey[frame.Key].Add(cur)
+		total.Add(cur)
+	}
+
+	summary.Add("(all)", validMean(aps), validMean(ap50s), validMean(ap75s), safeDiv(total.TP, total.Predicted), safeDiv(total.TP, total.GT), total.GT, total.Predicted)
+	for _, category := range categories {
+		result := results[category]
+		summary.Add(category, result.AP, result.AP50, result.AP75, safeDiv(result.Errors.TP, result.Errors.Predicted), safeDiv(result.Errors.TP, result.Errors.GT), result.Errors.GT, result.Errors.Predicted)
+	}
+
+	// confusion matrix from class-agnostic matching
+	confusionCounts := make(map[[2]string]int)
+	for _, frame := range frames {
+		pred := filterScore(frame.Pred, params.MinScore)
+		matches := skyhook.MatchDetections(frame.GT, pred, iouThreshold, false)
+		gtMatched := make([]bool, len(frame.GT))
+		for predIdx, gtIdx := range matches {
+			if gtIdx >= 0 {
+				gtMatched[gtIdx] = true
+				confusionCounts[[2]string{frame.GT[gtIdx].Category, pred[predIdx].Category}]++
+			} else {
+				confusionCounts[[2]string{backgroundLabel, pred[predIdx].Category}]++
+			}
+		}
+		for gtIdx, matched := range gtMatched {
+			if !matched {
+				confusionCounts[[2]string{frame.GT[gtIdx].Category, backgroundLabel}]++
+			}
+		}
+	}
+	confusion = confusionTable(confusionCounts, append(append([]string{}, categories...), backgroundLabel))
+
+	// per-key errors, with the keys with most errors first
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := errorsByKey[keys[i]], errorsByKey[keys[j]]
+		return a.FP()+a.FN > b.FP()+b.FN
+	})
+	errorTable = NewTable("key", "gt:int", "predicted:int", "tp:int", "fp:int", "fn:int", "mislabeled:int", "localization:int", "duplicate:int", "background:int")
+	for _, key := range keys {
+		e := errorsByKey[key]
+		errorTable.Add(key, e.GT, e.Predicted, e.TP, e.FP(), e.FN, e.Mislabeled, e.Localization, e.Duplicate, e.Background)
+	}
+
+	return summary, prCurve, confusion, errorTable
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "evaluate_detection",
+			Name: "Evaluate Detection",
+			Description: "Compute mAP, precision/recall, and errors of predicted detections against ground truth",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "summary", DataType: skyhook.TableType},
+			{Name: "pr_curve", DataType: skyhook.TableType},
+			{Name: "confusion", DataType: skyhook.TableType},
+			{Name: "errors", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask(OutputKey),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params DetectionParams
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			for _, threshold := range append(params.GetIOUThresholds(), params.GetIOU()) {
+				if threshold <= 0 || threshold > 1 || math.IsNaN(threshold) {
+					return nil, fmt.Errorf("IOU thresholds must be between 0 and 1")
+				}
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				frames, err := loadDetectionFrames(task.Items["ground_truth"][0], task.Items["predicted"][0])
+				if err != nil {
+					return err
+				}
+				summary, prCurve, confusion, errorTable := evaluateDetections(frames, params)
+				outputs := map[string]*Table{
+					"summary": summary,
+					"pr_curve": prCurve,
+					"confusion": confusion,
+					"errors": errorTable,
+				}
+				for name, table := range outputs {
+					if err := table.Write(url, node.OutputDatasets[name]); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -0,0 +1,256 @@
+package evaluate
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+)
+
+// Evaluate predicted segmentation masks against ground truth masks (Array).
+// Integer arrays are interpreted as class IDs in the first channel (like the output of
+// segmentation_mask), while floating point arrays are interpreted as per-class scores,
+// so each pixel is labeled with the class of highest score.
+
+type SegmentationParams struct {
+	// Names of the class IDs, where class 0 is typically the background.
+	// Classes without a name are labeled by their ID.
+	Categories []string
+	// Ground truth class IDs to ignore, e.g. unlabeled pixels.
+	Ignore []int
+}
+
+// Returns the class ID of each pixel in a frame of an Array.
+func arrayClasses(buf []byte, metadata skyhook.ArrayMetadata) ([]int, error) {
+	channels := metadata.Channels
+	if channels == 0 {
+		channels = 1
+	}
+	var size int
+	var isFloat bool
+	switch metadata.Type {
+	case "uint8", "int8":
+		size = 1
+	case "uint16", "int16":
+		size = 2
+	case "uint32", "int32":
+		size = 4
+	case "uint64", "int64":
+		size = 8
+	case "float32":
+		size, isFloat = 4, true
+	case "float64":
+		size, isFloat = 8, true
+	default:
+		return nil, fmt.Errorf("unsupported array type %s", metadata.Type)
+	}
+	numPixels := metadata.Width*metadata.Height
+	if len(buf) != numPixels*channels*size {
+		return nil, fmt.Errorf("expected %d bytes per frame but got %d", numPixels*channels*size, len(buf))
+	}
+
+	// arrays are stored big-endian with the channel as the last dimension
+	getValue := func(offset int) float64 {
+		b := buf[offset:offset+size]
+		switch metadata.Type {
+		case "uint8":
+			return float64(b[0])
+		case "int8":
+			return float64(int8(b[0]))
+		case "uint16":
+			return float64(binary.BigEndian.Uint16(b))
+		case "int16":
+			return float64(int16(binary.BigEndian.Uint16(b)))
+		case "uint32":
+			return float64(binary.BigEndian.Uint32(b))
+		case "int32":
+			return float64(int32(binary.BigEndian.Uint32(b)))
+		case "uint64":
+			return float64(binary.BigEndian.Uint64(b))
+		case "int64":
+			return float64(int64(binary.BigEndian.Uint64(b)))
+		case "float32":
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		default:
+			return math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+	}
+
+	classes := make([]int, numPixels)
+	for i := range classes {
+		offset := i*channels*size
+		if !isFloat {
+			classes[i] = int(getValue(offset))
+			continue
+		}
+		best := 0
+		bestScore := getValue(offset)
+		for c := 1; c < channels; c++ {
+			if score := getValue(offset+c*size); score > bestScore {
+				best = c
+				bestScore = score
+			}
+		}
+		classes[i] = best
+	}
+	return classes, nil
+}
+
+// Resize class IDs with nearest neighbor interpolation.
+func resizeClasses(classes []int, dims [2]int, newDims [2]int) []int {
+	if dims == newDims {
+		return classes
+	}
+	resized := make([]int, newDims[0]*newDims[1])
+	for y := 0; y < newDims[1]; y++ {
+		for x := 0; x < newDims[0]; x++ {
+			resized[y*newDims[0]+x] = classes[(y*dims[1]/newDims[1])*dims[0] + x*dims[0]/newDims[0]]
+		}
+	}
+	return resized
+}
+
+func evaluateSegmentation(gtItems []skyhook.Item, predItems []skyhook.Item, params SegmentationParams) (summary *Table, confusion *Table, err error) {
+	predByKey := make(map[string]skyhook.Item)
+	for _, item := range predItems {
+		predByKey[item.Key] = item
+	}
+	ignore := make(map[int]bool)
+	for _, cls := range params.Ignore {
+		ignore[cls] = true
+	}
+
+	// we count pixels by class ID, and only convert to labels at the end
+	counts := make(map[[2]int]int)
+	seen := make(map[int]bool)
+	for _, gtItem := range gtItems {
+		predItem, ok := predByKey[gtItem.Key]
+		if !ok {
+			log.Printf("[evaluate_segmentation] warning: no prediction for item %s", gtItem.Key)
+			continue
+		}
+		gtMetadata := gtItem.DecodeMetadata().(skyhook.ArrayMetadata)
+		predMetadata := predItem.DecodeMetadata().(skyhook.ArrayMetadata)
+		gtDims := [2]int{gtMetadata.Width, gtMetadata.Height}
+		predDims := [2]int{predMetadata.Width, predMetadata.Height}
+
+		err := skyhook.PerFrame([]skyhook.Item{gtItem, predItem}, func(pos int, datas []interface{}) error {
+			gt, err := arrayClasses(datas[0].([][]byte)[0], gtMetadata)
+			if err != nil {
+				return fmt.Errorf("error decoding ground truth %s: %v", gtItem.Key, err)
+			}
+			pred, err := arrayClasses(datas[1].([][]byte)[0], predMetadata)
+			if err != nil {
+				return fmt.Errorf("error decoding prediction %s: %v", predItem.Key, err)
+			}
+			pred = resizeClasses(pred, predDims, gtDims)
+			for i := range gt {
+				if ignore[gt[i]] {
+					continue
+				}
+				counts[[2]int{gt[i], pred[i]}]++
+				seen[gt[i]] = true
+				seen[pred[i]] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// order labels by class ID
+	maxClass := len(params.Categories)-1
+	for cls := range seen {
+		if cls > maxClass {
+			maxClass = cls
+		}
+	}
+	var classes []int
+	for cls := 0; cls <= maxClass; cls++ {
+		if cls < len(params.Categories) || seen[cls] {
+			classes = append(classes, cls)
+		}
+	}
+
+	gtTotals := make(map[int]int)
+	predTotals := make(map[int]int)
+	total, correct := 0, 0
+	pairCounts := make(map[[2]string]int)
+	var labels []string
+	for pair, count := range counts {
+		gtTotals[pair[0]] += count
+		predTotals[pair[1]] += count
+		total += count
+		if pair[0] == pair[1] {
+			correct += count
+		}
+		pairCounts[[2]string{classLabel(params.Categories, pair[0]), classLabel(params.Categories, pair[1])}] += count
+	}
+
+	summary = NewTable("category", "iou:float64", "precision:float64", "recall:float64", "gt:int", "predicted:int")
+	perClass := NewTable()
+	var ious []float64
+	for _, cls := range classes {
+		label := classLabel(params.Categories, cls)
+		labels = append(labels, label)
+		tp := counts[[2]int{cls, cls}]
+		union := gtTotals[cls] + predTotals[cls] - tp
+		iou := -1.0
+		// classes that appear in neither the ground truth nor the predictions don't count towards mIoU
+		if union > 0 {
+			iou = safeDiv(tp, union)
+			ious = append(ious, iou)
+		}
+		perClass.Add(label, iou, safeDiv(tp, predTotals[cls]), safeDiv(tp, gtTotals[cls]), gtTotals[cls], predTotals[cls])
+	}
+	// for the overall row, the iou is the mIoU while precision and recall are the pixel accuracy
+	accuracy := safeDiv(correct, total)
+	summary.Add("(all)", validMean(ious), accuracy, accuracy, total, total)
+	summary.Rows = append(summary.Rows, perClass.Rows...)
+
+	return summary, confusionTable(pairCounts, labels), nil
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "evaluate_segmentation",
+			Name: "Evaluate Segmentation",
+			Description: "Compute per-class IoU and mIoU of predicted segmentation masks against ground truth",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.ArrayType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.ArrayType}},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "summary", DataType: skyhook.TableType},
+			{Name: "confusion", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask(OutputKey),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params SegmentationParams
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				summary, confusion, err := evaluateSegmentation(task.Items["ground_truth"][0], task.Items["predicted"][0], params)
+				if err != nil {
+					return err
+				}
+				if err := summary.Write(url, node.OutputDatasets["summary"]); err != nil {
+					return err
+				}
+				return confusion.Write(url, node.OutputDatasets["confusion"])
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
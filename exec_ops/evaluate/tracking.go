@@ -0,0 +1,433 @@
+package evaluate
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"math"
+)
+
+// Evaluate predicted tracks against ground truth tracks.
+// Each item is a video, and detections are associated across frames by their TrackID.
+// We compute the CLEAR MOT metrics (MOTA, MOTP, ID switches, fragmentations),
+// the identity metrics (IDF1), and HOTA, following the definitions in TrackEval.
+
+type TrackingParams struct {
+	// IOU threshold for the CLEAR MOT and identity metrics.
+	// HOTA is always averaged over thresholds 0.05:0.05:0.95.
+	IOU float64
+}
+
+func (params TrackingParams) GetIOU() float64 {
+	if params.IOU == 0 {
+		return 0.5
+	}
+	return params.IOU
+}
+
+// Returns the HOTA localization thresholds.
+func hotaThresholds() []float64 {
+	var thresholds []float64
+	for i := 1; i < 20; i++ {
+		thresholds = append(thresholds, float64(i)*0.05)
+	}
+	return thresholds
+}
+
+// Bonus added to matching scores to keep matches from the previous frame.
+const continuationBonus = 1000
+
+// Counts from which the tracking metrics are computed.
+// Counts from different videos can be summed to get overall metrics.
+type trackingCounts struct {
+	GT int
+	Predicted int
+
+	// CLEAR MOT
+	TP int
+	IDSW int
+	Frag int
+	IOUSum float64
+
+	// identity
+	IDTP int
+
+	// HOTA, at each threshold
+	HotaTP []int
+	// Sum of AssA weighted by HotaTP.
+	AssSum []float64
+	LocSum []float64
+}
+
+func newTrackingCounts() *trackingCounts {
+	n := len(hotaThresholds())
+	return &trackingCounts{
+		HotaTP: make([]int, n),
+		AssSum: make([]float64, n),
+		LocSum: make([]float64, n),
+	}
+}
+
+func (c *trackingCounts) Add(other *trackingCounts) {
+	c.GT += other.GT
+	c.Predicted += other.Predicted
+	c.TP += other.TP
+	c.IDSW += other.IDSW
+	c.Frag += other.Frag
+	c.IOUSum += other.IOUSum
+	c.IDTP += other.IDTP
+	for i := range c.HotaTP {
+		c.HotaTP[i] += other.HotaTP[i]
+		c.AssSum[i] += other.AssSum[i]
+		c.LocSum[i] += other.LocSum[i]
+	}
+}
+
+// Returns HOTA, DetA, AssA, and LocA at each threshold.
+func (c *trackingCounts) Hota() (hota []float64, deta []float64, assa []float64, loca []float64) {
+	for i, tp := range c.HotaTP {
+		fn := c.GT - tp
+		fp := c.Predicted - tp
+		curDet := safeDiv(tp, tp+fn+fp)
+		curAss := 0.0
+		curLoc := 0.0
+		if tp > 0 {
+			curAss = c.AssSum[i] / float64(tp)
+			curLoc = c.LocSum[i] / float64(tp)
+		}
+		hota = append(hota, math.Sqrt(curDet*curAss))
+		deta = append(deta, curDet)
+		assa = append(assa, curAss)
+		loca = append(loca, curLoc)
+	}
+	return
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, x := range values {
+		sum += x
+	}
+	return sum / float64(len(values))
+}
+
+// Add a summary row for these counts.
+func (c *trackingCounts) AddRow(t *Table, key string) {
+	fp := c.Predicted - c.TP
+	fn := c.GT - c.TP
+	mota := 0.0
+	if c.GT > 0 {
+		mota = 1 - float64(fn+fp+c.IDSW)/float64(c.GT)
+	}
+	motp := 0.0
+	if c.TP > 0 {
+		motp = c.IOUSum / float64(c.TP)
+	}
+	hota, deta, assa, _ := c.Hota()
+	t.Add(
+		key, mota, motp,
+		safeDiv(2*c.IDTP, c.GT+c.Predicted), safeDiv(c.IDTP, c.Predicted), safeDiv(c.IDTP, c.GT),
+		mean(hota), mean(deta), mean(assa),
+		c.IDSW, c.Frag, c.TP, fp, fn, c.GT, c.Predicted,
+	)
+}
+
+// Returns the track ID of each detection in each frame.
+// Detections without a track ID each get their own (negative) ID.
+func getTrackIDs(frames [][]skyhook.Detection) [][]int {
+	ids := make([][]int, len(frames))
+	nextUntracked := -1
+	for frameIdx, dlist := range frames {
+		ids[frameIdx] = make([]int, len(dlist))
+		for i, d := range dlist {
+			if d.TrackID > 0 {
+				ids[frameIdx][i] = d.TrackID
+			} else {
+				ids[frameIdx][i] = nextUntracked
+				nextUntracked--
+			}
+		}
+	}
+	return ids
+}
+
+func iouMatrix(gt []skyhook.Detection, pred []skyhook.Detection) [][]float64 {
+	matrix := make([][]float64, len(gt))
+	for i := range gt {
+		matrix[i] = make([]float64, len(pred))
+		for j := range pred {
+			matrix[i][j] = gt[i].IOU(pred[j])
+		}
+	}
+	return matrix
+}
+
+// Compute the tracking counts of one video.
+func evaluateVideo(gt [][]skyhook.Detection, pred [][]skyhook.Detection, threshold float64) *trackingCounts {
+	c := newTrackingCounts()
+	gtIDs := getTrackIDs(gt)
+	predIDs := getTrackIDs(pred)
+	similarities := make([][][]float64, len(gt))
+	for frameIdx := range gt {
+		similarities[frameIdx] = iouMatrix(gt[frameIdx], pred[frameIdx])
+		c.GT += len(gt[frameIdx])
+		c.Predicted += len(pred[frameIdx])
+	}
+
+	// CLEAR MOT
+	// In each frame, we prefer to keep matches from the previous frame, and otherwise
+	// maximize the total IOU. Each change in the matched prediction of a ground truth
+	// track is an ID switch, and each time the track is matched again after being
+	// unmatched is a fragmentation.
+	prevFrameMatch := make(map[int]int)
+	lastMatch := make(map[int]int)
+	wasTracked := make(map[int]bool)
+	everTracked := make(map[int]bool)
+	for frameIdx, similarity := range similarities {
+		scores := make([][]float64, len(similarity))
+		for i := range similarity {
+			scores[i] = make([]float64, len(similarity[i]))
+			for j, iou := range similarity[i] {
+				if iou < threshold {
+					continue
+				}
+				scores[i][j] = -iou
+				if prev, ok := prevFrameMatch[gtIDs[frameIdx][i]]; ok && prev == predIDs[frameIdx][j] {
+					scores[i][j] -= continuationBonus
+				}
+			}
+		}
+		curFrameMatch := make(map[int]int)
+		for i, j := range skyhook.Hungarian(scores) {
+			gtID := gtIDs[frameIdx][i]
+			if j == -1 || similarity[i][j] < threshold {
+				wasTracked[gtID] = false
+				continue
+			}
+			predID := predIDs[frameIdx][j]
+			c.TP++
+			c.IOUSum += similarity[i][j]
+			if last, ok := lastMatch[gtID]; ok && last != predID {
+				c.IDSW++
+			}
+			if everTracked[gtID] && !wasTracked[gtID] {
+				c.Frag++
+			}
+			curFrameMatch[gtID] = predID
+			lastMatch[gtID] = predID
+			wasTracked[gtID] = true
+			everTracked[gtID] = true
+		}
+		prevFrameMatch = curFrameMatch
+	}
+
+	// identity metrics
+	// We find the one-to-one assignment between ground truth and predicted tracks that
+	// maximizes the number of frames where they match.
+	gtIndex := make(map[int]int)
+	predIndex := make(map[int]int)
+	for frameIdx := range gt {
+		for _, id := range gtIDs[frameIdx] {
+			if _, ok := gtIndex[id]; !ok {
+				gtIndex[id] = len(gtIndex)
+			}
+		}
+		for _, id := range predIDs[frameIdx] {
+			if _, ok := predIndex[id]; !ok {
+				predIndex[id] = len(predIndex)
+			}
+		}
+	}
+	newMatrix := func() [][]float64 {
+		matrix := make([][]float64, len(gtIndex))
+		for i := range matrix {
+			matrix[i] = make([]float64, len(predIndex))
+		}
+		return matrix
+	}
+	idMatches := newMatrix()
+	for frameIdx, similarity := range similarities {
+		for i := range similarity {
+			for j, iou := range similarity[i] {
+				if iou >= threshold {
+					idMatches[gtIndex[gtIDs[frameIdx][i]]][predIndex[predIDs[frameIdx][j]]]--
+				}
+			}
+		}
+	}
+	for i, j := range skyhook.Hungarian(idMatches) {
+		if j >= 0 {
+			c.IDTP += int(-idMatches[i][j])
+		}
+	}
+
+	// HOTA
+	// First we compute the global alignment score between each pair of tracks, which
+	// we use to weight the matching in each frame.
+	gtCounts := make([]float64, len(gtIndex))
+	predCounts := make([]float64, len(predIndex))
+	potentialMatches := newMatrix()
+	for frameIdx, similarity := range similarities {
+		for _, id := range gtIDs[frameIdx] {
+			gtCounts[gtIndex[id]]++
+		}
+		for _, id := range predIDs[frameIdx] {
+			predCounts[predIndex[id]]++
+		}
+		rowSums := make([]float64, len(gt[frameIdx]))
+		colSums := make([]float64, len(pred[frameIdx]))
+		for i := range similarity {
+			for j, iou := range similarity[i] {
+				rowSums[i] += iou
+				colSums[j] += iou
+			}
+		}
+		for i := range similarity {
+			for j, iou := range similarity[i] {
+				denom := rowSums[i] + colSums[j] - iou
+				if denom > 0 {
+					potentialMatches[gtIndex[gtIDs[frameIdx][i]]][predIndex[predIDs[frameIdx][j]]] += iou / denom
+				}
+			}
+		}
+	}
+	alignment := newMatrix()
+	for i := range alignment {
+		for j := range alignment[i] {
+			alignment[i][j] = potentialMatches[i][j] / (gtCounts[i] + predCounts[j] - potentialMatches[i][j])
+		}
+	}
+
+	thresholds := hotaThresholds()
+	matchCounts := make([][][]float64, len(thresholds))
+	for a := range thresholds {
+		matchCounts[a] = newMatrix()
+	}
+	for frameIdx, similarity := range similarities {
+		scores := make([][]float64, len(similarity))
+		for i := range similarity {
+			scores[i] = make([]float64, len(similarity[i]))
+			for j, iou := range similarity[i] {
+				scores[i][j] = -alignment[gtIndex[gtIDs[frameIdx][i]]][predIndex[predIDs[frameIdx][j]]] * iou
+			}
+		}
+		for i, j := range skyhook.Hungarian(scores) {
+			if j == -1 {
+				continue
+			}
+			gtIdx := gtIndex[gtIDs[frameIdx][i]]
+			predIdx := predIndex[predIDs[frameIdx][j]]
+			for a, alpha := range thresholds {
+				if similarity[i][j] < alpha-1e-9 {
+					continue
+				}
+				c.HotaTP[a]++
+				c.LocSum[a] += similarity[i][j]
+				matchCounts[a][gtIdx][predIdx]++
+			}
+		}
+	}
+	for a := range thresholds {
+		for i := range matchCounts[a] {
+			for j, count := range matchCounts[a][i] {
+				if count == 0 {
+					continue
+				}
+				c.AssSum[a] += count * count / (gtCounts[i] + predCounts[j] - count)
+			}
+		}
+	}
+
+	return c
+}
+
+func evaluateTracking(gtItems []skyhook.Item, predItems []skyhook.Item, params TrackingParams) (summary *Table, hota *Table, err error) {
+	frames, err := loadDetectionFrames(gtItems, predItems)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// group the frames by video
+	var keys []string
+	gtByKey := make(map[string][][]skyhook.Detection)
+	predByKey := make(map[string][][]skyhook.Detection)
+	for _, frame := range frames {
+		if _, ok := gtByKey[frame.Key]; !ok {
+			keys = append(keys, frame.Key)
+		}
+		gtByKey[frame.Key] = append(gtByKey[frame.Key], frame.GT)
+		predByKey[frame.Key] = append(predByKey[frame.Key], frame.Pred)
+	}
+
+	columns := []string{
+		"key", "mota:float64", "motp:float64",
+		"idf1:float64", "idp:float64", "idr:float64",
+		"hota:float64", "deta:float64", "assa:float64",
+		"idsw:int", "frag:int", "tp:int", "fp:int", "fn:int", "gt:int", "predicted:int",
+	}
+	perVideo := NewTable(columns...)
+	total := newTrackingCounts()
+	for _, key := range keys {
+		c := evaluateVideo(gtByKey[key], predByKey[key], params.GetIOU())
+		c.AddRow(perVideo, key)
+		total.Add(c)
+	}
+	summary = NewTable(columns...)
+	total.AddRow(summary, "(all)")
+	summary.Rows = append(summary.Rows, perVideo.Rows...)
+
+	hota = NewTable("alpha:float64", "hota:float64", "deta:float64", "assa:float64", "loca:float64")
+	hotas, detas, assas, locas := total.Hota()
+	for a, alpha := range hotaThresholds() {
+		hota.Add(alpha, hotas[a], detas[a], assas[a], locas[a])
+	}
+
+	return summary, hota, nil
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "evaluate_tracking",
+			Name: "Evaluate Tracking",
+			Description: "Compute MOTA, MOTP, IDF1, and HOTA of predicted tracks against ground truth",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "predicted", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "ground_truth", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "summary", DataType: skyhook.TableType},
+			{Name: "hota", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SingleTask(OutputKey),
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params TrackingParams
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if params.GetIOU() < 0 || params.GetIOU() > 1 {
+				return nil, fmt.Errorf("IOU threshold must be between 0 and 1")
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				summary, hota, err := evaluateTracking(task.Items["ground_truth"][0], task.Items["predicted"][0], params)
+				if err != nil {
+					return err
+				}
+				if err := summary.Write(url, node.OutputDatasets["summary"]); err != nil {
+					return err
+				}
+				return hota.Write(url, node.OutputDatasets["hota"])
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -0,0 +1,175 @@
+package evaluate
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Helpers shared by the evaluation ops.
+
+// Key of the output items.
+// Each output table is written as a single item.
+const OutputKey = "evaluation"
+
+func formatFloat(x float64) string {
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+// A table being built for one of the outputs.
+type Table struct {
+	Columns []skyhook.ColumnSpec
+	Rows skyhook.TableData
+}
+
+func NewTable(columns ...string) *Table {
+	t := &Table{}
+	// columns are specified as "label:type"
+	for _, column := range columns {
+		spec := skyhook.ColumnSpec{Label: column, Type: "string"}
+		for i := len(column)-1; i >= 0; i-- {
+			if column[i] == ':' {
+				spec = skyhook.ColumnSpec{Label: column[0:i], Type: column[i+1:]}
+				break
+			}
+		}
+		t.Columns = append(t.Columns, spec)
+	}
+	return t
+}
+
+// Add a row, formatting each value according to its type.
+func (t *Table) Add(values ...interface{}) {
+	row := make([]string, len(values))
+	for i, value := range values {
+		switch x := value.(type) {
+		case string:
+			row[i] = x
+		case int:
+			row[i] = strconv.Itoa(x)
+		case float64:
+			row[i] = formatFloat(x)
+		default:
+			row[i] = fmt.Sprintf("%v", x)
+		}
+	}
+	t.Rows = append(t.Rows, row)
+}
+
+func (t *Table) Write(url string, dataset skyhook.Dataset) error {
+	if t.Rows == nil {
+		t.Rows = skyhook.TableData{}
+	}
+	return exec_ops.WriteItem(url, dataset, OutputKey, t.Rows, skyhook.TableMetadata{
+		Columns: t.Columns,
+	})
+}
+
+// Create a confusion matrix table from counts of (ground truth, predicted) label pairs.
+// Rows are ordered by the specified labels, and pairs with zero count are omitted.
+func confusionTable(counts map[[2]string]int, labels []string) *Table {
+	t := NewTable("ground_truth", "predicted", "count:int")
+	for _, gtLabel := range labels {
+		for _, predLabel := range labels {
+			if count := counts[[2]string{gtLabel, predLabel}]; count > 0 {
+				t.Add(gtLabel, predLabel, count)
+			}
+		}
+	}
+	return t
+}
+
+// Number of recall thresholds used to compute COCO-style average precision.
+const RecallPoints = 101
+
+// A prediction that was matched (or not) to a ground truth object, used to compute precision/recall.
+type ScoredMatch struct {
+	Score float64
+	Correct bool
+}
+
+// Compute COCO-style average precision from scored matches and the number of
+// ground truth objects. Returns the AP along with the interpolated precision at
+// each of the RecallPoints recall thresholds.
+// AP is -1 if there are no ground truth objects.
+func AveragePrecision(matches []ScoredMatch, numGT int) (float64, []float64) {
+	curve := make([]float64, RecallPoints)
+	if numGT == 0 {
+		return -1, curve
+	}
+	sorted := append([]ScoredMatch{}, matches...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Score > sorted[j].Score
+	})
+
+	precisions := make([]float64, len(sorted))
+	recalls := make([]float64, len(sorted))
+	tp, fp := 0, 0
+	for i, match := range sorted {
+		if match.Correct {
+			tp++
+		} else {
+			fp++
+		}
+		precisions[i] = float64(tp)/float64(tp+fp)
+		recalls[i] = float64(tp)/float64(numGT)
+	}
+	// make precision monotonically decreasing
+	for i := len(precisions)-2; i >= 0; i-- {
+		if precisions[i+1] > precisions[i] {
+			precisions[i] = precisions[i+1]
+		}
+	}
+
+	var sum float64
+	idx := 0
+	for i := range curve {
+		r := float64(i)/float64(RecallPoints-1)
+		for idx < len(recalls) && recalls[idx] < r {
+			idx++
+		}
+		if idx < len(recalls) {
+			curve[i] = precisions[idx]
+		}
+		sum += curve[i]
+	}
+	return sum/float64(RecallPoints), curve
+}
+
+// Returns the mean of the values, ignoring negative values (which indicate undefined metrics).
+// Returns -1 if there are no valid values.
+func validMean(values []float64) float64 {
+	var sum float64
+	count := 0
+	for _, x := range values {
+		if x < 0 {
+			continue
+		}
+		sum += x
+		count++
+	}
+	if count == 0 {
+		return -1
+	}
+	return sum/float64(count)
+}
+
+func safeDiv(a int, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a)/float64(b)
+}
+
+// Returns sorted keys of a set.
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,34 @@
+package evaluate
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAveragePrecision(t *testing.T) {
+	tests := []struct {
+		label string
+		matches []ScoredMatch
+		numGT int
+		expected float64
+	}{
+		{"perfect", []ScoredMatch{{0.9, true}, {0.8, true}}, 2, 1},
+		// precision is 1 up to recall 0.5 (51 recall points), then 2/3 up to recall 1 (50 points)
+		{"false positive", []ScoredMatch{{0.9, true}, {0.8, false}, {0.7, true}}, 2, (51 + 50*2.0/3) / 101},
+		// the order of the matches shouldn't matter, only their scores
+		{"unsorted", []ScoredMatch{{0.7, true}, {0.9, true}, {0.8, false}}, 2, (51 + 50*2.0/3) / 101},
+		// recall only reaches 0.25, so precision is zero after the first 26 recall points
+		{"partial recall", []ScoredMatch{{0.9, true}}, 4, 26.0 / 101},
+		{"no matches", nil, 3, 0},
+		{"no ground truth", []ScoredMatch{{0.9, false}}, 0, -1},
+	}
+	for _, test := range tests {
+		ap, curve := AveragePrecision(test.matches, test.numGT)
+		if math.Abs(ap - test.expected) > 1e-6 {
+			t.Errorf("%s: AP = %v; want %v", test.label, ap, test.expected)
+		}
+		if len(curve) != RecallPoints {
+			t.Errorf("%s: curve has %d points; want %d", test.label, len(curve), RecallPoints)
+		}
+	}
+}
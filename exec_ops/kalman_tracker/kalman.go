@@ -0,0 +1,103 @@
+package kalman_tracker
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"math"
+)
+
+// Constant-velocity Kalman filter over the box center and size.
+// Since the motion model and noise are independent across the four coordinates
+// (center x, center y, width, height), we filter each coordinate separately with a
+// two-dimensional (position, velocity) state, which is equivalent to the full filter.
+// As in DeepSORT, the noise is proportional to the box height.
+
+const stdPosition = 1.0/20
+const stdVelocity = 1.0/160
+
+type kalman1D struct {
+	X, V float64
+	// covariance of (X, V)
+	P [2][2]float64
+}
+
+// Advance the state by one frame.
+func (k *kalman1D) Predict(qPos float64, qVel float64) {
+	k.X += k.V
+	p := k.P
+	k.P[0][0] = p[0][0] + p[0][1] + p[1][0] + p[1][1] + qPos
+	k.P[0][1] = p[0][1] + p[1][1]
+	k.P[1][0] = p[1][0] + p[1][1]
+	k.P[1][1] = p[1][1] + qVel
+}
+
+// Correct the state with a measurement of the position.
+func (k *kalman1D) Update(z float64, r float64) {
+	p := k.P
+	s := p[0][0] + r
+	k0, k1 := p[0][0]/s, p[1][0]/s
+	y := z - k.X
+	k.X += k0*y
+	k.V += k1*y
+	k.P[0][0] = (1-k0)*p[0][0]
+	k.P[0][1] = (1-k0)*p[0][1]
+	k.P[1][0] = p[1][0] - k1*p[0][0]
+	k.P[1][1] = p[1][1] - k1*p[0][1]
+}
+
+type BoxFilter struct {
+	// center x, center y, width, height
+	Coords [4]kalman1D
+}
+
+func boxMeasurement(d skyhook.Detection) [4]float64 {
+	return [4]float64{
+		float64(d.Left+d.Right)/2,
+		float64(d.Top+d.Bottom)/2,
+		float64(d.Right-d.Left),
+		float64(d.Bottom-d.Top),
+	}
+}
+
+func NewBoxFilter(d skyhook.Detection) *BoxFilter {
+	z := boxMeasurement(d)
+	h := math.Max(z[3], 1)
+	f := &BoxFilter{}
+	for i := range f.Coords {
+		f.Coords[i].X = z[i]
+		f.Coords[i].P[0][0] = math.Pow(2*stdPosition*h, 2)
+		f.Coords[i].P[1][1] = math.Pow(10*stdVelocity*h, 2)
+	}
+	return f
+}
+
+func (f *BoxFilter) height() float64 {
+	return math.Max(f.Coords[3].X, 1)
+}
+
+func (f *BoxFilter) Predict() {
+	h := f.height()
+	for i := range f.Coords {
+		f.Coords[i].Predict(math.Pow(stdPosition*h, 2), math.Pow(stdVelocity*h, 2))
+	}
+}
+
+func (f *BoxFilter) Update(d skyhook.Detection) {
+	z := boxMeasurement(d)
+	r := math.Pow(stdPosition*f.height(), 2)
+	for i := range f.Coords {
+		f.Coords[i].Update(z[i], r)
+	}
+}
+
+// Returns the current estimate of the box.
+func (f *BoxFilter) Box() skyhook.Detection {
+	cx, cy := f.Coords[0].X, f.Coords[1].X
+	w, h := math.Max(f.Coords[2].X, 1), math.Max(f.Coords[3].X, 1)
+	return skyhook.Detection{
+		Left: int(math.Round(cx - w/2)),
+		Top: int(math.Round(cy - h/2)),
+		Right: int(math.Round(cx + w/2)),
+		Bottom: int(math.Round(cy + h/2)),
+	}
+}
@@ -0,0 +1,388 @@
+package kalman_tracker
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/exec_ops/reid_tracker"
+
+	"encoding/json"
+	"fmt"
+	"math"
+	"runtime"
+)
+
+// SORT-style tracker: each track has a constant-velocity Kalman filter, and in each
+// frame we assign detections to the predicted track boxes with the Hungarian algorithm.
+// Tracks are tentative until they have been matched in MinHits frames; tentative tracks
+// are removed as soon as they miss a frame, while confirmed tracks survive up to MaxAge
+// frames without matches. Only detections of confirmed tracks are output.
+
+type Params struct {
+	// "iou" (default) or "center": how to compute the cost of matching a track to a detection
+	Cost string
+	// with iou cost, the minimum IOU between the predicted track box and the detection
+	MinIOU float64
+	// with center cost, the maximum distance between the centers of the predicted
+	// track box and the detection, relative to the diagonal of the predicted box
+	MaxDistance float64
+	// number of frames a track must be matched in before it is confirmed
+	MinHits int
+	// maximum number of frames a confirmed track can go without matches
+	MaxAge int
+	// only match tracks to detections of the same category
+	MatchCategory bool
+	// use a re-identification model (like reid_tracker) to add an appearance cost
+	Appearance bool
+	// cost = spatial cost + AppearanceWeight * (1 - re-identification probability)
+	AppearanceWeight *float64
+}
+
+func (params Params) GetMinIOU() float64 {
+	if params.MinIOU == 0 {
+		return 0.3
+	}
+	return params.MinIOU
+}
+
+func (params Params) GetMaxDistance() float64 {
+	if params.MaxDistance == 0 {
+		return 1
+	}
+	return params.MaxDistance
+}
+
+func (params Params) GetMinHits() int {
+	if params.MinHits == 0 {
+		return 3
+	}
+	return params.MinHits
+}
+
+func (params Params) GetMaxAge() int {
+	if params.MaxAge == 0 {
+		return 10
+	}
+	return params.MaxAge
+}
+
+func (params Params) GetAppearanceWeight() float64 {
+	if params.AppearanceWeight == nil {
+		return 1
+	}
+	return *params.AppearanceWeight
+}
+
+func decodeParams(rawParams string) Params {
+	var params Params
+	if rawParams != "" {
+		json.Unmarshal([]byte(rawParams), &params)
+	}
+	return params
+}
+
+// Returns the cost of matching a track with the predicted box to the detection,
+// or false if the detection is too far from the track to match.
+func (params Params) SpatialCost(predicted skyhook.Detection, d skyhook.Detection) (float64, bool) {
+	if params.MatchCategory && predicted.Category != d.Category {
+		return 0, false
+	}
+	if params.Cost == "center" {
+		diagonal := math.Hypot(float64(predicted.Right-predicted.Left), float64(predicted.Bottom-predicted.Top))
+		distance := predicted.CenterDistance(d) / math.Max(diagonal, 1)
+		if distance > params.GetMaxDistance() {
+			return 0, false
+		}
+		return distance / params.GetMaxDistance(), true
+	}
+	iou := predicted.IOU(d)
+	if iou < params.GetMinIOU() {
+		return 0, false
+	}
+	return 1 - iou, true
+}
+
+type Track struct {
+	ID int
+	Filter *BoxFilter
+	Category string
+	// number of frames where the track was matched
+	Hits int
+	// number of consecutive frames since the track was last matched
+	Misses int
+	Confirmed bool
+}
+
+// Predicted box of the track in the current frame.
+func (t *Track) Predicted() skyhook.Detection {
+	box := t.Filter.Box()
+	box.Category = t.Category
+	return box
+}
+
+type State struct {
+	Params Params
+	Tracks []*Track
+	nextID int
+}
+
+func NewState(params Params) *State {
+	return &State{Params: params, nextID: 1}
+}
+
+// Process the detections in the next frame, returning the ID of the track that each
+// detection is assigned to.
+// If appearanceCost is set, it is called with the active tracks to get an additional
+// cost between each track and detection.
+func (s *State) Step(dlist []skyhook.Detection, appearanceCost func(tracks []*Track) ([][]float64, error)) ([]int, error) {
+	for _, track := range s.Tracks {
+		track.Filter.Predict()
+	}
+
+	// cost matrix with rows for tracks and columns for detections
+	// infeasible pairs get a large cost so that the assignment prefers feasible
+	// matches, and they are discarded after the assignment
+	const infeasible = 1e6
+	feasible := make([][]bool, len(s.Tracks))
+	cost := make([][]float64, len(s.Tracks))
+	for i, track := range s.Tracks {
+		feasible[i] = make([]bool, len(dlist))
+		cost[i] = make([]float64, len(dlist))
+		predicted := track.Predicted()
+		for j, d := range dlist {
+			c, ok := s.Params.SpatialCost(predicted, d)
+			feasible[i][j] = ok
+			if ok {
+				cost[i][j] = c
+			} else {
+				cost[i][j] = infeasible
+			}
+		}
+	}
+	if appearanceCost != nil && len(s.Tracks) > 0 && len(dlist) > 0 {
+		appearance, err := appearanceCost(s.Tracks)
+		if err != nil {
+			return nil, err
+		}
+		for i := range cost {
+			for j := range cost[i] {
+				if feasible[i][j] {
+					cost[i][j] += s.Params.GetAppearanceWeight() * appearance[i][j]
+				}
+			}
+		}
+	}
+
+	trackIDs := make([]int, len(dlist))
+	matched := make([]bool, len(s.Tracks))
+	for i, j := range skyhook.Hungarian(cost) {
+		if j == -1 || !feasible[i][j] {
+			continue
+		}
+		track := s.Tracks[i]
+		track.Filter.Update(dlist[j])
+		track.Hits++
+		track.Misses = 0
+		if track.Hits >= s.Params.GetMinHits() {
+			track.Confirmed = true
+		}
+		trackIDs[j] = track.ID
+		matched[i] = true
+	}
+
+	// remove tentative tracks that weren't matched, and confirmed tracks that
+	// haven't been matched in too long
+	var tracks []*Track
+	for i, track := range s.Tracks {
+		if !matched[i] {
+			track.Misses++
+			if !track.Confirmed || track.Misses > s.Params.GetMaxAge() {
+				continue
+			}
+		}
+		tracks = append(tracks, track)
+	}
+
+	// unmatched detections start new tracks
+	for j, d := range dlist {
+		if trackIDs[j] != 0 {
+			continue
+		}
+		track := &Track{
+			ID: s.nextID,
+			Filter: NewBoxFilter(d),
+			Category: d.Category,
+			Hits: 1,
+			Confirmed: s.Params.GetMinHits() <= 1,
+		}
+		s.nextID++
+		tracks = append(tracks, track)
+		trackIDs[j] = track.ID
+	}
+	s.Tracks = tracks
+	return trackIDs, nil
+}
+
+type Tracker struct {
+	URL string
+	Dataset skyhook.Dataset
+	Params Params
+	// re-identification model, only set if Params.Appearance
+	model *reid_tracker.Model
+}
+
+func (e *Tracker) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *Tracker) Apply(task skyhook.ExecTask) error {
+	detectionItem := task.Items["detections"][0][0]
+	metadata := detectionItem.DecodeMetadata()
+	items := []skyhook.Item{detectionItem}
+	if e.model != nil {
+		items = append(items, task.Items["video"][0][0])
+	}
+
+	state := NewState(e.Params)
+	// the track ID assigned to each detection, and the latest crop of each track
+	var frames [][]skyhook.Detection
+	var frameIDs [][]int
+	confirmed := make(map[int]bool)
+	crops := make(map[int]skyhook.Image)
+
+	err := skyhook.PerFrame(items, func(frameIdx int, datas []interface{}) error {
+		dlist := datas[0].([][]skyhook.Detection)[0]
+
+		var appearanceCost func(tracks []*Track) ([][]float64, error)
+		var rightImages []skyhook.Image
+		if e.model != nil {
+			im := datas[1].([]skyhook.Image)[0]
+			detectionDims := metadata.(skyhook.DetectionMetadata).CanvasDims
+			for _, d := range dlist {
+				rightImages = append(rightImages, reid_tracker.CropDetection(im, d, detectionDims))
+			}
+			appearanceCost = func(tracks []*Track) ([][]float64, error) {
+				var leftImages []skyhook.Image
+				for _, track := range tracks {
+					leftImages = append(leftImages, crops[track.ID])
+				}
+				probs, err := e.model.Match(leftImages, rightImages)
+				if err != nil {
+					return nil, err
+				}
+				for i := range probs {
+					for j := range probs[i] {
+						probs[i][j] = 1 - probs[i][j]
+					}
+				}
+				return probs, nil
+			}
+		}
+
+		ids, err := state.Step(dlist, appearanceCost)
+		if err != nil {
+			return err
+		}
+		for j, id := range ids {
+			if rightImages != nil {
+				crops[id] = rightImages[j]
+			}
+		}
+		for _, track := range state.Tracks {
+			if track.Confirmed {
+				confirmed[track.ID] = true
+			}
+		}
+		frames = append(frames, dlist)
+		frameIDs = append(frameIDs, ids)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// output the detections of confirmed tracks, numbering the tracks in order of appearance
+	outputIDs := make(map[int]int)
+	ndetections := make([][]skyhook.Detection, len(frames))
+	for frameIdx, dlist := range frames {
+		ndetections[frameIdx] = []skyhook.Detection{}
+		for j, d := range dlist {
+			id := frameIDs[frameIdx][j]
+			if !confirmed[id] {
+				continue
+			}
+			if outputIDs[id] == 0 {
+				outputIDs[id] = len(outputIDs)+1
+			}
+			d.TrackID = outputIDs[id]
+			ndetections[frameIdx] = append(ndetections[frameIdx], d)
+		}
+	}
+
+	return exec_ops.WriteItem(e.URL, e.Dataset, task.Key, ndetections, metadata)
+}
+
+func (e *Tracker) Close() {
+	if e.model != nil {
+		e.model.Close()
+	}
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "kalman_tracker",
+			Name: "Kalman Tracker",
+			Description: "SORT-style object tracker with Kalman filter motion and Hungarian assignment",
+		},
+		GetInputs: func(rawParams string) []skyhook.ExecInput {
+			inputs := []skyhook.ExecInput{{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}}}
+			if decodeParams(rawParams).Appearance {
+				inputs = append(inputs,
+					skyhook.ExecInput{Name: "model", DataTypes: []skyhook.DataType{skyhook.FileType}},
+					skyhook.ExecInput{Name: "video", DataTypes: []skyhook.DataType{skyhook.VideoType}},
+				)
+			}
+			return inputs
+		},
+		Outputs: []skyhook.ExecOutput{{Name: "tracks", DataType: skyhook.DetectionType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			// provide everything but the model to SimpleTasks
+			items := map[string][][]skyhook.Item{
+				"detections": rawItems["detections"],
+			}
+			if rawItems["video"] != nil {
+				items["video"] = rawItems["video"]
+			}
+			return exec_ops.SimpleTasks(node, items)
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			// try to decode parameters, but it's okay if it's not configured
+			// since we have default settings
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			op := &Tracker{
+				URL: url,
+				Dataset: node.OutputDatasets["tracks"],
+				Params: params,
+			}
+			if params.Appearance {
+				op.model = reid_tracker.NewModel(fmt.Sprintf("kalman_tracker-%s", node.Name), node.InputDatasets["model"][0])
+			}
+			return op, nil
+		},
+		Incremental: true,
+		GetOutputKeys: exec_ops.MapGetOutputKeys,
+		GetNeededInputs: exec_ops.MapGetNeededInputs,
+		GetImageName: func(node skyhook.Runnable) (string, error) {
+			if decodeParams(node.Params).Appearance {
+				return "skyhookml/pytorch", nil
+			}
+			return "skyhookml/basic", nil
+		},
+	})
+}
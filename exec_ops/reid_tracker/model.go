@@ -0,0 +1,106 @@
+package reid_tracker
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const MinPadding = 4
+const CropSize = 64
+
+// Crop a detection from the image, and resize and pad it to the CropSize x CropSize
+// input expected by the re-identification model.
+func CropDetection(im skyhook.Image, d skyhook.Detection, detectionDims [2]int) skyhook.Image {
+	sx := skyhook.Clip(d.Left * im.Width / detectionDims[0], 0, im.Width-MinPadding)
+	ex := skyhook.Clip(d.Right * im.Width / detectionDims[0], sx+MinPadding, im.Width)
+	sy := skyhook.Clip(d.Top * im.Height / detectionDims[1], 0, im.Height-MinPadding)
+	ey := skyhook.Clip(d.Bottom * im.Height / detectionDims[1], sy+MinPadding, im.Height)
+	crop := im.Crop(sx, sy, ex, ey)
+
+	// resize to max 64x64 side
+	factor := math.Min(CropSize/float64(crop.Width), CropSize/float64(crop.Height))
+	resizeWidth := skyhook.Clip(int(factor*float64(crop.Width)), MinPadding, CropSize)
+	resizeHeight := skyhook.Clip(int(factor*float64(crop.Height)), MinPadding, CropSize)
+	resized := crop.Resize(resizeWidth, resizeHeight)
+	fix := skyhook.NewImage(CropSize, CropSize)
+	fix.DrawImage(0, 0, resized)
+	return fix
+}
+
+// Model runs the re-identification model in a python process.
+// It is safe to call Match concurrently.
+type Model struct {
+	mu sync.Mutex
+	cmd *skyhook.Cmd
+	stdin io.WriteCloser
+	rd *bufio.Reader
+}
+
+// Start the model stored in the specified File dataset.
+func NewModel(name string, modelDataset skyhook.Dataset) *Model {
+	cmd := skyhook.Command(
+		name, skyhook.CommandOptions{},
+		"python3", "exec_ops/reid_tracker/run.py",
+		strconv.Itoa(modelDataset.ID),
+	)
+	return &Model{
+		cmd: cmd,
+		stdin: cmd.Stdin(),
+		rd: bufio.NewReader(cmd.Stdout()),
+	}
+}
+
+// Returns a matrix of the probability that each left crop (e.g. the latest detection
+// of an active track) and each right crop (a detection in the current frame) are the
+// same object.
+func (m *Model) Match(leftImages []skyhook.Image, rightImages []skyhook.Image) ([][]float64, error) {
+	m.mu.Lock()
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(leftImages)))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(rightImages)))
+	m.stdin.Write(header)
+	for _, im := range leftImages {
+		m.stdin.Write(im.Bytes)
+	}
+	for _, im := range rightImages {
+		m.stdin.Write(im.Bytes)
+	}
+
+	signature := "json"
+	var line string
+	var err error
+	for {
+		line, err = m.rd.ReadString('\n')
+		if err != nil || strings.Contains(line, signature) {
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading from reid script: %v", err)
+	}
+
+	line = strings.TrimSpace(line[len(signature):])
+	var matrix [][]float64
+	skyhook.JsonUnmarshal([]byte(line), &matrix)
+	return matrix, nil
+}
+
+func (m *Model) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stdin.Close()
+	if m.cmd != nil {
+		m.cmd.Wait()
+		m.cmd = nil
+	}
+}
@@ -5,15 +5,8 @@ import (
 	"github.com/skyhookml/skyhookml/exec_ops"
 	strack "github.com/skyhookml/skyhookml/exec_ops/simple_tracker"
 
-	"bufio"
-	"encoding/binary"
 	"fmt"
-	"io"
-	"math"
 	"runtime"
-	"strconv"
-	"strings"
-	"sync"
 )
 
 type Params struct {
@@ -30,18 +23,11 @@ func (params Params) GetWeight() float64 {
 	return *params.Weight
 }
 
-const MinPadding = 4
-const CropSize = 64
-
 type Tracker struct {
 	URL string
 	Dataset skyhook.Dataset
 	Params Params
-
-	mu sync.Mutex
-	cmd *skyhook.Cmd
-	stdin io.WriteCloser
-	rd *bufio.Reader
+	model *Model
 }
 
 func Prepare(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
@@ -52,19 +38,11 @@ func Prepare(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 		return nil, err
 	}
 
-	cmd := skyhook.Command(
-		fmt.Sprintf("reid_tracker-%s", node.Name), skyhook.CommandOptions{},
-		"python3", "exec_ops/reid_tracker/run.py",
-		strconv.Itoa(node.InputDatasets["model"][0].ID),
-	)
-
 	return &Tracker{
 		URL: url,
 		Dataset: node.OutputDatasets["tracks"],
 		Params: params,
-		cmd: cmd,
-		stdin: cmd.Stdin(),
-		rd: bufio.NewReader(cmd.Stdout()),
+		model: NewModel(fmt.Sprintf("reid_tracker-%s", node.Name), node.InputDatasets["model"][0]),
 	}, nil
 }
 
@@ -105,55 +83,16 @@ func (e *Tracker) Apply(task skyhook.ExecTask) error {
 		}
 
 		for _, d := range dlist {
-			sx := skyhook.Clip(d.Left * im.Width / detectionDims[0], 0, im.Width-MinPadding)
-			ex := skyhook.Clip(d.Right * im.Width / detectionDims[0], sx+MinPadding, im.Width)
-			sy := skyhook.Clip(d.Top * im.Height / detectionDims[1], 0, im.Height-MinPadding)
-			ey := skyhook.Clip(d.Bottom * im.Height / detectionDims[1], sy+MinPadding, im.Height)
-			crop := im.Crop(sx, sy, ex, ey)
-
-			// resize to max 64x64 side
-			factor := math.Min(CropSize/float64(crop.Width), CropSize/float64(crop.Height))
-			resizeWidth := skyhook.Clip(int(factor*float64(crop.Width)), MinPadding, CropSize)
-			resizeHeight := skyhook.Clip(int(factor*float64(crop.Height)), MinPadding, CropSize)
-			resized := crop.Resize(resizeWidth, resizeHeight)
-			fix := skyhook.NewImage(CropSize, CropSize)
-			fix.DrawImage(0, 0, resized)
-			rightImages = append(rightImages, fix)
+			rightImages = append(rightImages, CropDetection(im, d, detectionDims))
 		}
 
 		matchedDetections := make([]bool, len(dlist))
 		if len(dlist) > 0 && len(activeTracks) > 0 {
-			e.mu.Lock()
-			header := make([]byte, 8)
-			binary.BigEndian.PutUint32(header[0:4], uint32(len(activeTracks)))
-			binary.BigEndian.PutUint32(header[4:8], uint32(len(dlist)))
-			e.stdin.Write(header)
-			for _, im := range leftImages {
-				e.stdin.Write(im.Bytes)
-			}
-			for _, im := range rightImages {
-				e.stdin.Write(im.Bytes)
-			}
-
-			signature := "json"
-			var line string
-			var err error
-			for {
-				line, err = e.rd.ReadString('\n')
-				if err != nil || strings.Contains(line, signature) {
-					break
-				}
-			}
-			e.mu.Unlock()
-
+			matrix, err := e.model.Match(leftImages, rightImages)
 			if err != nil {
-				return fmt.Errorf("error reading from reid script: %v", err)
+				return err
 			}
 
-			line = strings.TrimSpace(line[len(signature):])
-			var matrix [][]float64
-			skyhook.JsonUnmarshal([]byte(line), &matrix)
-
 			// combine this with strack matrix (uses spatial bbox coordinates)
 			simpleMatrix := e.Params.Simple.ComputeScores(frameIdx, activeList, dlist)
 			for i := range matrix {
@@ -211,7 +150,9 @@ func (e *Tracker) Apply(task skyhook.ExecTask) error {
 	return exec_ops.WriteItem(e.URL, e.Dataset, task.Key, ndetections, detectionItem.DecodeMetadata())
 }
 
-func (e *Tracker) Close() {}
+func (e *Tracker) Close() {
+	e.model.Close()
+}
 
 func init() {
 	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
@@ -0,0 +1,183 @@
+package render
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Parse a "#rrggbb" color.
+func parseColor(s string) ([3]uint8, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return [3]uint8{}, fmt.Errorf("invalid color %s", s)
+	}
+	var color [3]uint8
+	for i := range color {
+		x, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return [3]uint8{}, fmt.Errorf("invalid color %s", s)
+		}
+		color[i] = uint8(x)
+	}
+	return color, nil
+}
+
+func blendPixel(im skyhook.Image, x int, y int, color [3]uint8, alpha float64) {
+	if x < 0 || x >= im.Width || y < 0 || y >= im.Height {
+		return
+	}
+	cur := im.GetRGB(x, y)
+	var blended [3]uint8
+	for c := range blended {
+		blended[c] = uint8(math.Round(alpha*float64(color[c]) + (1-alpha)*float64(cur[c])))
+	}
+	im.SetRGB(x, y, blended)
+}
+
+// Like Image.DrawLine, but blends the line with the image.
+func blendLine(im skyhook.Image, sx, sy, ex, ey int, width int, color [3]uint8, alpha float64) {
+	// collect the pixels first so that overlapping squares are only blended once
+	pixels := make(map[[2]int]bool)
+	for _, p := range skyhook.DrawLineOnCells(sx, sy, ex, ey, im.Width, im.Height) {
+		for x := p[0]-width; x < p[0]+width; x++ {
+			for y := p[1]-width; y < p[1]+width; y++ {
+				pixels[[2]int{x, y}] = true
+			}
+		}
+	}
+	for p := range pixels {
+		blendPixel(im, p[0], p[1], color, alpha)
+	}
+}
+
+// Map a value in [0, 1] to a blue-cyan-green-yellow-red color.
+func heatColor(v float64) [3]uint8 {
+	stops := [][3]float64{{0, 0, 255}, {0, 255, 255}, {0, 255, 0}, {255, 255, 0}, {255, 0, 0}}
+	v = math.Max(0, math.Min(1, v)) * float64(len(stops)-1)
+	i := int(v)
+	if i >= len(stops)-1 {
+		i = len(stops)-2
+	}
+	t := v - float64(i)
+	var color [3]uint8
+	for c := range color {
+		color[c] = uint8(math.Round(stops[i][c] + t*(stops[i+1][c]-stops[i][c])))
+	}
+	return color
+}
+
+// Size in pixels of the heatmap cells.
+const HeatmapCellSize = 4
+
+// Heatmap of how many detections cover each cell, optionally over a sliding window of frames.
+type heatmap struct {
+	Width, Height int
+	Counts []float64
+	// boxes added in each of the recent frames, in cell coordinates, for the sliding window
+	history [][][4]int
+}
+
+func newHeatmap(width int, height int) *heatmap {
+	w := (width + HeatmapCellSize - 1) / HeatmapCellSize
+	h := (height + HeatmapCellSize - 1) / HeatmapCellSize
+	return &heatmap{Width: w, Height: h, Counts: make([]float64, w*h)}
+}
+
+func (hm *heatmap) addBox(box [4]int, weight float64) {
+	for y := box[1]; y < box[3]; y++ {
+		for x := box[0]; x < box[2]; x++ {
+			hm.Counts[y*hm.Width+x] += weight
+		}
+	}
+}
+
+// Add the detections of the next frame.
+// If window > 0, frames older than the window are removed.
+func (hm *heatmap) AddFrame(detections []skyhook.Detection, window int) {
+	var boxes [][4]int
+	for _, d := range detections {
+		box := [4]int{
+			skyhook.Clip(d.Left/HeatmapCellSize, 0, hm.Width),
+			skyhook.Clip(d.Top/HeatmapCellSize, 0, hm.Height),
+			skyhook.Clip((d.Right+HeatmapCellSize-1)/HeatmapCellSize, 0, hm.Width),
+			skyhook.Clip((d.Bottom+HeatmapCellSize-1)/HeatmapCellSize, 0, hm.Height),
+		}
+		hm.addBox(box, 1)
+		boxes = append(boxes, box)
+	}
+	if window <= 0 {
+		return
+	}
+	hm.history = append(hm.history, boxes)
+	for len(hm.history) > window {
+		for _, box := range hm.history[0] {
+			hm.addBox(box, -1)
+		}
+		hm.history = hm.history[1:]
+	}
+}
+
+// Blend the heatmap onto the image, normalized by the maximum count.
+func (hm *heatmap) Draw(im skyhook.Image, opacity float64) {
+	var max float64
+	for _, count := range hm.Counts {
+		max = math.Max(max, count)
+	}
+	if max == 0 {
+		return
+	}
+	for y := 0; y < im.Height; y++ {
+		for x := 0; x < im.Width; x++ {
+			count := hm.Counts[(y/HeatmapCellSize)*hm.Width + x/HeatmapCellSize]
+			if count <= 0 {
+				continue
+			}
+			blendPixel(im, x, y, heatColor(count/max), opacity)
+		}
+	}
+}
+
+type trailPoint struct {
+	Frame int
+	Point [2]int
+	Category string
+}
+
+// Recent positions of each track, for drawing trajectory trails.
+type trails map[int][]trailPoint
+
+// Add the detections of the frame, and remove points older than length frames.
+func (t trails) AddFrame(frame int, detections []skyhook.Detection, length int) {
+	for _, d := range detections {
+		if d.TrackID == 0 {
+			continue
+		}
+		t[d.TrackID] = append(t[d.TrackID], trailPoint{frame, [2]int{(d.Left+d.Right)/2, (d.Top+d.Bottom)/2}, d.Category})
+	}
+	for trackID, points := range t {
+		for len(points) > 0 && frame - points[0].Frame >= length {
+			points = points[1:]
+		}
+		if len(points) == 0 {
+			delete(t, trackID)
+		} else {
+			t[trackID] = points
+		}
+	}
+}
+
+// Draw each trail as a polyline that fades out with the age of the points.
+func (t trails) Draw(im skyhook.Image, frame int, length int, color func(trackID int, category string) [3]uint8) {
+	for trackID, points := range t {
+		c := color(trackID, points[len(points)-1].Category)
+		for i := 1; i < len(points); i++ {
+			alpha := 1 - float64(frame - points[i].Frame) / float64(length)
+			p1, p2 := points[i-1].Point, points[i].Point
+			blendLine(im, p1[0], p1[1], p2[0], p2[1], 1, c, alpha)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/skyhookml/skyhookml/exec_ops"
 
 	"fmt"
+	"hash/fnv"
 	"runtime"
 	"strconv"
 )
@@ -32,16 +33,145 @@ var Colors = [][3]uint8{
 }
 
 
+// Params for the render modes.
+// By default, detections are drawn as boxes colored by their track ID.
+type Params struct {
+	// "track" (default) colors detections by track ID, "category" by category
+	ColorBy string
+	// hex colors ("#rrggbb") for specific categories, overriding ColorBy
+	CategoryColors map[string]string
+	// draw category and score labels above the detections
+	Labels bool
+	// don't draw the detection boxes, e.g. to show only the heatmap or trails
+	HideBoxes bool
+	// overlay a heatmap of how often each pixel is covered by a detection
+	Heatmap bool
+	// for video, number of recent frames to accumulate in the heatmap, 0 for all frames so far
+	HeatmapWindow int
+	// opacity of the heatmap overlay, default 0.6
+	HeatmapOpacity float64
+	// for video, draw the trajectory of each track over this many previous frames
+	Trails int
+}
+
+func (params Params) GetHeatmapOpacity() float64 {
+	if params.HeatmapOpacity <= 0 {
+		return 0.6
+	}
+	return params.HeatmapOpacity
+}
+
 type Render struct {
 	URL string
 	Dataset skyhook.Dataset
+	Params Params
+	// parsed CategoryColors
+	CategoryColors map[string][3]uint8
 }
 
 func (e *Render) Parallelism() int {
 	return runtime.NumCPU()
 }
 
-func renderFrame(dtypes []skyhook.DataType, datas []interface{}, metadatas []skyhook.DataMetadata) (skyhook.Image, error) {
+// Returns the color to draw an object with the given track ID and category.
+// categories is the list of categories in the metadata of the object's dataset, if any.
+func (e *Render) getColor(trackID int, category string, categories []string) [3]uint8 {
+	if color, ok := e.CategoryColors[category]; ok {
+		return color
+	}
+	if e.Params.ColorBy == "category" && category != "" {
+		for i, s := range categories {
+			if s == category {
+				return Colors[i % len(Colors)]
+			}
+		}
+		h := fnv.New32a()
+		h.Write([]byte(category))
+		return Colors[int(h.Sum32() % uint32(len(Colors)))]
+	}
+	return Colors[trackID % len(Colors)]
+}
+
+// State accumulated over the frames of one task, for the heatmap and trails.
+type renderState struct {
+	// keyed by the index of the detection input
+	heatmaps map[int]*heatmap
+	trails map[int]trails
+}
+
+func newRenderState() *renderState {
+	return &renderState{
+		heatmaps: make(map[int]*heatmap),
+		trails: make(map[int]trails),
+	}
+}
+
+func (e *Render) drawDetections(canvas skyhook.Image, state *renderState, inputIdx int, pos int, detections []skyhook.Detection, metadata skyhook.DetectionMetadata) {
+	origDims := metadata.CanvasDims
+	targetDims := [2]int{canvas.Width, canvas.Height}
+	var rescaled []skyhook.Detection
+	for _, d := range detections {
+		if origDims[0] != 0 && origDims != targetDims {
+			d = d.Rescale(origDims, targetDims)
+		}
+		rescaled = append(rescaled, d)
+	}
+
+	if e.Params.Heatmap {
+		hm := state.heatmaps[inputIdx]
+		if hm == nil {
+			hm = newHeatmap(canvas.Width, canvas.Height)
+			state.heatmaps[inputIdx] = hm
+		}
+		hm.AddFrame(rescaled, e.Params.HeatmapWindow)
+		hm.Draw(canvas, e.Params.GetHeatmapOpacity())
+	}
+
+	if e.Params.Trails > 0 {
+		t := state.trails[inputIdx]
+		if t == nil {
+			t = make(trails)
+			state.trails[inputIdx] = t
+		}
+		t.AddFrame(pos, rescaled, e.Params.Trails)
+		t.Draw(canvas, pos, e.Params.Trails, func(trackID int, category string) [3]uint8 {
+			return e.getColor(trackID, category, metadata.Categories)
+		})
+	}
+
+	for _, d := range rescaled {
+		if !e.Params.HideBoxes {
+			color := e.getColor(d.TrackID, d.Category, metadata.Categories)
+			canvas.DrawRectangle(d.Left, d.Top, d.Right, d.Bottom, 2, color)
+		}
+		if e.Params.Labels {
+			var text string
+			if d.Category != "" {
+				text = d.Category
+			}
+			if d.Score != 0 {
+				if text != "" {
+					text += " "
+				}
+				text += fmt.Sprintf("%.2f", d.Score)
+			}
+			if text == "" {
+				continue
+			}
+			// DrawText treats (0, 0) as the default position, so nudge it
+			x, y := d.Left, d.Top-13
+			if y < 0 {
+				y = 0
+			}
+			if x == 0 && y == 0 {
+				x = 1
+			}
+			canvas.DrawText(skyhook.RichText{Text: text, X: x, Y: y})
+		}
+	}
+}
+
+func (e *Render) renderFrame(state *renderState, pos int, dtypes []skyhook.DataType, datas []interface{}, metadatas []skyhook.DataMetadata) (skyhook.Image, error) {
 	var canvas skyhook.Image
 	var canvases []skyhook.Image
 	for i, data := range datas {
@@ -66,12 +196,18 @@ func renderFrame(dtypes []skyhook.DataType, datas []interface{}, metadatas []sky
 			canvas.DrawText(skyhook.RichText{Text: text})
 		} else if dtypes[i] == skyhook.ShapeType {
 			shapes := data.([][]skyhook.Shape)[0]
-			origDims := metadatas[i].(skyhook.ShapeMetadata).CanvasDims
+			shapeMetadata := metadatas[i].(skyhook.ShapeMetadata)
+			origDims := shapeMetadata.CanvasDims
 			targetDims := [2]int{canvas.Width, canvas.Height}
 			if origDims[0] == 0 {
 				origDims = targetDims
 			}
 			for _, shape := range shapes {
+				// shapes are red unless they have a configured category color
+				color := [3]uint8{255, 0, 0}
+				if _, ok := e.CategoryColors[shape.Category]; ok || (e.Params.ColorBy == "category" && shape.Category != "") {
+					color = e.getColor(0, shape.Category, shapeMetadata.Categories)
+				}
 				if shape.Type == "box" {
 					bounds := shape.Bounds()
 					canvas.DrawRectangle(
@@ -79,7 +215,7 @@ func renderFrame(dtypes []skyhook.DataType, datas []interface{}, metadatas []sky
 						bounds[1]*targetDims[1]/origDims[1],
 						bounds[2]*targetDims[0]/origDims[0],
 						bounds[3]*targetDims[1]/origDims[1],
-						2, [3]uint8{255, 0, 0},
+						2, color,
 					)
 				} else if shape.Type == "line" {
 					canvas.DrawLine(
@@ -87,21 +223,13 @@ func renderFrame(dtypes []skyhook.DataType, datas []interface{}, metadatas []sky
 						shape.Points[0][1]*targetDims[1]/origDims[1],
 						shape.Points[1][0]*targetDims[0]/origDims[0],
 						shape.Points[1][1]*targetDims[1]/origDims[1],
-						1, [3]uint8{255, 0, 0},
+						1, color,
 					)
 				}
 			}
 		} else if dtypes[i] == skyhook.DetectionType {
 			detections := data.([][]skyhook.Detection)[0]
-			origDims := metadatas[i].(skyhook.DetectionMetadata).CanvasDims
-			targetDims := [2]int{canvas.Width, canvas.Height}
-			for _, d := range detections {
-				if origDims[0] != 0 && origDims != targetDims {
-					d = d.Rescale(origDims, targetDims)
-				}
-				color := Colors[d.TrackID % len(Colors)]
-				canvas.DrawRectangle(d.Left, d.Top, d.Right, d.Bottom, 2, color)
-			}
+			e.drawDetections(canvas, state, i, pos, detections, metadatas[i].(skyhook.DetectionMetadata))
 		}
 	}
 
@@ -178,8 +306,9 @@ func (e *Render) Apply(task skyhook.ExecTask) error {
 		dtypes = append(dtypes, item.Dataset.DataType)
 		metadatas = append(metadatas, item.DecodeMetadata())
 	}
+	state := newRenderState()
 	err := skyhook.PerFrame(inputItems, func(pos int, datas []interface{}) error {
-		im, err := renderFrame(dtypes, datas, metadatas)
+		im, err := e.renderFrame(state, pos, dtypes, datas, metadatas)
 		if err != nil {
 			return err
 		}
@@ -222,7 +351,19 @@ func init() {
 		},
 		GetTasks: exec_ops.SimpleTasks,
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
-			op := &Render{url, node.OutputDatasets["output"]}
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			categoryColors := make(map[string][3]uint8)
+			for category, s := range params.CategoryColors {
+				color, err := parseColor(s)
+				if err != nil {
+					return nil, fmt.Errorf("color for category %s: %v", category, err)
+				}
+				categoryColors[category] = color
+			}
+			op := &Render{url, node.OutputDatasets["output"], params, categoryColors}
 			return op, nil
 		},
 		Incremental: true,
@@ -0,0 +1,237 @@
+package render_compare
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"runtime"
+)
+
+// Render two label sets, usually ground truth labels and model predictions, on the same
+// images or video to compare them.
+// Predictions are matched to labels at an IOU threshold. Matched predictions (true
+// positives) are drawn in green, unmatched predictions (false positives) in red, and
+// unmatched labels (misses) in yellow.
+
+var (
+	TruePositiveColor = [3]uint8{0, 255, 0}
+	FalsePositiveColor = [3]uint8{255, 0, 0}
+	MissColor = [3]uint8{255, 255, 0}
+	// color of labels that were matched, in overlay mode
+	MatchedLabelColor = [3]uint8{255, 255, 255}
+)
+
+type Params struct {
+	// "overlay" (default) draws both label sets on the same frame
+	// "side_by_side" draws the labels on the left and the predictions on the right
+	Mode string
+	// minimum IOU for a prediction to match a label, default 0.5
+	IOUThreshold float64
+	// only match predictions to labels of the same category
+	MatchCategory bool
+	// draw the number of true positives, false positives, and misses in each frame
+	Counts bool
+}
+
+func (params Params) GetMode() string {
+	if params.Mode == "" {
+		return "overlay"
+	}
+	return params.Mode
+}
+
+func (params Params) GetIOUThreshold() float64 {
+	if params.IOUThreshold <= 0 {
+		return 0.5
+	}
+	return params.IOUThreshold
+}
+
+// Convert the labels of one frame to detections on the canvas.
+// Shapes are converted to their bounding boxes.
+func toDetections(dtype skyhook.DataType, data interface{}, metadata skyhook.DataMetadata, canvasDims [2]int) []skyhook.Detection {
+	var detections []skyhook.Detection
+	var origDims [2]int
+	if dtype == skyhook.DetectionType {
+		detections = data.([][]skyhook.Detection)[0]
+		origDims = metadata.(skyhook.DetectionMetadata).CanvasDims
+	} else if dtype == skyhook.ShapeType {
+		for _, shape := range data.([][]skyhook.Shape)[0] {
+			if len(shape.Points) == 0 {
+				continue
+			}
+			bounds := shape.Bounds()
+			detections = append(detections, skyhook.Detection{
+				Left: bounds[0],
+				Top: bounds[1],
+				Right: bounds[2],
+				Bottom: bounds[3],
+				Category: shape.Category,
+				TrackID: shape.TrackID,
+			})
+		}
+		origDims = metadata.(skyhook.ShapeMetadata).CanvasDims
+	}
+	if origDims[0] == 0 || origDims == canvasDims {
+		return detections
+	}
+	rescaled := make([]skyhook.Detection, len(detections))
+	for i, d := range detections {
+		rescaled[i] = d.Rescale(origDims, canvasDims)
+	}
+	return rescaled
+}
+
+type RenderCompare struct {
+	URL string
+	Dataset skyhook.Dataset
+	Params Params
+}
+
+func (e *RenderCompare) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *RenderCompare) renderFrame(im skyhook.Image, labels []skyhook.Detection, predictions []skyhook.Detection) skyhook.Image {
+	matches := skyhook.MatchDetections(labels, predictions, e.Params.GetIOUThreshold(), e.Params.MatchCategory)
+	labelMatched := make([]bool, len(labels))
+	var tp, fp int
+	for _, labelIdx := range matches {
+		if labelIdx >= 0 {
+			labelMatched[labelIdx] = true
+			tp++
+		} else {
+			fp++
+		}
+	}
+	misses := len(labels) - tp
+
+	left := im.Copy()
+	right := left
+	if e.Params.GetMode() == "side_by_side" {
+		right = im.Copy()
+	}
+	for i, d := range labels {
+		if labelMatched[i] {
+			color := MatchedLabelColor
+			if e.Params.GetMode() == "side_by_side" {
+				color = TruePositiveColor
+			}
+			left.DrawRectangle(d.Left, d.Top, d.Right, d.Bottom, 1, color)
+		} else {
+			left.DrawRectangle(d.Left, d.Top, d.Right, d.Bottom, 2, MissColor)
+		}
+	}
+	for i, d := range predictions {
+		color := FalsePositiveColor
+		if matches[i] >= 0 {
+			color = TruePositiveColor
+		}
+		right.DrawRectangle(d.Left, d.Top, d.Right, d.Bottom, 2, color)
+	}
+	if e.Params.Counts {
+		left.DrawText(skyhook.RichText{Text: fmt.Sprintf("TP %d  FP %d  miss %d", tp, fp, misses)})
+	}
+
+	if e.Params.GetMode() != "side_by_side" {
+		return left
+	}
+	canvas := skyhook.NewImage(2*im.Width, im.Height)
+	canvas.DrawImage(0, 0, left)
+	canvas.DrawImage(im.Width, 0, right)
+	return canvas
+}
+
+func (e *RenderCompare) Apply(task skyhook.ExecTask) error {
+	inputItems := []skyhook.Item{
+		task.Items["images"][0][0],
+		task.Items["labels"][0][0],
+		task.Items["predictions"][0][0],
+	}
+	imageItem := inputItems[0]
+	widthFactor := 1
+	if e.Params.GetMode() == "side_by_side" {
+		widthFactor = 2
+	}
+
+	var outputItem skyhook.Item
+	var err error
+	if imageItem.Dataset.DataType == skyhook.VideoType {
+		metadata := imageItem.DecodeMetadata().(skyhook.VideoMetadata)
+		metadata.Dims[0] *= widthFactor
+		outputItem, err = exec_ops.AddItem(e.URL, e.Dataset, task.Key, imageItem.Ext, imageItem.Format, metadata)
+	} else if imageItem.Dataset.DataType == skyhook.ImageType {
+		outputItem, err = exec_ops.AddItem(e.URL, e.Dataset, task.Key, imageItem.Ext, imageItem.Format, skyhook.NoMetadata{})
+	} else {
+		return fmt.Errorf("images input must be either video or image type")
+	}
+	if err != nil {
+		return err
+	}
+
+	writer := outputItem.LoadWriter()
+	var dtypes []skyhook.DataType
+	var metadatas []skyhook.DataMetadata
+	for _, item := range inputItems {
+		dtypes = append(dtypes, item.Dataset.DataType)
+		metadatas = append(metadatas, item.DecodeMetadata())
+	}
+	err = skyhook.PerFrame(inputItems, func(pos int, datas []interface{}) error {
+		im := datas[0].([]skyhook.Image)[0]
+		canvasDims := [2]int{im.Width, im.Height}
+		labels := toDetections(dtypes[1], datas[1], metadatas[1], canvasDims)
+		predictions := toDetections(dtypes[2], datas[2], metadatas[2], canvasDims)
+		return writer.Write([]skyhook.Image{e.renderFrame(im, labels, predictions)})
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func (e *RenderCompare) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "render_compare",
+			Name: "Render Comparison",
+			Description: "Render ground truth labels and predictions together, marking true positives, false positives, and misses",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType, skyhook.VideoType}},
+			{Name: "labels", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}},
+			{Name: "predictions", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}},
+		},
+		GetOutputs: func(params string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			// output video or image depending on the images input
+			var dtype skyhook.DataType = skyhook.VideoType
+			if len(inputTypes["images"]) > 0 {
+				dtype = inputTypes["images"][0]
+			}
+			return []skyhook.ExecOutput{{
+				Name: "output",
+				DataType: dtype,
+			}}
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			if mode := params.GetMode(); mode != "overlay" && mode != "side_by_side" {
+				return nil, fmt.Errorf("unknown mode %s", mode)
+			}
+			return &RenderCompare{url, node.OutputDatasets["output"], params}, nil
+		},
+		Incremental: true,
+		GetOutputKeys: exec_ops.MapGetOutputKeys,
+		GetNeededInputs: exec_ops.MapGetNeededInputs,
+		ImageName: "skyhookml/basic",
+	})
+}
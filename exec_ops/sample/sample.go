@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
-	urllib "net/url"
 )
 
 type Params struct {
@@ -70,28 +69,34 @@ func init() {
 					tasks = append(tasks, task)
 				}
 			}
-			return tasks, nil
+			// Batch the tasks so that we can add the output items together.
+			return exec_ops.BatchTasks(tasks), nil
 		},
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 			applyFunc := func(task skyhook.ExecTask) error {
 				// Simply copy each input to the output dataset.
 				// The sampling is taken care of in GetTasks already.
-				for i, itemList := range task.Items["inputs"] {
-					item := itemList[0]
-					dsName := fmt.Sprintf("outputs%d", i) // matches exec_ops.GetOutputsSimilarToInputs
-					err := skyhook.JsonPostForm(url, fmt.Sprintf("/datasets/%d/items", node.OutputDatasets[dsName].ID), urllib.Values{
-						"key": {task.Key},
-						"ext": {item.Ext},
-						"format": {item.Format},
-						"metadata": {item.Metadata},
-						"provider": {"reference"},
-						"provider_info": {item.Fname()},
-					}, nil)
-					if err != nil {
-						return err
+				buffer := exec_ops.NewItemBuffer(url)
+				for j, key := range exec_ops.BatchTaskKeys(task) {
+					for i, itemList := range task.Items["inputs"] {
+						item := itemList[j]
+						dsName := fmt.Sprintf("outputs%d", i) // matches exec_ops.GetOutputsSimilarToInputs
+						provider := "reference"
+						fname := item.Fname()
+						err := buffer.Add(node.OutputDatasets[dsName], skyhook.Item{
+							Key: key,
+							Ext: item.Ext,
+							Format: item.Format,
+							Metadata: item.Metadata,
+							Provider: &provider,
+							ProviderInfo: &fname,
+						})
+						if err != nil {
+							return err
+						}
 					}
 				}
-				return nil
+				return buffer.Flush()
 			}
 			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
 		},
@@ -0,0 +1,380 @@
+package tiles
+
+import (
+	"github.com/skyhookml/skyhookml/exec_ops"
+	"github.com/skyhookml/skyhookml/exec_ops/detection_merge"
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sliced inference for large images.
+// slice_tiles splits each image into overlapping tiles, which can be passed to any
+// model inference node. stitch_tiles then maps the detections or shapes in each tile
+// back to the coordinates of the original image, and merges duplicates across tiles.
+//
+// Tile keys have the form [key]_[left]_[top]. slice_tiles also outputs a layout Table
+// for each image listing its tiles, which stitch_tiles uses to map the coordinates.
+
+type SliceParams struct {
+	// Width and height of the tiles, default 640x640.
+	Size [2]int
+	// Fraction of each tile that overlaps the adjacent tiles, default 0.2.
+	Overlap float64
+}
+
+func (params SliceParams) GetSize() [2]int {
+	if params.Size[0] <= 0 || params.Size[1] <= 0 {
+		return [2]int{640, 640}
+	}
+	return params.Size
+}
+
+func (params SliceParams) GetOverlap() float64 {
+	if params.Overlap <= 0 || params.Overlap >= 1 {
+		return 0.2
+	}
+	return params.Overlap
+}
+
+// Returns the start positions of the tiles along an axis.
+// The last tile is aligned with the end of the image, so all tiles are the same size
+// unless the image is smaller than the tile.
+func tilePositions(length int, size int, overlap float64) []int {
+	if length <= size {
+		return []int{0}
+	}
+	stride := int(float64(size) * (1 - overlap))
+	if stride < 1 {
+		stride = 1
+	}
+	var positions []int
+	for pos := 0; pos+size < length; pos += stride {
+		positions = append(positions, pos)
+	}
+	return append(positions, length-size)
+}
+
+func TileKey(key string, left int, top int) string {
+	return fmt.Sprintf("%s_%d_%d", key, left, top)
+}
+
+// Returns the key of the original image from a tile key.
+func ParseTileKey(tileKey string) (string, bool) {
+	parts := strings.Split(tileKey, "_")
+	if len(parts) < 3 {
+		return "", false
+	}
+	for _, part := range parts[len(parts)-2:] {
+		if _, err := strconv.Atoi(part); err != nil {
+			return "", false
+		}
+	}
+	return strings.Join(parts[0:len(parts)-2], "_"), true
+}
+
+var layoutColumns = []skyhook.ColumnSpec{
+	{Label: "tile", Type: "string"},
+	{Label: "left", Type: "int"},
+	{Label: "top", Type: "int"},
+	{Label: "right", Type: "int"},
+	{Label: "bottom", Type: "int"},
+	{Label: "width", Type: "int"},
+	{Label: "height", Type: "int"},
+}
+
+type tileLayout struct {
+	Key string
+	Rect [4]int
+	// dimensions of the original image
+	Dims [2]int
+}
+
+func decodeLayout(data skyhook.TableData, metadata skyhook.TableMetadata) ([]tileLayout, error) {
+	columns := make(map[string]int)
+	for i, spec := range metadata.Columns {
+		columns[spec.Label] = i
+	}
+	for _, spec := range layoutColumns {
+		if _, ok := columns[spec.Label]; !ok {
+			return nil, fmt.Errorf("layout table is missing column %s", spec.Label)
+		}
+	}
+	var layout []tileLayout
+	for _, row := range data {
+		var values [6]int
+		for i, label := range []string{"left", "top", "right", "bottom", "width", "height"} {
+			x, err := strconv.Atoi(row[columns[label]])
+			if err != nil {
+				return nil, fmt.Errorf("bad %s value in layout: %v", label, err)
+			}
+			values[i] = x
+		}
+		layout = append(layout, tileLayout{
+			Key: row[columns["tile"]],
+			Rect: [4]int{values[0], values[1], values[2], values[3]},
+			Dims: [2]int{values[4], values[5]},
+		})
+	}
+	return layout, nil
+}
+
+type StitchParams struct {
+	// How to merge duplicate detections across overlapping tiles.
+	// Shapes are always merged with NMS on their bounding boxes.
+	detection_merge.Params
+}
+
+// Maps detections from tile coordinates to image coordinates.
+func stitchDetections(tile tileLayout, detections []skyhook.Detection, canvasDims [2]int) []skyhook.Detection {
+	tileDims := [2]int{tile.Rect[2]-tile.Rect[0], tile.Rect[3]-tile.Rect[1]}
+	var stitched []skyhook.Detection
+	for _, d := range detections {
+		if canvasDims[0] > 0 && canvasDims != tileDims {
+			d = d.Rescale(canvasDims, tileDims)
+		}
+		d.Left += tile.Rect[0]
+		d.Top += tile.Rect[1]
+		d.Right += tile.Rect[0]
+		d.Bottom += tile.Rect[1]
+		stitched = append(stitched, d)
+	}
+	return stitched
+}
+
+func stitchShapes(tile tileLayout, shapes []skyhook.Shape, canvasDims [2]int) []skyhook.Shape {
+	tileDims := [2]int{tile.Rect[2]-tile.Rect[0], tile.Rect[3]-tile.Rect[1]}
+	var stitched []skyhook.Shape
+	for _, shape := range shapes {
+		points := make([][2]int, len(shape.Points))
+		for i, p := range shape.Points {
+			if canvasDims[0] > 0 && canvasDims != tileDims {
+				p = [2]int{p[0]*tileDims[0]/canvasDims[0], p[1]*tileDims[1]/canvasDims[1]}
+			}
+			points[i] = [2]int{p[0]+tile.Rect[0], p[1]+tile.Rect[1]}
+		}
+		shape.Points = points
+		stitched = append(stitched, shape)
+	}
+	return stitched
+}
+
+// Class-aware NMS on shape bounding boxes.
+// Shapes don't have a score, so we use the "score" metadata if set.
+func shapeNMS(shapes []skyhook.Shape, iouThreshold float64) []skyhook.Shape {
+	scores := make([]float64, len(shapes))
+	boxes := make([]skyhook.Detection, len(shapes))
+	for i, shape := range shapes {
+		if len(shape.Points) == 0 {
+			continue
+		}
+		scores[i], _ = strconv.ParseFloat(shape.Metadata["score"], 64)
+		bounds := shape.Bounds()
+		boxes[i] = skyhook.Detection{Left: bounds[0], Top: bounds[1], Right: bounds[2], Bottom: bounds[3]}
+	}
+	order := make([]int, len(shapes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	var kept []int
+	for _, i := range order {
+		suppressed := false
+		for _, j := range kept {
+			if shapes[i].Category == shapes[j].Category && boxes[i].IOU(boxes[j]) > iouThreshold {
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, i)
+		}
+	}
+	sort.Ints(kept)
+	merged := []skyhook.Shape{}
+	for _, i := range kept {
+		merged = append(merged, shapes[i])
+	}
+	return merged
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "slice_tiles",
+			Name: "Slice Tiles",
+			Description: "Slice large images into overlapping tiles for sliced inference",
+		},
+		Inputs: []skyhook.ExecInput{{Name: "images", DataTypes: []skyhook.DataType{skyhook.ImageType, skyhook.GeoImageType}}},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "tiles", DataType: skyhook.ImageType},
+			{Name: "layout", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params SliceParams
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			size := params.GetSize()
+			applyFunc := func(task skyhook.ExecTask) error {
+				data, _, err := task.Items["images"][0][0].LoadData()
+				if err != nil {
+					return err
+				}
+				im := data.(skyhook.Image)
+
+				buf := exec_ops.NewItemBuffer(url)
+				var layout skyhook.TableData
+				for _, top := range tilePositions(im.Height, size[1], params.GetOverlap()) {
+					for _, left := range tilePositions(im.Width, size[0], params.GetOverlap()) {
+						right := skyhook.Clip(left+size[0], 0, im.Width)
+						bottom := skyhook.Clip(top+size[1], 0, im.Height)
+						tileKey := TileKey(task.Key, left, top)
+						tile := im.Crop(left, top, right, bottom)
+						if err := buf.WriteItem(node.OutputDatasets["tiles"], tileKey, tile, skyhook.NoMetadata{}); err != nil {
+							return err
+						}
+						layout = append(layout, []string{
+							tileKey,
+							strconv.Itoa(left), strconv.Itoa(top), strconv.Itoa(right), strconv.Itoa(bottom),
+							strconv.Itoa(im.Width), strconv.Itoa(im.Height),
+						})
+					}
+				}
+				if err := buf.Flush(); err != nil {
+					return err
+				}
+				return exec_ops.WriteItem(url, node.OutputDatasets["layout"], task.Key, layout, skyhook.TableMetadata{
+					Columns: layoutColumns,
+				})
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "stitch_tiles",
+			Name: "Stitch Tiles",
+			Description: "Stitch detections or shapes computed on tiles from slice_tiles back into the original images",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "layout", DataTypes: []skyhook.DataType{skyhook.TableType}},
+			{Name: "tiles", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			// output has the same type as the tiles
+			var dataType skyhook.DataType = skyhook.DetectionType
+			if len(inputTypes["tiles"]) > 0 && inputTypes["tiles"][0] == skyhook.ShapeType {
+				dataType = skyhook.ShapeType
+			}
+			return []skyhook.ExecOutput{{Name: "output", DataType: dataType}}
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			// group the tile items by the original image
+			tileItems := make(map[string][]skyhook.Item)
+			for _, item := range rawItems["tiles"][0] {
+				key, ok := ParseTileKey(item.Key)
+				if !ok {
+					log.Printf("[stitch_tiles] warning: skipping item %s that is not a tile", item.Key)
+					continue
+				}
+				tileItems[key] = append(tileItems[key], item)
+			}
+			var tasks []skyhook.ExecTask
+			for _, item := range rawItems["layout"][0] {
+				tasks = append(tasks, skyhook.ExecTask{
+					Key: item.Key,
+					Items: map[string][][]skyhook.Item{
+						"layout": {{item}},
+						"tiles": {tileItems[item.Key]},
+					},
+				})
+			}
+			return tasks, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params StitchParams
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				data, metadata, err := task.Items["layout"][0][0].LoadData()
+				if err != nil {
+					return err
+				}
+				layout, err := decodeLayout(data.(skyhook.TableData), metadata.(skyhook.TableMetadata))
+				if err != nil {
+					return fmt.Errorf("error decoding layout of %s: %v", task.Key, err)
+				}
+				if len(layout) == 0 {
+					return fmt.Errorf("layout of %s has no tiles", task.Key)
+				}
+				dims := layout[0].Dims
+
+				tileItems := make(map[string]skyhook.Item)
+				for _, item := range task.Items["tiles"][0] {
+					tileItems[item.Key] = item
+				}
+
+				var detections []skyhook.Detection
+				var shapes []skyhook.Shape
+				var categories []string
+				var dataType skyhook.DataType
+				for _, tile := range layout {
+					item, ok := tileItems[tile.Key]
+					if !ok {
+						log.Printf("[stitch_tiles] warning: missing tile %s", tile.Key)
+						continue
+					}
+					dataType = item.Dataset.DataType
+					data, metadata, err := item.LoadData()
+					if err != nil {
+						return err
+					}
+					if dataType == skyhook.DetectionType {
+						metadata := metadata.(skyhook.DetectionMetadata)
+						categories = metadata.Categories
+						if frames := data.([][]skyhook.Detection); len(frames) > 0 {
+							detections = append(detections, stitchDetections(tile, frames[0], metadata.CanvasDims)...)
+						}
+					} else {
+						metadata := metadata.(skyhook.ShapeMetadata)
+						categories = metadata.Categories
+						if frames := data.([][]skyhook.Shape); len(frames) > 0 {
+							shapes = append(shapes, stitchShapes(tile, frames[0], metadata.CanvasDims)...)
+						}
+					}
+				}
+
+				output := node.OutputDatasets["output"]
+				if output.DataType == skyhook.ShapeType {
+					return exec_ops.WriteItem(url, output, task.Key, [][]skyhook.Shape{shapeNMS(shapes, params.GetIOU())}, skyhook.ShapeMetadata{
+						CanvasDims: dims,
+						Categories: categories,
+					})
+				}
+				return exec_ops.WriteItem(url, output, task.Key, [][]skyhook.Detection{params.Merge(detections, 1)}, skyhook.DetectionMetadata{
+					CanvasDims: dims,
+					Categories: categories,
+				})
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
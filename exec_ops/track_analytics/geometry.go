@@ -0,0 +1,104 @@
+package track_analytics
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+)
+
+type point [2]float64
+
+func cross(o point, a point, b point) float64 {
+	return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+}
+
+// Returns whether segment p1-p2 crosses segment a-b, and if so, the direction of the
+// crossing: 1 if p1 is on the left of a->b (as seen in the image, where y points down)
+// and p2 is on the right, or -1 for the opposite direction.
+// Points exactly on the line count as being on the right, so that a track that stops
+// on the line is counted once.
+func crossing(p1 point, p2 point, a point, b point) int {
+	left1 := cross(a, b, p1) < 0
+	left2 := cross(a, b, p2) < 0
+	if left1 == left2 {
+		return 0
+	}
+	// check that the crossing point is within the segment a-b
+	d3 := cross(p1, p2, a)
+	d4 := cross(p1, p2, b)
+	if d3*d4 > 0 {
+		return 0
+	}
+	if left1 {
+		return 1
+	}
+	return -1
+}
+
+// Ray casting point-in-polygon test.
+func inPolygon(p point, polygon []point) bool {
+	inside := false
+	for i := range polygon {
+		a := polygon[i]
+		b := polygon[(i+1)%len(polygon)]
+		if (a[1] > p[1]) != (b[1] > p[1]) {
+			x := a[0] + (p[1]-a[1])/(b[1]-a[1])*(b[0]-a[0])
+			if p[0] < x {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// A zone (polygon or box shape) or a line (line or polyline shape) to count.
+type region struct {
+	Name string
+	Points []point
+}
+
+// Extract zones and lines from the shapes, rescaled to the detection canvas.
+// Shapes are named by their category, or "zone1", "line1", etc. if they don't have one.
+func regionsFromShapes(shapes []skyhook.Shape, shapeDims [2]int, detectionDims [2]int) (zones []region, lines []region) {
+	scale := [2]float64{1, 1}
+	if shapeDims[0] > 0 && shapeDims[1] > 0 && detectionDims[0] > 0 && detectionDims[1] > 0 {
+		scale = [2]float64{
+			float64(detectionDims[0]) / float64(shapeDims[0]),
+			float64(detectionDims[1]) / float64(shapeDims[1]),
+		}
+	}
+	for _, shape := range shapes {
+		var points []point
+		for _, p := range shape.Points {
+			points = append(points, point{float64(p[0])*scale[0], float64(p[1])*scale[1]})
+		}
+		switch shape.Type {
+		case skyhook.PolygonShape, skyhook.BoxShape:
+			if shape.Type == skyhook.BoxShape {
+				if len(points) < 2 {
+					continue
+				}
+				a, b := points[0], points[1]
+				points = []point{a, {b[0], a[1]}, b, {a[0], b[1]}}
+			}
+			if len(points) < 3 {
+				continue
+			}
+			name := shape.Category
+			if name == "" {
+				name = fmt.Sprintf("zone%d", len(zones)+1)
+			}
+			zones = append(zones, region{name, points})
+		case skyhook.LineShape, skyhook.PolyLineShape:
+			if len(points) < 2 {
+				continue
+			}
+			name := shape.Category
+			if name == "" {
+				name = fmt.Sprintf("line%d", len(lines)+1)
+			}
+			lines = append(lines, region{name, points})
+		}
+	}
+	return zones, lines
+}
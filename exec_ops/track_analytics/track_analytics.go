@@ -0,0 +1,437 @@
+package track_analytics
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Compute traffic-style analytics over tracks: line-crossing counts with direction,
+// zone visits and dwell times, entry/exit zone pairs, and track speeds.
+// Zones (polygons and boxes) and lines (lines and polylines) are read from the first
+// frame of an optional shape dataset, matched by key, or from its only item if it has
+// just one, so that the same zones can be used for every video.
+// Times are in seconds if the framerate is known (from the parameters or the optional
+// video input), and in frames otherwise.
+
+type Params struct {
+	// Point of the detection box used as the object position: "center" (default) or
+	// "bottom" (center of the bottom edge, e.g. where a vehicle touches the road).
+	Anchor string
+	// Framerate of the tracks, overriding the framerate of the video input.
+	Framerate float64
+	// Length of each time bucket in seconds (or frames if the framerate is unknown).
+	// Defaults to one hour.
+	BucketSize float64
+	// Scale from pixels to the units of the distances and speeds, e.g. meters per pixel.
+	// Defaults to 1 (pixels).
+	UnitsPerPixel float64
+}
+
+func (params Params) GetBucketSize() float64 {
+	if params.BucketSize <= 0 {
+		return 3600
+	}
+	return params.BucketSize
+}
+
+func (params Params) GetUnitsPerPixel() float64 {
+	if params.UnitsPerPixel <= 0 {
+		return 1
+	}
+	return params.UnitsPerPixel
+}
+
+func (params Params) anchor(d skyhook.Detection) point {
+	if params.Anchor == "bottom" {
+		return point{float64(d.Left+d.Right)/2, float64(d.Bottom)}
+	}
+	return point{float64(d.Left+d.Right)/2, float64(d.Top+d.Bottom)/2}
+}
+
+type trackPoint struct {
+	Frame int
+	P point
+}
+
+// An event (line crossing, zone entry, or entry/exit zone pair) to count.
+type event struct {
+	Type string
+	Name string
+	Direction string
+	Category string
+}
+
+type zoneVisit struct {
+	Zone string
+	Start int
+	End int
+}
+
+type trackStats struct {
+	ID int
+	Category string
+	First int
+	Last int
+	Distance float64
+	Entry string
+	Exit string
+}
+
+type analytics struct {
+	// counts of events in each time bucket
+	counts map[int]map[event]int
+	// visits to each (zone, category)
+	visits map[[2]string][]zoneVisit
+	tracks []trackStats
+}
+
+func (a *analytics) add(bucket int, e event) {
+	if a.counts[bucket] == nil {
+		a.counts[bucket] = make(map[event]int)
+	}
+	a.counts[bucket][e]++
+}
+
+func (params Params) analyze(detections [][]skyhook.Detection, zones []region, lines []region, bucketFrames float64) *analytics {
+	a := &analytics{
+		counts: make(map[int]map[event]int),
+		visits: make(map[[2]string][]zoneVisit),
+	}
+	bucketOf := func(frame int) int {
+		return int(float64(frame) / bucketFrames)
+	}
+
+	tracks := make(map[int][]trackPoint)
+	categories := make(map[int]string)
+	for frameIdx, dlist := range detections {
+		for _, d := range dlist {
+			if d.TrackID == 0 {
+				continue
+			}
+			track := tracks[d.TrackID]
+			if len(track) > 0 && track[len(track)-1].Frame == frameIdx {
+				continue
+			}
+			tracks[d.TrackID] = append(track, trackPoint{frameIdx, params.anchor(d)})
+			if categories[d.TrackID] == "" {
+				categories[d.TrackID] = d.Category
+			}
+		}
+	}
+	var trackIDs []int
+	for trackID := range tracks {
+		trackIDs = append(trackIDs, trackID)
+	}
+	sort.Ints(trackIDs)
+
+	for _, trackID := range trackIDs {
+		track := tracks[trackID]
+		category := categories[trackID]
+		stats := trackStats{
+			ID: trackID,
+			Category: category,
+			First: track[0].Frame,
+			Last: track[len(track)-1].Frame,
+		}
+
+		// line crossings and distance
+		for i := 1; i < len(track); i++ {
+			p1, p2 := track[i-1].P, track[i].P
+			stats.Distance += math.Hypot(p2[0]-p1[0], p2[1]-p1[1])
+			for _, line := range lines {
+				for j := 1; j < len(line.Points); j++ {
+					dir := crossing(p1, p2, line.Points[j-1], line.Points[j])
+					if dir == 0 {
+						continue
+					}
+					direction := "forward"
+					if dir < 0 {
+						direction = "backward"
+					}
+					a.add(bucketOf(track[i].Frame), event{"line", line.Name, direction, category})
+					break
+				}
+			}
+		}
+
+		// zone visits, which are maximal runs of track points inside the zone
+		var visits []zoneVisit
+		for _, zone := range zones {
+			var cur *zoneVisit
+			for _, tp := range track {
+				if inPolygon(tp.P, zone.Points) {
+					if cur == nil {
+						cur = &zoneVisit{Zone: zone.Name, Start: tp.Frame}
+					}
+					cur.End = tp.Frame
+				} else if cur != nil {
+					visits = append(visits, *cur)
+					cur = nil
+				}
+			}
+			if cur != nil {
+				visits = append(visits, *cur)
+			}
+		}
+		sort.Slice(visits, func(i, j int) bool {
+			return visits[i].Start < visits[j].Start
+		})
+		for _, visit := range visits {
+			key := [2]string{visit.Zone, category}
+			a.visits[key] = append(a.visits[key], visit)
+			a.add(bucketOf(visit.Start), event{"zone", visit.Zone, "", category})
+		}
+		if len(visits) > 0 {
+			stats.Entry = visits[0].Zone
+			stats.Exit = visits[len(visits)-1].Zone
+		}
+		if len(visits) >= 2 {
+			last := visits[len(visits)-1]
+			a.add(bucketOf(last.Start), event{"transition", fmt.Sprintf("%s -> %s", stats.Entry, stats.Exit), "", category})
+		}
+
+		a.tracks = append(a.tracks, stats)
+	}
+	return a
+}
+
+func sortedEvents(counts map[event]int) []event {
+	var events []event
+	for e := range counts {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		} else if a.Name != b.Name {
+			return a.Name < b.Name
+		} else if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.Category < b.Category
+	})
+	return events
+}
+
+func formatFloat(x float64) string {
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+// Build the output tables.
+func (a *analytics) tables(fps float64, bucketSize float64, unitsPerPixel float64) map[string]skyhook.TableData {
+	tables := map[string]skyhook.TableData{
+		"summary": {},
+		"buckets": {},
+		"zones": {},
+		"tracks": {},
+	}
+
+	totals := make(map[event]int)
+	var buckets []int
+	for bucket, counts := range a.counts {
+		buckets = append(buckets, bucket)
+		for e, count := range counts {
+			totals[e] += count
+		}
+	}
+	sort.Ints(buckets)
+	for _, e := range sortedEvents(totals) {
+		tables["summary"] = append(tables["summary"], []string{e.Type, e.Name, e.Direction, e.Category, strconv.Itoa(totals[e])})
+	}
+	for _, bucket := range buckets {
+		start := float64(bucket) * bucketSize
+		for _, e := range sortedEvents(a.counts[bucket]) {
+			tables["buckets"] = append(tables["buckets"], []string{
+				formatFloat(start), formatFloat(start + bucketSize),
+				e.Type, e.Name, e.Direction, e.Category,
+				strconv.Itoa(a.counts[bucket][e]),
+			})
+		}
+	}
+
+	var zoneKeys [][2]string
+	for key := range a.visits {
+		zoneKeys = append(zoneKeys, key)
+	}
+	sort.Slice(zoneKeys, func(i, j int) bool {
+		if zoneKeys[i][0] != zoneKeys[j][0] {
+			return zoneKeys[i][0] < zoneKeys[j][0]
+		}
+		return zoneKeys[i][1] < zoneKeys[j][1]
+	})
+	for _, key := range zoneKeys {
+		visits := a.visits[key]
+		var total float64
+		for _, visit := range visits {
+			total += float64(visit.End - visit.Start + 1) / fps
+		}
+		tables["zones"] = append(tables["zones"], []string{
+			key[0], key[1],
+			strconv.Itoa(len(visits)),
+			formatFloat(total),
+			formatFloat(total / float64(len(visits))),
+		})
+	}
+
+	for _, stats := range a.tracks {
+		duration := float64(stats.Last - stats.First) / fps
+		distance := stats.Distance * unitsPerPixel
+		var speed float64
+		if duration > 0 {
+			speed = distance / duration
+		}
+		tables["tracks"] = append(tables["tracks"], []string{
+			strconv.Itoa(stats.ID), stats.Category,
+			strconv.Itoa(stats.First), strconv.Itoa(stats.Last),
+			formatFloat(duration), formatFloat(distance), formatFloat(speed),
+			stats.Entry, stats.Exit,
+		})
+	}
+	return tables
+}
+
+var tableColumns = map[string][]skyhook.ColumnSpec{
+	"summary": {
+		{Label: "event", Type: "string"},
+		{Label: "name", Type: "string"},
+		{Label: "direction", Type: "string"},
+		{Label: "category", Type: "string"},
+		{Label: "count", Type: "int"},
+	},
+	"buckets": {
+		{Label: "bucket_start", Type: "float64"},
+		{Label: "bucket_end", Type: "float64"},
+		{Label: "event", Type: "string"},
+		{Label: "name", Type: "string"},
+		{Label: "direction", Type: "string"},
+		{Label: "category", Type: "string"},
+		{Label: "count", Type: "int"},
+	},
+	"zones": {
+		{Label: "zone", Type: "string"},
+		{Label: "category", Type: "string"},
+		{Label: "visits", Type: "int"},
+		{Label: "total_dwell", Type: "float64"},
+		{Label: "mean_dwell", Type: "float64"},
+	},
+	"tracks": {
+		{Label: "track_id", Type: "int"},
+		{Label: "category", Type: "string"},
+		{Label: "first_frame", Type: "int"},
+		{Label: "last_frame", Type: "int"},
+		{Label: "duration", Type: "float64"},
+		{Label: "distance", Type: "float64"},
+		{Label: "speed", Type: "float64"},
+		{Label: "entry", Type: "string"},
+		{Label: "exit", Type: "string"},
+	},
+}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "track_analytics",
+			Name: "Track Analytics",
+			Description: "Count line crossings, zone visits and entry/exit pairs of tracks, and compute dwell times and speeds",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "tracks", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "zones", DataTypes: []skyhook.DataType{skyhook.ShapeType}, Variable: true},
+			{Name: "video", DataTypes: []skyhook.DataType{skyhook.VideoType}, Variable: true},
+		},
+		Outputs: []skyhook.ExecOutput{
+			{Name: "summary", DataType: skyhook.TableType},
+			{Name: "buckets", DataType: skyhook.TableType},
+			{Name: "zones", DataType: skyhook.TableType},
+			{Name: "tracks", DataType: skyhook.TableType},
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			// match the zones by key, or use the only zones item for every key
+			items := map[string][][]skyhook.Item{
+				"tracks": rawItems["tracks"],
+			}
+			if rawItems["video"] != nil {
+				items["video"] = rawItems["video"]
+			}
+			var sharedZones []skyhook.Item
+			if len(rawItems["zones"]) > 0 {
+				if len(rawItems["zones"][0]) == 1 {
+					sharedZones = rawItems["zones"][0]
+				} else {
+					items["zones"] = rawItems["zones"]
+				}
+			}
+			tasks, err := exec_ops.SimpleTasks(node, items)
+			if err != nil {
+				return nil, err
+			}
+			if sharedZones != nil {
+				for i := range tasks {
+					tasks[i].Items["zones"] = [][]skyhook.Item{sharedZones}
+				}
+			}
+			return tasks, nil
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			applyFunc := func(task skyhook.ExecTask) error {
+				data, metadata, err := task.Items["tracks"][0][0].LoadData()
+				if err != nil {
+					return err
+				}
+				detections := data.([][]skyhook.Detection)
+
+				var zones, lines []region
+				if len(task.Items["zones"]) > 0 {
+					data, shapeMetadata, err := task.Items["zones"][0][0].LoadData()
+					if err != nil {
+						return err
+					}
+					shapes := data.([][]skyhook.Shape)
+					if len(shapes) > 0 {
+						shapeDims := shapeMetadata.(skyhook.ShapeMetadata).CanvasDims
+						detectionDims := metadata.(skyhook.DetectionMetadata).CanvasDims
+						zones, lines = regionsFromShapes(shapes[0], shapeDims, detectionDims)
+					}
+				}
+
+				fps := params.Framerate
+				if fps <= 0 && len(task.Items["video"]) > 0 {
+					videoMetadata := task.Items["video"][0][0].DecodeMetadata().(skyhook.VideoMetadata)
+					if videoMetadata.Framerate[1] > 0 {
+						fps = float64(videoMetadata.Framerate[0]) / float64(videoMetadata.Framerate[1])
+					}
+				}
+				if fps <= 0 {
+					fps = 1
+				}
+
+				a := params.analyze(detections, zones, lines, params.GetBucketSize()*fps)
+				tables := a.tables(fps, params.GetBucketSize(), params.GetUnitsPerPixel())
+				for name, table := range tables {
+					err := exec_ops.WriteItem(url, node.OutputDatasets[name], task.Key, table, skyhook.TableMetadata{
+						Columns: tableColumns[name],
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -0,0 +1,269 @@
+package track_interpolate
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+)
+
+// Fill gaps in tracks (detections with the same TrackID) by interpolating the boxes,
+// and optionally smooth the box trajectories.
+// Detections without a TrackID are passed through unchanged.
+
+type Params struct {
+	// "linear" (default), "spline", or "none"
+	Interpolation string
+	// maximum number of missing frames between two detections of a track to fill
+	// 0 for no limit
+	MaxGap int
+	// "" (none), "moving_average", or "rts" (Rauch-Tung-Striebel smoother)
+	Smoothing string
+	// window size for moving average smoothing
+	Window int
+	// for RTS smoothing, the ratio of measurement noise to the default; higher is smoother
+	Smoothness float64
+}
+
+func (params Params) GetInterpolation() string {
+	if params.Interpolation == "" {
+		return "linear"
+	}
+	return params.Interpolation
+}
+
+func (params Params) GetWindow() int {
+	if params.Window <= 0 {
+		return 5
+	}
+	return params.Window
+}
+
+func (params Params) GetSmoothness() float64 {
+	if params.Smoothness <= 0 {
+		return 1
+	}
+	return params.Smoothness
+}
+
+type keyframe struct {
+	Frame int
+	Detection skyhook.Detection
+}
+
+// Split the keyframes of a track into segments where the gaps can be filled.
+func (params Params) segments(keyframes []keyframe) [][]keyframe {
+	var segments [][]keyframe
+	var cur []keyframe
+	for _, kf := range keyframes {
+		if len(cur) > 0 {
+			gap := kf.Frame - cur[len(cur)-1].Frame - 1
+			// without interpolation, we still keep contiguous runs together so that
+			// they can be smoothed
+			if (params.GetInterpolation() == "none" && gap > 0) || (params.MaxGap > 0 && gap > params.MaxGap) {
+				segments = append(segments, cur)
+				cur = nil
+			}
+		}
+		cur = append(cur, kf)
+	}
+	if len(cur) > 0 {
+		segments = append(segments, cur)
+	}
+	return segments
+}
+
+// Compute the dense boxes (center x, center y, width, height) of a segment, from its
+// first keyframe to its last keyframe.
+func (params Params) denseBoxes(segment []keyframe) ([4][]float64, error) {
+	frames := make([]int, len(segment))
+	var coords [4][]float64
+	for i, kf := range segment {
+		frames[i] = kf.Frame
+		d := kf.Detection
+		values := [4]float64{
+			float64(d.Left+d.Right)/2,
+			float64(d.Top+d.Bottom)/2,
+			float64(d.Right-d.Left),
+			float64(d.Bottom-d.Top),
+		}
+		for c := range coords {
+			coords[c] = append(coords[c], values[c])
+		}
+	}
+
+	var dense [4][]float64
+	first, last := frames[0], frames[len(frames)-1]
+	for c := range coords {
+		var at func(t int) float64
+		switch params.GetInterpolation() {
+		case "linear", "none":
+			at = func(t int) float64 {
+				return linear(frames, coords[c], t)
+			}
+		case "spline":
+			at = newSpline(frames, coords[c]).At
+		default:
+			return dense, fmt.Errorf("unknown interpolation %s", params.Interpolation)
+		}
+		for t := first; t <= last; t++ {
+			dense[c] = append(dense[c], at(t))
+		}
+	}
+
+	switch params.Smoothing {
+	case "":
+	case "moving_average":
+		for c := range dense {
+			dense[c] = movingAverage(dense[c], params.GetWindow())
+		}
+	case "rts":
+		// noise proportional to the mean box height, like the kalman_tracker
+		var height float64
+		for _, h := range dense[3] {
+			height += h
+		}
+		height = math.Max(height/float64(len(dense[3])), 1)
+		r := math.Pow(params.GetSmoothness()*height/20, 2)
+		q := math.Pow(height/160, 2)
+		for c := range dense {
+			dense[c] = rtsSmooth(dense[c], q, r)
+		}
+	default:
+		return dense, fmt.Errorf("unknown smoothing %s", params.Smoothing)
+	}
+	return dense, nil
+}
+
+func (params Params) Interpolate(detections [][]skyhook.Detection, numFrames int) ([][]skyhook.Detection, error) {
+	ndetections := make([][]skyhook.Detection, numFrames)
+	for i := range ndetections {
+		ndetections[i] = []skyhook.Detection{}
+	}
+
+	// group the detections by track
+	tracks := make(map[int][]keyframe)
+	for frameIdx, dlist := range detections {
+		if frameIdx >= numFrames {
+			break
+		}
+		for _, d := range dlist {
+			if d.TrackID == 0 {
+				ndetections[frameIdx] = append(ndetections[frameIdx], d)
+				continue
+			}
+			track := tracks[d.TrackID]
+			if len(track) > 0 && track[len(track)-1].Frame == frameIdx {
+				// keep only the first detection of a track in each frame
+				continue
+			}
+			tracks[d.TrackID] = append(track, keyframe{frameIdx, d})
+		}
+	}
+	var trackIDs []int
+	for trackID := range tracks {
+		trackIDs = append(trackIDs, trackID)
+	}
+	sort.Ints(trackIDs)
+
+	for _, trackID := range trackIDs {
+		for _, segment := range params.segments(tracks[trackID]) {
+			dense, err := params.denseBoxes(segment)
+			if err != nil {
+				return nil, err
+			}
+			first := segment[0].Frame
+			kfIdx := 0
+			for i := range dense[0] {
+				frameIdx := first + i
+				for kfIdx+1 < len(segment) && segment[kfIdx+1].Frame <= frameIdx {
+					kfIdx++
+				}
+				// copy the other fields from the latest keyframe
+				d := segment[kfIdx].Detection
+				if segment[kfIdx].Frame != frameIdx {
+					metadata := map[string]string{"interpolated": "1"}
+					for k, v := range d.Metadata {
+						metadata[k] = v
+					}
+					d.Metadata = metadata
+				}
+				cx, cy, w, h := dense[0][i], dense[1][i], dense[2][i], dense[3][i]
+				d.Left = int(math.Round(cx - w/2))
+				d.Top = int(math.Round(cy - h/2))
+				d.Right = int(math.Round(cx + w/2))
+				d.Bottom = int(math.Round(cy + h/2))
+				ndetections[frameIdx] = append(ndetections[frameIdx], d)
+			}
+		}
+	}
+	return ndetections, nil
+}
+
+type Interpolator struct {
+	URL string
+	Dataset skyhook.Dataset
+	Params Params
+}
+
+func (e *Interpolator) Parallelism() int {
+	return runtime.NumCPU()
+}
+
+func (e *Interpolator) Apply(task skyhook.ExecTask) error {
+	data, metadata, err := task.Items["detections"][0][0].LoadData()
+	if err != nil {
+		return err
+	}
+	detections := data.([][]skyhook.Detection)
+
+	// align the output to the frame count of the video if it is provided
+	numFrames := len(detections)
+	if videoItems := task.Items["video"]; len(videoItems) > 0 {
+		videoMetadata := videoItems[0][0].DecodeMetadata().(skyhook.VideoMetadata)
+		if videoMetadata.Framerate[1] > 0 && videoMetadata.NumFrames() > 0 {
+			numFrames = videoMetadata.NumFrames()
+		}
+	}
+
+	ndetections, err := e.Params.Interpolate(detections, numFrames)
+	if err != nil {
+		return err
+	}
+	return exec_ops.WriteItem(e.URL, e.Dataset, task.Key, ndetections, metadata)
+}
+
+func (e *Interpolator) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "track_interpolate",
+			Name: "Track Interpolation",
+			Description: "Fill gaps in tracks by interpolation, and optionally smooth the track boxes",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "detections", DataTypes: []skyhook.DataType{skyhook.DetectionType}},
+			{Name: "video", DataTypes: []skyhook.DataType{skyhook.VideoType}, Variable: true},
+		},
+		Outputs: []skyhook.ExecOutput{{Name: "tracks", DataType: skyhook.DetectionType}},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			return &Interpolator{url, node.OutputDatasets["tracks"], params}, nil
+		},
+		Incremental: true,
+		GetOutputKeys: exec_ops.MapGetOutputKeys,
+		GetNeededInputs: exec_ops.MapGetNeededInputs,
+		ImageName: "skyhookml/basic",
+	})
+}
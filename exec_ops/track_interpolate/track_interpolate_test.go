@@ -0,0 +1,87 @@
+package track_interpolate
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"math"
+	"testing"
+)
+
+// Interpolating keyframes of a linear trajectory should give back the linear values.
+func TestInterpolateLinearTrajectory(t *testing.T) {
+	tests := []struct {
+		label string
+		frames []int
+	}{
+		{"two keyframes", []int{0, 10}},
+		{"three keyframes", []int{0, 4, 10}},
+		{"uneven keyframes", []int{0, 3, 4, 8, 10}},
+	}
+	f := func(t int) float64 {
+		return 2.5*float64(t) - 7
+	}
+	for _, test := range tests {
+		values := make([]float64, len(test.frames))
+		for i, frame := range test.frames {
+			values[i] = f(frame)
+		}
+		s := newSpline(test.frames, values)
+		for frame := 0; frame <= 10; frame++ {
+			if got := s.At(frame); math.Abs(got - f(frame)) > 1e-6 {
+				t.Errorf("%s: spline at %d = %v; want %v", test.label, frame, got, f(frame))
+			}
+			if got := linear(test.frames, values, frame); math.Abs(got - f(frame)) > 1e-6 {
+				t.Errorf("%s: linear at %d = %v; want %v", test.label, frame, got, f(frame))
+			}
+		}
+	}
+}
+
+// With Interpolation "none", gaps should not be filled, but contiguous runs of a track
+// should still be smoothed.
+func TestSmoothWithoutInterpolation(t *testing.T) {
+	// a track moving right at 10 pixels per frame with alternating jitter,
+	// on frames 0-9 and 15-19
+	jitter := func(frame int) int {
+		if frame % 2 == 0 {
+			return 6
+		}
+		return -6
+	}
+	detections := make([][]skyhook.Detection, 20)
+	for frame := range detections {
+		if frame >= 10 && frame < 15 {
+			continue
+		}
+		x := 100 + 10*frame + jitter(frame)
+		detections[frame] = []skyhook.Detection{{Left: x, Top: 100, Right: x+40, Bottom: 180, TrackID: 1}}
+	}
+
+	params := Params{Interpolation: "none", Smoothing: "rts"}
+	output, err := params.Interpolate(detections, len(detections))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jitterSum, origJitterSum int
+	for frame, dlist := range output {
+		if len(dlist) != len(detections[frame]) {
+			t.Fatalf("frame %d has %d detections; want %d", frame, len(dlist), len(detections[frame]))
+		}
+		if len(dlist) == 0 {
+			continue
+		}
+		expected := 100 + 10*frame
+		jitterSum += abs(dlist[0].Left - expected)
+		origJitterSum += abs(detections[frame][0].Left - expected)
+	}
+	if jitterSum >= origJitterSum/2 {
+		t.Errorf("jitter after smoothing = %d; want less than half of %d", jitterSum, origJitterSum)
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,177 @@
+package track_interpolate
+
+import (
+	"math"
+)
+
+// Interpolation and smoothing of one-dimensional trajectories, which we apply
+// separately to the center x, center y, width, and height of the track boxes.
+
+// Linearly interpolate the value at frame t between the keyframes.
+// The keyframes must be sorted, and t must be within their range.
+func linear(frames []int, values []float64, t int) float64 {
+	i := 0
+	for i+1 < len(frames) && frames[i+1] <= t {
+		i++
+	}
+	if i+1 == len(frames) {
+		return values[i]
+	}
+	alpha := float64(t-frames[i]) / float64(frames[i+1]-frames[i])
+	return values[i] + alpha*(values[i+1]-values[i])
+}
+
+// Natural cubic spline through the keyframes.
+type spline struct {
+	frames []int
+	values []float64
+	// second derivatives at the keyframes
+	m []float64
+}
+
+func newSpline(frames []int, values []float64) spline {
+	n := len(frames)
+	s := spline{frames: frames, values: values, m: make([]float64, n)}
+	if n < 3 {
+		return s
+	}
+	// solve the tridiagonal system for the second derivatives, with m[0] = m[n-1] = 0
+	h := make([]float64, n-1)
+	for i := range h {
+		h[i] = float64(frames[i+1] - frames[i])
+	}
+	diag := make([]float64, n)
+	rhs := make([]float64, n)
+	for i := 1; i < n-1; i++ {
+		diag[i] = 2 * (h[i-1] + h[i])
+		rhs[i] = 6 * ((values[i+1]-values[i])/h[i] - (values[i]-values[i-1])/h[i-1])
+	}
+	// forward elimination
+	for i := 2; i < n-1; i++ {
+		factor := h[i-1] / diag[i-1]
+		diag[i] -= factor * h[i-1]
+		rhs[i] -= factor * rhs[i-1]
+	}
+	// back substitution
+	for i := n-2; i >= 1; i-- {
+		s.m[i] = (rhs[i] - h[i]*s.m[i+1]) / diag[i]
+	}
+	return s
+}
+
+func (s spline) At(t int) float64 {
+	if len(s.frames) < 3 {
+		return linear(s.frames, s.values, t)
+	}
+	i := 0
+	for i+2 < len(s.frames) && s.frames[i+1] <= t {
+		i++
+	}
+	h := float64(s.frames[i+1] - s.frames[i])
+	a := float64(s.frames[i+1] - t) / h
+	b := float64(t - s.frames[i]) / h
+	return a*s.values[i] + b*s.values[i+1] + ((a*a*a-a)*s.m[i]+(b*b*b-b)*s.m[i+1])*h*h/6
+}
+
+// Centered moving average over a window of frames, which is truncated at the ends.
+func movingAverage(values []float64, window int) []float64 {
+	radius := window / 2
+	smoothed := make([]float64, len(values))
+	for i := range values {
+		var sum float64
+		var count int
+		for j := i-radius; j <= i+radius; j++ {
+			if j < 0 || j >= len(values) {
+				continue
+			}
+			sum += values[j]
+			count++
+		}
+		smoothed[i] = sum / float64(count)
+	}
+	return smoothed
+}
+
+// Rauch-Tung-Striebel smoother with a constant-velocity model.
+// q is the process noise variance of the velocity per frame, and r is the variance
+// of the measurements.
+func rtsSmooth(values []float64, q float64, r float64) []float64 {
+	n := len(values)
+	if n < 2 {
+		return append([]float64{}, values...)
+	}
+	type state struct {
+		X [2]float64
+		P [2][2]float64
+	}
+	// predicted and filtered states for each frame
+	predicted := make([]state, n)
+	filtered := make([]state, n)
+
+	// the initial velocity is unknown, so we give it a large variance
+	cur := state{X: [2]float64{values[0], 0}, P: [2][2]float64{{r, 0}, {0, 100*r}}}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			// predict with F = [1 1; 0 1] and Q = q * [1/3 1/2; 1/2 1]
+			p := cur.P
+			cur.X = [2]float64{cur.X[0] + cur.X[1], cur.X[1]}
+			cur.P = [2][2]float64{
+				{p[0][0] + p[0][1] + p[1][0] + p[1][1] + q/3, p[0][1] + p[1][1] + q/2},
+				{p[1][0] + p[1][1] + q/2, p[1][1] + q},
+			}
+		}
+		predicted[i] = cur
+
+		// update with the measurement of the position
+		p := cur.P
+		s := p[0][0] + r
+		k0, k1 := p[0][0]/s, p[1][0]/s
+		y := values[i] - cur.X[0]
+		cur.X = [2]float64{cur.X[0] + k0*y, cur.X[1] + k1*y}
+		cur.P = [2][2]float64{
+			{(1-k0)*p[0][0], (1-k0)*p[0][1]},
+			{p[1][0] - k1*p[0][0], p[1][1] - k1*p[0][1]},
+		}
+		filtered[i] = cur
+	}
+
+	// backward pass
+	smoothed := make([]float64, n)
+	next := filtered[n-1]
+	smoothed[n-1] = next.X[0]
+	for i := n-2; i >= 0; i-- {
+		f := filtered[i]
+		pred := predicted[i+1]
+		// gain C = P_f F^T P_pred^-1
+		pf := f.P
+		pft := [2][2]float64{
+			{pf[0][0] + pf[0][1], pf[0][1]},
+			{pf[1][0] + pf[1][1], pf[1][1]},
+		}
+		det := pred.P[0][0]*pred.P[1][1] - pred.P[0][1]*pred.P[1][0]
+		if math.Abs(det) < 1e-12 {
+			next = state{X: f.X}
+			smoothed[i] = f.X[0]
+			continue
+		}
+		inv := [2][2]float64{
+			{pred.P[1][1] / det, -pred.P[0][1] / det},
+			{-pred.P[1][0] / det, pred.P[0][0] / det},
+		}
+		var c [2][2]float64
+		for a := 0; a < 2; a++ {
+			for b := 0; b < 2; b++ {
+				c[a][b] = pft[a][0]*inv[0][b] + pft[a][1]*inv[1][b]
+			}
+		}
+		dx := [2]float64{next.X[0] - pred.X[0], next.X[1] - pred.X[1]}
+		var x [2]float64
+		for a := 0; a < 2; a++ {
+			x[a] = f.X[a] + c[a][0]*dx[0] + c[a][1]*dx[1]
+		}
+		// the smoothed means don't depend on the smoothed covariances, so we skip them
+		next = state{X: x}
+		smoothed[i] = x[0]
+	}
+	return smoothed
+}
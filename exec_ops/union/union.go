@@ -2,10 +2,9 @@ package union
 
 import (
 	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
 
-	"fmt"
 	"strconv"
-	urllib "net/url"
 )
 
 func init() {
@@ -44,24 +43,30 @@ func init() {
 					})
 				}
 			}
-			return tasks, nil
+			// Batch the tasks so that we can add the output items together.
+			return exec_ops.BatchTasks(tasks), nil
 		},
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 			applyFunc := func(task skyhook.ExecTask) error {
-				item := task.Items["inputs"][0][0]
 				outDataset := node.OutputDatasets["output"]
-				err := skyhook.JsonPostForm(url, fmt.Sprintf("/datasets/%d/items", outDataset.ID), urllib.Values{
-					"key": {task.Key},
-					"ext": {item.Ext},
-					"format": {item.Format},
-					"metadata": {item.Metadata},
-					"provider": {"reference"},
-					"provider_info": {item.Fname()},
-				}, nil)
-				if err != nil {
-					return err
+				buffer := exec_ops.NewItemBuffer(url)
+				for i, key := range exec_ops.BatchTaskKeys(task) {
+					item := task.Items["inputs"][0][i]
+					provider := "reference"
+					fname := item.Fname()
+					err := buffer.Add(outDataset, skyhook.Item{
+						Key: key,
+						Ext: item.Ext,
+						Format: item.Format,
+						Metadata: item.Metadata,
+						Provider: &provider,
+						ProviderInfo: &fname,
+					})
+					if err != nil {
+						return err
+					}
 				}
-				return nil
+				return buffer.Flush()
 			}
 			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
 		},
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	urllib "net/url"
+	"sync"
 )
 
 func GetDataset(url string, id int) (skyhook.Dataset, error) {
@@ -30,15 +31,31 @@ func GetDatasets(url string, ids []int) ([]skyhook.Dataset, error) {
 	return datasets, nil
 }
 
+// Number of items to fetch per request in GetDatasetItems.
+const ItemsPageSize = 8192
+
 func GetDatasetItems(url string, dataset skyhook.Dataset) (map[string]skyhook.Item, error) {
-	var rawItems []skyhook.Item
-	err := skyhook.JsonGet(url, fmt.Sprintf("/datasets/%d/items", dataset.ID), &rawItems)
-	if err != nil {
-		return nil, fmt.Errorf("error getting items in dataset %d: %v", dataset.ID, err)
-	}
 	items := make(map[string]skyhook.Item)
-	for _, item := range rawItems {
-		items[item.Key] = item
+	// fetch the items page by page to avoid huge responses on large datasets
+	after := ""
+	for {
+		var response struct {
+			Items []skyhook.Item
+			More bool
+			Next string
+		}
+		path := fmt.Sprintf("/datasets/%d/items?limit=%d&after=%s", dataset.ID, ItemsPageSize, urllib.QueryEscape(after))
+		err := skyhook.JsonGet(url, path, &response)
+		if err != nil {
+			return nil, fmt.Errorf("error getting items in dataset %d: %v", dataset.ID, err)
+		}
+		for _, item := range response.Items {
+			items[item.Key] = item
+		}
+		if !response.More {
+			break
+		}
+		after = response.Next
 	}
 	return items, nil
 }
@@ -181,6 +198,137 @@ func WriteItem(url string, dataset skyhook.Dataset, key string, data interface{}
 	return WriteItemWithFormat(url, dataset, key, data, metadata, ext, format)
 }
 
+// Number of items that ItemBuffer adds per request, and that BatchTasks puts in each task.
+const BatchSize = 1000
+
+// ItemBuffer buffers items to add to datasets, and adds them with batch requests
+// to cut per-item HTTP overhead.
+// Callers must call Flush before returning from ExecOp.Apply, since the items
+// are not visible in the dataset until they are flushed.
+type ItemBuffer struct {
+	URL string
+	// pending items by dataset ID
+	pending map[int][]skyhook.Item
+	count int
+	mu sync.Mutex
+}
+
+func NewItemBuffer(url string) *ItemBuffer {
+	return &ItemBuffer{
+		URL: url,
+		pending: make(map[int][]skyhook.Item),
+	}
+}
+
+// Buffer an arbitrary item, e.g. one with a provider.
+// The item is flushed automatically once BatchSize items are buffered.
+func (b *ItemBuffer) Add(dataset skyhook.Dataset, item skyhook.Item) error {
+	item.Dataset = dataset
+	b.mu.Lock()
+	b.pending[dataset.ID] = append(b.pending[dataset.ID], item)
+	b.count++
+	full := b.count >= BatchSize
+	b.mu.Unlock()
+	if full {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Like the AddItem function, but the item is buffered.
+// The returned item can be used to write the data before it is flushed.
+func (b *ItemBuffer) AddItem(dataset skyhook.Dataset, key string, ext string, format string, metadata skyhook.DataMetadata) (skyhook.Item, error) {
+	item := skyhook.Item{
+		Dataset: dataset,
+		Key: key,
+		Ext: ext,
+		Format: format,
+		Metadata: string(skyhook.JsonMarshal(metadata)),
+	}
+	return item, b.Add(dataset, item)
+}
+
+// Like the WriteItemWithFormat function, but the item is buffered.
+// We write the data immediately, so the item will have its data once it's flushed.
+func (b *ItemBuffer) WriteItemWithFormat(dataset skyhook.Dataset, key string, data interface{}, metadata skyhook.DataMetadata, ext string, format string) error {
+	item := skyhook.Item{
+		Dataset: dataset,
+		Key: key,
+		Ext: ext,
+		Format: format,
+		Metadata: string(skyhook.JsonMarshal(metadata)),
+	}
+	if err := item.UpdateData(data, metadata); err != nil {
+		return err
+	}
+	return b.Add(dataset, item)
+}
+
+// Like the WriteItem function, but the item is buffered.
+func (b *ItemBuffer) WriteItem(dataset skyhook.Dataset, key string, data interface{}, metadata skyhook.DataMetadata) error {
+	ext, format := dataset.DataSpec().GetDefaultExtAndFormat(data, metadata)
+	return b.WriteItemWithFormat(dataset, key, data, metadata, ext, format)
+}
+
+// Add all buffered items to their datasets.
+func (b *ItemBuffer) Flush() error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[int][]skyhook.Item)
+	b.count = 0
+	b.mu.Unlock()
+
+	for dsID, items := range pending {
+		err := skyhook.JsonPost(b.URL, fmt.Sprintf("/datasets/%d/batch/add", dsID), items, nil)
+		if err != nil {
+			return fmt.Errorf("error adding items to dataset %d: %v", dsID, err)
+		}
+	}
+	return nil
+}
+
+// Merge tasks into batches of up to BatchSize tasks each, so that ops can handle
+// many keys per task and add their outputs with an ItemBuffer.
+// Each original task must have one item per input dataset, as in SimpleTasks.
+// In the merged task, the items at each input are concatenated, and Metadata is the
+// JSON-encoded list of keys of the original tasks (see BatchTaskKeys).
+// This should only be used for non-incremental ops since Key is not an output key.
+func BatchTasks(tasks []skyhook.ExecTask) []skyhook.ExecTask {
+	var batches []skyhook.ExecTask
+	for start := 0; start < len(tasks); start += BatchSize {
+		end := start+BatchSize
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		var keys []string
+		items := make(map[string][][]skyhook.Item)
+		for _, task := range tasks[start:end] {
+			keys = append(keys, task.Key)
+			for name, itemLists := range task.Items {
+				if items[name] == nil {
+					items[name] = make([][]skyhook.Item, len(itemLists))
+				}
+				for i, itemList := range itemLists {
+					items[name][i] = append(items[name][i], itemList...)
+				}
+			}
+		}
+		batches = append(batches, skyhook.ExecTask{
+			Key: keys[0],
+			Items: items,
+			Metadata: string(skyhook.JsonMarshal(keys)),
+		})
+	}
+	return batches
+}
+
+// Returns the keys of the original tasks in a task produced by BatchTasks.
+func BatchTaskKeys(task skyhook.ExecTask) []string {
+	var keys []string
+	skyhook.JsonUnmarshal([]byte(task.Metadata), &keys)
+	return keys
+}
+
 func MapGetOutputKeys(node skyhook.ExecNode, inputs map[string][][]string) []string {
 	// get shared keys across parents
 	var numDatasets int = 0
@@ -0,0 +1,159 @@
+package video_edit
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A range of frames [Start, End). End is -1 for the end of the video.
+type frameRange [2]int
+
+// Parse a time like "12:30", "1:02:03.5", or "95.5" to seconds.
+func parseTime(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	var seconds float64
+	for _, part := range parts {
+		x, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || x < 0 {
+			return 0, fmt.Errorf("invalid time %s", s)
+		}
+		seconds = seconds*60 + x
+	}
+	return seconds, nil
+}
+
+// Parse a range boundary in the given units to a frame index.
+// An empty string returns -1.
+func parseBoundary(s string, units string, fps float64) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return -1, nil
+	}
+	if units == "frames" {
+		x, err := strconv.Atoi(s)
+		if err != nil || x < 0 {
+			return 0, fmt.Errorf("invalid frame index %s", s)
+		}
+		return x, nil
+	}
+	seconds, err := parseTime(s)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(seconds * fps)), nil
+}
+
+func parseRange(start string, end string, units string, fps float64) (frameRange, error) {
+	var r frameRange
+	var err error
+	r[0], err = parseBoundary(start, units, fps)
+	if err != nil {
+		return r, err
+	}
+	if r[0] < 0 {
+		r[0] = 0
+	}
+	r[1], err = parseBoundary(end, units, fps)
+	if err != nil {
+		return r, err
+	}
+	if r[1] >= 0 && r[1] <= r[0] {
+		return r, fmt.Errorf("range %s-%s is empty", start, end)
+	}
+	return r, nil
+}
+
+// Parse ranges like "12:00-18:00, 20:00-", separated by commas or newlines.
+func parseRanges(s string, units string, fps float64) ([]frameRange, error) {
+	var ranges []frameRange
+	for _, line := range strings.FieldsFunc(s, func(c rune) bool { return c == '\n' || c == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid range %s, expected start-end", line)
+		}
+		r, err := parseRange(parts[0], parts[1], units, fps)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Get the ranges from a table, using the "start" and "end" columns if they exist,
+// or else the first two columns.
+func tableRanges(table skyhook.TableData, metadata skyhook.TableMetadata, units string, fps float64) ([]frameRange, error) {
+	startCol, endCol := 0, 1
+	for i, col := range metadata.Columns {
+		if col.Label == "start" {
+			startCol = i
+		} else if col.Label == "end" {
+			endCol = i
+		}
+	}
+	var ranges []frameRange
+	for _, row := range table {
+		if startCol >= len(row) {
+			continue
+		}
+		var end string
+		if endCol < len(row) {
+			end = row[endCol]
+		}
+		r, err := parseRange(row[startCol], end, units, fps)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// Clip the ranges to the number of frames, if known, and drop ranges that become empty.
+func clipRanges(ranges []frameRange, numFrames int) []frameRange {
+	var clipped []frameRange
+	for _, r := range ranges {
+		if numFrames > 0 && (r[1] < 0 || r[1] > numFrames) {
+			r[1] = numFrames
+		}
+		if r[1] >= 0 && r[1] <= r[0] {
+			continue
+		}
+		clipped = append(clipped, r)
+	}
+	return clipped
+}
+
+// Sort the ranges and merge overlapping ones, so that they can be written in one pass.
+func mergeRanges(ranges []frameRange) []frameRange {
+	sorted := append([]frameRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0] < sorted[j][0]
+	})
+	var merged []frameRange
+	for _, r := range sorted {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if last[1] < 0 || r[0] <= last[1] {
+				if last[1] >= 0 && (r[1] < 0 || r[1] > last[1]) {
+					last[1] = r[1]
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
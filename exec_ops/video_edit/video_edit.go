@@ -0,0 +1,436 @@
+package video_edit
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+)
+
+// Trim videos to time or frame ranges, and optionally concatenate the clips.
+// Detection and shape datasets aligned with the video are cut the same way.
+// The ranges come from the ranges table input for each key if it is provided, or else
+// from the parameters. Note that if the ranges table is provided, only keys that appear
+// in the table are processed.
+
+type Params struct {
+	// "trim" (default) writes the ranges of each video to an item with the same key
+	// "clips" writes each range to a separate item
+	// "concatenate" writes the ranges of all the videos, in order of key, to one item
+	Mode string
+	// "seconds" (default), where times can also be written like "12:30", or "frames"
+	Units string
+	// ranges like "12:00-18:00", separated by commas or newlines
+	// leave the end empty (like "12:00-") to extract until the end of the video
+	// if there are no ranges, the entire video is used
+	Ranges string
+}
+
+func (params Params) GetMode() string {
+	if params.Mode == "" {
+		return "trim"
+	}
+	return params.Mode
+}
+
+func (params Params) GetUnits() string {
+	if params.Units == "" {
+		return "seconds"
+	}
+	return params.Units
+}
+
+// A video, the items aligned with it, and the ranges to extract.
+type clipSource struct {
+	Key string
+	Video skyhook.Item
+	Metadata skyhook.VideoMetadata
+	Others []skyhook.Item
+	// loaded data of Others
+	OthersData []interface{}
+	Ranges []frameRange
+}
+
+// Returns the number of frames in the ranges, or 0 if it is not known.
+func (src clipSource) numFrames(ranges []frameRange) int {
+	var n int
+	for _, r := range ranges {
+		if r[1] < 0 {
+			return 0
+		}
+		n += r[1] - r[0]
+	}
+	return n
+}
+
+// Cut the frames [i, j) from the aligned detection or shape data, offsetting the track
+// IDs by trackOffset. Frames beyond the end of the data are empty.
+// Also returns the maximum track ID after the offset.
+func sliceFrames(data interface{}, i int, j int, trackOffset int) (interface{}, int) {
+	var maxID int
+	switch x := data.(type) {
+	case [][]skyhook.Detection:
+		out := make([][]skyhook.Detection, j-i)
+		for k := range out {
+			out[k] = []skyhook.Detection{}
+			if i+k >= len(x) {
+				continue
+			}
+			for _, d := range x[i+k] {
+				if d.TrackID > 0 {
+					d.TrackID += trackOffset
+					if d.TrackID > maxID {
+						maxID = d.TrackID
+					}
+				}
+				out[k] = append(out[k], d)
+			}
+		}
+		return out, maxID
+	case [][]skyhook.Shape:
+		out := make([][]skyhook.Shape, j-i)
+		for k := range out {
+			out[k] = []skyhook.Shape{}
+			if i+k >= len(x) {
+				continue
+			}
+			for _, shape := range x[i+k] {
+				if shape.TrackID > 0 {
+					shape.TrackID += trackOffset
+					if shape.TrackID > maxID {
+						maxID = shape.TrackID
+					}
+				}
+				out[k] = append(out[k], shape)
+			}
+		}
+		return out, maxID
+	}
+	return nil, 0
+}
+
+type VideoEdit struct {
+	URL string
+	Params Params
+	Datasets map[string]skyhook.Dataset
+}
+
+func (e *VideoEdit) Parallelism() int {
+	// each ffmpeg runs with two threads
+	return runtime.NumCPU()/2
+}
+
+func (e *VideoEdit) getSource(key string, group map[string][]skyhook.Item) (clipSource, error) {
+	src := clipSource{
+		Key: key,
+		Video: group["video"][0],
+		Others: group["others"],
+	}
+	src.Metadata = src.Video.DecodeMetadata().(skyhook.VideoMetadata)
+	fps := 1.0
+	if src.Metadata.Framerate[0] > 0 && src.Metadata.Framerate[1] > 0 {
+		fps = float64(src.Metadata.Framerate[0]) / float64(src.Metadata.Framerate[1])
+	}
+
+	var ranges []frameRange
+	var err error
+	if len(group["ranges"]) > 0 {
+		data, metadata, loadErr := group["ranges"][0].LoadData()
+		if loadErr != nil {
+			return src, loadErr
+		}
+		ranges, err = tableRanges(data.(skyhook.TableData), metadata.(skyhook.TableMetadata), e.Params.GetUnits(), fps)
+	} else {
+		ranges, err = parseRanges(e.Params.Ranges, e.Params.GetUnits(), fps)
+	}
+	if err != nil {
+		return src, fmt.Errorf("ranges for %s: %v", key, err)
+	}
+	if len(ranges) == 0 {
+		ranges = []frameRange{{0, -1}}
+	}
+	var numFrames int
+	if src.Metadata.Framerate[1] > 0 {
+		numFrames = src.Metadata.NumFrames()
+	}
+	src.Ranges = clipRanges(ranges, numFrames)
+	if len(src.Ranges) == 0 {
+		return src, fmt.Errorf("ranges for %s are beyond the end of the video", key)
+	}
+
+	for _, item := range src.Others {
+		data, _, err := item.LoadData()
+		if err != nil {
+			return src, err
+		}
+		src.OthersData = append(src.OthersData, data)
+	}
+	return src, nil
+}
+
+// Add output items for the video and the aligned datasets, and return their writers.
+func (e *VideoEdit) addOutputs(key string, src clipSource, numFrames int) ([]skyhook.SequenceWriter, error) {
+	var writers []skyhook.SequenceWriter
+	closeAll := func() {
+		for _, writer := range writers {
+			writer.Close()
+		}
+	}
+
+	metadata := src.Metadata
+	if numFrames > 0 && metadata.Framerate[0] > 0 {
+		metadata.Duration = float64(numFrames*metadata.Framerate[1])/float64(metadata.Framerate[0])
+	}
+	item, err := exec_ops.AddItem(e.URL, e.Datasets["video"], key, src.Video.Ext, src.Video.Format, metadata)
+	if err != nil {
+		return nil, err
+	}
+	writers = append(writers, item.LoadWriter())
+
+	for i, other := range src.Others {
+		ds, ok := e.Datasets[fmt.Sprintf("others%d", i)]
+		if !ok {
+			closeAll()
+			return nil, fmt.Errorf("output others%d is missing", i)
+		}
+		item, err := exec_ops.AddItem(e.URL, ds, key, other.Ext, other.Format, other.DecodeMetadata())
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		writers = append(writers, item.LoadWriter())
+	}
+	return writers, nil
+}
+
+// Write the frames in the range from the video and the aligned datasets.
+// trackOffsets are added to the track IDs of each aligned dataset, and maxIDs is updated
+// with the maximum track IDs that were written.
+func copyRange(src clipSource, r frameRange, writers []skyhook.SequenceWriter, trackOffsets []int, maxIDs []int) error {
+	// seek to the start of the range if the video is in a file
+	var reader skyhook.SequenceReader
+	pos := 0
+	sliceSpec, ok := src.Video.DataSpec().(skyhook.RandomAccessDataSpec)
+	if fname := src.Video.Fname(); ok && fname != "" {
+		end := r[0]
+		if r[1] >= 0 {
+			end = r[1]
+		}
+		reader = sliceSpec.ReadSlice(src.Video.Format, src.Metadata, fname, r[0], end)
+		pos = r[0]
+	} else {
+		reader, _ = src.Video.LoadReader()
+	}
+	defer reader.Close()
+
+	for r[1] < 0 || pos < r[1] {
+		data, err := reader.Read(32)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		ims := data.([]skyhook.Image)
+		// drop frames before or after the range
+		lo, hi := 0, len(ims)
+		if pos < r[0] {
+			lo = r[0] - pos
+		}
+		if r[1] >= 0 && pos+hi > r[1] {
+			hi = r[1] - pos
+		}
+		if lo < hi {
+			if err := writers[0].Write(ims[lo:hi]); err != nil {
+				return err
+			}
+			for i, otherData := range src.OthersData {
+				cut, maxID := sliceFrames(otherData, pos+lo, pos+hi, trackOffsets[i])
+				if maxID > maxIDs[i] {
+					maxIDs[i] = maxID
+				}
+				if err := writers[i+1].Write(cut); err != nil {
+					return err
+				}
+			}
+		}
+		pos += len(ims)
+	}
+	return nil
+}
+
+func closeWriters(writers []skyhook.SequenceWriter) error {
+	var closeErr error
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+func (e *VideoEdit) Apply(task skyhook.ExecTask) error {
+	groups := exec_ops.GroupItems(task.Items)
+	var keys []string
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sources []clipSource
+	for _, key := range keys {
+		src, err := e.getSource(key, groups[key])
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	mode := e.Params.GetMode()
+	numOthers := len(sources[0].Others)
+	noOffsets := make([]int, numOthers)
+
+	if mode == "trim" || mode == "clips" {
+		for _, src := range sources {
+			if mode == "trim" {
+				// the ranges must be in order to write them in one pass
+				ranges := mergeRanges(src.Ranges)
+				writers, err := e.addOutputs(src.Key, src, src.numFrames(ranges))
+				if err != nil {
+					return err
+				}
+				for _, r := range ranges {
+					if err := copyRange(src, r, writers, noOffsets, make([]int, numOthers)); err != nil {
+						closeWriters(writers)
+						return err
+					}
+				}
+				if err := closeWriters(writers); err != nil {
+					return err
+				}
+				continue
+			}
+
+			for _, r := range src.Ranges {
+				clipKey := fmt.Sprintf("%s_%d_%d", src.Key, r[0], r[1])
+				writers, err := e.addOutputs(clipKey, src, src.numFrames([]frameRange{r}))
+				if err != nil {
+					return err
+				}
+				if err := copyRange(src, r, writers, noOffsets, make([]int, numOthers)); err != nil {
+					closeWriters(writers)
+					return err
+				}
+				if err := closeWriters(writers); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	} else if mode != "concatenate" {
+		return fmt.Errorf("unknown mode %s", mode)
+	}
+
+	// concatenate: the videos must have the same dims and framerate
+	first := sources[0].Metadata
+	var numFrames int
+	for _, src := range sources {
+		if src.Metadata.Dims != first.Dims || src.Metadata.Framerate != first.Framerate {
+			return fmt.Errorf(
+				"cannot concatenate %s (dims %v, framerate %v) with %s (dims %v, framerate %v)",
+				src.Key, src.Metadata.Dims, src.Metadata.Framerate,
+				sources[0].Key, first.Dims, first.Framerate,
+			)
+		}
+		if len(src.Others) != numOthers {
+			return fmt.Errorf("item %s is missing aligned items", src.Key)
+		}
+		n := src.numFrames(src.Ranges)
+		if n == 0 || numFrames < 0 {
+			numFrames = -1
+		} else {
+			numFrames += n
+		}
+	}
+	if numFrames < 0 {
+		numFrames = 0
+	}
+	writers, err := e.addOutputs(task.Key, sources[0], numFrames)
+	if err != nil {
+		return err
+	}
+	// offset the track IDs of each video so that tracks from different videos don't collide
+	trackOffsets := make([]int, numOthers)
+	maxIDs := make([]int, numOthers)
+	for _, src := range sources {
+		for _, r := range src.Ranges {
+			if err := copyRange(src, r, writers, trackOffsets, maxIDs); err != nil {
+				closeWriters(writers)
+				return err
+			}
+		}
+		copy(trackOffsets, maxIDs)
+	}
+	return closeWriters(writers)
+}
+
+func (e *VideoEdit) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "video_edit",
+			Name: "Video Edit",
+			Description: "Trim videos by time or frame ranges and concatenate clips, along with aligned detections or shapes",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "video", DataTypes: []skyhook.DataType{skyhook.VideoType}},
+			{Name: "ranges", DataTypes: []skyhook.DataType{skyhook.TableType}, Variable: true},
+			{Name: "others", DataTypes: []skyhook.DataType{skyhook.DetectionType, skyhook.ShapeType}, Variable: true},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			outputs := []skyhook.ExecOutput{{Name: "video", DataType: skyhook.VideoType}}
+			for i, inputType := range inputTypes["others"] {
+				outputs = append(outputs, skyhook.ExecOutput{
+					Name: fmt.Sprintf("others%d", i),
+					DataType: inputType,
+				})
+			}
+			return outputs
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			var params Params
+			if node.Params != "" {
+				if err := json.Unmarshal([]byte(node.Params), &params); err != nil {
+					return nil, fmt.Errorf("error decoding parameters: %v", err)
+				}
+			}
+			if params.GetMode() == "concatenate" {
+				return exec_ops.SingleTask("concatenate")(node, rawItems)
+			}
+			return exec_ops.SimpleTasks(node, rawItems)
+		},
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			op := &VideoEdit{
+				URL: url,
+				Params: params,
+				Datasets: node.OutputDatasets,
+			}
+			return op, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
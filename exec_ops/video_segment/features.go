@@ -0,0 +1,215 @@
+package video_segment
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+
+	"math"
+	"sort"
+)
+
+// Frames are downsampled to a grid of this many cells horizontally for computing motion.
+const GridWidth = 32
+
+// Number of histogram bins per color channel.
+const HistogramBins = 16
+
+// Per-frame features computed while streaming through the video.
+type frameFeatures struct {
+	// normalized color histogram, with HistogramBins bins for each channel
+	Histogram []float64
+	// mean absolute grayscale difference from the previous frame, in [0, 1]
+	Motion float64
+	// histogram distance from the previous frame, in [0, 1]
+	HistDiff float64
+}
+
+type featureExtractor struct {
+	prevGray []float64
+	frames []frameFeatures
+}
+
+func (fe *featureExtractor) Add(im skyhook.Image) {
+	gridHeight := GridWidth * im.Height / im.Width
+	if gridHeight < 1 {
+		gridHeight = 1
+	}
+	gray := make([]float64, GridWidth*gridHeight)
+	histogram := make([]float64, 3*HistogramBins)
+	var count float64
+	for gy := 0; gy < gridHeight; gy++ {
+		for gx := 0; gx < GridWidth; gx++ {
+			// sample the center pixel of each cell
+			x := (2*gx+1) * im.Width / (2*GridWidth)
+			y := (2*gy+1) * im.Height / (2*gridHeight)
+			color := im.GetRGB(x, y)
+			gray[gy*GridWidth+gx] = (0.299*float64(color[0]) + 0.587*float64(color[1]) + 0.114*float64(color[2])) / 255
+			for c := 0; c < 3; c++ {
+				histogram[c*HistogramBins + int(color[c])*HistogramBins/256]++
+			}
+			count++
+		}
+	}
+	for i := range histogram {
+		histogram[i] /= 3*count
+	}
+
+	features := frameFeatures{Histogram: histogram}
+	if len(fe.frames) > 0 && len(fe.prevGray) == len(gray) {
+		var diff float64
+		for i := range gray {
+			diff += math.Abs(gray[i] - fe.prevGray[i])
+		}
+		features.Motion = diff / float64(len(gray))
+		features.HistDiff = histogramDistance(histogram, fe.frames[len(fe.frames)-1].Histogram)
+	}
+	fe.prevGray = gray
+	fe.frames = append(fe.frames, features)
+}
+
+// Total variation distance between two normalized histograms.
+func histogramDistance(a []float64, b []float64) float64 {
+	var d float64
+	for i := range a {
+		d += math.Abs(a[i] - b[i])
+	}
+	return d / 2
+}
+
+type segment struct {
+	// frame range [Start, End)
+	Start int
+	End int
+	// histogram distance at the cut that starts this segment
+	CutScore float64
+	MeanMotion float64
+	MaxMotion float64
+}
+
+// Split the frames into shots at frames whose histogram changes by at least cutThreshold.
+// Cuts closer than minLength frames to the previous cut are ignored.
+func findSegments(frames []frameFeatures, cutThreshold float64, minLength int) []segment {
+	var segments []segment
+	cur := segment{}
+	for i := 1; i < len(frames); i++ {
+		if frames[i].HistDiff < cutThreshold || i - cur.Start < minLength {
+			continue
+		}
+		cur.End = i
+		segments = append(segments, cur)
+		cur = segment{Start: i, CutScore: frames[i].HistDiff}
+	}
+	if len(frames) > 0 {
+		cur.End = len(frames)
+		segments = append(segments, cur)
+	}
+
+	for i := range segments {
+		seg := &segments[i]
+		// the motion of the first frame is across the cut, so we skip it
+		var sum float64
+		var count int
+		for j := seg.Start+1; j < seg.End; j++ {
+			sum += frames[j].Motion
+			seg.MaxMotion = math.Max(seg.MaxMotion, frames[j].Motion)
+			count++
+		}
+		if count > 0 {
+			seg.MeanMotion = sum / float64(count)
+		}
+	}
+	return segments
+}
+
+// Returns the frame in [start, end) whose histogram is closest to the mean histogram of the range.
+func representativeFrame(frames []frameFeatures, start int, end int) int {
+	mean := make([]float64, len(frames[start].Histogram))
+	for i := start; i < end; i++ {
+		for j, x := range frames[i].Histogram {
+			mean[j] += x / float64(end-start)
+		}
+	}
+	best := start
+	bestDistance := math.Inf(1)
+	for i := start; i < end; i++ {
+		d := histogramDistance(frames[i].Histogram, mean)
+		if d < bestDistance {
+			best = i
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// Pick count representative frames in each segment, by splitting the segment into count
+// equal parts and picking the representative frame of each part.
+// Returns [start, end) intervals of the given length centered at the frames.
+func representativeSamples(frames []frameFeatures, segments []segment, count int, length int) [][2]int {
+	var samples [][2]int
+	for _, seg := range segments {
+		n := count
+		if n > seg.End - seg.Start {
+			n = seg.End - seg.Start
+		}
+		for i := 0; i < n; i++ {
+			partStart := seg.Start + i*(seg.End-seg.Start)/n
+			partEnd := seg.Start + (i+1)*(seg.End-seg.Start)/n
+			frame := representativeFrame(frames, partStart, partEnd)
+			start := frame - length/2
+			if start + length > seg.End {
+				start = seg.End - length
+			}
+			if start < seg.Start {
+				start = seg.Start
+			}
+			end := start + length
+			if end > seg.End {
+				// the segment is shorter than the sample length
+				continue
+			}
+			samples = append(samples, [2]int{start, end})
+		}
+	}
+	return samples
+}
+
+// Split each segment into windows of the given length, and pick windows where the mean
+// motion is at least threshold. If count > 0, only the count windows with highest motion
+// are picked.
+func motionSamples(frames []frameFeatures, segments []segment, threshold float64, count int, length int) [][2]int {
+	type window struct {
+		Interval [2]int
+		Motion float64
+	}
+	var windows []window
+	for _, seg := range segments {
+		for start := seg.Start; start + length <= seg.End; start += length {
+			var sum float64
+			var n int
+			for i := start; i < start+length; i++ {
+				if i == seg.Start {
+					continue
+				}
+				sum += frames[i].Motion
+				n++
+			}
+			if n == 0 || sum / float64(n) < threshold {
+				continue
+			}
+			windows = append(windows, window{[2]int{start, start+length}, sum / float64(n)})
+		}
+	}
+	if count > 0 && len(windows) > count {
+		sort.SliceStable(windows, func(i, j int) bool {
+			return windows[i].Motion > windows[j].Motion
+		})
+		windows = windows[0:count]
+	}
+	samples := make([][2]int, len(windows))
+	for i, w := range windows {
+		samples[i] = w.Interval
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i][0] < samples[j][0]
+	})
+	return samples
+}
@@ -0,0 +1,272 @@
+package video_segment
+
+import (
+	"github.com/skyhookml/skyhookml/skyhook"
+	"github.com/skyhookml/skyhookml/exec_ops"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"strconv"
+)
+
+// Split videos into shots at scene cuts, which are detected from changes in the color
+// histogram between consecutive frames, and measure the motion in each shot by frame
+// differencing. Optionally, sample representative frames from each shot, or windows
+// with high motion, so that we don't waste annotation effort on static frames.
+
+type Params struct {
+	// minimum histogram distance between consecutive frames to detect a cut, default 0.35
+	CutThreshold float64
+	// minimum segment length in frames, default 5
+	MinLength int
+
+	// "" (no samples), "representative", or "motion"
+	Sample string
+	// length in frames of each sample, default 1
+	// samples of length 1 are output as images, and longer samples as video
+	Length int
+	// for "representative", the number of samples per segment, default 1
+	// for "motion", the maximum number of samples per video, 0 for no limit
+	Count int
+	// for "motion", the minimum mean motion of a sample (0-1), default 0.02
+	MotionThreshold float64
+}
+
+func (params Params) GetCutThreshold() float64 {
+	if params.CutThreshold <= 0 {
+		return 0.35
+	}
+	return params.CutThreshold
+}
+
+func (params Params) GetMinLength() int {
+	if params.MinLength <= 0 {
+		return 5
+	}
+	return params.MinLength
+}
+
+func (params Params) GetLength() int {
+	if params.Length <= 0 {
+		return 1
+	}
+	return params.Length
+}
+
+func (params Params) GetMotionThreshold() float64 {
+	if params.MotionThreshold <= 0 {
+		return 0.02
+	}
+	return params.MotionThreshold
+}
+
+func (params Params) samples(frames []frameFeatures, segments []segment) ([][2]int, error) {
+	switch params.Sample {
+	case "":
+		return nil, nil
+	case "representative":
+		count := params.Count
+		if count <= 0 {
+			count = 1
+		}
+		return representativeSamples(frames, segments, count, params.GetLength()), nil
+	case "motion":
+		return motionSamples(frames, segments, params.GetMotionThreshold(), params.Count, params.GetLength()), nil
+	}
+	return nil, fmt.Errorf("unknown sample mode %s", params.Sample)
+}
+
+func formatFloat(x float64) string {
+	return strconv.FormatFloat(x, 'f', 4, 64)
+}
+
+var segmentColumns = []skyhook.ColumnSpec{
+	{Label: "segment", Type: "int"},
+	{Label: "start", Type: "int"},
+	{Label: "end", Type: "int"},
+	{Label: "start_time", Type: "float64"},
+	{Label: "end_time", Type: "float64"},
+	{Label: "cut_score", Type: "float64"},
+	{Label: "mean_motion", Type: "float64"},
+	{Label: "max_motion", Type: "float64"},
+	{Label: "representative", Type: "int"},
+}
+
+type VideoSegment struct {
+	URL string
+	Params Params
+	Datasets map[string]skyhook.Dataset
+}
+
+func (e *VideoSegment) Parallelism() int {
+	// each ffmpeg runs with two threads
+	return runtime.NumCPU()/2
+}
+
+func (e *VideoSegment) Apply(task skyhook.ExecTask) error {
+	item := task.Items["video"][0][0]
+	metadata := item.DecodeMetadata().(skyhook.VideoMetadata)
+	fps := 1.0
+	if metadata.Framerate[0] > 0 && metadata.Framerate[1] > 0 {
+		fps = float64(metadata.Framerate[0]) / float64(metadata.Framerate[1])
+	}
+
+	// compute the per-frame features in one pass through the video
+	reader, _ := item.LoadReader()
+	fe := &featureExtractor{}
+	for {
+		data, err := reader.Read(32)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			reader.Close()
+			return err
+		}
+		for _, im := range data.([]skyhook.Image) {
+			fe.Add(im)
+		}
+	}
+	reader.Close()
+
+	segments := findSegments(fe.frames, e.Params.GetCutThreshold(), e.Params.GetMinLength())
+	var table skyhook.TableData
+	for i, seg := range segments {
+		table = append(table, []string{
+			strconv.Itoa(i),
+			strconv.Itoa(seg.Start), strconv.Itoa(seg.End),
+			formatFloat(float64(seg.Start) / fps), formatFloat(float64(seg.End) / fps),
+			formatFloat(seg.CutScore),
+			formatFloat(seg.MeanMotion), formatFloat(seg.MaxMotion),
+			strconv.Itoa(representativeFrame(fe.frames, seg.Start, seg.End)),
+		})
+	}
+	err := exec_ops.WriteItem(e.URL, e.Datasets["segments"], task.Key, table, skyhook.TableMetadata{
+		Columns: segmentColumns,
+	})
+	if err != nil {
+		return err
+	}
+
+	samples, err := e.Params.samples(fe.frames, segments)
+	if err != nil {
+		return err
+	}
+	log.Printf("[video_segment] found %d segments and %d samples in %s", len(segments), len(samples), task.Key)
+	if len(samples) == 0 {
+		return nil
+	}
+	return e.extractSamples(task.Key, item, metadata, samples)
+}
+
+// Write the frames in each sample interval to the samples dataset, in a second pass
+// through the video.
+func (e *VideoSegment) extractSamples(key string, item skyhook.Item, metadata skyhook.VideoMetadata, samples [][2]int) error {
+	ds, ok := e.Datasets["samples"]
+	if !ok {
+		return fmt.Errorf("samples output is missing, the node may need to be saved again")
+	}
+	startToEnd := make(map[int][]int)
+	for _, sample := range samples {
+		startToEnd[sample[0]] = append(startToEnd[sample[0]], sample[1])
+	}
+
+	type processingSample struct {
+		End int
+		Writer skyhook.SequenceWriter
+	}
+	processing := make(map[string]processingSample)
+
+	err := skyhook.PerFrame([]skyhook.Item{item}, func(pos int, datas []interface{}) error {
+		for _, end := range startToEnd[pos] {
+			sampleKey := fmt.Sprintf("%s_%d_%d", key, pos, end)
+			if _, ok := processing[sampleKey]; ok {
+				continue
+			}
+			var outputItem skyhook.Item
+			var err error
+			if ds.DataType == skyhook.ImageType {
+				outputItem, err = exec_ops.AddItem(e.URL, ds, sampleKey, "jpg", "jpeg", skyhook.NoMetadata{})
+			} else {
+				vmeta := metadata
+				vmeta.Duration = float64((end-pos)*vmeta.Framerate[1])/float64(vmeta.Framerate[0])
+				outputItem, err = exec_ops.AddItem(e.URL, ds, sampleKey, item.Ext, item.Format, vmeta)
+			}
+			if err != nil {
+				return err
+			}
+			processing[sampleKey] = processingSample{end, outputItem.LoadWriter()}
+		}
+
+		for sampleKey, sample := range processing {
+			if err := sample.Writer.Write(datas[0]); err != nil {
+				return err
+			}
+			if pos+1 < sample.End {
+				continue
+			}
+			delete(processing, sampleKey)
+			if err := sample.Writer.Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// close any remaining writers, e.g. if the video is shorter than its metadata says
+	for sampleKey, sample := range processing {
+		delete(processing, sampleKey)
+		sample.Writer.Close()
+		if err == nil {
+			err = fmt.Errorf("sample %s still processing after iteration", sampleKey)
+		}
+	}
+	return err
+}
+
+func (e *VideoSegment) Close() {}
+
+func init() {
+	skyhook.AddExecOpImpl(skyhook.ExecOpImpl{
+		Config: skyhook.ExecOpConfig{
+			ID: "video_segment",
+			Name: "Video Segmentation",
+			Description: "Detect scene cuts and motion in video, and sample representative or high-motion frames",
+		},
+		Inputs: []skyhook.ExecInput{
+			{Name: "video", DataTypes: []skyhook.DataType{skyhook.VideoType}},
+		},
+		GetOutputs: func(rawParams string, inputTypes map[string][]skyhook.DataType) []skyhook.ExecOutput {
+			outputs := []skyhook.ExecOutput{{Name: "segments", DataType: skyhook.TableType}}
+			var params Params
+			if err := json.Unmarshal([]byte(rawParams), &params); err != nil || params.Sample == "" {
+				return outputs
+			}
+			// like video_sample, samples of one frame are images
+			var dtype skyhook.DataType = skyhook.VideoType
+			if params.GetLength() == 1 {
+				dtype = skyhook.ImageType
+			}
+			return append(outputs, skyhook.ExecOutput{Name: "samples", DataType: dtype})
+		},
+		Requirements: func(node skyhook.Runnable) map[string]int {
+			return nil
+		},
+		GetTasks: exec_ops.SimpleTasks,
+		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
+			var params Params
+			if err := exec_ops.DecodeParams(node, &params, true); err != nil {
+				return nil, err
+			}
+			op := &VideoSegment{
+				URL: url,
+				Params: params,
+				Datasets: node.OutputDatasets,
+			}
+			return op, nil
+		},
+		ImageName: "skyhookml/basic",
+	})
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/skyhookml/skyhookml/exec_ops"
 
 	"fmt"
-	urllib "net/url"
 )
 
 func init() {
@@ -29,25 +28,36 @@ func init() {
 		Requirements: func(node skyhook.Runnable) map[string]int {
 			return nil
 		},
-		GetTasks: exec_ops.SimpleTasks,
+		GetTasks: func(node skyhook.Runnable, rawItems map[string][][]skyhook.Item) ([]skyhook.ExecTask, error) {
+			tasks, err := exec_ops.SimpleTasks(node, rawItems)
+			if err != nil {
+				return nil, err
+			}
+			return exec_ops.BatchTasks(tasks), nil
+		},
 		Prepare: func(url string, node skyhook.Runnable) (skyhook.ExecOp, error) {
 			applyFunc := func(task skyhook.ExecTask) error {
-				for i, itemList := range task.Items["inputs"] {
-					item := itemList[0]
-					dataset := node.OutputDatasets[fmt.Sprintf("outputs%d", i)]
-					err := skyhook.JsonPostForm(url, fmt.Sprintf("/datasets/%d/items", dataset.ID), urllib.Values{
-						"key": {task.Key},
-						"ext": {item.Ext},
-						"format": {item.Format},
-						"metadata": {item.Metadata},
-						"provider": {"virtual_debug"},
-						"provider_info": {string(skyhook.JsonMarshal(item))},
-					}, nil)
-					if err != nil {
-						return err
+				buffer := exec_ops.NewItemBuffer(url)
+				for j, key := range exec_ops.BatchTaskKeys(task) {
+					for i, itemList := range task.Items["inputs"] {
+						item := itemList[j]
+						dataset := node.OutputDatasets[fmt.Sprintf("outputs%d", i)]
+						provider := "virtual_debug"
+						providerInfo := string(skyhook.JsonMarshal(item))
+						err := buffer.Add(dataset, skyhook.Item{
+							Key: key,
+							Ext: item.Ext,
+							Format: item.Format,
+							Metadata: item.Metadata,
+							Provider: &provider,
+							ProviderInfo: &providerInfo,
+						})
+						if err != nil {
+							return err
+						}
 					}
 				}
-				return nil
+				return buffer.Flush()
 			}
 			return skyhook.SimpleExecOp{ApplyFunc: applyFunc}, nil
 		},
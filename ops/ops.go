@@ -1,14 +1,20 @@
 package ops
 
 import (
+	_ "github.com/skyhookml/skyhookml/exec_ops/active_sample"
+	_ "github.com/skyhookml/skyhookml/exec_ops/augment"
 	_ "github.com/skyhookml/skyhookml/exec_ops/concatenate"
 	_ "github.com/skyhookml/skyhookml/exec_ops/convert"
 	_ "github.com/skyhookml/skyhookml/exec_ops/cropresize"
+	_ "github.com/skyhookml/skyhookml/exec_ops/dedup"
 	_ "github.com/skyhookml/skyhookml/exec_ops/detection_filter"
+	_ "github.com/skyhookml/skyhookml/exec_ops/detection_merge"
+	_ "github.com/skyhookml/skyhookml/exec_ops/evaluate"
 	_ "github.com/skyhookml/skyhookml/exec_ops/extract_polygons"
 	_ "github.com/skyhookml/skyhookml/exec_ops/filter"
 	_ "github.com/skyhookml/skyhookml/exec_ops/geoimage_to_image"
 	_ "github.com/skyhookml/skyhookml/exec_ops/geojson_to_shape"
+	_ "github.com/skyhookml/skyhookml/exec_ops/kalman_tracker"
 	_ "github.com/skyhookml/skyhookml/exec_ops/make_geoimage"
 	_ "github.com/skyhookml/skyhookml/exec_ops/materialize"
 	_ "github.com/skyhookml/skyhookml/exec_ops/python"
@@ -16,14 +22,20 @@ import (
 	_ "github.com/skyhookml/skyhookml/exec_ops/pytorch/archs"
 	_ "github.com/skyhookml/skyhookml/exec_ops/reid_tracker"
 	_ "github.com/skyhookml/skyhookml/exec_ops/render"
+	_ "github.com/skyhookml/skyhookml/exec_ops/render_compare"
 	_ "github.com/skyhookml/skyhookml/exec_ops/resample"
 	_ "github.com/skyhookml/skyhookml/exec_ops/sample"
 	_ "github.com/skyhookml/skyhookml/exec_ops/segmentation_mask"
 	_ "github.com/skyhookml/skyhookml/exec_ops/simple_tracker"
 	_ "github.com/skyhookml/skyhookml/exec_ops/split"
+	_ "github.com/skyhookml/skyhookml/exec_ops/tiles"
+	_ "github.com/skyhookml/skyhookml/exec_ops/track_analytics"
+	_ "github.com/skyhookml/skyhookml/exec_ops/track_interpolate"
 	_ "github.com/skyhookml/skyhookml/exec_ops/union"
 	_ "github.com/skyhookml/skyhookml/exec_ops/unsupervised_reid"
+	_ "github.com/skyhookml/skyhookml/exec_ops/video_edit"
 	_ "github.com/skyhookml/skyhookml/exec_ops/video_sample"
+	_ "github.com/skyhookml/skyhookml/exec_ops/video_segment"
 	_ "github.com/skyhookml/skyhookml/exec_ops/virtual_debug"
 	_ "github.com/skyhookml/skyhookml/exec_ops/yolov3"
 )
@@ -1,9 +1,20 @@
 package skyhook
 
+// Specifies how the next key to annotate is chosen.
+type AnnotateSampler struct {
+	// "random" (default) samples uniformly among the unannotated keys.
+	// "ranked" picks the first unannotated key in the Ranking table.
+	Mode string
+	// Table dataset listing keys in priority order, e.g. the ranking output of active_sample.
+	// Keys are read from the "key" column, or the first column if there is none.
+	Ranking *ExecParent `json:",omitempty"`
+}
+
 type AnnotateDataset struct {
 	ID int
 	Dataset Dataset
 	Inputs []ExecParent
 	Tool string
 	Params string
+	Sampler AnnotateSampler
 }
@@ -3,6 +3,7 @@ package skyhook
 import (
 	"encoding/json"
 	"math"
+	"sort"
 )
 
 type DetectionMetadata struct {
@@ -40,6 +41,61 @@ func (d Detection) CenterDistance(other Detection) float64 {
 	return math.Sqrt(float64(dx*dx+dy*dy))
 }
 
+// Returns the intersection-over-union of the two boxes.
+func (d Detection) IOU(other Detection) float64 {
+	ix := math.Min(float64(d.Right), float64(other.Right)) - math.Max(float64(d.Left), float64(other.Left))
+	iy := math.Min(float64(d.Bottom), float64(other.Bottom)) - math.Max(float64(d.Top), float64(other.Top))
+	if ix <= 0 || iy <= 0 {
+		return 0
+	}
+	intersection := ix*iy
+	union := d.Area() + other.Area() - intersection
+	if union <= 0 {
+		return 0
+	}
+	return intersection/union
+}
+
+func (d Detection) Area() float64 {
+	return float64((d.Right-d.Left)*(d.Bottom-d.Top))
+}
+
+// Greedily match predictions to ground truth objects, in order of decreasing score.
+// Each prediction is matched to the unmatched ground truth object with highest IOU,
+// if it is at least the threshold. If sameCategory is set, we only match objects of the
+// same category.
+// Returns the index of the matched ground truth object for each prediction, or -1.
+func MatchDetections(gt []Detection, pred []Detection, threshold float64, sameCategory bool) []int {
+	order := make([]int, len(pred))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return pred[order[i]].Score > pred[order[j]].Score
+	})
+
+	matches := make([]int, len(pred))
+	gtUsed := make([]bool, len(gt))
+	for _, predIdx := range order {
+		matches[predIdx] = -1
+		bestIOU := threshold
+		for gtIdx := range gt {
+			if gtUsed[gtIdx] || (sameCategory && gt[gtIdx].Category != pred[predIdx].Category) {
+				continue
+			}
+			iou := pred[predIdx].IOU(gt[gtIdx])
+			if iou >= bestIOU {
+				bestIOU = iou
+				matches[predIdx] = gtIdx
+			}
+		}
+		if matches[predIdx] >= 0 {
+			gtUsed[matches[predIdx]] = true
+		}
+	}
+	return matches
+}
+
 func (d Detection) Rescale(origDims [2]int, newDims [2]int) Detection {
 	copy := d
 	copy.Left = copy.Left * newDims[0] / origDims[0]
@@ -80,6 +136,85 @@ func (s DetectionJsonSpec) Slice(data interface{}, i int, j int) interface{} {
 	return data.([][]Detection)[i:j]
 }
 
+type DetectionStats struct {
+	// Total number of frames across all items.
+	Frames int
+	// Frames with no detections.
+	EmptyFrames int
+	// Items with no detections in any frame.
+	EmptyItems StatsKeyList
+	Detections int
+	// Number of detections in each category.
+	Categories map[string]int
+	// Number of distinct track IDs, counted per item.
+	Tracks int
+
+	PerFrame Distribution
+	Widths Distribution
+	Heights Distribution
+	Areas Distribution
+	Scores Distribution
+}
+
+type detectionStatsAccumulator struct {
+	stats DetectionStats
+	perFrame, widths, heights, areas, scores DistributionAccumulator
+}
+
+func (a *detectionStatsAccumulator) Add(item Item) error {
+	data, _, err := item.LoadData()
+	if err != nil {
+		return err
+	}
+	frames := data.([][]Detection)
+	trackIDs := make(map[int]bool)
+	numDetections := 0
+	for _, dlist := range frames {
+		a.stats.Frames++
+		if len(dlist) == 0 {
+			a.stats.EmptyFrames++
+		}
+		a.perFrame.Add(float64(len(dlist)))
+		for _, d := range dlist {
+			numDetections++
+			a.stats.Categories[d.Category]++
+			if d.TrackID > 0 {
+				trackIDs[d.TrackID] = true
+			}
+			w := d.Right - d.Left
+			h := d.Bottom - d.Top
+			a.widths.Add(float64(w))
+			a.heights.Add(float64(h))
+			a.areas.Add(float64(w*h))
+			if d.Score != 0 {
+				a.scores.Add(d.Score)
+			}
+		}
+	}
+	a.stats.Detections += numDetections
+	a.stats.Tracks += len(trackIDs)
+	if numDetections == 0 {
+		a.stats.EmptyItems.Add(item.Key)
+	}
+	return nil
+}
+
+func (a *detectionStatsAccumulator) Result() interface{} {
+	stats := a.stats
+	stats.PerFrame = a.perFrame.Result()
+	stats.Widths = a.widths.Result()
+	stats.Heights = a.heights.Result()
+	stats.Areas = a.areas.Result()
+	stats.Scores = a.scores.Result()
+	return stats
+}
+
+func (s DetectionJsonSpec) NewStats() StatsAccumulator {
+	return &detectionStatsAccumulator{
+		stats: DetectionStats{Categories: make(map[string]int)},
+	}
+}
+
 func init() {
 	DataSpecs[DetectionType] = SequenceJsonDataImpl{DetectionJsonSpec{}}
 }
@@ -30,6 +30,47 @@ func (s FloatJsonSpec) Slice(data interface{}, i int, j int) interface{} {
 	return data.([][]float64)[i:j]
 }
 
+type FloatsStats struct {
+	// Number of vectors, across all items.
+	Count int
+	// Distribution of vector lengths.
+	Lengths Distribution
+	// Distribution of the values in all of the vectors.
+	Values Distribution
+}
+
+type floatsStatsAccumulator struct {
+	count int
+	lengths, values DistributionAccumulator
+}
+
+func (a *floatsStatsAccumulator) Add(item Item) error {
+	data, _, err := item.LoadData()
+	if err != nil {
+		return err
+	}
+	for _, vector := range data.([][]float64) {
+		a.count++
+		a.lengths.Add(float64(len(vector)))
+		for _, x := range vector {
+			a.values.Add(x)
+		}
+	}
+	return nil
+}
+
+func (a *floatsStatsAccumulator) Result() interface{} {
+	return FloatsStats{
+		Count: a.count,
+		Lengths: a.lengths.Result(),
+		Values: a.values.Result(),
+	}
+}
+
+func (s FloatJsonSpec) NewStats() StatsAccumulator {
+	return &floatsStatsAccumulator{}
+}
+
 func init() {
 	DataSpecs[FloatsType] = SequenceJsonDataImpl{FloatJsonSpec{}}
 }
@@ -152,6 +152,55 @@ func (s ImageDataSpec) GetExtFromFormat(format string) (ext string) {
 	return ""
 }
 
+type ImageStats struct {
+	// Number of images with each resolution, e.g. "1920x1080".
+	Dims map[string]int
+	Widths Distribution
+	Heights Distribution
+}
+
+type imageStatsAccumulator struct {
+	dims map[string]int
+	widths, heights DistributionAccumulator
+}
+
+func (a *imageStatsAccumulator) Add(item Item) error {
+	// read the dimensions from the file header if possible, to avoid decoding the image
+	var dims [2]int
+	if fname := item.Fname(); fname != "" {
+		var err error
+		dims, err = GetImageDimsFromFile(fname)
+		if err != nil {
+			return err
+		}
+	} else {
+		data, _, err := item.LoadData()
+		if err != nil {
+			return err
+		}
+		im := data.(Image)
+		dims = [2]int{im.Width, im.Height}
+	}
+	a.dims[fmt.Sprintf("%dx%d", dims[0], dims[1])]++
+	a.widths.Add(float64(dims[0]))
+	a.heights.Add(float64(dims[1]))
+	return nil
+}
+
+func (a *imageStatsAccumulator) Result() interface{} {
+	return ImageStats{
+		Dims: a.dims,
+		Widths: a.widths.Result(),
+		Heights: a.heights.Result(),
+	}
+}
+
+func (s ImageDataSpec) NewStats() StatsAccumulator {
+	return &imageStatsAccumulator{
+		dims: make(map[string]int),
+	}
+}
+
 func init() {
 	DataSpecs[ImageType] = ImageDataSpec{}
 }
@@ -2,6 +2,7 @@ package skyhook
 
 import (
 	"encoding/json"
+	"strconv"
 )
 
 type IntMetadata struct {
@@ -47,6 +48,50 @@ func (s IntJsonSpec) Slice(data interface{}, i int, j int) interface{} {
 	return data.([]int)[i:j]
 }
 
+type IntStats struct {
+	// Number of values, across all items.
+	Count int
+	// Number of occurrences of each value.
+	// If the metadata specifies categories, values are labeled with the category name.
+	Values map[string]int
+	Distribution Distribution
+}
+
+type intStatsAccumulator struct {
+	stats IntStats
+	dist DistributionAccumulator
+}
+
+func (a *intStatsAccumulator) Add(item Item) error {
+	data, metadata, err := item.LoadData()
+	if err != nil {
+		return err
+	}
+	categories := metadata.(IntMetadata).Categories
+	for _, x := range data.([]int) {
+		a.stats.Count++
+		a.dist.Add(float64(x))
+		label := strconv.Itoa(x)
+		if x >= 0 && x < len(categories) {
+			label = categories[x]
+		}
+		a.stats.Values[label]++
+	}
+	return nil
+}
+
+func (a *intStatsAccumulator) Result() interface{} {
+	stats := a.stats
+	stats.Distribution = a.dist.Result()
+	return stats
+}
+
+func (s IntJsonSpec) NewStats() StatsAccumulator {
+	return &intStatsAccumulator{
+		stats: IntStats{Values: make(map[string]int)},
+	}
+}
+
 func init() {
 	DataSpecs[IntType] = SequenceJsonDataImpl{IntJsonSpec{}}
 }
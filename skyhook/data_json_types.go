@@ -110,3 +110,12 @@ func (s SequenceJsonDataImpl) Writer(format string, metadata DataMetadata, w io.
 func (s SequenceJsonDataImpl) Length(data interface{}) int { return s.Spec.Length(data) }
 func (s SequenceJsonDataImpl) Append(data interface{}, more interface{}) interface{} { return s.Spec.Append(data, more) }
 func (s SequenceJsonDataImpl) Slice(data interface{}, i int, j int) interface{} { return s.Spec.Slice(data, i, j) }
+
+// Forward to the SequenceJsonSpec if it supports statistics.
+func (s SequenceJsonDataImpl) NewStats() StatsAccumulator {
+	statsSpec, ok := s.Spec.(interface{ NewStats() StatsAccumulator })
+	if !ok {
+		return nil
+	}
+	return statsSpec.NewStats()
+}
@@ -93,6 +93,88 @@ func (s ShapeJsonSpec) Slice(data interface{}, i int, j int) interface{} {
 	return data.([][]Shape)[i:j]
 }
 
+type ShapeStats struct {
+	// Total number of frames across all items.
+	Frames int
+	// Frames with no shapes.
+	EmptyFrames int
+	// Items with no shapes in any frame.
+	EmptyItems StatsKeyList
+	Shapes int
+	// Number of shapes in each category, and of each type.
+	Categories map[string]int
+	Types map[TypeOfShape]int
+	// Number of distinct track IDs, counted per item.
+	Tracks int
+
+	PerFrame Distribution
+	// Sizes of the shape bounding boxes.
+	Widths Distribution
+	Heights Distribution
+	Points Distribution
+}
+
+type shapeStatsAccumulator struct {
+	stats ShapeStats
+	perFrame, widths, heights, points DistributionAccumulator
+}
+
+func (a *shapeStatsAccumulator) Add(item Item) error {
+	data, _, err := item.LoadData()
+	if err != nil {
+		return err
+	}
+	frames := data.([][]Shape)
+	trackIDs := make(map[int]bool)
+	numShapes := 0
+	for _, shapes := range frames {
+		a.stats.Frames++
+		if len(shapes) == 0 {
+			a.stats.EmptyFrames++
+		}
+		a.perFrame.Add(float64(len(shapes)))
+		for _, shp := range shapes {
+			numShapes++
+			a.stats.Categories[shp.Category]++
+			a.stats.Types[shp.Type]++
+			if shp.TrackID > 0 {
+				trackIDs[shp.TrackID] = true
+			}
+			a.points.Add(float64(len(shp.Points)))
+			if len(shp.Points) == 0 {
+				continue
+			}
+			bounds := shp.Bounds()
+			a.widths.Add(float64(bounds[2]-bounds[0]))
+			a.heights.Add(float64(bounds[3]-bounds[1]))
+		}
+	}
+	a.stats.Shapes += numShapes
+	a.stats.Tracks += len(trackIDs)
+	if numShapes == 0 {
+		a.stats.EmptyItems.Add(item.Key)
+	}
+	return nil
+}
+
+func (a *shapeStatsAccumulator) Result() interface{} {
+	stats := a.stats
+	stats.PerFrame = a.perFrame.Result()
+	stats.Widths = a.widths.Result()
+	stats.Heights = a.heights.Result()
+	stats.Points = a.points.Result()
+	return stats
+}
+
+func (s ShapeJsonSpec) NewStats() StatsAccumulator {
+	return &shapeStatsAccumulator{
+		stats: ShapeStats{
+			Categories: make(map[string]int),
+			Types: make(map[TypeOfShape]int),
+		},
+	}
+}
+
 func init() {
 	DataSpecs[ShapeType] = SequenceJsonDataImpl{ShapeJsonSpec{}}
 }
@@ -204,6 +204,48 @@ func (s TableDataSpec) GetMetadataFromFile(fname string) (format string, metadat
 	return "", nil, fmt.Errorf("unknown extension %s for table type", ext)
 }
 
+type TableStats struct {
+	// Total number of rows across all items.
+	Rows int
+	// Distribution of the number of rows per item.
+	PerItem Distribution
+	// Number of items having each set of columns.
+	Columns map[string]int
+}
+
+type tableStatsAccumulator struct {
+	stats TableStats
+	perItem DistributionAccumulator
+}
+
+func (a *tableStatsAccumulator) Add(item Item) error {
+	data, metadata, err := item.LoadData()
+	if err != nil {
+		return err
+	}
+	rows := len(data.(TableData))
+	a.stats.Rows += rows
+	a.perItem.Add(float64(rows))
+	var labels []string
+	for _, column := range metadata.(TableMetadata).Columns {
+		labels = append(labels, column.Label)
+	}
+	a.stats.Columns[strings.Join(labels, ",")]++
+	return nil
+}
+
+func (a *tableStatsAccumulator) Result() interface{} {
+	stats := a.stats
+	stats.PerItem = a.perItem.Result()
+	return stats
+}
+
+func (s TableDataSpec) NewStats() StatsAccumulator {
+	return &tableStatsAccumulator{
+		stats: TableStats{Columns: make(map[string]int)},
+	}
+}
+
 func init() {
 	DataSpecs[TableType] = TableDataSpec{}
 }
@@ -306,6 +306,57 @@ func (s VideoDataSpec) GetMetadataFromFile(fname string) (format string, metadat
 	return "mp4", metadata, nil
 }
 
+type VideoStats struct {
+	// Total duration and approximate number of frames across all videos.
+	Duration float64
+	Frames int
+	// Number of videos with each resolution (e.g. "1920x1080") and framerate (e.g. "30/1").
+	Dims map[string]int
+	Framerates map[string]int
+	// Videos with no duration in the metadata.
+	MissingMetadata StatsKeyList
+
+	Durations Distribution
+	FPS Distribution
+}
+
+// Video statistics are computed from the metadata since decoding videos is expensive.
+type videoStatsAccumulator struct {
+	stats VideoStats
+	durations, fps DistributionAccumulator
+}
+
+func (a *videoStatsAccumulator) Add(item Item) error {
+	metadata := item.DecodeMetadata().(VideoMetadata)
+	if metadata.Duration == 0 || metadata.Framerate[1] == 0 {
+		a.stats.MissingMetadata.Add(item.Key)
+		return nil
+	}
+	a.stats.Duration += metadata.Duration
+	a.stats.Frames += metadata.NumFrames()
+	a.stats.Dims[fmt.Sprintf("%dx%d", metadata.Dims[0], metadata.Dims[1])]++
+	a.stats.Framerates[fmt.Sprintf("%d/%d", metadata.Framerate[0], metadata.Framerate[1])]++
+	a.durations.Add(metadata.Duration)
+	a.fps.Add(float64(metadata.Framerate[0]) / float64(metadata.Framerate[1]))
+	return nil
+}
+
+func (a *videoStatsAccumulator) Result() interface{} {
+	stats := a.stats
+	stats.Durations = a.durations.Result()
+	stats.FPS = a.fps.Result()
+	return stats
+}
+
+func (s VideoDataSpec) NewStats() StatsAccumulator {
+	return &videoStatsAccumulator{
+		stats: VideoStats{
+			Dims: make(map[string]int),
+			Framerates: make(map[string]int),
+		},
+	}
+}
+
 func init() {
 	DataSpecs[VideoType] = VideoDataSpec{}
 }
@@ -214,9 +214,15 @@ func Ffprobe(fname string) (width int, height int, duration float64, err error)
 	var line string
 	line, err = rd.ReadString('\n')
 	if err != nil {
+		cmd.Wait()
 		return
 	}
 	parts := strings.Split(strings.TrimSpace(line), ",")
+	if len(parts) < 3 {
+		cmd.Wait()
+		err = fmt.Errorf("unexpected ffprobe output %s", strings.TrimSpace(line))
+		return
+	}
 	width, _ = strconv.Atoi(parts[0])
 	height, _ = strconv.Atoi(parts[1])
 	duration, _ = strconv.ParseFloat(parts[2], 64)
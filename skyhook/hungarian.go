@@ -0,0 +1,96 @@
+package skyhook
+
+import (
+	"math"
+)
+
+// Solve the assignment problem, minimizing the total cost of the assignment.
+// Returns the column assigned to each row, or -1 if the row is unassigned (which
+// only happens if there are more rows than columns).
+func Hungarian(cost [][]float64) []int {
+	n := len(cost)
+	if n == 0 {
+		return nil
+	}
+	m := len(cost[0])
+	assignment := make([]int, n)
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	if m == 0 {
+		return assignment
+	}
+	if n > m {
+		// the algorithm below requires at least as many columns as rows
+		transposed := make([][]float64, m)
+		for j := range transposed {
+			transposed[j] = make([]float64, n)
+			for i := range cost {
+				transposed[j][i] = cost[i][j]
+			}
+		}
+		for j, i := range Hungarian(transposed) {
+			assignment[i] = j
+		}
+		return assignment
+	}
+
+	// potentials, matching (p[j] is the row matched to column j), and the augmenting path
+	// rows and columns are 1-indexed, with column 0 used as the source of each augmenting path
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, m+1)
+		used := make([]bool, m+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			assignment[p[j]-1] = j-1
+		}
+	}
+	return assignment
+}
@@ -0,0 +1,37 @@
+package skyhook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHungarian(t *testing.T) {
+	tests := []struct {
+		label string
+		cost [][]float64
+		expected []int
+	}{
+		// greedily taking the cheapest pair (row 1, column 1) gives total cost 6, but the optimum is 5
+		{"3x3", [][]float64{
+			{4, 1, 3},
+			{2, 0, 5},
+			{3, 2, 2},
+		}, []int{1, 0, 2}},
+		{"more columns", [][]float64{
+			{5, 1, 9},
+			{1, 5, 9},
+		}, []int{1, 0}},
+		{"more rows", [][]float64{
+			{1, 5},
+			{5, 1},
+			{3, 3},
+		}, []int{0, 1, -1}},
+		{"empty", nil, nil},
+	}
+	for _, test := range tests {
+		assignment := Hungarian(test.cost)
+		if !reflect.DeepEqual(assignment, test.expected) {
+			t.Errorf("%s: Hungarian = %v; want %v", test.label, assignment, test.expected)
+		}
+	}
+}
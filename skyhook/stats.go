@@ -0,0 +1,180 @@
+package skyhook
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Data types can implement StatsDataSpec to support computing statistics over
+// all the items in a dataset.
+type StatsDataSpec interface {
+	DataSpec
+	// Create an accumulator for aggregating statistics over items of this type.
+	// Returns nil if statistics are not supported.
+	NewStats() StatsAccumulator
+}
+
+type StatsAccumulator interface {
+	// Add an item to the statistics.
+	// Implementations should avoid loading the item data if the statistics can be
+	// computed from the metadata alone.
+	Add(item Item) error
+	// Returns the aggregated statistics, which must be JSON-encodable.
+	Result() interface{}
+}
+
+// Returns a StatsAccumulator for the specified data type, or nil if the data type
+// does not support statistics.
+func NewStatsAccumulator(dtype DataType) StatsAccumulator {
+	spec, ok := DataSpecs[dtype].(StatsDataSpec)
+	if !ok {
+		return nil
+	}
+	return spec.NewStats()
+}
+
+// Statistics about a dataset.
+type DatasetStats struct {
+	// Number of items in the dataset.
+	Items int
+	// Number of items stored in each format.
+	Formats map[string]int
+	// Items that could not be read while computing the statistics.
+	Errors StatsKeyList
+	// Statistics specific to the data type, nil if the data type doesn't support it.
+	Data interface{}
+}
+
+// Maximum number of keys that we list in statistics like "items with no labels".
+const MaxStatsKeys = 100
+
+// Collects up to MaxStatsKeys keys while counting the total.
+type StatsKeyList struct {
+	Count int
+	Keys []string
+}
+
+func (l *StatsKeyList) Add(key string) {
+	l.Count++
+	if len(l.Keys) < MaxStatsKeys {
+		l.Keys = append(l.Keys, key)
+	}
+}
+
+// Summary of a distribution of values.
+type Distribution struct {
+	Count int
+	Min float64
+	Max float64
+	Mean float64
+	Stddev float64
+	// Percentiles at 5, 25, 50, 75, 95.
+	// These are estimated from a sample if there are many values.
+	Percentiles [5]float64
+	Histogram []HistogramBin
+}
+
+type HistogramBin struct {
+	// The bin covers [Start, End).
+	Start float64
+	End float64
+	// Number of values in the bin.
+	// This is estimated from a sample if there are many values.
+	Count int
+}
+
+// Number of values to keep in DistributionAccumulator for computing percentiles and histograms.
+const DistributionSampleSize = 10000
+
+// Number of bins in Distribution.Histogram.
+const DistributionBins = 10
+
+// Computes a Distribution over values that are added one at a time.
+// The count, min, max, mean, and stddev are exact, but the percentiles and histogram
+// are computed from a fixed-size reservoir sample to bound memory usage.
+type DistributionAccumulator struct {
+	count int
+	min float64
+	max float64
+	// running mean and sum of squared differences (Welford's method)
+	mean float64
+	m2 float64
+
+	sample []float64
+	rng *rand.Rand
+}
+
+func (d *DistributionAccumulator) Add(x float64) {
+	if d.count == 0 || x < d.min {
+		d.min = x
+	}
+	if d.count == 0 || x > d.max {
+		d.max = x
+	}
+	d.count++
+	delta := x - d.mean
+	d.mean += delta / float64(d.count)
+	d.m2 += delta * (x - d.mean)
+
+	// reservoir sampling
+	// we use a fixed seed so that the statistics are deterministic
+	if len(d.sample) < DistributionSampleSize {
+		d.sample = append(d.sample, x)
+		return
+	}
+	if d.rng == nil {
+		d.rng = rand.New(rand.NewSource(0))
+	}
+	if idx := d.rng.Intn(d.count); idx < DistributionSampleSize {
+		d.sample[idx] = x
+	}
+}
+
+func (d *DistributionAccumulator) Result() Distribution {
+	dist := Distribution{
+		Count: d.count,
+		Min: d.min,
+		Max: d.max,
+		Mean: d.mean,
+		Histogram: []HistogramBin{},
+	}
+	if d.count == 0 {
+		return dist
+	}
+	dist.Stddev = math.Sqrt(d.m2 / float64(d.count))
+
+	sample := append([]float64{}, d.sample...)
+	sort.Float64s(sample)
+	for i, p := range []float64{0.05, 0.25, 0.5, 0.75, 0.95} {
+		dist.Percentiles[i] = sample[int(p * float64(len(sample)-1))]
+	}
+
+	// the sample covers only part of the values, so we scale up the bin counts
+	scale := float64(d.count) / float64(len(sample))
+	if d.max == d.min {
+		dist.Histogram = append(dist.Histogram, HistogramBin{
+			Start: d.min,
+			End: d.max,
+			Count: d.count,
+		})
+		return dist
+	}
+	binSize := (d.max - d.min) / DistributionBins
+	counts := make([]int, DistributionBins)
+	for _, x := range sample {
+		bin := int((x - d.min) / binSize)
+		if bin >= DistributionBins {
+			bin = DistributionBins-1
+		}
+		counts[bin]++
+	}
+	for i, count := range counts {
+		dist.Histogram = append(dist.Histogram, HistogramBin{
+			Start: d.min + float64(i)*binSize,
+			End: d.min + float64(i+1)*binSize,
+			Count: int(math.Round(float64(count)*scale)),
+		})
+	}
+	return dist
+}
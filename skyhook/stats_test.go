@@ -0,0 +1,36 @@
+package skyhook
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistributionAccumulator(t *testing.T) {
+	var acc DistributionAccumulator
+	for i := 1; i <= 100; i++ {
+		acc.Add(float64(i))
+	}
+	dist := acc.Result()
+	check := func(label string, got float64, expected float64) {
+		if math.Abs(got - expected) > 1e-6 {
+			t.Errorf("%s = %v; want %v", label, got, expected)
+		}
+	}
+	check("Count", float64(dist.Count), 100)
+	check("Min", dist.Min, 1)
+	check("Max", dist.Max, 100)
+	check("Mean", dist.Mean, 50.5)
+	check("Stddev", dist.Stddev, math.Sqrt(833.25))
+	check("Median", dist.Percentiles[2], 50)
+	total := 0
+	for _, bin := range dist.Histogram {
+		total += bin.Count
+	}
+	check("Histogram total", float64(total), 100)
+
+	// empty distribution should not have histogram bins
+	var empty DistributionAccumulator
+	if len(empty.Result().Histogram) != 0 {
+		t.Errorf("expected empty histogram")
+	}
+}